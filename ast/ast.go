@@ -0,0 +1,479 @@
+// Package ast defines a typed syntax tree for KQL queries.
+//
+// Trees are produced by kql.ParseQuery from the ANTLR parse tree. They model the
+// parts of KQL that tooling usually needs to reason about (let statements, the
+// tabular pipeline, where/project/project-rename/project-away/extend/summarize/
+// mv-expand/parse/parse-kv/join/union operators and scalar expressions). Operators without
+// a dedicated node are kept as GenericOperator values carrying their source text,
+// so no pipeline stage is silently dropped.
+package ast
+
+// Node is implemented by every node of the syntax tree.
+type Node interface {
+	node()
+}
+
+// Statement is a query-level statement that precedes the tabular expression.
+type Statement interface {
+	Node
+	statementNode()
+}
+
+// Source is the first element of a tabular expression.
+type Source interface {
+	Node
+	sourceNode()
+}
+
+// Operator is a pipeline stage following a "|".
+type Operator interface {
+	Node
+	// Name returns the operator keyword as written in KQL (e.g. "where", "project-away").
+	Name() string
+	operatorNode()
+}
+
+// Expr is a scalar expression.
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// Query is the root of a parsed KQL query.
+type Query struct {
+	Statements []Statement        `json:"statements,omitempty"`
+	Body       *TabularExpression `json:"body,omitempty"`
+}
+
+// LetKind identifies which form of let statement was used.
+type LetKind string
+
+const (
+	LetScalar   LetKind = "scalar"   // let x = <scalar expression>
+	LetTabular  LetKind = "tabular"  // let x = T | ... or let x = { T | ... }
+	LetFunction LetKind = "function" // let f = (a:string) { T | ... }
+	LetView     LetKind = "view"     // let v = view () { T | ... }
+)
+
+// LetStatement binds a name to a scalar value, a tabular expression, a function or a view.
+type LetStatement struct {
+	Name       string             `json:"name"`
+	Kind       LetKind            `json:"kind"`
+	Parameters []*Parameter       `json:"parameters,omitempty"` // Function parameters
+	Value      Expr               `json:"value,omitempty"`      // Scalar value
+	Body       *TabularExpression `json:"body,omitempty"`       // Tabular, function and view bodies
+	Text       string             `json:"text"`                 // Right-hand side as written in the query
+}
+
+// Parameter is a declared parameter of a let function.
+type Parameter struct {
+	Name    string `json:"name"`
+	Type    string `json:"type,omitempty"`
+	Default Expr   `json:"default,omitempty"`
+}
+
+// GenericStatement is a statement without a dedicated node (set, alias, declare, ...).
+type GenericStatement struct {
+	Keyword string `json:"keyword"`
+	Text    string `json:"text"`
+}
+
+// TabularExpression is a source followed by zero or more piped operators.
+type TabularExpression struct {
+	Source    Source     `json:"source"`
+	Operators []Operator `json:"operators,omitempty"`
+}
+
+// TableSource reads from a table, optionally qualified as database.table or cluster.database.table.
+type TableSource struct {
+	Name string `json:"name"`
+}
+
+// CallSource reads from the result of a tabular function call.
+type CallSource struct {
+	Call *CallExpr `json:"call"`
+}
+
+// SubquerySource reads from a parenthesized or materialized tabular expression.
+type SubquerySource struct {
+	Query        *TabularExpression `json:"query"`
+	Materialized bool               `json:"materialized,omitempty"`
+}
+
+// GenericSource is a source without a dedicated node (range, print, datatable, externaldata).
+type GenericSource struct {
+	Keyword string `json:"keyword"`
+	Text    string `json:"text"`
+}
+
+// Column is an output column of project, extend or summarize. Name is empty when
+// the column is not explicitly named (e.g. "project Account" or "extend tolower(x)").
+type Column struct {
+	Name string `json:"name,omitempty"`
+	Expr Expr   `json:"expr"`
+	Text string `json:"text,omitempty"` // Expression as written
+}
+
+// OutputName returns the column name KQL assigns to the column: the explicit name
+// if any, otherwise the name of a plain column reference.
+func (c *Column) OutputName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if id, ok := c.Expr.(*Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// WhereOperator filters rows by a predicate.
+type WhereOperator struct {
+	Predicate Expr `json:"predicate"`
+}
+
+// ProjectOperator selects and computes the output columns.
+type ProjectOperator struct {
+	Columns []*Column `json:"columns"`
+}
+
+// ExtendOperator adds computed columns.
+type ExtendOperator struct {
+	Columns []*Column `json:"columns"`
+}
+
+// ProjectRenameOperator renames columns. Each column's Name is the new name and its
+// Expr the Ident of the old one.
+type ProjectRenameOperator struct {
+	Columns []*Column `json:"columns"`
+}
+
+// ProjectAwayOperator removes columns. Names may contain * wildcards.
+type ProjectAwayOperator struct {
+	Columns []string `json:"columns"`
+}
+
+// MvExpandOperator expands multi-value columns into one row per element.
+type MvExpandOperator struct {
+	BagExpansion string          `json:"bag_expansion,omitempty"` // "bag" or "array", from kind= or bagexpansion=
+	ItemIndex    string          `json:"item_index,omitempty"`    // Column named by with_itemindex=
+	Items        []*MvExpandItem `json:"items"`
+	Limit        Expr            `json:"limit,omitempty"`
+}
+
+// MvExpandItem is one expanded column. Name is empty when the column is not
+// explicitly named, as in "mv-expand Targets".
+type MvExpandItem struct {
+	Name string `json:"name,omitempty"`
+	Expr Expr   `json:"expr"`
+	Type string `json:"type,omitempty"` // Element type given by "to typeof(T)"
+	Text string `json:"text,omitempty"` // Expression as written
+}
+
+// OutputName returns the column the item expands into: the explicit name if any,
+// otherwise the name of a plain column reference.
+func (i *MvExpandItem) OutputName() string {
+	if i.Name != "" {
+		return i.Name
+	}
+	if id, ok := i.Expr.(*Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// ParseOperator extracts columns from a string with a pattern (parse and parse-where).
+type ParseOperator struct {
+	Where   bool                `json:"where,omitempty"` // parse-where, which drops rows the pattern does not match
+	Kind    string              `json:"kind,omitempty"`  // simple, regex or relaxed; empty for the default simple
+	Expr    Expr                `json:"expr"`
+	Pattern []*ParsePatternItem `json:"pattern"`
+	Text    string              `json:"text"` // Operator as written
+}
+
+// ParsePatternItem is one element of a parse pattern: a string literal anchor
+// (Literal, as written), a * wildcard (Star) or a column to extract (Column, with
+// its declared Type).
+type ParsePatternItem struct {
+	Literal string `json:"literal,omitempty"`
+	Star    bool   `json:"star,omitempty"`
+	Column  string `json:"column,omitempty"`
+	Type    string `json:"type,omitempty"`
+}
+
+// ParseKvOperator extracts the values of keys from a string of key-value pairs
+// (parse-kv).
+type ParseKvOperator struct {
+	Expr    Expr                `json:"expr"`
+	Columns []*ParsePatternItem `json:"columns"`        // Keys to extract, with their declared Type
+	With    []*NamedArg         `json:"with,omitempty"` // Parameters such as pair_delimiter and kv_delimiter
+	Text    string              `json:"text"`           // Operator as written
+}
+
+// SummarizeOperator aggregates rows, optionally grouped by the By columns.
+type SummarizeOperator struct {
+	Aggregates []*Column `json:"aggregates"`
+	By         []*Column `json:"by,omitempty"`
+}
+
+// JoinOperator combines the pipeline with the Right tabular expression.
+type JoinOperator struct {
+	Kind  string             `json:"kind"` // Join flavor; "innerunique" when not specified
+	Right *TabularExpression `json:"right"`
+	On    []*JoinKey         `json:"on,omitempty"`
+	Where Expr               `json:"where,omitempty"` // Free-form join condition, when not a key list
+}
+
+// JoinKey is one equality of a join condition. For "on Key" both sides hold the same name.
+type JoinKey struct {
+	Left  string `json:"left"`
+	Right string `json:"right"`
+}
+
+// UnionOperator appends the rows of the listed tables to the pipeline.
+type UnionOperator struct {
+	Kind       string               `json:"kind,omitempty"`
+	WithSource string               `json:"with_source,omitempty"`
+	IsFuzzy    bool                 `json:"is_fuzzy,omitempty"`
+	Tables     []*TabularExpression `json:"tables"`
+}
+
+// GenericOperator is an operator without a dedicated node.
+type GenericOperator struct {
+	Keyword string `json:"keyword"`
+	Text    string `json:"text"`
+}
+
+// Ident references a column, let variable or table by name.
+type Ident struct {
+	Name string `json:"name"`
+}
+
+// LiteralKind is the KQL scalar type of a literal.
+type LiteralKind string
+
+const (
+	StringLiteral   LiteralKind = "string"
+	LongLiteral     LiteralKind = "long"
+	RealLiteral     LiteralKind = "real"
+	DecimalLiteral  LiteralKind = "decimal"
+	BoolLiteral     LiteralKind = "bool"
+	DatetimeLiteral LiteralKind = "datetime"
+	TimespanLiteral LiteralKind = "timespan"
+	GuidLiteral     LiteralKind = "guid"
+	DynamicLiteral  LiteralKind = "dynamic"
+	NullLiteral     LiteralKind = "null"
+)
+
+// Literal is a constant value. Text is the literal as written, including quotes.
+type Literal struct {
+	Kind LiteralKind `json:"kind"`
+	Text string      `json:"text"`
+}
+
+// BinaryExpr is a binary operation: and/or, comparisons, string operators and arithmetic.
+// Op is the operator as written, with "and" and "or" lowercased.
+type BinaryExpr struct {
+	Op string `json:"op"`
+	X  Expr   `json:"x"`
+	Y  Expr   `json:"y"`
+}
+
+// UnaryExpr is a prefix operation: "not", "-" or "+".
+type UnaryExpr struct {
+	Op string `json:"op"`
+	X  Expr   `json:"x"`
+}
+
+// InExpr is a set membership test: in, !in, in~, !in~, has_any or has_all.
+// Values is empty when the right-hand side is a table reference.
+type InExpr struct {
+	Op     string `json:"op"`
+	X      Expr   `json:"x"`
+	Values []Expr `json:"values,omitempty"`
+	Table  string `json:"table,omitempty"`
+}
+
+// BetweenExpr is a range test: X between (Low .. High).
+type BetweenExpr struct {
+	Negated bool `json:"negated,omitempty"`
+	X       Expr `json:"x"`
+	Low     Expr `json:"low"`
+	High    Expr `json:"high"`
+}
+
+// CallExpr is a function call. Receiver is set for method-style calls (x.f()).
+// iff/iif and the built-in pack, bag_pack, make_set, make_list and typeof forms are
+// represented as calls as well.
+type CallExpr struct {
+	Func     string `json:"func"`
+	Args     []Expr `json:"args,omitempty"`
+	Receiver Expr   `json:"receiver,omitempty"`
+}
+
+// NamedArg is a "name = value" function argument.
+type NamedArg struct {
+	Name  string `json:"name"`
+	Value Expr   `json:"value"`
+}
+
+// MemberExpr is a property access: X.Name, or X?.Name when Optional is set.
+type MemberExpr struct {
+	X        Expr   `json:"x"`
+	Name     string `json:"name"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// IndexExpr is an element access: X[Index].
+type IndexExpr struct {
+	X     Expr `json:"x"`
+	Index Expr `json:"index"`
+}
+
+// ParenExpr is a parenthesized expression.
+type ParenExpr struct {
+	X Expr `json:"x"`
+}
+
+// CaseExpr is case(when1, then1, ..., else).
+type CaseExpr struct {
+	Whens []*CaseWhen `json:"whens"`
+	Else  Expr        `json:"else,omitempty"`
+}
+
+// CaseWhen is one predicate/value pair of a case expression.
+type CaseWhen struct {
+	Cond  Expr `json:"cond"`
+	Value Expr `json:"value"`
+}
+
+// ToScalarExpr is toscalar(<tabular expression>).
+type ToScalarExpr struct {
+	Query *TabularExpression `json:"query"`
+}
+
+// SubqueryExpr is a parenthesized tabular expression used as a scalar operand.
+type SubqueryExpr struct {
+	Query *TabularExpression `json:"query"`
+}
+
+// ArrayExpr is pack_array(...) or [...].
+type ArrayExpr struct {
+	Elems []Expr `json:"elems,omitempty"`
+}
+
+// ObjectExpr is an inline property bag: {key: value, ...}.
+type ObjectExpr struct {
+	Fields []*ObjectField `json:"fields,omitempty"`
+}
+
+// ObjectField is one property of an ObjectExpr.
+type ObjectField struct {
+	Key   string `json:"key"`
+	Value Expr   `json:"value"`
+}
+
+// StarExpr is the "*" argument of calls such as count(*).
+type StarExpr struct{}
+
+func (*Query) node()                 {}
+func (*LetStatement) node()          {}
+func (*Parameter) node()             {}
+func (*GenericStatement) node()      {}
+func (*TabularExpression) node()     {}
+func (*TableSource) node()           {}
+func (*CallSource) node()            {}
+func (*SubquerySource) node()        {}
+func (*GenericSource) node()         {}
+func (*Column) node()                {}
+func (*WhereOperator) node()         {}
+func (*ProjectOperator) node()       {}
+func (*ExtendOperator) node()        {}
+func (*SummarizeOperator) node()     {}
+func (*ProjectRenameOperator) node() {}
+func (*ProjectAwayOperator) node()   {}
+func (*MvExpandOperator) node()      {}
+func (*MvExpandItem) node()          {}
+func (*ParseOperator) node()         {}
+func (*ParsePatternItem) node()      {}
+func (*ParseKvOperator) node()       {}
+func (*JoinOperator) node()          {}
+func (*JoinKey) node()               {}
+func (*UnionOperator) node()         {}
+func (*GenericOperator) node()       {}
+func (*Ident) node()                 {}
+func (*Literal) node()               {}
+func (*BinaryExpr) node()            {}
+func (*UnaryExpr) node()             {}
+func (*InExpr) node()                {}
+func (*BetweenExpr) node()           {}
+func (*CallExpr) node()              {}
+func (*NamedArg) node()              {}
+func (*MemberExpr) node()            {}
+func (*IndexExpr) node()             {}
+func (*ParenExpr) node()             {}
+func (*CaseExpr) node()              {}
+func (*CaseWhen) node()              {}
+func (*ToScalarExpr) node()          {}
+func (*SubqueryExpr) node()          {}
+func (*ArrayExpr) node()             {}
+func (*ObjectExpr) node()            {}
+func (*ObjectField) node()           {}
+func (*StarExpr) node()              {}
+
+func (*LetStatement) statementNode()     {}
+func (*GenericStatement) statementNode() {}
+
+func (*TableSource) sourceNode()    {}
+func (*CallSource) sourceNode()     {}
+func (*SubquerySource) sourceNode() {}
+func (*GenericSource) sourceNode()  {}
+
+func (*WhereOperator) operatorNode()         {}
+func (*ProjectOperator) operatorNode()       {}
+func (*ExtendOperator) operatorNode()        {}
+func (*SummarizeOperator) operatorNode()     {}
+func (*ProjectRenameOperator) operatorNode() {}
+func (*ProjectAwayOperator) operatorNode()   {}
+func (*MvExpandOperator) operatorNode()      {}
+func (*ParseOperator) operatorNode()         {}
+func (*ParseKvOperator) operatorNode()       {}
+func (*JoinOperator) operatorNode()          {}
+func (*UnionOperator) operatorNode()         {}
+func (*GenericOperator) operatorNode()       {}
+
+func (*WhereOperator) Name() string         { return "where" }
+func (*ProjectOperator) Name() string       { return "project" }
+func (*ExtendOperator) Name() string        { return "extend" }
+func (*SummarizeOperator) Name() string     { return "summarize" }
+func (*ProjectRenameOperator) Name() string { return "project-rename" }
+func (*ProjectAwayOperator) Name() string   { return "project-away" }
+func (*MvExpandOperator) Name() string      { return "mv-expand" }
+func (*ParseKvOperator) Name() string       { return "parse-kv" }
+func (*JoinOperator) Name() string          { return "join" }
+func (*UnionOperator) Name() string         { return "union" }
+func (o *GenericOperator) Name() string     { return o.Keyword }
+
+func (o *ParseOperator) Name() string {
+	if o.Where {
+		return "parse-where"
+	}
+	return "parse"
+}
+
+func (*Ident) exprNode()        {}
+func (*Literal) exprNode()      {}
+func (*BinaryExpr) exprNode()   {}
+func (*UnaryExpr) exprNode()    {}
+func (*InExpr) exprNode()       {}
+func (*BetweenExpr) exprNode()  {}
+func (*CallExpr) exprNode()     {}
+func (*NamedArg) exprNode()     {}
+func (*MemberExpr) exprNode()   {}
+func (*IndexExpr) exprNode()    {}
+func (*ParenExpr) exprNode()    {}
+func (*CaseExpr) exprNode()     {}
+func (*ToScalarExpr) exprNode() {}
+func (*SubqueryExpr) exprNode() {}
+func (*ArrayExpr) exprNode()    {}
+func (*ObjectExpr) exprNode()   {}
+func (*StarExpr) exprNode()     {}
@@ -0,0 +1,154 @@
+package ast
+
+import "reflect"
+
+// Inspect traverses the tree rooted at node in depth-first order. It calls f(node)
+// for each non-nil node; if f returns true, Inspect recurses into the node's children.
+func Inspect(node Node, f func(Node) bool) {
+	if isNil(node) || !f(node) {
+		return
+	}
+	for _, child := range Children(node) {
+		Inspect(child, f)
+	}
+}
+
+// Children returns the direct, non-nil children of node in source order.
+func Children(node Node) []Node {
+	var out []Node
+	add := func(nodes ...Node) {
+		for _, n := range nodes {
+			if !isNil(n) {
+				out = append(out, n)
+			}
+		}
+	}
+
+	switch n := node.(type) {
+	case *Query:
+		for _, s := range n.Statements {
+			add(s)
+		}
+		add(n.Body)
+	case *LetStatement:
+		for _, p := range n.Parameters {
+			add(p)
+		}
+		add(n.Value, n.Body)
+	case *Parameter:
+		add(n.Default)
+	case *TabularExpression:
+		add(n.Source)
+		for _, op := range n.Operators {
+			add(op)
+		}
+	case *CallSource:
+		add(n.Call)
+	case *SubquerySource:
+		add(n.Query)
+	case *Column:
+		add(n.Expr)
+	case *WhereOperator:
+		add(n.Predicate)
+	case *ProjectOperator:
+		addColumns(add, n.Columns)
+	case *ExtendOperator:
+		addColumns(add, n.Columns)
+	case *SummarizeOperator:
+		addColumns(add, n.Aggregates)
+		addColumns(add, n.By)
+	case *ProjectRenameOperator:
+		addColumns(add, n.Columns)
+	case *MvExpandOperator:
+		for _, item := range n.Items {
+			add(item)
+		}
+		add(n.Limit)
+	case *MvExpandItem:
+		add(n.Expr)
+	case *ParseOperator:
+		add(n.Expr)
+		for _, item := range n.Pattern {
+			add(item)
+		}
+	case *ParseKvOperator:
+		add(n.Expr)
+		for _, item := range n.Columns {
+			add(item)
+		}
+		for _, arg := range n.With {
+			add(arg)
+		}
+	case *JoinOperator:
+		add(n.Right)
+		for _, k := range n.On {
+			add(k)
+		}
+		add(n.Where)
+	case *UnionOperator:
+		for _, t := range n.Tables {
+			add(t)
+		}
+	case *BinaryExpr:
+		add(n.X, n.Y)
+	case *UnaryExpr:
+		add(n.X)
+	case *InExpr:
+		add(n.X)
+		for _, e := range n.Values {
+			add(e)
+		}
+	case *BetweenExpr:
+		add(n.X, n.Low, n.High)
+	case *CallExpr:
+		add(n.Receiver)
+		for _, e := range n.Args {
+			add(e)
+		}
+	case *NamedArg:
+		add(n.Value)
+	case *MemberExpr:
+		add(n.X)
+	case *IndexExpr:
+		add(n.X, n.Index)
+	case *ParenExpr:
+		add(n.X)
+	case *CaseExpr:
+		for _, w := range n.Whens {
+			add(w)
+		}
+		add(n.Else)
+	case *CaseWhen:
+		add(n.Cond, n.Value)
+	case *ToScalarExpr:
+		add(n.Query)
+	case *SubqueryExpr:
+		add(n.Query)
+	case *ArrayExpr:
+		for _, e := range n.Elems {
+			add(e)
+		}
+	case *ObjectExpr:
+		for _, f := range n.Fields {
+			add(f)
+		}
+	case *ObjectField:
+		add(n.Value)
+	}
+	return out
+}
+
+func addColumns(add func(...Node), columns []*Column) {
+	for _, c := range columns {
+		add(c)
+	}
+}
+
+// isNil reports whether n is nil or a typed nil pointer stored in an interface.
+func isNil(n Node) bool {
+	if n == nil {
+		return true
+	}
+	v := reflect.ValueOf(n)
+	return v.Kind() == reflect.Pointer && v.IsNil()
+}
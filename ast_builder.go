@@ -0,0 +1,835 @@
+package kql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/craftedsignal/kql-parser/ast"
+)
+
+// ParseQuery parses a KQL query into a typed syntax tree.
+//
+// The tabular body is parsed after the same normalization ExtractConditions applies,
+// so the tree reflects the normalized form (e.g. filter becomes where). Let statements
+// are parsed individually from the original text. Syntax errors do not abort parsing:
+// the returned tree holds everything the parser could recover, and the errors are
+// returned alongside it. Recovers from panics.
+func ParseQuery(query string) (q *ast.Query, errs []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			q = &ast.Query{}
+			errs = append(errs, fmt.Sprintf("parser panic: %v", r))
+		}
+	}()
+
+	q = &ast.Query{}
+	for _, statement := range splitStatements(normalizeNewlines(query)) {
+		text := strings.TrimSpace(trimLeadingLineComments(statement))
+		if text == "" {
+			continue
+		}
+		if let, letErrs, ok := parseLetStatementNode(context.Background(), text); ok {
+			q.Statements = append(q.Statements, let)
+			errs = append(errs, letErrs...)
+			continue
+		}
+		if keyword := statementKeyword(text); keyword != "" {
+			q.Statements = append(q.Statements, &ast.GenericStatement{Keyword: keyword, Text: text})
+		}
+	}
+
+	normalized, sourceMap := normalizeQueryWithSourceMap(query, astConfig)
+	if strings.TrimSpace(normalized) == "" {
+		return q, errs
+	}
+	p := newKQLParser(context.Background(), normalized)
+	p.sourceMap = sourceMap
+	tree := p.parser.Query()
+	errs = append(errs, p.errors()...)
+	if tree.TabularExpression() != nil {
+		b := &astBuilder{input: p.input, locator: newSpanLocator(sourceMap)}
+		q.Body = b.tabularExpression(tree.TabularExpression())
+	}
+	return q, errs
+}
+
+// statementKeyword returns the leading keyword of a non-let query statement,
+// or "" when text is not one.
+func statementKeyword(text string) string {
+	word := strings.ToLower(strings.Fields(text)[0])
+	switch word {
+	case "set", "alias", "declare", "pattern", "restrict":
+		return word
+	}
+	return ""
+}
+
+// parseLetStatementNode parses a single let statement. The statement is first parsed
+// as written; if that fails, the right-hand side is normalized and parsed as a tabular
+// expression, which covers lets whose bodies rely on normalizeQuery rewrites. Both
+// parses stop with a parseCanceled panic once ctx is done.
+func parseLetStatementNode(ctx context.Context, text string) (*ast.LetStatement, []string, bool) {
+	name, rhs, ok := parseLetAssignment(text)
+	if !ok {
+		return nil, nil, false
+	}
+	rhs = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rhs), ";"))
+	let := &ast.LetStatement{Name: name, Text: rhs}
+
+	p := newKQLParser(ctx, "let "+name+" = "+rhs)
+	tree := p.parser.LetStatement()
+	if len(p.errors()) == 0 && p.atEOF() {
+		b := &astBuilder{input: p.input}
+		b.fillLetStatement(let, tree)
+		return let, nil, true
+	}
+
+	if strings.HasPrefix(rhs, "(") && strings.Contains(rhs, "{") {
+		let.Kind = ast.LetFunction
+		return let, p.errors(), true
+	}
+
+	tp := newKQLParser(ctx, normalizeQuery(rhs))
+	tctx := tp.parser.TabularExpression()
+	if len(tp.errors()) == 0 && tp.atEOF() {
+		b := &astBuilder{input: tp.input}
+		let.Kind = ast.LetTabular
+		let.Body = b.tabularExpression(tctx)
+		return let, nil, true
+	}
+
+	let.Kind = ast.LetScalar
+	errs := p.errors()
+	if len(errs) == 0 {
+		errs = []string{fmt.Sprintf("let %s: unexpected input after expression", name)}
+	}
+	return let, errs, true
+}
+
+// kqlParser bundles a parser with the error listeners attached to it and its lexer.
+type kqlParser struct {
+	input        antlr.CharStream
+	stream       *antlr.CommonTokenStream
+	parser       *KQLParser
+	lexerErrors  *errorListener
+	parserErrors *errorListener
+	sourceMap    *SourceMap // maps error positions back to the caller's query, if set
+}
+
+// newKQLParser sets up a lexer and parser over text with the default error
+// listeners replaced by collecting ones. Parsing panics with parseCanceled once
+// ctx is done.
+func newKQLParser(ctx context.Context, text string) *kqlParser {
+	input := antlr.NewInputStream(text)
+	lexer := NewKQLLexer(input)
+	lexer.RemoveErrorListeners()
+	lexerErrors := &errorListener{lexer: true}
+	lexer.AddErrorListener(lexerErrors)
+
+	stream := antlr.NewCommonTokenStream(lexer, antlr.TokenDefaultChannel)
+	parser := NewKQLParser(newContextTokenStream(ctx, stream))
+	parser.RemoveErrorListeners()
+	parserErrors := &errorListener{}
+	parser.AddErrorListener(parserErrors)
+
+	return &kqlParser{
+		input:        input,
+		stream:       stream,
+		parser:       parser,
+		lexerErrors:  lexerErrors,
+		parserErrors: parserErrors,
+	}
+}
+
+// errors returns lexer errors followed by parser errors. When a source map is set,
+// each message is prefixed with its line and column in the original query.
+func (p *kqlParser) errors() []string {
+	return diagnosticMessages(p.diagnostics())
+}
+
+// atEOF reports whether the parser consumed all input.
+func (p *kqlParser) atEOF() bool {
+	return p.stream.LA(1) == antlr.TokenEOF
+}
+
+// astBuilder converts ANTLR contexts into ast nodes.
+type astBuilder struct {
+	input   antlr.CharStream
+	locator *spanLocator       // Maps written text back to the original query, when set
+	spans   map[ast.Node]*Span // Collects the original spans of expressions, when set
+}
+
+// locate records the original span of ctx as n's when spans are collected.
+func (b *astBuilder) locate(n ast.Node, ctx antlr.ParserRuleContext) {
+	if b.spans == nil || n == nil {
+		return
+	}
+	if span := b.locator.ruleSpan(ctx); span != nil {
+		b.spans[n] = span
+	}
+}
+
+// text returns the source text of ctx including whitespace and comments between tokens.
+func (b *astBuilder) text(ctx antlr.ParserRuleContext) string {
+	if ctx == nil {
+		return ""
+	}
+	start, stop := ctx.GetStart(), ctx.GetStop()
+	if start == nil || stop == nil || stop.GetStop() < start.GetStart() {
+		return ctx.GetText()
+	}
+	return b.input.GetTextFromInterval(antlr.NewInterval(start.GetStart(), stop.GetStop()))
+}
+
+// sourceText returns the text of ctx as the user wrote it, before normalization,
+// falling back to the parsed text when there is no locator or the node was
+// produced by normalization.
+func (b *astBuilder) sourceText(ctx antlr.ParserRuleContext) string {
+	if ctx == nil {
+		return ""
+	}
+	if span := b.locator.ruleSpan(ctx); span != nil {
+		return span.Text(b.locator.sourceMap.original)
+	}
+	return b.text(ctx)
+}
+
+func (b *astBuilder) fillLetStatement(let *ast.LetStatement, ctx ILetStatementContext) {
+	switch {
+	case ctx.ViewExpression() != nil:
+		let.Kind = ast.LetView
+		let.Body = b.tabularExpression(ctx.ViewExpression().TabularExpression())
+	case ctx.LPAREN() != nil:
+		let.Kind = ast.LetFunction
+		if params := ctx.FunctionParameters(); params != nil {
+			for _, p := range params.AllFunctionParameter() {
+				param := &ast.Parameter{Name: p.Identifier().GetText()}
+				if p.TypeSpecifier() != nil {
+					param.Type = strings.ToLower(p.TypeSpecifier().GetText())
+				}
+				if p.Expression() != nil {
+					param.Default = b.expression(p.Expression())
+				}
+				let.Parameters = append(let.Parameters, param)
+			}
+		}
+		let.Body = b.tabularExpression(ctx.TabularExpression())
+	case ctx.TabularExpression() != nil:
+		let.Kind = ast.LetTabular
+		let.Body = b.tabularExpression(ctx.TabularExpression())
+	default:
+		// A bare name or call is ambiguous between a scalar and a tabular reference;
+		// anything the expression rule accepts is reported as scalar.
+		let.Kind = ast.LetScalar
+		let.Value = b.expression(ctx.Expression())
+	}
+}
+
+func (b *astBuilder) tabularExpression(ctx ITabularExpressionContext) *ast.TabularExpression {
+	if ctx == nil {
+		return nil
+	}
+	te := &ast.TabularExpression{Source: b.tabularSource(ctx.TabularSource())}
+	for _, op := range ctx.AllTabularOperator() {
+		te.Operators = append(te.Operators, b.tabularOperator(op))
+	}
+	return te
+}
+
+func (b *astBuilder) tabularSource(ctx ITabularSourceContext) ast.Source {
+	if ctx == nil {
+		return nil
+	}
+	switch {
+	case ctx.TableName() != nil:
+		return &ast.TableSource{Name: tableNameText(ctx.TableName())}
+	case ctx.FunctionCall() != nil:
+		return &ast.CallSource{Call: b.functionCall(ctx.FunctionCall())}
+	case ctx.TabularExpression() != nil:
+		return &ast.SubquerySource{Query: b.tabularExpression(ctx.TabularExpression())}
+	case ctx.MaterializeExpression() != nil:
+		return &ast.SubquerySource{
+			Query:        b.tabularExpression(ctx.MaterializeExpression().TabularExpression()),
+			Materialized: true,
+		}
+	}
+	text := b.text(ctx)
+	keyword := strings.ToLower(text)
+	if i := strings.IndexAny(keyword, " \t\r\n("); i > 0 {
+		keyword = keyword[:i]
+	}
+	return &ast.GenericSource{Keyword: keyword, Text: text}
+}
+
+// tableNameText returns a table reference with [Name] and ['Name'] quoting removed.
+func tableNameText(ctx ITableNameContext) string {
+	if ctx.QUOTED_IDENTIFIER() != nil {
+		return unquoteIdentifier(ctx.QUOTED_IDENTIFIER().GetText())
+	}
+	return ctx.GetText()
+}
+
+// unquoteIdentifier strips the brackets and quotes of [Name] and ['Name'].
+func unquoteIdentifier(s string) string {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		s = s[1 : len(s)-1]
+	}
+	return s
+}
+
+func (b *astBuilder) tabularOperator(ctx ITabularOperatorContext) ast.Operator {
+	switch {
+	case ctx.WhereOperator() != nil:
+		return &ast.WhereOperator{Predicate: b.expression(ctx.WhereOperator().Expression())}
+	case ctx.ProjectOperator() != nil:
+		op := &ast.ProjectOperator{}
+		for _, item := range ctx.ProjectOperator().ProjectItemList().AllProjectItem() {
+			op.Columns = append(op.Columns, b.namedColumn(item.Identifier(), item.Expression()))
+		}
+		return op
+	case ctx.ExtendOperator() != nil:
+		op := &ast.ExtendOperator{}
+		for _, item := range ctx.ExtendOperator().ExtendItemList().AllExtendItem() {
+			op.Columns = append(op.Columns, b.namedColumn(item.Identifier(), item.Expression()))
+		}
+		return op
+	case ctx.SummarizeOperator() != nil:
+		return b.summarizeOperator(ctx.SummarizeOperator())
+	case ctx.JoinOperator() != nil:
+		return b.joinOperator(ctx.JoinOperator())
+	case ctx.UnionOperator() != nil:
+		return b.unionOperator(ctx.UnionOperator())
+	case ctx.ProjectRenameOperator() != nil && ctx.ProjectRenameOperator().RenameList() != nil:
+		op := &ast.ProjectRenameOperator{}
+		for _, item := range ctx.ProjectRenameOperator().RenameList().AllRenameItem() {
+			names := item.AllIdentifier()
+			if len(names) == 2 {
+				old := names[1].GetText()
+				op.Columns = append(op.Columns, &ast.Column{Name: names[0].GetText(), Expr: &ast.Ident{Name: old}, Text: old})
+			}
+		}
+		return op
+	case ctx.ProjectAwayOperator() != nil && ctx.ProjectAwayOperator().IdentifierOrWildcardList() != nil:
+		op := &ast.ProjectAwayOperator{}
+		for _, item := range ctx.ProjectAwayOperator().IdentifierOrWildcardList().AllIdentifierOrWildcard() {
+			op.Columns = append(op.Columns, item.GetText())
+		}
+		return op
+	case ctx.MvExpandOperator() != nil && ctx.MvExpandOperator().MvExpandItemList() != nil:
+		return b.mvExpandOperator(ctx.MvExpandOperator())
+	case ctx.ParseOperator() != nil && ctx.ParseOperator().ParsePattern() != nil:
+		return b.parseOperator(ctx.ParseOperator())
+	case ctx.ParseKvOperator() != nil && ctx.ParseKvOperator().KvPairList() != nil:
+		return b.parseKvOperator(ctx.ParseKvOperator())
+	}
+	text := b.text(ctx)
+	keyword := strings.ToLower(text)
+	if i := strings.IndexAny(keyword, " \t\r\n("); i > 0 {
+		keyword = keyword[:i]
+	}
+	return &ast.GenericOperator{Keyword: keyword, Text: text}
+}
+
+// namedColumn builds a column from the "name = expr" or "expr as name" item forms.
+func (b *astBuilder) namedColumn(name IIdentifierContext, expr IExpressionContext) *ast.Column {
+	col := &ast.Column{Expr: b.expression(expr), Text: b.sourceText(expr)}
+	if name != nil {
+		col.Name = name.GetText()
+	}
+	return col
+}
+
+func (b *astBuilder) summarizeOperator(ctx ISummarizeOperatorContext) *ast.SummarizeOperator {
+	op := &ast.SummarizeOperator{}
+	if list := ctx.AggregationList(); list != nil {
+		for _, item := range list.AllAggregationItem() {
+			col := &ast.Column{}
+			if item.Identifier() != nil {
+				col.Name = item.Identifier().GetText()
+			}
+			if fn := item.AggregationFunction(); fn != nil {
+				if fn.FunctionCall() != nil {
+					col.Expr = b.functionCall(fn.FunctionCall())
+				} else {
+					col.Expr = b.expression(fn.Expression())
+				}
+				col.Text = b.sourceText(fn)
+			}
+			op.Aggregates = append(op.Aggregates, col)
+		}
+	}
+	if list := ctx.GroupByList(); list != nil {
+		for _, item := range list.AllGroupByItem() {
+			op.By = append(op.By, b.namedColumn(item.Identifier(), item.Expression()))
+		}
+	}
+	return op
+}
+
+func (b *astBuilder) mvExpandOperator(ctx IMvExpandOperatorContext) *ast.MvExpandOperator {
+	op := &ast.MvExpandOperator{}
+	if kind := ctx.MvExpandKind(); kind != nil && kind.Identifier() != nil {
+		op.BagExpansion = strings.ToLower(kind.Identifier().GetText())
+	}
+	if params := ctx.MvExpandParams(); params != nil && params.Identifier() != nil {
+		if params.WITH_ITEMINDEX() != nil {
+			op.ItemIndex = params.Identifier().GetText()
+		} else {
+			op.BagExpansion = strings.ToLower(params.Identifier().GetText())
+		}
+	}
+	for _, item := range ctx.MvExpandItemList().AllMvExpandItem() {
+		expanded := &ast.MvExpandItem{Expr: b.expression(item.Expression()), Text: b.sourceText(item.Expression())}
+		if item.Identifier() != nil {
+			expanded.Name = item.Identifier().GetText()
+		}
+		if item.TypeSpecifier() != nil {
+			expanded.Type = strings.ToLower(item.TypeSpecifier().GetText())
+		}
+		op.Items = append(op.Items, expanded)
+	}
+	if limit := ctx.LimitClause(); limit != nil {
+		op.Limit = b.expression(limit.Expression())
+	}
+	return op
+}
+
+func (b *astBuilder) parseOperator(ctx IParseOperatorContext) *ast.ParseOperator {
+	op := &ast.ParseOperator{
+		Where: ctx.PARSE_WHERE() != nil,
+		Expr:  b.expression(ctx.Expression()),
+		Text:  b.sourceText(ctx),
+	}
+	if kind := ctx.ParseKind(); kind != nil && kind.Identifier() != nil {
+		op.Kind = strings.ToLower(kind.Identifier().GetText())
+	}
+	for _, item := range ctx.ParsePattern().AllParsePatternItem() {
+		switch {
+		case item.Identifier() != nil:
+			column := &ast.ParsePatternItem{Column: item.Identifier().GetText()}
+			if item.TypeSpecifier() != nil {
+				column.Type = strings.ToLower(item.TypeSpecifier().GetText())
+			}
+			op.Pattern = append(op.Pattern, column)
+		case item.STAR() != nil:
+			op.Pattern = append(op.Pattern, &ast.ParsePatternItem{Star: true})
+		default:
+			op.Pattern = append(op.Pattern, &ast.ParsePatternItem{Literal: item.GetText()})
+		}
+	}
+	return op
+}
+
+func (b *astBuilder) parseKvOperator(ctx IParseKvOperatorContext) *ast.ParseKvOperator {
+	op := &ast.ParseKvOperator{Expr: b.expression(ctx.Expression()), Text: b.sourceText(ctx)}
+	for _, pair := range ctx.KvPairList().AllKvPair() {
+		if pair.Identifier() == nil {
+			continue
+		}
+		column := &ast.ParsePatternItem{Column: pair.Identifier().GetText()}
+		if pair.TypeSpecifier() != nil {
+			column.Type = strings.ToLower(pair.TypeSpecifier().GetText())
+		}
+		op.Columns = append(op.Columns, column)
+	}
+	if params := ctx.ParseKvParameters(); params != nil {
+		for _, param := range params.AllParseKvParam() {
+			if param.Identifier() != nil {
+				op.With = append(op.With, &ast.NamedArg{Name: param.Identifier().GetText(), Value: b.expression(param.Expression())})
+			}
+		}
+	}
+	return op
+}
+
+func (b *astBuilder) joinOperator(ctx IJoinOperatorContext) *ast.JoinOperator {
+	op := &ast.JoinOperator{Kind: "innerunique"} // KQL default
+	if ctx.JoinKind() != nil && ctx.JoinKind().JoinFlavor() != nil {
+		op.Kind = strings.ToLower(ctx.JoinKind().JoinFlavor().GetText())
+	}
+	if ctx.TabularExpression() != nil {
+		op.Right = b.tabularExpression(ctx.TabularExpression())
+	} else if ctx.TableName() != nil {
+		op.Right = &ast.TabularExpression{Source: &ast.TableSource{Name: tableNameText(ctx.TableName())}}
+	}
+	if cond := ctx.JoinCondition(); cond != nil {
+		if cond.Expression() != nil {
+			op.Where = b.expression(cond.Expression())
+		}
+		for _, attr := range cond.AllJoinAttribute() {
+			ids := attr.AllIdentifier()
+			switch {
+			case len(attr.AllDOLLAR()) >= 2 && len(ids) >= 2:
+				op.On = append(op.On, &ast.JoinKey{Left: ids[0].GetText(), Right: ids[1].GetText()})
+			case len(ids) == 1:
+				op.On = append(op.On, &ast.JoinKey{Left: ids[0].GetText(), Right: ids[0].GetText()})
+			}
+		}
+	}
+	return op
+}
+
+func (b *astBuilder) unionOperator(ctx IUnionOperatorContext) *ast.UnionOperator {
+	op := &ast.UnionOperator{}
+	// Normalization removes the parameters, so they are read from the original
+	// query when there is one.
+	if text := b.locator.unionParameterText(b.locator.unionSpan(ctx), b.locator.firstUnionLegSpan(ctx)); text != "" {
+		var info UnionInfo
+		unionParameters(&info, text)
+		op.Kind, op.WithSource, op.IsFuzzy = info.Kind, info.WithSource, info.IsFuzzy
+	} else if params := ctx.UnionParameters(); params != nil {
+		for _, p := range params.AllUnionParameter() {
+			switch {
+			case p.KIND() != nil && p.Identifier() != nil:
+				op.Kind = strings.ToLower(p.Identifier().GetText())
+			case p.WITH_SOURCE() != nil && p.Identifier() != nil:
+				op.WithSource = p.Identifier().GetText()
+			case p.IS_FUZZY() != nil && p.BooleanLiteral() != nil:
+				op.IsFuzzy = strings.EqualFold(p.BooleanLiteral().GetText(), "true")
+			}
+		}
+	}
+	if tables := ctx.UnionTables(); tables != nil {
+		for _, t := range tables.AllUnionTable() {
+			if t.TabularExpression() != nil {
+				op.Tables = append(op.Tables, b.tabularExpression(t.TabularExpression()))
+			} else if t.TableName() != nil {
+				op.Tables = append(op.Tables, &ast.TabularExpression{Source: &ast.TableSource{Name: tableNameText(t.TableName())}})
+			}
+		}
+	}
+	return op
+}
+
+func (b *astBuilder) expression(ctx IExpressionContext) ast.Expr {
+	if ctx == nil || ctx.OrExpression() == nil {
+		return nil
+	}
+	or := ctx.OrExpression()
+	var x ast.Expr
+	for i, and := range or.AllAndExpression() {
+		y := b.andExpression(and)
+		if i == 0 {
+			x = y
+			continue
+		}
+		x = &ast.BinaryExpr{Op: "or", X: x, Y: y}
+	}
+	b.locate(x, ctx)
+	return x
+}
+
+func (b *astBuilder) andExpression(ctx IAndExpressionContext) ast.Expr {
+	var x ast.Expr
+	for i, not := range ctx.AllNotExpression() {
+		y := b.notExpression(not)
+		if i == 0 {
+			x = y
+			continue
+		}
+		x = &ast.BinaryExpr{Op: "and", X: x, Y: y}
+	}
+	return x
+}
+
+func (b *astBuilder) notExpression(ctx INotExpressionContext) ast.Expr {
+	if ctx.NOT() != nil {
+		return &ast.UnaryExpr{Op: "not", X: b.notExpression(ctx.NotExpression())}
+	}
+	return b.comparisonExpression(ctx.ComparisonExpression())
+}
+
+func (b *astBuilder) comparisonExpression(ctx IComparisonExpressionContext) ast.Expr {
+	if ctx == nil {
+		return nil
+	}
+	operands := ctx.AllAdditiveExpression()
+	if len(operands) == 0 {
+		return nil
+	}
+	x := b.additiveExpression(operands[0])
+
+	switch {
+	case ctx.ComparisonOperator() != nil && len(operands) == 2:
+		return &ast.BinaryExpr{Op: ctx.ComparisonOperator().GetText(), X: x, Y: b.additiveExpression(operands[1])}
+	case ctx.StringOperator() != nil && len(operands) == 2:
+		return &ast.BinaryExpr{Op: ctx.StringOperator().GetText(), X: x, Y: b.additiveExpression(operands[1])}
+	case (ctx.BETWEEN() != nil || ctx.NOT_BETWEEN() != nil) && len(operands) == 3:
+		return &ast.BetweenExpr{
+			Negated: ctx.NOT_BETWEEN() != nil,
+			X:       x,
+			Low:     b.additiveExpression(operands[1]),
+			High:    b.additiveExpression(operands[2]),
+		}
+	}
+
+	var op string
+	switch {
+	case ctx.IN() != nil:
+		op = "in"
+	case ctx.NOT_IN() != nil:
+		op = "!in"
+	case ctx.IN_CS() != nil:
+		op = "in~"
+	case ctx.NOT_IN_CS() != nil:
+		op = "!in~"
+	case ctx.HAS_ANY() != nil:
+		op = "has_any"
+	case ctx.HAS_ALL() != nil:
+		op = "has_all"
+	default:
+		return x
+	}
+	in := &ast.InExpr{Op: op, X: x}
+	if ctx.TableName() != nil {
+		in.Table = tableNameText(ctx.TableName())
+	} else if ctx.ExpressionList() != nil {
+		in.Values = b.expressionList(ctx.ExpressionList())
+	}
+	return in
+}
+
+func (b *astBuilder) expressionList(ctx IExpressionListContext) []ast.Expr {
+	if ctx == nil {
+		return nil
+	}
+	var out []ast.Expr
+	for _, e := range ctx.AllExpression() {
+		out = append(out, b.expression(e))
+	}
+	return out
+}
+
+func (b *astBuilder) additiveExpression(ctx IAdditiveExpressionContext) ast.Expr {
+	var x ast.Expr
+	op := ""
+	for _, child := range ctx.GetChildren() {
+		switch c := child.(type) {
+		case IMultiplicativeExpressionContext:
+			y := b.multiplicativeExpression(c)
+			if x == nil {
+				x = y
+			} else {
+				x = &ast.BinaryExpr{Op: op, X: x, Y: y}
+			}
+		case antlr.TerminalNode:
+			op = c.GetText()
+		}
+	}
+	return x
+}
+
+func (b *astBuilder) multiplicativeExpression(ctx IMultiplicativeExpressionContext) ast.Expr {
+	var x ast.Expr
+	op := ""
+	for _, child := range ctx.GetChildren() {
+		switch c := child.(type) {
+		case IUnaryExpressionContext:
+			y := b.unaryExpression(c)
+			if x == nil {
+				x = y
+			} else {
+				x = &ast.BinaryExpr{Op: op, X: x, Y: y}
+			}
+		case antlr.TerminalNode:
+			op = c.GetText()
+		}
+	}
+	return x
+}
+
+func (b *astBuilder) unaryExpression(ctx IUnaryExpressionContext) ast.Expr {
+	switch {
+	case ctx.MINUS() != nil:
+		return &ast.UnaryExpr{Op: "-", X: b.unaryExpression(ctx.UnaryExpression())}
+	case ctx.PLUS() != nil:
+		return &ast.UnaryExpr{Op: "+", X: b.unaryExpression(ctx.UnaryExpression())}
+	case ctx.PostfixExpression() != nil:
+		return b.postfixExpression(ctx.PostfixExpression())
+	}
+	return nil
+}
+
+func (b *astBuilder) postfixExpression(ctx IPostfixExpressionContext) ast.Expr {
+	x := b.primaryExpression(ctx.PrimaryExpression())
+	for _, op := range ctx.AllPostfixOperator() {
+		switch {
+		case op.FunctionCall() != nil:
+			call := b.functionCall(op.FunctionCall())
+			call.Receiver = x
+			x = call
+		case op.Identifier() != nil:
+			x = &ast.MemberExpr{X: x, Name: op.Identifier().GetText(), Optional: op.QUESTIONDOT() != nil}
+		case op.LBRACKET() != nil:
+			x = &ast.IndexExpr{X: x, Index: b.expression(op.Expression())}
+		}
+	}
+	return x
+}
+
+func (b *astBuilder) primaryExpression(ctx IPrimaryExpressionContext) ast.Expr {
+	if ctx == nil {
+		return nil
+	}
+	switch {
+	case ctx.Literal() != nil:
+		return literalNode(ctx.Literal())
+	case ctx.Identifier() != nil:
+		return &ast.Ident{Name: ctx.Identifier().GetText()}
+	case ctx.QUOTED_IDENTIFIER() != nil:
+		return &ast.Ident{Name: unquoteIdentifier(ctx.QUOTED_IDENTIFIER().GetText())}
+	case ctx.CLIENT_PARAMETER() != nil:
+		return &ast.Ident{Name: ctx.CLIENT_PARAMETER().GetText()}
+	case ctx.FunctionCall() != nil:
+		return b.functionCall(ctx.FunctionCall())
+	case ctx.Expression() != nil:
+		return &ast.ParenExpr{X: b.expression(ctx.Expression())}
+	case ctx.TabularExpression() != nil:
+		return &ast.SubqueryExpr{Query: b.tabularExpression(ctx.TabularExpression())}
+	case ctx.CaseExpression() != nil:
+		return b.caseExpression(ctx.CaseExpression())
+	case ctx.IffExpression() != nil:
+		iff := ctx.IffExpression()
+		name := "iff"
+		if iff.IIF() != nil {
+			name = "iif"
+		}
+		return &ast.CallExpr{Func: name, Args: b.expressions(iff.AllExpression())}
+	case ctx.ToScalarExpression() != nil:
+		return &ast.ToScalarExpr{Query: b.tabularExpression(ctx.ToScalarExpression().TabularExpression())}
+	case ctx.ArrayExpression() != nil:
+		return &ast.ArrayExpr{Elems: b.expressionList(ctx.ArrayExpression().ExpressionList())}
+	case ctx.ObjectExpression() != nil:
+		return b.objectExpression(ctx.ObjectExpression())
+	case ctx.STAR() != nil:
+		return &ast.StarExpr{}
+	}
+	return nil
+}
+
+func (b *astBuilder) expressions(list []IExpressionContext) []ast.Expr {
+	out := make([]ast.Expr, 0, len(list))
+	for _, e := range list {
+		out = append(out, b.expression(e))
+	}
+	return out
+}
+
+func (b *astBuilder) caseExpression(ctx ICaseExpressionContext) *ast.CaseExpr {
+	c := &ast.CaseExpr{}
+	for _, branch := range ctx.AllCaseBranch() {
+		exprs := branch.AllExpression()
+		if len(exprs) != 2 {
+			continue
+		}
+		c.Whens = append(c.Whens, &ast.CaseWhen{Cond: b.expression(exprs[0]), Value: b.expression(exprs[1])})
+	}
+	if ctx.Expression() != nil {
+		c.Else = b.expression(ctx.Expression())
+	}
+	return c
+}
+
+func (b *astBuilder) objectExpression(ctx IObjectExpressionContext) *ast.ObjectExpr {
+	obj := &ast.ObjectExpr{}
+	if ctx.ObjectPropertyList() == nil {
+		return obj
+	}
+	for _, prop := range ctx.ObjectPropertyList().AllObjectProperty() {
+		exprs := prop.AllExpression()
+		field := &ast.ObjectField{}
+		switch {
+		case prop.STRING_LITERAL() != nil:
+			field.Key = extractValue(prop.STRING_LITERAL().GetText())
+		case prop.Identifier() != nil:
+			field.Key = prop.Identifier().GetText()
+		case len(exprs) == 2:
+			field.Key = extractValue(exprs[0].GetText())
+			exprs = exprs[1:]
+		}
+		if len(exprs) > 0 {
+			field.Value = b.expression(exprs[len(exprs)-1])
+		}
+		obj.Fields = append(obj.Fields, field)
+	}
+	return obj
+}
+
+func (b *astBuilder) functionCall(ctx IFunctionCallContext) *ast.CallExpr {
+	if builtin := ctx.BuiltinFunction(); builtin != nil {
+		call := &ast.CallExpr{}
+		switch {
+		case builtin.TYPEOF() != nil:
+			call.Func = "typeof"
+			call.Args = []ast.Expr{&ast.Ident{Name: strings.ToLower(builtin.TypeSpecifier().GetText())}}
+			return call
+		case builtin.PACK() != nil:
+			call.Func = "pack"
+		case builtin.PACK_ALL() != nil:
+			call.Func = "pack_all"
+		case builtin.BAG_PACK() != nil:
+			call.Func = "bag_pack"
+		case builtin.MAKE_SET() != nil:
+			call.Func = "make_set"
+		case builtin.MAKE_LIST() != nil:
+			call.Func = "make_list"
+		}
+		call.Args = b.arguments(builtin.ArgumentList())
+		return call
+	}
+	call := &ast.CallExpr{}
+	if ctx.Identifier() != nil {
+		call.Func = ctx.Identifier().GetText()
+	}
+	call.Args = b.arguments(ctx.ArgumentList())
+	b.locate(call, ctx)
+	return call
+}
+
+func (b *astBuilder) arguments(ctx IArgumentListContext) []ast.Expr {
+	if ctx == nil {
+		return nil
+	}
+	var out []ast.Expr
+	for _, arg := range ctx.AllArgument() {
+		switch {
+		case arg.ASSIGN() != nil && arg.Identifier() != nil:
+			out = append(out, &ast.NamedArg{Name: arg.Identifier().GetText(), Value: b.expression(arg.Expression())})
+		case arg.Expression() != nil:
+			out = append(out, b.expression(arg.Expression()))
+		case arg.STAR() != nil:
+			out = append(out, &ast.StarExpr{})
+		}
+	}
+	return out
+}
+
+func literalNode(ctx ILiteralContext) *ast.Literal {
+	lit := &ast.Literal{Text: ctx.GetText()}
+	switch {
+	case ctx.STRING_LITERAL() != nil, ctx.VERBATIM_STRING() != nil, ctx.MULTILINE_STRING() != nil:
+		lit.Kind = ast.StringLiteral
+	case ctx.INT_NUMBER() != nil, ctx.LONG_NUMBER() != nil, ctx.HEX_NUMBER() != nil:
+		lit.Kind = ast.LongLiteral
+	case ctx.REAL_NUMBER() != nil:
+		lit.Kind = ast.RealLiteral
+	case ctx.DECIMAL_NUMBER() != nil:
+		lit.Kind = ast.DecimalLiteral
+	case ctx.BooleanLiteral() != nil:
+		lit.Kind = ast.BoolLiteral
+	case ctx.NULL() != nil:
+		lit.Kind = ast.NullLiteral
+	case ctx.DATETIME_LITERAL() != nil:
+		lit.Kind = ast.DatetimeLiteral
+	case ctx.TIMESPAN_LITERAL() != nil, ctx.TIMESPAN_SHORT() != nil:
+		lit.Kind = ast.TimespanLiteral
+	case ctx.GUID_LITERAL() != nil:
+		lit.Kind = ast.GuidLiteral
+	case ctx.DYNAMIC_LITERAL() != nil:
+		lit.Kind = ast.DynamicLiteral
+	}
+	return lit
+}
@@ -0,0 +1,256 @@
+package kql
+
+import (
+	"testing"
+
+	"github.com/craftedsignal/kql-parser/ast"
+)
+
+func TestParseQueryPipeline(t *testing.T) {
+	query := `SecurityEvent
+| where EventID == 4688 and (Process has "cmd" or Process has "powershell")
+| extend Cmd = tolower(CommandLine)
+| summarize Count = count() by Account, bin(TimeGenerated, 1h)
+| project-away Count`
+
+	q, errs := ParseQuery(query)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if q.Body == nil {
+		t.Fatal("expected a query body")
+	}
+
+	source, ok := q.Body.Source.(*ast.TableSource)
+	if !ok || source.Name != "SecurityEvent" {
+		t.Fatalf("expected table source SecurityEvent, got %#v", q.Body.Source)
+	}
+
+	var names []string
+	for _, op := range q.Body.Operators {
+		names = append(names, op.Name())
+	}
+	want := []string{"where", "extend", "summarize", "project-away"}
+	if len(names) != len(want) {
+		t.Fatalf("expected operators %v, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("expected operators %v, got %v", want, names)
+		}
+	}
+
+	where := q.Body.Operators[0].(*ast.WhereOperator)
+	and, ok := where.Predicate.(*ast.BinaryExpr)
+	if !ok || and.Op != "and" {
+		t.Fatalf("expected top-level and, got %#v", where.Predicate)
+	}
+	paren, ok := and.Y.(*ast.ParenExpr)
+	if !ok {
+		t.Fatalf("expected parenthesized right operand, got %#v", and.Y)
+	}
+	if or, ok := paren.X.(*ast.BinaryExpr); !ok || or.Op != "or" {
+		t.Fatalf("expected or inside parentheses, got %#v", paren.X)
+	}
+
+	extend := q.Body.Operators[1].(*ast.ExtendOperator)
+	if len(extend.Columns) != 1 || extend.Columns[0].Name != "Cmd" {
+		t.Fatalf("unexpected extend columns: %#v", extend.Columns)
+	}
+	if call, ok := extend.Columns[0].Expr.(*ast.CallExpr); !ok || call.Func != "tolower" {
+		t.Fatalf("expected tolower call, got %#v", extend.Columns[0].Expr)
+	}
+
+	summarize := q.Body.Operators[2].(*ast.SummarizeOperator)
+	if len(summarize.Aggregates) != 1 || summarize.Aggregates[0].Name != "Count" {
+		t.Fatalf("unexpected aggregates: %#v", summarize.Aggregates)
+	}
+	if len(summarize.By) != 2 || summarize.By[0].OutputName() != "Account" {
+		t.Fatalf("unexpected by columns: %#v", summarize.By)
+	}
+}
+
+func TestParseQueryLetStatements(t *testing.T) {
+	query := `let procs = dynamic(["a.exe", "b.exe"]);
+let Base = SecurityEvent | where EventID == 4688;
+let Filter = (name:string, threshold:int = 10) { Base | where Account == name };
+Base
+| where FileName in (procs)`
+
+	q, errs := ParseQuery(query)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(q.Statements) != 3 {
+		t.Fatalf("expected 3 statements, got %d", len(q.Statements))
+	}
+
+	procs := q.Statements[0].(*ast.LetStatement)
+	if procs.Kind != ast.LetScalar {
+		t.Errorf("expected procs to be scalar, got %s", procs.Kind)
+	}
+	if lit, ok := procs.Value.(*ast.Literal); !ok || lit.Kind != ast.DynamicLiteral {
+		t.Errorf("expected dynamic literal, got %#v", procs.Value)
+	}
+
+	base := q.Statements[1].(*ast.LetStatement)
+	if base.Kind != ast.LetTabular || base.Body == nil || len(base.Body.Operators) != 1 {
+		t.Errorf("expected tabular let with one operator, got %#v", base)
+	}
+
+	filter := q.Statements[2].(*ast.LetStatement)
+	if filter.Kind != ast.LetFunction {
+		t.Fatalf("expected function let, got %s", filter.Kind)
+	}
+	if len(filter.Parameters) != 2 || filter.Parameters[1].Name != "threshold" || filter.Parameters[1].Type != "int" {
+		t.Errorf("unexpected parameters: %#v", filter.Parameters)
+	}
+	if filter.Parameters[1].Default == nil {
+		t.Error("expected default value on threshold")
+	}
+
+	where := q.Body.Operators[0].(*ast.WhereOperator)
+	in, ok := where.Predicate.(*ast.InExpr)
+	if !ok || in.Op != "in" || len(in.Values) != 1 {
+		t.Fatalf("expected in expression, got %#v", where.Predicate)
+	}
+}
+
+func TestParseQueryJoinAndUnion(t *testing.T) {
+	query := `DeviceProcessEvents
+| join kind=leftouter (DeviceInfo | project DeviceId, OSPlatform) on DeviceId
+| join SigninLogs on $left.AccountUpn == $right.UserPrincipalName
+| union (DeviceFileEvents | where ActionType == "FileCreated"), DeviceNetworkEvents`
+
+	q, errs := ParseQuery(query)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	join := q.Body.Operators[0].(*ast.JoinOperator)
+	if join.Kind != "leftouter" {
+		t.Errorf("expected leftouter join, got %s", join.Kind)
+	}
+	if join.Right == nil || len(join.Right.Operators) != 1 {
+		t.Errorf("expected right side with project, got %#v", join.Right)
+	}
+	if len(join.On) != 1 || join.On[0].Left != "DeviceId" || join.On[0].Right != "DeviceId" {
+		t.Errorf("unexpected join keys: %#v", join.On)
+	}
+
+	join = q.Body.Operators[1].(*ast.JoinOperator)
+	if join.Kind != "innerunique" {
+		t.Errorf("expected default join kind, got %s", join.Kind)
+	}
+	if len(join.On) != 1 || join.On[0].Left != "AccountUpn" || join.On[0].Right != "UserPrincipalName" {
+		t.Errorf("unexpected join keys: %#v", join.On)
+	}
+
+	union := q.Body.Operators[2].(*ast.UnionOperator)
+	if len(union.Tables) != 2 {
+		t.Fatalf("expected 2 union legs, got %d", len(union.Tables))
+	}
+	if src, ok := union.Tables[1].Source.(*ast.TableSource); !ok || src.Name != "DeviceNetworkEvents" {
+		t.Errorf("unexpected second union leg: %#v", union.Tables[1].Source)
+	}
+
+	q, _ = ParseQuery(`union kind=inner withsource=Src isfuzzy=true SecurityEvent, SigninLogs`)
+	union = q.Body.Operators[0].(*ast.UnionOperator)
+	if union.Kind != "inner" || union.WithSource != "Src" || !union.IsFuzzy {
+		t.Errorf("expected the union parameters, got %+v", union)
+	}
+}
+
+func TestParseQueryExpressions(t *testing.T) {
+	query := `T
+| where not(A == 1)
+| where B between (1 .. 10)
+| where C has_any ("x", "y")
+| where D.Name == "x" and E?.Id == 1
+| where G > ago(1d) and H == datetime(2024-01-01) and I == true`
+
+	q, errs := ParseQuery(query)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	var kinds []ast.LiteralKind
+	var members []*ast.MemberExpr
+	var sawNot, sawBetween, sawHasAny bool
+	ast.Inspect(q, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Literal:
+			kinds = append(kinds, n.Kind)
+		case *ast.MemberExpr:
+			members = append(members, n)
+		case *ast.UnaryExpr:
+			sawNot = sawNot || n.Op == "not"
+		case *ast.BetweenExpr:
+			sawBetween = true
+		case *ast.InExpr:
+			sawHasAny = sawHasAny || n.Op == "has_any"
+		}
+		return true
+	})
+
+	if !sawNot || !sawBetween || !sawHasAny {
+		t.Errorf("missing nodes: not=%v between=%v has_any=%v", sawNot, sawBetween, sawHasAny)
+	}
+	if len(members) != 2 || members[0].Name != "Name" || !members[1].Optional {
+		t.Errorf("unexpected member expressions: %#v", members)
+	}
+
+	want := map[ast.LiteralKind]bool{
+		ast.LongLiteral:     true,
+		ast.StringLiteral:   true,
+		ast.TimespanLiteral: true,
+		ast.DatetimeLiteral: true,
+		ast.BoolLiteral:     true,
+	}
+	for _, kind := range kinds {
+		delete(want, kind)
+	}
+	if len(want) > 0 {
+		t.Errorf("missing literal kinds: %v", want)
+	}
+}
+
+func TestParseQueryGenericOperator(t *testing.T) {
+	q, _ := ParseQuery("T | take 10 | sort by A desc")
+	if len(q.Body.Operators) != 2 {
+		t.Fatalf("expected 2 operators, got %d", len(q.Body.Operators))
+	}
+	take, ok := q.Body.Operators[0].(*ast.GenericOperator)
+	if !ok || take.Keyword != "take" || take.Text != "take 10" {
+		t.Errorf("unexpected take operator: %#v", q.Body.Operators[0])
+	}
+}
+
+func TestParseQueryReshapingOperators(t *testing.T) {
+	q, errs := ParseQuery("T | project-rename Cmd = CommandLine | mv-expand with_itemindex=i Tag = Tags to typeof(string)" +
+		` | parse-kv Cmd as (User:string, Port:int) with (pair_delimiter=" ")`)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	rename, ok := q.Body.Operators[0].(*ast.ProjectRenameOperator)
+	if !ok || len(rename.Columns) != 1 || rename.Columns[0].Name != "Cmd" {
+		t.Fatalf("unexpected project-rename: %#v", q.Body.Operators[0])
+	}
+	if old, ok := rename.Columns[0].Expr.(*ast.Ident); !ok || old.Name != "CommandLine" {
+		t.Errorf("expected the old name as an identifier, got %#v", rename.Columns[0].Expr)
+	}
+	expand, ok := q.Body.Operators[1].(*ast.MvExpandOperator)
+	if !ok || expand.ItemIndex != "i" || len(expand.Items) != 1 {
+		t.Fatalf("unexpected mv-expand: %#v", q.Body.Operators[1])
+	}
+	if item := expand.Items[0]; item.OutputName() != "Tag" || item.Type != "string" || item.Text != "Tags" {
+		t.Errorf("unexpected mv-expand item: %#v", item)
+	}
+	kv, ok := q.Body.Operators[2].(*ast.ParseKvOperator)
+	if !ok || len(kv.Columns) != 2 || kv.Columns[1].Column != "Port" || kv.Columns[1].Type != "int" {
+		t.Fatalf("unexpected parse-kv: %#v", q.Body.Operators[2])
+	}
+	if len(kv.With) != 1 || kv.With[0].Name != "pair_delimiter" {
+		t.Errorf("unexpected parse-kv parameters: %#v", kv.With)
+	}
+}
@@ -0,0 +1,265 @@
+package kql
+
+import (
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+)
+
+// BoolOp is the kind of a BoolExpr node.
+type BoolOp string
+
+const (
+	BoolAnd  BoolOp = "and"
+	BoolOr   BoolOp = "or"
+	BoolNot  BoolOp = "not"
+	BoolLeaf BoolOp = "leaf"
+)
+
+// WhereClause is the predicate of one where operator as a boolean tree. Unlike the
+// flat Conditions list, the tree keeps parenthesization and not(), so
+// (A or B) and C and A or (B and C) can be told apart.
+type WhereClause struct {
+	PipeStage int       `json:"pipe_stage"`
+	Predicate *BoolExpr `json:"predicate"`
+	Span      *Span     `json:"span,omitempty"` // Location of the predicate in the original query
+}
+
+// BoolExpr is a node of a where predicate. And and Or nodes have two or more
+// Operands, Not nodes exactly one, and leaves none.
+//
+// A leaf's Condition is the predicate as written at that position: negation from
+// enclosing not() is expressed by Not nodes rather than by Condition.Negated, and
+// OR alternatives on the same field are not merged. Index refers to the entry of
+// ParseResult.Conditions the leaf was reported as, which may have been merged with
+// others. Leaves for predicates that yield no condition, like strlen(x) > 5, have
+// a nil Condition, an Index of -1, and the predicate's Text and Span.
+type BoolExpr struct {
+	Op        BoolOp      `json:"op"`
+	Operands  []*BoolExpr `json:"operands,omitempty"`
+	Condition *Condition  `json:"condition,omitempty"`
+	Index     int         `json:"index"`
+	Text      string      `json:"text,omitempty"`
+	Span      *Span       `json:"span,omitempty"`
+}
+
+// Leaves returns the leaf nodes of the tree in source order.
+func (b *BoolExpr) Leaves() []*BoolExpr {
+	if b == nil {
+		return nil
+	}
+	if b.Op == BoolLeaf {
+		return []*BoolExpr{b}
+	}
+	var leaves []*BoolExpr
+	for _, operand := range b.Operands {
+		leaves = append(leaves, operand.Leaves()...)
+	}
+	return leaves
+}
+
+// String renders the tree with explicit parentheses, for debugging and tests.
+func (b *BoolExpr) String() string {
+	if b == nil {
+		return ""
+	}
+	switch b.Op {
+	case BoolNot:
+		return "not(" + b.Operands[0].String() + ")"
+	case BoolAnd, BoolOr:
+		parts := make([]string, 0, len(b.Operands))
+		for _, operand := range b.Operands {
+			parts = append(parts, operand.String())
+		}
+		return "(" + strings.Join(parts, " "+string(b.Op)+" ") + ")"
+	}
+	if b.Condition == nil {
+		return b.Text
+	}
+	c := b.Condition
+	s := c.Field + " " + c.Operator + " " + c.Value
+	if len(c.Alternatives) > 0 {
+		s = c.Field + " " + c.Operator + " (" + strings.Join(c.Alternatives, ", ") + ")"
+	}
+	if c.Negated {
+		return "!" + s
+	}
+	return s
+}
+
+// addCondition records a condition and associates it with the comparison being
+// walked, so that the where clause tree can refer to it. Conditions in a function
+// or conditional aggregation of the main pipeline are kept with its filters, tagged
+// with that scope; conditions outside the main pipeline are tagged with the
+// outermost enclosing scope and kept apart.
+func (e *conditionExtractor) addCondition(cond Condition) {
+	if e.inSubquery > 0 {
+		return // reported through the join's Subsearch
+	}
+	e.describePath(&cond)
+	if len(e.scopes) > 0 {
+		cond.Scope = e.scopes[0].kind
+		cond.ScopeName = e.scopes[0].name
+		if cond.Scope == ScopeFunction || cond.Scope == ScopeAggregation {
+			e.conditions = append(e.conditions, cond)
+		} else {
+			e.scopedConditions = append(e.scopedConditions, cond)
+		}
+		return
+	}
+	if n := len(e.comparisons); n > 0 {
+		top := e.comparisons[n-1]
+		if e.comparisonConditions == nil {
+			e.comparisonConditions = make(map[*ComparisonExpressionContext][]int)
+		}
+		e.comparisonConditions[top] = append(e.comparisonConditions[top], len(e.conditions))
+	}
+	e.conditions = append(e.conditions, cond)
+}
+
+// ExitComparisonExpression closes the comparison opened in EnterComparisonExpression.
+func (e *conditionExtractor) ExitComparisonExpression(ctx *ComparisonExpressionContext) {
+	e.comparisons = e.comparisons[:len(e.comparisons)-1]
+}
+
+// EnterWhereOperator remembers the negation in effect outside the predicate, which
+// is non-zero for a where inside a negated subquery.
+func (e *conditionExtractor) EnterWhereOperator(ctx *WhereOperatorContext) {
+	e.whereNegated = append(e.whereNegated, e.negated)
+}
+
+// ExitWhereOperator builds the boolean tree of the where predicate from the
+// conditions recorded while walking it.
+func (e *conditionExtractor) ExitWhereOperator(ctx *WhereOperatorContext) {
+	negated := e.whereNegated[len(e.whereNegated)-1]
+	e.whereNegated = e.whereNegated[:len(e.whereNegated)-1]
+	if e.inSubquery > 0 || len(e.scopes) > 0 || ctx.Expression() == nil {
+		return
+	}
+	e.whereClauses = append(e.whereClauses, WhereClause{
+		PipeStage: e.currentStage,
+		Predicate: e.boolExpr(ctx.Expression(), negated),
+		Span:      e.locator.ruleSpan(ctx.Expression()),
+	})
+}
+
+// boolExpr converts an expression subtree to a BoolExpr. negated is the parity of
+// the not operators enclosing node, which the extractor folded into Condition.Negated.
+func (e *conditionExtractor) boolExpr(node antlr.Tree, negated bool) *BoolExpr {
+	switch ctx := node.(type) {
+	case *ExpressionContext:
+		return e.boolExpr(ctx.OrExpression(), negated)
+	case *OrExpressionContext:
+		operands := ctx.AllAndExpression()
+		if len(operands) == 1 {
+			return e.boolExpr(operands[0], negated)
+		}
+		out := &BoolExpr{Op: BoolOr, Index: -1}
+		for _, operand := range operands {
+			out.Operands = append(out.Operands, e.boolExpr(operand, negated))
+		}
+		return out
+	case *AndExpressionContext:
+		operands := ctx.AllNotExpression()
+		if len(operands) == 1 {
+			return e.boolExpr(operands[0], negated)
+		}
+		out := &BoolExpr{Op: BoolAnd, Index: -1}
+		for _, operand := range operands {
+			out.Operands = append(out.Operands, e.boolExpr(operand, negated))
+		}
+		return out
+	case *NotExpressionContext:
+		if ctx.NOT() != nil {
+			return &BoolExpr{Op: BoolNot, Index: -1, Operands: []*BoolExpr{e.boolExpr(ctx.NotExpression(), !negated)}}
+		}
+		return e.boolExpr(ctx.ComparisonExpression(), negated)
+	case *ComparisonExpressionContext:
+		if inner := parenthesizedExpression(ctx); inner != nil {
+			return e.boolExpr(inner, negated)
+		}
+		return e.comparisonLeaf(ctx, negated)
+	}
+	return &BoolExpr{Op: BoolLeaf, Index: -1}
+}
+
+// comparisonLeaf returns the leaf, or the small tree of leaves, for the conditions
+// extracted from one comparison.
+func (e *conditionExtractor) comparisonLeaf(ctx *ComparisonExpressionContext, negated bool) *BoolExpr {
+	indexes := e.comparisonConditions[ctx]
+	if len(indexes) == 0 {
+		return &BoolExpr{
+			Op:    BoolLeaf,
+			Index: -1,
+			Text:  ctx.GetText(),
+			Span:  e.locator.ruleSpan(ctx),
+		}
+	}
+
+	notBetween := ctx.NOT_BETWEEN() != nil
+	leaves := make([]*BoolExpr, 0, len(indexes))
+	for _, i := range indexes {
+		cond := e.conditions[i]
+		cond.Negated = cond.Negated != negated
+		if cond.Span != nil {
+			span := *cond.Span
+			cond.Span = &span
+		}
+		if notBetween {
+			// !between is expressed as not(low <= x and x <= high) below
+			cond.Negated, cond.NegatedByOperator = false, false
+		}
+		leaves = append(leaves, &BoolExpr{Op: BoolLeaf, Condition: &cond, Index: i})
+	}
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+
+	// between yields two ANDed bounds, has_all ANDed terms and has_any ORed terms
+	op := BoolAnd
+	if e.conditions[indexes[1]].LogicalOp == "OR" {
+		op = BoolOr
+	}
+	out := &BoolExpr{Op: op, Index: -1, Operands: leaves}
+	if notBetween {
+		out = &BoolExpr{Op: BoolNot, Index: -1, Operands: []*BoolExpr{out}}
+	}
+	return out
+}
+
+// parenthesizedExpression returns the inner expression when ctx is only a
+// parenthesized expression, like the (A or B) in (A or B) and C.
+func parenthesizedExpression(ctx *ComparisonExpressionContext) IExpressionContext {
+	var node antlr.Tree = ctx
+	for {
+		switch node.GetChildCount() {
+		case 1:
+			child, ok := node.GetChild(0).(antlr.ParserRuleContext)
+			if !ok {
+				return nil
+			}
+			node = child
+		case 3:
+			open, ok := node.GetChild(0).(antlr.TerminalNode)
+			if !ok || open.GetSymbol().GetTokenType() != KQLParserLPAREN {
+				return nil
+			}
+			inner, _ := node.GetChild(1).(IExpressionContext)
+			return inner
+		default:
+			return nil
+		}
+	}
+}
+
+// remapWhereClauses rewrites leaf indexes from the extractor's conditions to the
+// grouped conditions reported in ParseResult.
+func remapWhereClauses(clauses []WhereClause, mapping []int) {
+	for _, clause := range clauses {
+		for _, leaf := range clause.Predicate.Leaves() {
+			if leaf.Index >= 0 && leaf.Index < len(mapping) {
+				leaf.Index = mapping[leaf.Index]
+			}
+		}
+	}
+}
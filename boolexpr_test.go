@@ -0,0 +1,113 @@
+package kql
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestWhereClauseTreeKeepsGrouping(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`T | where (A == 1 or B == 2) and C == 3`, `((A == 1 or B == 2) and C == 3)`},
+		{`T | where A == 1 or (B == 2 and C == 3)`, `(A == 1 or (B == 2 and C == 3))`},
+		{`T | where not(A == 1 or A == 2) and B !in ("x", "y")`, `(not((A == 1 or A == 2)) and !B in (x, y))`},
+		{`T | where X has_any ("a", "b") and Y !between (1 .. 5)`, `((X has a or X has b) and not((Y >= 1 and Y <= 5)))`},
+		{`T | where strlen(Z) > 5 and isnotempty(W)`, `(strlen(Z)>5 and W isnotnull )`},
+	}
+	for _, tt := range tests {
+		result := ExtractConditions(tt.query)
+		if len(result.WhereClauses) != 1 {
+			t.Errorf("%s: expected 1 where clause, got %d", tt.query, len(result.WhereClauses))
+			continue
+		}
+		if got := result.WhereClauses[0].Predicate.String(); got != tt.want {
+			t.Errorf("%s:\n  got  %s\n  want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestWhereClauseLeavesReferenceConditions(t *testing.T) {
+	query := "T\n| where A == 1 or A == 2\n| where strlen(B) > 3 and C contains \"x\""
+	result := ExtractConditions(query)
+	if len(result.WhereClauses) != 2 {
+		t.Fatalf("expected 2 where clauses, got %d", len(result.WhereClauses))
+	}
+
+	first := result.WhereClauses[0]
+	if first.PipeStage != 0 || first.Span == nil || first.Span.Text(query) != "A == 1 or A == 2" {
+		t.Errorf("unexpected first clause %+v", first)
+	}
+	for _, leaf := range first.Predicate.Leaves() {
+		if leaf.Index != 0 || leaf.Condition == nil || len(leaf.Condition.Alternatives) != 0 {
+			t.Errorf("OR alternatives should stay separate leaves of the merged condition, got %+v", leaf)
+		}
+	}
+
+	leaves := result.WhereClauses[1].Predicate.Leaves()
+	if len(leaves) != 2 {
+		t.Fatalf("expected 2 leaves, got %d", len(leaves))
+	}
+	if leaves[0].Condition != nil || leaves[0].Index != -1 || leaves[0].Span.Text(query) != "strlen(B) > 3" {
+		t.Errorf("expected an opaque leaf for strlen(B) > 3, got %+v", leaves[0])
+	}
+	if leaves[1].Index < 0 || result.Conditions[leaves[1].Index].Field != "C" {
+		t.Errorf("expected leaf to reference the condition on C, got %+v", leaves[1])
+	}
+}
+
+func TestNotBetweenTreeEvaluation(t *testing.T) {
+	result := ExtractConditions(`T | where Y !between (1 .. 5)`)
+	if len(result.WhereClauses) != 1 {
+		t.Fatalf("expected 1 where clause, got %d", len(result.WhereClauses))
+	}
+	tree := result.WhereClauses[0].Predicate
+	for _, leaf := range tree.Leaves() {
+		if leaf.Condition == nil || leaf.Condition.Negated || leaf.Condition.NegatedByOperator {
+			t.Errorf("expected the Not node to carry the negation, got leaf %+v", leaf.Condition)
+		}
+	}
+	for y, want := range map[float64]bool{0: true, 1: false, 3: false, 5: false, 7: true} {
+		if got := evaluateNumeric(t, tree, y); got != want {
+			t.Errorf("Y = %v: expected %v, got %v", y, want, got)
+		}
+	}
+}
+
+// evaluateNumeric evaluates a tree of numeric comparisons on a single column
+// with value y, treating either negation flag of a leaf as negating it.
+func evaluateNumeric(t *testing.T, b *BoolExpr, y float64) bool {
+	switch b.Op {
+	case BoolAnd:
+		for _, operand := range b.Operands {
+			if !evaluateNumeric(t, operand, y) {
+				return false
+			}
+		}
+		return true
+	case BoolOr:
+		for _, operand := range b.Operands {
+			if evaluateNumeric(t, operand, y) {
+				return true
+			}
+		}
+		return false
+	case BoolNot:
+		return !evaluateNumeric(t, b.Operands[0], y)
+	}
+	value, err := strconv.ParseFloat(b.Condition.Value, 64)
+	if err != nil {
+		t.Fatalf("unexpected value %q", b.Condition.Value)
+	}
+	var out bool
+	switch b.Condition.Operator {
+	case ">=":
+		out = y >= value
+	case "<=":
+		out = y <= value
+	default:
+		t.Fatalf("unexpected operator %s", b.Condition.Operator)
+	}
+	return out != (b.Condition.Negated || b.Condition.NegatedByOperator)
+}
@@ -0,0 +1,83 @@
+package kql
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/antlr4-go/antlr/v4"
+)
+
+// cancelCheckInterval is how many token stream accesses pass between context checks.
+// Prediction touches the stream constantly, so this bounds cancellation latency to
+// a few microseconds of parser work while keeping the check off the hot path.
+const cancelCheckInterval = 64
+
+// parseCanceled is raised as a panic from inside the parser when the context ends,
+// and recovered by extractConditionsInternal.
+type parseCanceled struct {
+	err error
+}
+
+// contextTokenStream is a token stream that aborts parsing once its context is done.
+// The lexer runs lazily as the parser pulls tokens, so this stops both.
+type contextTokenStream struct {
+	*antlr.CommonTokenStream
+	done  <-chan struct{}
+	ctx   context.Context
+	calls int
+}
+
+func newContextTokenStream(ctx context.Context, stream *antlr.CommonTokenStream) *contextTokenStream {
+	return &contextTokenStream{CommonTokenStream: stream, done: ctx.Done(), ctx: ctx}
+}
+
+func (s *contextTokenStream) check() {
+	if s.done == nil {
+		return
+	}
+	s.calls++
+	if s.calls%cancelCheckInterval != 0 {
+		return
+	}
+	select {
+	case <-s.done:
+		panic(parseCanceled{err: s.ctx.Err()})
+	default:
+	}
+}
+
+func (s *contextTokenStream) LA(i int) int {
+	s.check()
+	return s.CommonTokenStream.LA(i)
+}
+
+func (s *contextTokenStream) LT(k int) antlr.Token {
+	s.check()
+	return s.CommonTokenStream.LT(k)
+}
+
+func (s *contextTokenStream) Consume() {
+	s.check()
+	s.CommonTokenStream.Consume()
+}
+
+// contextDiagnostic describes why a context ended. limit is the timeout that was
+// configured for the call, or 0 when the deadline came from the caller's context.
+func contextDiagnostic(err error, limit time.Duration) Diagnostic {
+	if errors.Is(err, context.Canceled) {
+		return Diagnostic{
+			Severity: SeverityError,
+			Code:     CodeCanceled,
+			Message:  "parser canceled: " + err.Error(),
+		}
+	}
+	if limit > 0 {
+		return timeoutDiagnostic(limit)
+	}
+	return Diagnostic{
+		Severity: SeverityError,
+		Code:     CodeTimeout,
+		Message:  "parser timeout: " + err.Error(),
+	}
+}
@@ -0,0 +1,71 @@
+package kql
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtractConditionsContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result := ExtractConditionsContext(ctx, "SecurityEvent | where EventID == 4624")
+	if len(result.Conditions) != 0 {
+		t.Errorf("expected no conditions, got %+v", result.Conditions)
+	}
+	if len(result.DiagnosticsWithCode(CodeCanceled)) != 1 {
+		t.Fatalf("expected a canceled diagnostic, got %+v", result.Diagnostics)
+	}
+}
+
+func TestExtractConditionsContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	result := ExtractConditionsContext(ctx, "SecurityEvent | where EventID == 4624")
+	timeouts := result.DiagnosticsWithCode(CodeTimeout)
+	if len(timeouts) != 1 || !strings.HasPrefix(timeouts[0].Message, "parser timeout:") {
+		t.Fatalf("expected a timeout diagnostic, got %+v", result.Diagnostics)
+	}
+}
+
+func TestExtractConditionsContextCompletes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	result := ExtractConditionsContext(ctx, "SecurityEvent | where EventID == 4624")
+	if len(result.Conditions) != 1 || result.HasFatalErrors() {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestParserStopsWhenContextEnds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	query := "SecurityEvent" + strings.Repeat(" | where A == 1", 100)
+	p := newKQLParser(ctx, query)
+	defer func() {
+		r := recover()
+		if _, ok := r.(parseCanceled); !ok {
+			t.Fatalf("expected the parser to panic with parseCanceled, got %v", r)
+		}
+	}()
+	p.parser.Query()
+}
+
+func TestLetParsingStopsWhenContextEnds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	query := "let Base = SecurityEvent" + strings.Repeat(" | where A == 1", 100) + ";\nBase"
+	defer func() {
+		r := recover()
+		if _, ok := r.(parseCanceled); !ok {
+			t.Fatalf("expected let parsing to panic with parseCanceled, got %v", r)
+		}
+	}()
+	letDefinitions(ctx, query)
+}
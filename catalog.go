@@ -0,0 +1,383 @@
+package kql
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ColumnType is the KQL scalar type of a column.
+type ColumnType string
+
+const (
+	TypeString   ColumnType = "string"
+	TypeInt      ColumnType = "int"
+	TypeLong     ColumnType = "long"
+	TypeReal     ColumnType = "real"
+	TypeDecimal  ColumnType = "decimal"
+	TypeBool     ColumnType = "bool"
+	TypeDatetime ColumnType = "datetime"
+	TypeTimespan ColumnType = "timespan"
+	TypeGuid     ColumnType = "guid"
+	TypeDynamic  ColumnType = "dynamic"
+)
+
+// columnTypeNames maps the spellings accepted in a catalog to their types. Besides
+// the KQL names and their aliases, the .NET names reported by getschema are accepted,
+// so its output can be pasted into a catalog.
+var columnTypeNames = map[string]ColumnType{
+	"string": TypeString, "int": TypeInt, "long": TypeLong, "real": TypeReal,
+	"decimal": TypeDecimal, "bool": TypeBool, "datetime": TypeDatetime,
+	"timespan": TypeTimespan, "guid": TypeGuid, "dynamic": TypeDynamic,
+
+	"boolean": TypeBool, "double": TypeReal, "date": TypeDatetime, "time": TypeTimespan,
+	"uniqueid": TypeGuid, "int32": TypeInt, "int64": TypeLong, "sbyte": TypeBool,
+	"object": TypeDynamic,
+}
+
+// parseColumnType returns the type named by s, ignoring case and a System. prefix.
+func parseColumnType(s string) (ColumnType, bool) {
+	name := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "system.")
+	t, ok := columnTypeNames[name]
+	return t, ok
+}
+
+// ColumnSchema is a column of a table in a Catalog.
+type ColumnSchema struct {
+	Name string     `json:"name"`
+	Type ColumnType `json:"type"`
+}
+
+// TableSchema is a table of a Catalog, with its columns in schema order. Unless
+// Complete is set the table may have columns that are not listed, so a column
+// missing from Columns is not known not to exist.
+type TableSchema struct {
+	Name     string         `json:"name"`
+	Columns  []ColumnSchema `json:"columns"`
+	Complete bool           `json:"complete,omitempty"` // Columns lists every column of the table
+
+	index map[string]int // lower-case column name -> position in Columns
+}
+
+// Column returns the column called name, matched case-insensitively.
+func (t *TableSchema) Column(name string) (ColumnSchema, bool) {
+	i, ok := t.index[strings.ToLower(name)]
+	if !ok {
+		return ColumnSchema{}, false
+	}
+	return t.Columns[i], true
+}
+
+// Catalog maps table names to their columns. Catalogs are not modified once built,
+// so one can be shared by concurrent extractions.
+type Catalog struct {
+	Version string
+
+	tables map[string]*TableSchema // lower-case table name
+	names  []string                // table names in load order
+}
+
+//go:embed schema/catalog.json
+var defaultCatalogData []byte
+
+var (
+	defaultCatalogOnce sync.Once
+	defaultCatalog     *Catalog
+)
+
+// DefaultCatalog returns the built-in catalog of common Microsoft Sentinel, Defender
+// XDR and Azure Monitor tables. Its Version changes whenever tables or columns are
+// added or corrected. Its tables list the commonly used columns and are not
+// Complete.
+func DefaultCatalog() *Catalog {
+	defaultCatalogOnce.Do(func() {
+		c, err := LoadCatalog(defaultCatalogData)
+		if err != nil {
+			panic("kql: embedded schema catalog: " + err.Error())
+		}
+		defaultCatalog = c
+	})
+	return defaultCatalog
+}
+
+// LoadCatalog reads a catalog written in JSON or YAML:
+//
+//	version: "1"
+//	tables:
+//	  MyApp_CL:
+//	    columns:
+//	      TimeGenerated: datetime
+//	      Message_s: string
+//	    complete: true
+//
+// A document starting with { is read as JSON, with the same keys. Column types are
+// KQL type names; the .NET names reported by getschema, such as System.Int64, are
+// accepted too. A table is Complete when it says so with complete: true.
+func LoadCatalog(data []byte) (*Catalog, error) {
+	data = bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	decode := decodeYAMLCatalog
+	if bytes.HasPrefix(data, []byte("{")) {
+		decode = decodeJSONCatalog
+	}
+	root, err := decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("schema catalog: %w", err)
+	}
+	c, err := catalogFromNode(root)
+	if err != nil {
+		return nil, fmt.Errorf("schema catalog: %w", err)
+	}
+	return c, nil
+}
+
+// Table returns the table called name, matched case-insensitively, or nil.
+func (c *Catalog) Table(name string) *TableSchema {
+	if c == nil {
+		return nil
+	}
+	return c.tables[strings.ToLower(name)]
+}
+
+// Tables returns the names of the catalog's tables in the order they were loaded.
+func (c *Catalog) Tables() []string {
+	if c == nil {
+		return nil
+	}
+	return append([]string(nil), c.names...)
+}
+
+// HasColumn reports whether table is in the catalog and has the column.
+func (c *Catalog) HasColumn(table, column string) bool {
+	t := c.Table(table)
+	if t == nil {
+		return false
+	}
+	_, ok := t.Column(column)
+	return ok
+}
+
+// Merge returns a catalog with the tables of both c and other, such as the default
+// catalog and a file of custom _CL tables. A table in other replaces the table of
+// the same name in c. The result keeps c's Version.
+func (c *Catalog) Merge(other *Catalog) *Catalog {
+	out := &Catalog{tables: make(map[string]*TableSchema)}
+	if c != nil {
+		out.Version = c.Version
+	}
+	for _, from := range []*Catalog{c, other} {
+		if from == nil {
+			continue
+		}
+		for _, name := range from.names {
+			out.add(from.tables[strings.ToLower(name)])
+		}
+	}
+	return out
+}
+
+// add adds t to c, replacing a table of the same name but keeping its position.
+func (c *Catalog) add(t *TableSchema) {
+	key := strings.ToLower(t.Name)
+	if old, ok := c.tables[key]; ok {
+		for i, name := range c.names {
+			if name == old.Name {
+				c.names[i] = t.Name
+			}
+		}
+	} else {
+		c.names = append(c.names, t.Name)
+	}
+	c.tables[key] = t
+}
+
+// catalogNode is a decoded JSON or YAML object, or a scalar within one. Keys keep
+// their order, so columns are listed as the file lists them.
+type catalogNode struct {
+	isMap  bool
+	scalar string
+	keys   []string
+	fields map[string]*catalogNode
+}
+
+func newCatalogMap() *catalogNode {
+	return &catalogNode{isMap: true, fields: make(map[string]*catalogNode)}
+}
+
+func (n *catalogNode) set(key string, child *catalogNode) error {
+	if _, dup := n.fields[key]; dup {
+		return fmt.Errorf("duplicate key %q", key)
+	}
+	n.keys = append(n.keys, key)
+	n.fields[key] = child
+	return nil
+}
+
+// object returns the object under key, nil when the key is missing or empty.
+func (n *catalogNode) object(key string) (*catalogNode, error) {
+	child := n.fields[key]
+	if child == nil || (!child.isMap && child.scalar == "") {
+		return nil, nil
+	}
+	if !child.isMap {
+		return nil, fmt.Errorf("%s: expected an object, got %q", key, child.scalar)
+	}
+	return child, nil
+}
+
+// catalogFromNode builds a catalog from its decoded document. Keys other than
+// version, tables, columns and complete are ignored, leaving room for annotations.
+func catalogFromNode(root *catalogNode) (*Catalog, error) {
+	if !root.isMap {
+		return nil, fmt.Errorf("expected an object with version and tables")
+	}
+	c := &Catalog{tables: make(map[string]*TableSchema)}
+	if v := root.fields["version"]; v != nil {
+		if v.isMap {
+			return nil, fmt.Errorf("version: expected a scalar")
+		}
+		c.Version = v.scalar
+	}
+	tables, err := root.object("tables")
+	if err != nil || tables == nil {
+		return c, err
+	}
+	for _, name := range tables.keys {
+		table := tables.fields[name]
+		if !table.isMap {
+			return nil, fmt.Errorf("table %s: expected an object with columns", name)
+		}
+		columns, err := table.object("columns")
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", name, err)
+		}
+		if c.Table(name) != nil {
+			return nil, fmt.Errorf("table %s is defined twice", name)
+		}
+		schema := &TableSchema{Name: name, index: make(map[string]int)}
+		if complete := table.fields["complete"]; complete != nil {
+			if complete.isMap || (complete.scalar != "true" && complete.scalar != "false") {
+				return nil, fmt.Errorf("table %s: complete: expected true or false", name)
+			}
+			schema.Complete = complete.scalar == "true"
+		}
+		if columns != nil {
+			for _, column := range columns.keys {
+				typeNode := columns.fields[column]
+				if typeNode.isMap {
+					return nil, fmt.Errorf("table %s, column %s: expected a type", name, column)
+				}
+				t, ok := parseColumnType(typeNode.scalar)
+				if !ok {
+					return nil, fmt.Errorf("table %s, column %s: unknown type %q", name, column, typeNode.scalar)
+				}
+				if _, dup := schema.index[strings.ToLower(column)]; dup {
+					return nil, fmt.Errorf("table %s: column %s is defined twice", name, column)
+				}
+				schema.index[strings.ToLower(column)] = len(schema.Columns)
+				schema.Columns = append(schema.Columns, ColumnSchema{Name: column, Type: t})
+			}
+		}
+		c.add(schema)
+	}
+	return c, nil
+}
+
+// decodeJSONCatalog decodes a JSON document into a catalogNode tree. encoding/json
+// is walked token by token because decoding into a map would lose column order.
+func decodeJSONCatalog(data []byte) (*catalogNode, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	root, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the top-level object")
+	}
+	return root, nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (*catalogNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t != '{' {
+			return nil, fmt.Errorf("arrays are not supported, at offset %d", dec.InputOffset())
+		}
+		node := newCatalogMap()
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			child, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			if err := node.set(keyTok.(string), child); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case string:
+		return &catalogNode{scalar: t}, nil
+	case json.Number:
+		return &catalogNode{scalar: t.String()}, nil
+	case bool:
+		return &catalogNode{scalar: strconv.FormatBool(t)}, nil
+	}
+	return &catalogNode{}, nil
+}
+
+// decodeYAMLCatalog decodes a YAML document into a catalogNode tree. The document
+// is read as a yaml.Node, which keeps the order of keys.
+func decodeYAMLCatalog(data []byte) (*catalogNode, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return newCatalogMap(), nil
+	}
+	return decodeYAMLValue(doc.Content[0])
+}
+
+func decodeYAMLValue(n *yaml.Node) (*catalogNode, error) {
+	switch n.Kind {
+	case yaml.AliasNode:
+		return decodeYAMLValue(n.Alias)
+	case yaml.SequenceNode:
+		return nil, fmt.Errorf("arrays are not supported, at line %d", n.Line)
+	case yaml.MappingNode:
+		node := newCatalogMap()
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			child, err := decodeYAMLValue(n.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if err := node.set(n.Content[i].Value, child); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n.Content[i].Line, err)
+			}
+		}
+		return node, nil
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			return &catalogNode{}, nil
+		}
+		return &catalogNode{scalar: n.Value}, nil
+	}
+	return &catalogNode{}, nil
+}
@@ -0,0 +1,120 @@
+package kql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefaultCatalog(t *testing.T) {
+	c := DefaultCatalog()
+	if c.Version == "" {
+		t.Error("expected the embedded catalog to have a version")
+	}
+	if !c.HasColumn("DeviceProcessEvents", "ProcessCommandLine") {
+		t.Error("expected DeviceProcessEvents.ProcessCommandLine")
+	}
+	if c.HasColumn("SecurityEvent", "ProcessCommandLine") || !c.HasColumn("securityevent", "commandline") {
+		t.Error("expected SecurityEvent to have CommandLine but not ProcessCommandLine")
+	}
+	table := c.Table("SigninLogs")
+	if table == nil || table.Columns[0].Name != "TenantId" {
+		t.Fatalf("expected SigninLogs columns in schema order, got %+v", table)
+	}
+	if col, ok := table.Column("IsInteractive"); !ok || col.Type != TypeBool {
+		t.Errorf("expected IsInteractive to be bool, got %+v", col)
+	}
+	if c.Table("MyApp_CL") != nil {
+		t.Error("unexpected custom table in the default catalog")
+	}
+	for _, name := range c.Tables() {
+		if c.Table(name).Complete {
+			t.Errorf("%s: built-in tables do not list every column", name)
+		}
+	}
+}
+
+func TestLoadCatalog(t *testing.T) {
+	yaml := `# custom tables
+version: "7"
+tables:
+  MyApp_CL:
+    description: 'app log'  # ignored
+    columns:
+      TimeGenerated: datetime
+      "Level_d": System.Int64
+      Message_s: string
+    complete: true
+  Empty_CL:
+    columns: {}
+`
+	json := `{
+  "version": 7,
+  "tables": {
+    "MyApp_CL": {
+      "description": "app log",
+      "columns": {"TimeGenerated": "datetime", "Level_d": "System.Int64", "Message_s": "string"},
+      "complete": true
+    },
+    "Empty_CL": {"columns": {}}
+  }
+}`
+	for _, data := range []string{yaml, json} {
+		c, err := LoadCatalog([]byte(data))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		table := c.Table("myapp_cl")
+		if c.Version != "7" || table == nil || len(table.Columns) != 3 || c.Table("Empty_CL") == nil {
+			t.Fatalf("unexpected catalog %+v", c)
+		}
+		if col := table.Columns[1]; col.Name != "Level_d" || col.Type != TypeLong {
+			t.Errorf("expected Level_d long in second place, got %+v", col)
+		}
+		if !table.Complete || c.Table("Empty_CL").Complete {
+			t.Errorf("expected only MyApp_CL to be complete")
+		}
+	}
+
+	for _, data := range []string{
+		`{"tables": {"T": {"columns": {"A": "text"}}}}`,
+		`{"tables": {"T": {"columns": ["A"]}}}`,
+		`{"tables": {"T": {}, "t": {}}}`,
+		`{"tables": {"T": {"columns": {"A": "string", "A": "long"}}}}`,
+		`{"tables": {"T": {"columns": {"A": "string"}, "complete": "yes"}}}`,
+		"tables:\n  T:\n    columns:\n      A: text\n",
+		"tables:\n  T:\n    columns:\n      - A\n",
+		"tables:\n  T:\n  columns:\n   A: string\n",
+		"tables:\n\tT: {}\n",
+		"tables:\n  T: {}\n  t: {}\n",
+		"tables:\n  T:\n    columns:\n      A: string\n      A: long\n",
+	} {
+		if _, err := LoadCatalog([]byte(data)); err == nil || !strings.HasPrefix(err.Error(), "schema catalog: ") {
+			t.Errorf("%q: expected an error, got %v", data, err)
+		}
+	}
+}
+
+func TestCatalogOption(t *testing.T) {
+	custom, err := LoadCatalog([]byte(`{"tables": {"MyApp_CL": {"columns": {"Message_s": "string"}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := DefaultCatalog().Merge(custom)
+	if !catalog.HasColumn("MyApp_CL", "Message_s") || !catalog.HasColumn("SigninLogs", "UserPrincipalName") {
+		t.Fatal("expected the merged catalog to have both default and custom tables")
+	}
+	if catalog.Version != DefaultCatalog().Version {
+		t.Errorf("expected the merged catalog to keep the default version, got %q", catalog.Version)
+	}
+
+	// Catalog tables are only excluded from fields when asked for
+	query := `T | where MyApp_CL == "x" and Syslog == "y"`
+	result := ExtractConditionsWithOptions(query, Options{Catalog: catalog, DisablePortableFallback: true})
+	if len(result.Conditions) != 2 {
+		t.Errorf("expected conditions on MyApp_CL and Syslog, got %+v", result.Conditions)
+	}
+	result = ExtractConditionsWithOptions(query, Options{Catalog: catalog, Tables: catalog.Tables(), DisablePortableFallback: true})
+	if len(result.Conditions) != 0 || len(result.DiagnosticsWithCode(CodeExcludedField)) != 2 {
+		t.Errorf("expected catalog tables to be excluded from fields, got %+v", result.Conditions)
+	}
+}
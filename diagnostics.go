@@ -0,0 +1,171 @@
+package kql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Severity ranks how a diagnostic affects the reliability of a ParseResult.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"   // The query could not be fully analyzed
+	SeverityWarning Severity = "warning" // Analysis completed, but part of the query was ignored or approximated
+	SeverityInfo    Severity = "info"    // Informational note about how results were produced
+)
+
+// DiagnosticCode identifies the kind of a diagnostic independently of its message.
+type DiagnosticCode string
+
+const (
+	CodeSyntaxError        DiagnosticCode = "syntax_error"        // Parser could not match the grammar
+	CodeLexerError         DiagnosticCode = "lexer_error"         // Lexer met a character sequence it does not recognize
+	CodeTimeout            DiagnosticCode = "timeout"             // Parsing exceeded the configured time limit
+	CodeCanceled           DiagnosticCode = "canceled"            // The caller's context was canceled
+	CodeInternalPanic      DiagnosticCode = "internal_panic"      // A panic was recovered while parsing
+	CodePortablePredicates DiagnosticCode = "portable_predicates" // Conditions came from the string-based fallback
+	CodePortableKeyword    DiagnosticCode = "portable_keyword"    // A _keyword_ condition came from the string-based fallback
+	CodeExcludedField      DiagnosticCode = "excluded_field"      // A condition was dropped because its field is excluded
+	CodeUnknownColumn      DiagnosticCode = "unknown_column"      // A condition's field is not a column of the tables read, per the catalog
+	CodeTypeMismatch       DiagnosticCode = "type_mismatch"       // A condition's operator or value does not fit the column's type
+	CodeTypeError          DiagnosticCode = "type_error"          // An expression applies a function or operator to a value of the wrong type
+	CodeLetNotInlined      DiagnosticCode = "let_not_inlined"     // References to a let were left in place instead of replaced by its body
+)
+
+// Diagnostic is a structured error, warning or note produced while parsing a query.
+type Diagnostic struct {
+	Severity       Severity       `json:"severity"`
+	Code           DiagnosticCode `json:"code"`
+	Message        string         `json:"message"`
+	Span           *Span          `json:"span,omitempty"`            // Location in the original query
+	Line           int            `json:"line,omitempty"`            // 1-based line of Span.Start
+	Column         int            `json:"column,omitempty"`          // 1-based column of Span.Start
+	OffendingToken string         `json:"offending_token,omitempty"` // Token text the parser rejected
+	Suggestions    []string       `json:"suggestions,omitempty"`     // Likely corrections, best first
+}
+
+// String renders the diagnostic the way it appears in ParseResult.Errors.
+func (d Diagnostic) String() string {
+	if d.Line > 0 {
+		return fmt.Sprintf("line %d:%d %s", d.Line, d.Column, d.Message)
+	}
+	return d.Message
+}
+
+// HasFatalErrors reports whether any diagnostic has error severity, meaning the
+// extracted conditions may be incomplete.
+func (r *ParseResult) HasFatalErrors() bool {
+	for _, d := range r.Diagnostics {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// DiagnosticsWithCode returns the diagnostics that have the given code.
+func (r *ParseResult) DiagnosticsWithCode(code DiagnosticCode) []Diagnostic {
+	var out []Diagnostic
+	for _, d := range r.Diagnostics {
+		if d.Code == code {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// diagnosticMessages renders diagnostics for the legacy Errors field. Excluded
+// fields are left out, as dropping them is the configured behavior rather than a
+// problem with the query, and so are schema checks, which are only run on request,
+// and lets left in place, which the query was analyzed without before lets were
+// inlined at all.
+func diagnosticMessages(diagnostics []Diagnostic) []string {
+	var out []string
+	for _, d := range diagnostics {
+		switch d.Code {
+		case CodeExcludedField, CodeUnknownColumn, CodeTypeMismatch, CodeTypeError, CodeLetNotInlined:
+		default:
+			out = append(out, d.String())
+		}
+	}
+	return out
+}
+
+// diagnostics converts the lexer and parser errors to diagnostics. Positions are
+// mapped to the original query when a source map is set.
+func (p *kqlParser) diagnostics() []Diagnostic {
+	var out []Diagnostic
+	for _, l := range []*errorListener{p.lexerErrors, p.parserErrors} {
+		for _, err := range l.errors {
+			out = append(out, syntaxDiagnostic(err, p.sourceMap))
+		}
+	}
+	return out
+}
+
+func syntaxDiagnostic(err syntaxError, sm *SourceMap) Diagnostic {
+	d := Diagnostic{
+		Severity:       SeverityError,
+		Code:           CodeSyntaxError,
+		Message:        err.msg,
+		OffendingToken: err.token,
+	}
+	if err.lexer {
+		d.Code = CodeLexerError
+		if i := strings.Index(err.msg, "at: '"); i >= 0 {
+			d.OffendingToken = strings.TrimSuffix(err.msg[i+len("at: '"):], "'")
+		}
+	}
+	if sm == nil {
+		return d
+	}
+	start := sm.normalizedOffset(err.line, err.column)
+	end := start + len(d.OffendingToken)
+	if d.OffendingToken == "<EOF>" {
+		end = start
+	}
+	span := sm.OriginalSpan(start, min(end, len(sm.normalized)))
+	d.Span = &span
+	d.Line, d.Column = Position(sm.original, span.Start)
+	return d
+}
+
+func timeoutDiagnostic(limit time.Duration) Diagnostic {
+	return Diagnostic{
+		Severity: SeverityError,
+		Code:     CodeTimeout,
+		Message:  fmt.Sprintf("parser timeout: query took longer than %s to parse", limit),
+	}
+}
+
+func panicDiagnostic(r interface{}) Diagnostic {
+	return Diagnostic{
+		Severity: SeverityError,
+		Code:     CodeInternalPanic,
+		Message:  fmt.Sprintf("parser panic: %v", r),
+	}
+}
+
+// portableDiagnostic describes which string-based fallback produced conditions.
+func portableDiagnostic(note string) Diagnostic {
+	code := CodePortablePredicates
+	if note == portableKeywordExtractionNote {
+		code = CodePortableKeyword
+	}
+	return Diagnostic{Severity: SeverityInfo, Code: code, Message: note}
+}
+
+// excludedFieldDiagnostic notes a condition on field that was dropped for reason.
+func excludedFieldDiagnostic(field, reason string, span *Span, original string) Diagnostic {
+	d := Diagnostic{
+		Severity: SeverityInfo,
+		Code:     CodeExcludedField,
+		Message:  fmt.Sprintf("condition on %s dropped: %s", field, reason),
+		Span:     span,
+	}
+	if span != nil {
+		d.Line, d.Column = Position(original, span.Start)
+	}
+	return d
+}
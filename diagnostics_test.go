@@ -0,0 +1,58 @@
+package kql
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyntaxErrorDiagnostics(t *testing.T) {
+	query := "let x = 1;\nSecurityEvent\n| where EventID == 4624 )"
+	result := ExtractConditions(query)
+
+	syntax := result.DiagnosticsWithCode(CodeSyntaxError)
+	if len(syntax) == 0 {
+		t.Fatalf("expected a syntax error diagnostic, got %+v", result.Diagnostics)
+	}
+	d := syntax[0]
+	if d.Severity != SeverityError {
+		t.Errorf("expected error severity, got %s", d.Severity)
+	}
+	if d.OffendingToken == "" {
+		t.Error("expected an offending token")
+	}
+	if d.Line != 3 || d.Span == nil || d.Span.Text(query) != d.OffendingToken {
+		t.Errorf("expected span of %q on line 3, got line %d span %+v", d.OffendingToken, d.Line, d.Span)
+	}
+	if !result.HasFatalErrors() {
+		t.Error("expected HasFatalErrors to be true")
+	}
+	if len(result.Errors) != len(result.Diagnostics) || !strings.HasPrefix(result.Errors[0], "line 3:") {
+		t.Errorf("Errors should mirror Diagnostics, got %v", result.Errors)
+	}
+}
+
+func TestPortableNoteIsInformational(t *testing.T) {
+	result := ExtractConditions(`search "mimikatz"`)
+	if result.HasFatalErrors() {
+		t.Fatalf("unexpected fatal diagnostics: %+v", result.Diagnostics)
+	}
+	notes := result.DiagnosticsWithCode(CodePortableKeyword)
+	if len(notes) != 1 || notes[0].Severity != SeverityInfo {
+		t.Fatalf("expected one informational keyword note, got %+v", result.Diagnostics)
+	}
+	if !containsString(result.Errors, portableKeywordExtractionNote) {
+		t.Errorf("expected note to remain in Errors, got %v", result.Errors)
+	}
+}
+
+func TestTimeoutDiagnostic(t *testing.T) {
+	d := timeoutDiagnostic(5 * time.Second)
+	result := failedParseResult(d)
+	if !result.HasFatalErrors() || result.Diagnostics[0].Code != CodeTimeout {
+		t.Fatalf("expected fatal timeout diagnostic, got %+v", result.Diagnostics)
+	}
+	if result.Errors[0] != "parser timeout: query took longer than 5s to parse" {
+		t.Errorf("unexpected timeout message %q", result.Errors[0])
+	}
+}
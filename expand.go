@@ -0,0 +1,131 @@
+package kql
+
+import (
+	"strings"
+)
+
+// arrayElement is where the values of a column holding the elements of a dynamic
+// array come from, such as an mv-expand or mv-apply item.
+type arrayElement struct {
+	array     FieldPath // Column holding the array and the path to the array within it
+	known     bool      // The path is known; the items of split(Text, ",") only have a column
+	expansion string    // bagexpansion of an mv-expand over a property bag, bag or array; empty for arrays
+	index     bool      // The with_itemindex column of the expansion rather than an element
+}
+
+// EnterMvExpandOperator tracks the columns mv-expand fills with array elements, so
+// conditions on them are attributed to the array, and its with_itemindex column.
+func (e *conditionExtractor) EnterMvExpandOperator(ctx *MvExpandOperatorContext) {
+	if ctx.MvExpandItemList() == nil {
+		return
+	}
+	expansion, index := "", ""
+	if kind := ctx.MvExpandKind(); kind != nil && kind.Identifier() != nil {
+		expansion = strings.ToLower(kind.Identifier().GetText())
+	}
+	if params := ctx.MvExpandParams(); params != nil && params.Identifier() != nil {
+		if params.WITH_ITEMINDEX() != nil {
+			index = params.Identifier().GetText()
+		} else {
+			expansion = strings.ToLower(params.Identifier().GetText())
+		}
+	}
+	if e.elements == nil {
+		e.elements = make(map[string]arrayElement)
+	}
+	var first arrayElement
+	for i, item := range ctx.MvExpandItemList().AllMvExpandItem() {
+		if item.Expression() == nil {
+			continue
+		}
+		text := item.Expression().GetText()
+		element := e.arrayOf(text)
+		element.expansion = expansion
+		if i == 0 {
+			first = element
+		}
+		alias := text
+		if item.Identifier() != nil {
+			alias = item.Identifier().GetText()
+		}
+		if isSimpleIdentifier(alias) {
+			e.elements[strings.ToLower(alias)] = element
+		}
+	}
+	if index != "" && first.array.Root != "" {
+		e.elements[strings.ToLower(index)] = arrayElement{array: FieldPath{Root: first.array.Root}, index: true}
+	}
+}
+
+// arrayOf returns the array an mv-expand or mv-apply item expands, given the item's
+// expression. A property of an enclosing item or of a column computed with
+// parse_json resolves to the column the value comes from:
+// P.Items, after extend P = parse_json(AdditionalFields) -> AdditionalFields $.Items
+func (e *conditionExtractor) arrayOf(expr string) arrayElement {
+	element := arrayElementOf(expr)
+	if !element.known {
+		return element
+	}
+	if path, ok := e.resolve(element.array); ok {
+		element.array = path
+	} else {
+		element = arrayElement{array: FieldPath{Root: path.Root}}
+	}
+	return element
+}
+
+// arrayElementOf returns the array an expression holds, looking through
+// parse_json and todynamic:
+// todynamic(AdditionalFields.Items) -> column AdditionalFields, path $.Items
+// The path is not known when the expression is not a column or a property of one.
+func arrayElementOf(expr string) arrayElement {
+	path, ok := parseFieldPath(expr)
+	if !ok {
+		return arrayElement{array: FieldPath{Root: firstFieldInExpressionText(expr)}}
+	}
+	return arrayElement{array: path, known: true}
+}
+
+// elementPath returns the path of a field of an element, given the segments of
+// the field after the element column, such as result for p.result. Elements of an
+// array are [*] of the array; with bagexpansion=bag each element is a bag of one
+// property, and with bagexpansion=array a [key, value] pair. ok is false for an
+// index column, a key and an array whose path is unknown.
+func (a arrayElement) elementPath(rest []PathSegment) (FieldPath, bool) {
+	if a.index || !a.known {
+		return FieldPath{Root: a.array.Root}, false
+	}
+	segments := append([]PathSegment(nil), a.array.Segments...)
+	switch a.expansion {
+	case "bag":
+		if len(rest) == 0 {
+			segments = append(segments, PathSegment{Kind: SegmentWildcard})
+		}
+	case "array":
+		if len(rest) == 0 || rest[0].Kind != SegmentIndex || rest[0].Index != 1 {
+			return FieldPath{Root: a.array.Root}, false
+		}
+		segments = append(segments, PathSegment{Kind: SegmentWildcard})
+		rest = rest[1:]
+	default:
+		segments = append(segments, PathSegment{Kind: SegmentWildcard})
+	}
+	return FieldPath{Root: a.array.Root, Segments: append(segments, rest...)}, true
+}
+
+// attributeElement marks a condition on an expanded column, or a property of
+// one, as computed from the array column, with the JSON path of the field within
+// it when known:
+// p.result, with p an element of ConditionalAccessPolicies -> ConditionalAccessPolicies $[*].result
+func (e *conditionExtractor) attributeElement(cond *Condition, path FieldPath) {
+	element, ok := e.elements[strings.ToLower(path.Root)]
+	if !ok {
+		return
+	}
+	e.elementConditions++
+	cond.IsComputed = true
+	cond.SourceField = element.array.Root
+	if source, ok := element.elementPath(path.Segments); ok {
+		cond.SourcePath = source.JSONPath()
+	}
+}
@@ -0,0 +1,48 @@
+package kql
+
+import (
+	"testing"
+)
+
+func TestMvExpandConditions(t *testing.T) {
+	tests := []struct {
+		query  string
+		field  string
+		source string
+		path   string
+	}{
+		{`AuditLogs | mv-expand Target = parse_json(TargetResources) | where Target.userPrincipalName has "admin"`, "Target.userPrincipalName", "TargetResources", "$[*].userPrincipalName"},
+		{`AuditLogs | mv-expand TargetResources | where TargetResources.type == "User"`, "TargetResources.type", "TargetResources", "$[*].type"},
+		{`AuditLogs | mv-expand Target = TargetResources to typeof(string) | where Target == "x"`, "Target", "TargetResources", "$[*]"},
+		{`AuditLogs | mv-expand Target = TargetResources | where Target.modifiedProperties[0].displayName == "x"`, "Target.modifiedProperties._idx0.displayName", "TargetResources", "$[*].modifiedProperties[0].displayName"},
+		{`AuditLogs | mv-expand with_itemindex=Idx Target = TargetResources | where Idx == 0`, "Idx", "TargetResources", ""},
+		{`AuditLogs | mv-expand kind=bag Prop = AdditionalDetails | where Prop.key == "x"`, "Prop.key", "AdditionalDetails", "$.key"},
+		{`AuditLogs | mv-expand bagexpansion=array Prop = AdditionalDetails | where Prop[1].value == "x"`, "Prop._idx1.value", "AdditionalDetails", "$[*].value"},
+		{`AuditLogs | mv-expand bagexpansion=array Prop = AdditionalDetails | where Prop[0] == "x"`, "Prop._idx0", "AdditionalDetails", ""},
+		{`AuditLogs | extend LLM = parse_json(LLMEventData) | mv-expand AR = LLM.AccessedResources | where AR.name == "x"`, "AR.name", "LLMEventData", "$.AccessedResources[*].name"},
+		{`AuditLogs | mv-expand T = TargetResources | mv-expand P = T.modifiedProperties | where P.displayName == "x"`, "P.displayName", "TargetResources", "$[*].modifiedProperties[*].displayName"},
+		{`AuditLogs | mv-expand T = TargetResources | project X = T | where X.id == "x"`, "X.id", "TargetResources", "$[*].id"},
+	}
+	for _, tt := range tests {
+		result := ExtractConditions(tt.query)
+		if len(result.Errors) != 0 {
+			t.Errorf("%s: unexpected errors %v", tt.query, result.Errors)
+		}
+		if len(result.Conditions) != 1 {
+			t.Errorf("%s: expected one condition, got %+v", tt.query, result.Conditions)
+			continue
+		}
+		cond := result.Conditions[0]
+		if cond.Field != tt.field || !cond.IsComputed || cond.SourceField != tt.source || cond.SourcePath != tt.path {
+			t.Errorf("%s: expected %s from %s %q, got %s from %s %q (computed=%v)",
+				tt.query, tt.field, tt.source, tt.path, cond.Field, cond.SourceField, cond.SourcePath, cond.IsComputed)
+		}
+	}
+
+	// Assigning the name again ends the element
+	result := ExtractConditionsWithOptions(`AuditLogs | mv-expand T = TargetResources | extend T = tostring(T.id) | where T == "x"`,
+		Options{DisablePortableFallback: true})
+	if len(result.Conditions) != 1 || result.Conditions[0].SourcePath != "" {
+		t.Errorf("expected T not to be an element after extend, got %+v", result.Conditions)
+	}
+}
@@ -1,6 +1,7 @@
 package kql
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"strconv"
@@ -8,43 +9,72 @@ import (
 	"time"
 
 	"github.com/antlr4-go/antlr/v4"
+	"github.com/craftedsignal/kql-parser/ast"
 )
 
-// MaxParseTime is the maximum time allowed for parsing a single query.
-// Queries that exceed this are returned with an error.
+// MaxParseTime is the maximum time allowed for parsing a single query with
+// ExtractConditions. Queries that exceed this are returned with an error.
+//
+// Deprecated: the variable is shared by every caller in the process. Use
+// ExtractConditionsContext with a context deadline to set the limit per call.
 var MaxParseTime = 5 * time.Second
 
 const (
 	portablePredicateExtractionNote = "parser-native portable predicate extraction emitted conditions"
 	portableKeywordExtractionNote   = "parser-native keyword extraction emitted _keyword_ condition"
+
+	// externalDataTable is the table normalization puts in place of externaldata(...)
+	externalDataTable = "ExtDataResult"
 )
 
 // Condition represents a field condition extracted from a KQL query
 type Condition struct {
-	Field          string   `json:"field"`
-	Operator       string   `json:"operator"`
-	Value          string   `json:"value"`
-	ValueReference string   `json:"value_reference,omitempty"` // Variable or symbol referenced by the value expression
-	Negated        bool     `json:"negated"`
-	PipeStage      int      `json:"pipe_stage"`
-	LogicalOp      string   `json:"logical_op"`             // "AND" or "OR" connecting to previous condition
-	Alternatives   []string `json:"alternatives,omitempty"` // For OR conditions on same field
-	IsComputed     bool     `json:"is_computed,omitempty"`  // True if field was created by extend/project
-	SourceField    string   `json:"source_field,omitempty"` // Original field before transformation (for computed fields)
+	Field             string         `json:"field"`
+	Operator          string         `json:"operator"`
+	OperatorKind      OperatorKind   `json:"operator_kind,omitempty"`       // Canonical operator, without case or negation
+	OperatorFamily    OperatorFamily `json:"operator_family,omitempty"`     // How the operator matches: term (has), substring (contains), equality, ...
+	CaseSensitive     bool           `json:"case_sensitive,omitempty"`      // Operator compares case-sensitively, like == or has_cs
+	NegatedByOperator bool           `json:"negated_by_operator,omitempty"` // Operator itself is negated, like !has or !in
+	NegatedByNot      bool           `json:"negated_by_not,omitempty"`      // Condition is inside not()
+	Value             string         `json:"value"`
+	RawValue          string         `json:"raw_value,omitempty"`       // String literal as written, when Value was decoded from it
+	ValueReference    string         `json:"value_reference,omitempty"` // Variable or symbol referenced by the value expression
+	Literal           *Literal       `json:"literal,omitempty"`         // Typed value, when it is a literal or function call
+	Negated           bool           `json:"negated"`
+	PipeStage         int            `json:"pipe_stage"`
+	LogicalOp         string         `json:"logical_op"`             // "AND" or "OR" connecting to previous condition
+	Alternatives      []string       `json:"alternatives,omitempty"` // For OR conditions on same field
+	IsComputed        bool           `json:"is_computed,omitempty"`  // True if field was created by extend/project
+	SourceField       string         `json:"source_field,omitempty"` // Original field before transformation (for computed fields)
+	SourcePath        string         `json:"source_path,omitempty"`  // JSON path of the field within SourceField, like $[*].result for a property of an mv-expand or mv-apply item
+	Path              *FieldPath     `json:"path,omitempty"`         // Column the value is read from and the path to it within a dynamic column
+	Implicit          bool           `json:"implicit,omitempty"`     // Implied by an operator rather than written as a predicate, like the anchors of parse-where
+	Scope             ScopeKind      `json:"scope,omitempty"`        // Part of the query the condition was found in
+	ScopeName         string         `json:"scope_name,omitempty"`   // Let name, function or data source identifying the scope
+	Span              *Span          `json:"span,omitempty"`         // Location of the predicate in the original query
 }
 
 // ParseResult contains all conditions extracted from the query
 type ParseResult struct {
 	Conditions          []Condition       `json:"conditions"`
 	DataSources         []string          `json:"data_sources,omitempty"`         // Table/source names referenced by the query
+	DataSourceSpans     map[string][]Span `json:"data_source_spans,omitempty"`    // Map of data source -> locations in the original query
 	LetStatements       []LetStatement    `json:"let_statements,omitempty"`       // KQL let variable definitions
 	ComputedFields      map[string]string `json:"computed_fields,omitempty"`      // Map of computed field name -> source field (from extend)
 	ComputedExpressions map[string]string `json:"computed_expressions,omitempty"` // Map of computed field name -> source expression
+	Lineage             []ColumnLineage   `json:"lineage,omitempty"`              // Inputs and data source columns of the columns each pipe stage outputs
+	OutputColumns       []OutputColumn    `json:"output_columns,omitempty"`       // Columns the query returns, with types from the schema catalog
+	OutputComplete      bool              `json:"output_complete,omitempty"`      // OutputColumns lists every column the query returns
 	GroupByFields       []string          `json:"group_by_fields,omitempty"`      // Fields from summarize BY clauses
 	Commands            []string          `json:"commands,omitempty"`             // List of commands used in the query (summarize, extend, etc.)
 	ProjectedFields     []string          `json:"projected_fields,omitempty"`     // Fields selected by project operators
 	Joins               []JoinInfo        `json:"joins,omitempty"`
-	Errors              []string          `json:"errors,omitempty"`
+	Unions              []UnionInfo       `json:"unions,omitempty"`
+	ScopedConditions    []Condition       `json:"scoped_conditions,omitempty"` // Conditions outside the main pipeline (let bodies, joins, subqueries, mv-apply)
+	WhereClauses        []WhereClause     `json:"where_clauses,omitempty"`     // Boolean tree of each where predicate
+	TimeWindow          *TimeWindow       `json:"time_window,omitempty"`       // Time range read, from filters on time columns
+	Errors              []string          `json:"errors,omitempty"`            // Messages of Diagnostics other than excluded fields and schema checks, kept for compatibility
+	Diagnostics         []Diagnostic      `json:"diagnostics,omitempty"`       // Structured errors, warnings and notes
 }
 
 // FieldProvenance indicates where a field originates relative to a join
@@ -67,292 +97,353 @@ type JoinInfo struct {
 	Subsearch     *ParseResult `json:"subsearch,omitempty"`      // Recursively parsed right-side expression (if subquery)
 	PipeStage     int          `json:"pipe_stage"`               // Pipeline stage where join appears
 	ExposedFields []string     `json:"exposed_fields,omitempty"` // Fields the right side makes available
+	Span          *Span        `json:"span,omitempty"`           // Location of the join operator in the original query
 }
 
-// LetStatement captures a KQL let variable definition.
-type LetStatement struct {
-	Name       string `json:"name"`
-	Expression string `json:"expression"`
+// UnionInfo captures the structured decomposition of a UNION operator. The rows
+// piped into the union, if any, are not one of its legs.
+type UnionInfo struct {
+	Kind       string     `json:"kind"`                  // "outer" or "inner" (default: "outer")
+	WithSource string     `json:"with_source,omitempty"` // Column withsource= adds, holding the table each row came from
+	IsFuzzy    bool       `json:"is_fuzzy,omitempty"`    // isfuzzy=true: legs that do not exist are skipped rather than an error
+	Legs       []UnionLeg `json:"legs,omitempty"`        // Tables and subqueries the union reads, in order
+	PipeStage  int        `json:"pipe_stage"`            // Pipeline stage where union appears
+	Span       *Span      `json:"span,omitempty"`        // Location of the union operator in the original query
 }
 
-// KQL keywords that should be excluded from conditions
-// These are metadata fields or table names, not actual data fields
-// Note: We don't exclude aggregation function names like "count", "sum" etc.
-// because they can also be valid field names (e.g., "Count > 5" after summarize)
-var kqlKeywords = map[string]bool{
-	// Common table names
-	"securityevent": true, "signinlogs": true, "auditlogs": true,
-	"deviceevents": true, "deviceprocessevents": true, "devicenetworkevents": true,
-	"devicefileevents": true, "deviceregistryevents": true, "devicelogonevent": true,
-	"commoncomputerenvironment": true, "aaboracletable": true,
-
-	// Time-related (these are typically metadata, not user data)
-	"timegenerated": true, "timestamp": true, "ingestiontime": true,
+// UnionLeg is one of the tables a union reads.
+type UnionLeg struct {
+	Table     string       `json:"table,omitempty"`     // Table, view or function name, or a pattern like Device* or *
+	Wildcard  bool         `json:"wildcard,omitempty"`  // Table is a pattern matching every table it fits
+	Arguments []string     `json:"arguments,omitempty"` // Arguments of a function call, as written
+	Subsearch *ParseResult `json:"subsearch,omitempty"` // Recursively parsed leg (if subquery)
+	Span      *Span        `json:"span,omitempty"`      // Location of the leg in the original query
+}
 
-	// Operators/keywords (these shouldn't appear as field names in conditions)
-	"where": true, "project": true, "extend": true, "summarize": true,
-	"join": true, "union": true, "let": true, "datatable": true,
-	"by": true, "on": true, "with": true, "and": true, "or": true, "not": true,
-	"in": true, "between": true,
+// LetStatement captures a KQL let variable definition.
+type LetStatement struct {
+	Name       string           `json:"name"`
+	Expression string           `json:"expression"`
+	Kind       ast.LetKind      `json:"kind,omitempty"`       // Scalar, tabular, function or view
+	Parameters []*ast.Parameter `json:"parameters,omitempty"` // Declared parameters of a function let
+	Inlined    bool             `json:"inlined,omitempty"`    // References were replaced by the body before parsing
+	Span       *Span            `json:"span,omitempty"`       // Location of the statement in the original query
 }
 
 // conditionExtractor walks the parse tree to extract conditions
 type conditionExtractor struct {
 	*BaseKQLParserListener
-	conditions          []Condition
-	computedFields      map[string]string // Fields created by extend/project: computed field -> source field
-	computedExpressions map[string]string // Fields created by extend/project: computed field -> expression
-	groupByFields       []string          // Fields from summarize BY clauses
-	commands            []string          // Commands used in the query
-	projectedFields     []string          // Fields selected by project operators
-	joins               []JoinInfo
-	currentStage        int
-	inSubquery          int // depth of subquery nesting
-	inFunctionCall      int // depth of function call nesting (countif, sumif, etc.)
-	negated             bool
-	lastLogicalOp       string
-	errors              []string
-	originalQuery       string // normalized query text for extracting subexpressions
+	conditions           []Condition
+	computedFields       map[string]string // Fields created by extend/project: computed field -> source field
+	computedExpressions  map[string]string // Fields created by extend/project: computed field -> expression
+	groupByFields        []string          // Fields from summarize BY clauses
+	commands             []string          // Commands used in the query
+	projectedFields      []string          // Fields selected by project operators
+	joins                []JoinInfo
+	unions               []UnionInfo
+	currentStage         int
+	inSubquery           int                     // depth of join subquery nesting
+	scopes               []scopeFrame            // constructs outside the main pipeline being walked, outermost first
+	elements             map[string]arrayElement // columns holding array elements, such as mv-expand and mv-apply items: lowercase name -> array
+	elementConditions    int                     // conditions attributed to an array element
+	parsedColumns        map[string]bool         // columns parse, parse-where and parse-kv extract, lowercase
+	windowColumns        map[string]bool         // time columns the query's TimeWindow has filters on
+	scopedConditions     []Condition
+	negated              bool
+	lastLogicalOp        string
+	diagnostics          []Diagnostic
+	originalQuery        string // normalized query text for extracting subexpressions
+	locator              *spanLocator
+	ctx                  context.Context // bounds recursive extraction of join subqueries
+	limit                time.Duration
+	cfg                  *extractConfig
+	predicateSpan        *Span                                  // span of the comparison currently being handled
+	comparisons          []*ComparisonExpressionContext         // comparisons being walked, innermost last
+	comparisonConditions map[*ComparisonExpressionContext][]int // indexes of conditions extracted from each comparison
+	whereNegated         []bool                                 // negation in effect outside each open where predicate
+	whereClauses         []WhereClause
 }
 
 // errorListener collects parse errors
 type errorListener struct {
 	*antlr.DefaultErrorListener
-	errors []string
+	errors []syntaxError
+	lexer  bool // listener is attached to the lexer rather than the parser
+}
+
+// syntaxError is an error reported by the lexer or parser. Line is 1-based and
+// column is the 0-based rune offset within the line, both in the parsed text.
+type syntaxError struct {
+	line   int
+	column int
+	msg    string
+	token  string // offending token text, empty for lexer errors
+	lexer  bool
 }
 
 func (l *errorListener) SyntaxError(recognizer antlr.Recognizer, offendingSymbol interface{}, line, column int, msg string, e antlr.RecognitionException) {
-	l.errors = append(l.errors, msg)
+	err := syntaxError{line: line, column: column, msg: msg, lexer: l.lexer}
+	if token, ok := offendingSymbol.(antlr.Token); ok && token != nil {
+		err.token = token.GetText()
+	}
+	l.errors = append(l.errors, err)
 }
 
 // normalizeQuery preprocesses a KQL query to normalize operators and functions that the parser doesn't handle well.
 // This converts case-sensitive operators and special functions to their standard forms for parsing purposes.
 func normalizeQuery(query string) string {
-	normalized := query
+	r := &rewriter{ctx: context.Background(), text: query, cfg: defaultConfig}
+	r.normalize()
+	return r.text
+}
+
+// normalizeQueryWithSourceMap normalizes query like normalizeQuery, with the parameter
+// and ASIM settings of cfg, and records every rewrite so that offsets in the result
+// can be mapped back to query.
+func normalizeQueryWithSourceMap(query string, cfg *extractConfig) (string, *SourceMap) {
+	r := normalizeWithSourceMap(context.Background(), query, cfg)
+	return r.text, r.sm
+}
+
+// normalizeWithSourceMap is normalizeQueryWithSourceMap returning the rewriter, which
+// also records the let statements that were inlined. Inlining stops early once ctx
+// is done.
+func normalizeWithSourceMap(ctx context.Context, query string, cfg *extractConfig) *rewriter {
+	r := &rewriter{ctx: ctx, text: query, sm: newSourceMap(query), cfg: cfg}
+	r.normalize()
+	r.sm.normalized = r.text
+	return r
+}
+
+// normalize runs the normalization steps described on normalizeQuery.
+func (r *rewriter) normalize() {
+	// Replace references to tabular lets with their bodies, so that their filters
+	// are parsed as part of the main query
+	if r.cfg.inlineLets {
+		r.lets = letDefinitions(r.ctx, r.text)
+		r.inlineLets(r.lets)
+	}
 
 	// Remove line continuation backslashes (backslash followed by newline)
 	// Common in PowerShell-style queries copied from scripts
-	normalized = strings.ReplaceAll(normalized, "\\\n", "\n")
-	normalized = strings.ReplaceAll(normalized, "\\\r\n", "\r\n")
+	r.replaceAll("\\\n", "\n")
+	r.replaceAll("\\\r\n", "\r\n")
 
 	// Fix escaped newlines from JSON extraction - but only outside of string literals
 	// This handles queries extracted from YAML/JSON where \r\n became literal characters
-	normalized = normalizeEscapeSequences(normalized)
+	r.apply(normalizeEscapeSequences)
 
 	// Strip documentation preambles like "Description:...Query:..."
 	// These are common in documentation templates where the actual query follows "Query:"
-	normalized = stripDocumentationPreamble(normalized)
+	r.apply(stripDocumentationPreamble)
 
 	// Strip leading comments to get to the actual query
-	normalized = stripLeadingComments(normalized)
+	r.apply(stripLeadingComments)
 
 	// Strip declare query_parameters(...) statements
 	// These define query parameters but aren't needed for condition extraction
-	normalized = stripDeclareStatements(normalized)
+	r.apply(stripDeclareStatements)
+
+	// Drop the h prefix of obfuscated strings (h"secret" -> "secret")
+	r.stripObfuscatedStrings()
 
 	// Replace parameterized placeholders with dummy values
 	// e.g., {TimeRange} -> 1d, {SourceTable} -> DummyTable
-	normalized = replaceParameters(normalized)
+	r.apply(func(q string) string { return replaceParametersWith(q, r.cfg.parameters) })
 
 	// Convert ASIM functions to dummy table names (these are parser functions that return tables)
 	// Handle both simple calls (imAuthentication) and parameterized calls (_Im_Dns(param=value))
-	normalized = replaceASIMFunctions(normalized)
+	r.apply(func(q string) string { return replaceASIMFunctionsWith(q, r.cfg.asim) })
 
 	// Handle externaldata operator by replacing with dummy table
-	normalized = replaceExternalData(normalized)
+	r.apply(replaceExternalData)
 
 	// Handle datatable with inline data by replacing with dummy table
-	normalized = replaceDatatableWithData(normalized)
+	r.apply(replaceDatatableWithData)
 
 	// Handle arg() cross-workspace function: arg("...").Table -> Table
 	// Azure Resource Graph queries use arg("sub-id").Resources pattern
-	normalized = replaceArgFunction(normalized)
+	r.apply(replaceArgFunction)
 
 	// Handle materialize by stripping it (handles both with and without space)
-	normalized = strings.ReplaceAll(normalized, "materialize(", "(")
-	normalized = strings.ReplaceAll(normalized, "materialize (", "(")
-	normalized = strings.ReplaceAll(normalized, "materialize  (", "(")
+	r.replaceAll("materialize(", "(")
+	r.replaceAll("materialize (", "(")
+	r.replaceAll("materialize  (", "(")
 
 	// Rename reserved keywords used as field names
 	// "pattern" is a reserved word in the grammar but used as a field name in some queries
-	normalized = renameReservedFieldNames(normalized)
-
-	// Convert case-sensitive IN operators to standard forms
-	// in~ -> in (case-insensitive IN becomes regular IN for parsing)
-	// !in~ -> !in (case-insensitive NOT IN becomes regular NOT IN)
-	normalized = strings.ReplaceAll(normalized, "!in~", "!in")
-	normalized = strings.ReplaceAll(normalized, " in~ ", " in ")
-	normalized = strings.ReplaceAll(normalized, "\tin~\t", "\tin\t")
-	normalized = strings.ReplaceAll(normalized, "\tin~ ", "\tin ")
-	normalized = strings.ReplaceAll(normalized, " in~\t", " in\t")
-	normalized = strings.ReplaceAll(normalized, "\nin~", "\nin")
-	normalized = strings.ReplaceAll(normalized, "in~(", "in(")
+	r.apply(renameReservedFieldNames)
 
 	// Convert make_set and make_list to generic function names that the parser recognizes
 	// Handle both make_set( and make_set ( with space
-	normalized = strings.ReplaceAll(normalized, "make_set(", "makeset(")
-	normalized = strings.ReplaceAll(normalized, "make_set (", "makeset(")
-	normalized = strings.ReplaceAll(normalized, "make_list(", "makelist(")
-	normalized = strings.ReplaceAll(normalized, "make_list (", "makelist(")
+	r.replaceAll("make_set(", "makeset(")
+	r.replaceAll("make_set (", "makeset(")
+	r.replaceAll("make_list(", "makelist(")
+	r.replaceAll("make_list (", "makelist(")
 
 	// Handle summarize without aggregation (summarize by x -> summarize count() by x)
 	// The grammar requires aggregation before BY, but KQL allows just "summarize by"
-	normalized = normalizeSummarizeBy(normalized)
+	r.apply(normalizeSummarizeBy)
 
 	// Convert SQL-style <> to KQL != (handle all spacing variations)
-	normalized = normalizeNotEqualOperator(normalized)
+	r.apply(normalizeNotEqualOperator)
 
 	// Normalize timespan literals without space: 0min -> 0 min, 30min -> 30 min
 	// The lexer expects space or recognizes combined form only for certain patterns
-	normalized = normalizeTimespanLiterals(normalized)
+	r.apply(normalizeTimespanLiterals)
 
 	// Normalize trailing decimals: 1000. -> 1000.0
 	// The grammar requires at least one digit after the decimal point
-	normalized = normalizeTrailingDecimals(normalized)
+	r.apply(normalizeTrailingDecimals)
 
 	// Normalize \0 escape sequences to \x00 (null character)
 	// The grammar only supports \x hex escapes, not bare \0
-	normalized = normalizeNullEscapes(normalized)
+	r.apply(normalizeNullEscapes)
 
 	// Convert operator aliases to standard forms
-	normalized = strings.ReplaceAll(normalized, "| mvexpand ", "| mv-expand ")
-	normalized = strings.ReplaceAll(normalized, "\nmvexpand ", "\nmv-expand ")
-	normalized = strings.ReplaceAll(normalized, "| mvapply ", "| mv-apply ")
+	r.replaceAll("| mvexpand ", "| mv-expand ")
+	r.replaceAll("\nmvexpand ", "\nmv-expand ")
+	r.replaceAll("| mvapply ", "| mv-apply ")
 
 	// Convert "filter" to "where" (filter is a legacy alias)
-	normalized = strings.ReplaceAll(normalized, "| filter ", "| where ")
-	normalized = strings.ReplaceAll(normalized, "\nfilter ", "\nwhere ")
+	r.replaceAll("| filter ", "| where ")
+	r.replaceAll("\nfilter ", "\nwhere ")
 
 	// Strip kind= from lookup operator (grammar doesn't support it)
-	normalized = strings.ReplaceAll(normalized, "lookup kind=leftouter ", "lookup ")
-	normalized = strings.ReplaceAll(normalized, "lookup kind=inner ", "lookup ")
-	normalized = strings.ReplaceAll(normalized, "lookup kind=rightouter ", "lookup ")
-	normalized = strings.ReplaceAll(normalized, "lookup kind=fullouter ", "lookup ")
+	r.replaceAll("lookup kind=leftouter ", "lookup ")
+	r.replaceAll("lookup kind=inner ", "lookup ")
+	r.replaceAll("lookup kind=rightouter ", "lookup ")
+	r.replaceAll("lookup kind=fullouter ", "lookup ")
 
 	// Normalize lookup subqueries: lookup (union ...) -> lookup (LookupTable)
 	// The grammar doesn't support complex expressions inside lookup
-	normalized = normalizeLookupSubquery(normalized)
+	r.apply(normalizeLookupSubquery)
 
 	// Normalize make-series: convert "in range(...)" to "from ... to ... step ..."
 	// and add default step if missing
-	normalized = normalizeMakeSeries(normalized)
+	r.apply(normalizeMakeSeries)
 
 	// Normalize join kind aliases (grammar supports leftanti/rightsemi but not combined forms)
-	normalized = strings.ReplaceAll(normalized, "kind=leftantisemi", "kind=leftanti")
-	normalized = strings.ReplaceAll(normalized, "kind=rightantisemi", "kind=rightanti")
-	normalized = strings.ReplaceAll(normalized, "kind=leftsemijoin", "kind=leftsemi")
-	normalized = strings.ReplaceAll(normalized, "kind=rightsemijoin", "kind=rightsemi")
+	r.replaceAll("kind=leftantisemi", "kind=leftanti")
+	r.replaceAll("kind=rightantisemi", "kind=rightanti")
+	r.replaceAll("kind=leftsemijoin", "kind=leftsemi")
+	r.replaceAll("kind=rightsemijoin", "kind=rightsemi")
 
 	// Normalize join condition 'and' to comma (grammar expects comma-separated conditions)
 	// on $left.A == $right.B and $left.C == $right.D -> on $left.A == $right.B, $left.C == $right.D
-	normalized = strings.ReplaceAll(normalized, " and $left.", ", $left.")
-	normalized = strings.ReplaceAll(normalized, " and $right.", ", $right.")
+	r.replaceAll(" and $left.", ", $left.")
+	r.replaceAll(" and $right.", ", $right.")
 
 	// Strip all hint.xxx=value patterns (hint.strategy=broadcast, hint.shufflekey=x, etc.)
 	// The grammar doesn't support these join hints
-	normalized = stripJoinHints(normalized)
+	r.apply(stripJoinHints)
 
-	// Strip mv-apply subqueries: mv-apply x on (subquery) -> mv-apply x
-	// The subquery isn't needed for condition extraction
-	normalized = stripMvApplySubquery(normalized)
+	// Rewrite mv-apply subqueries: mv-apply x = col on (where ...) -> mv-apply x = col (DummyTable | where ...)
+	r.apply(normalizeMvApplySubquery)
 
-	// Strip parse statements: parse field with pattern -> (removed)
-	// The parse operator extracts substrings but isn't needed for condition extraction
-	normalized = stripParseStatements(normalized)
+	// Give untyped parse columns the colon the grammar requires: parse x with * "a" Name -> Name:
+	r.apply(normalizeParsePatterns)
 
 	// Strip return type annotations from evaluate: evaluate func(x) : (col:type) -> evaluate func(x)
-	normalized = stripReturnTypeAnnotations(normalized)
+	r.apply(stripReturnTypeAnnotations)
 
 	// Normalize dot-bracket pattern: obj.[0] -> obj[0], obj.["key"] -> obj["key"]
 	// This unusual KQL syntax isn't handled by our grammar
-	normalized = strings.ReplaceAll(normalized, ".[", "[")
+	r.replaceAll(".[", "[")
 
 	// Convert bracket property access to dot notation
 	// obj['key'] -> obj._key_ (the lexer's QUOTED_IDENTIFIER conflicts with bracket access)
-	normalized = convertBracketAccess(normalized)
+	r.apply(convertBracketAccess)
 
 	// Fix identifiers that start with numbers by prepending underscore
 	// e.g., 3plogTime -> _3plogTime
-	normalized = fixNumericIdentifiers(normalized)
+	r.apply(fixNumericIdentifiers)
 
 	// Convert tuple unpacking to single assignment
 	// (a, b, c) = func() -> _tuple_result = func()
-	normalized = convertTupleUnpacking(normalized)
+	r.apply(convertTupleUnpacking)
 
 	// Extract main query from let statements (parse only the final query for conditions)
 	// This MUST happen before union normalization so (union ...) after lets is handled
-	normalized = extractMainQuery(normalized)
+	r.apply(extractMainQuery)
 
 	// Handle queries that start with a pipe (workbook queries)
-	normalized = strings.TrimLeft(normalized, " \t")
-	if strings.HasPrefix(normalized, "|") {
-		normalized = "DummyTable " + normalized
-	}
+	r.apply(func(s string) string {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "|") {
+			s = "DummyTable " + s
+		}
+		return s
+	})
 
 	// Handle queries that start with operators but no table name
 	// Azure Resource Graph queries can start with "where", workbook queries with "extend", etc.
-	lowerNorm := strings.ToLower(normalized)
-	operatorPrefixes := []string{
-		"where ", "where\t", "where\n",
-		"extend ", "extend\t", "extend\n",
-		"project ", "project\t", "project\n",
-		"summarize ", "summarize\t", "summarize\n",
-	}
-	for _, prefix := range operatorPrefixes {
-		if strings.HasPrefix(lowerNorm, prefix) {
-			normalized = "DummyTable | " + normalized
-			break
+	r.apply(func(s string) string {
+		lower := strings.ToLower(s)
+		operatorPrefixes := []string{
+			"where ", "where\t", "where\n",
+			"extend ", "extend\t", "extend\n",
+			"project ", "project\t", "project\n",
+			"summarize ", "summarize\t", "summarize\n",
 		}
-	}
+		for _, prefix := range operatorPrefixes {
+			if strings.HasPrefix(lower, prefix) {
+				return "DummyTable | " + s
+			}
+		}
+		return s
+	})
 
 	// Strip function parameters in union statements (grammar doesn't support them)
 	// union Func('a'), Func2('b') -> union Func, Func2
-	normalized = stripUnionFunctionParams(normalized)
+	r.apply(stripUnionFunctionParams)
 
 	// Handle union with withsource and isfuzzy parameters
 	// union withsource=... -> union
 	// union isfuzzy=true -> union
 	// Also handles (union ...) wrapped queries
-	normalized = normalizeUnionParameters(normalized)
+	r.apply(normalizeUnionParameters)
 
 	// Handle queries that start with union (grammar requires union to follow a table reference)
-	if strings.HasPrefix(strings.ToLower(normalized), "union") {
-		normalized = "DummyTable | " + normalized
-	}
+	r.apply(func(s string) string {
+		if strings.HasPrefix(strings.ToLower(s), "union") {
+			return "DummyTable | " + s
+		}
+		return s
+	})
 
 	// Handle union inside join parentheses: join (union ...) -> join (DummyTable | union ...)
 	// The grammar requires a tabularSource before union, even inside join
-	normalized = normalizeJoinUnion(normalized)
+	r.apply(normalizeJoinUnion)
 
 	// Handle find operator: find in (Table1, Table2, ...) where ... -> extract conditions from where clause
 	// The find operator isn't in the grammar, so convert to table + where
-	normalized = normalizeFindOperator(normalized)
+	r.apply(normalizeFindOperator)
 
 	// Handle search operator: search in (Table1, Table2) "pattern" -> simplified form
 	// The search operator needs special handling
-	normalized = normalizeSearchOperator(normalized)
+	r.apply(normalizeSearchOperator)
 
 	// Normalize top-nested operator: top-nested N of X by count() -> summarize count() by X
 	// The grammar doesn't support the "of" keyword in top-nested
-	normalized = normalizeTopNested(normalized)
+	r.apply(normalizeTopNested)
 
 	// Strip named parameters from function calls: func(param=value) -> func()
 	// These are common in user-defined function calls like parser(pack=true)
-	normalized = stripNamedFunctionParams(normalized)
+	r.apply(stripNamedFunctionParams)
 
 	// Normalize distinct clauses: distinct a, tostring(b) -> distinct a, b
 	// The grammar doesn't support function calls in distinct column lists
-	normalized = normalizeDistinctColumns(normalized)
+	r.apply(normalizeDistinctColumns)
 
 	// Strip render operator parameters: render areachart kind=stacked -> render areachart
 	// The grammar doesn't support all render parameter forms
-	normalized = stripRenderParameters(normalized)
+	r.apply(stripRenderParameters)
 
 	// Strip trailing semicolons and comments (common in saved queries and function definitions)
 	// Must handle cases like "| where x == 1; // comment" -> "| where x == 1"
-	normalized = stripTrailingSemicolonsAndComments(normalized)
+	r.apply(stripTrailingSemicolonsAndComments)
 
-	return normalized
 }
 
 // extractMainQuery extracts the main query from a let statement sequence
@@ -620,7 +711,7 @@ func convertBracketAccess(query string) string {
 		// Look for [ pattern (only outside strings)
 		if c == '[' && i+1 < len(query) {
 			// Check if preceded by an identifier (property access) or standalone (column reference)
-			precededByIdent := i > 0 && (isIdentChar(query[i-1]) || query[i-1] == ')')
+			precededByIdent := i > 0 && (isIdentChar(query[i-1]) || query[i-1] == ')' || query[i-1] == ']')
 
 			// Case 1: ['...'] or ["..."] - quoted property access or column alias
 			if query[i+1] == '\'' || query[i+1] == '"' {
@@ -789,6 +880,14 @@ func fixNumericIdentifiers(query string) string {
 			continue
 		}
 
+		// Copy the arguments of datetime(...), guid(...) and timespan(...) literals,
+		// whose digit groups are not identifiers
+		if end := literalCallEnd(query, i); end > i {
+			result.WriteString(query[i:end])
+			i = end
+			continue
+		}
+
 		// Check for identifier starting with digit
 		// Only consider it an identifier if preceded by non-identifier char
 		if c >= '0' && c <= '9' {
@@ -816,8 +915,10 @@ func fixNumericIdentifiers(query string) string {
 						suffix == "hour" || suffix == "hours" ||
 						suffix == "day" || suffix == "days" ||
 						suffix == "second" || suffix == "seconds"
+					// Long literals like 10l and hex numbers like 0x1F
+					isNumber := suffix == "l" || suffix == "L" || query[i] == '0' && j == i+1 && isHexLiteralSuffix(suffix)
 
-					if !isTimeLiteral {
+					if !isTimeLiteral && !isNumber {
 						// This is an identifier starting with digits, prepend underscore
 						result.WriteByte('_')
 					}
@@ -832,6 +933,44 @@ func fixNumericIdentifiers(query string) string {
 	return result.String()
 }
 
+// literalCallEnd returns the end of a datetime(...), guid(...), timespan(...) or
+// time(...) literal starting at i, or -1 when there is none.
+func literalCallEnd(query string, i int) int {
+	if i > 0 && isIdentChar(query[i-1]) {
+		return -1
+	}
+	for _, name := range []string{"datetime", "guid", "timespan", "time"} {
+		if len(query)-i <= len(name) || !strings.EqualFold(query[i:i+len(name)], name) {
+			continue
+		}
+		j := i + len(name)
+		for j < len(query) && (query[j] == ' ' || query[j] == '\t') {
+			j++
+		}
+		if j == len(query) || query[j] != '(' {
+			return -1
+		}
+		if end := strings.IndexByte(query[j:], ')'); end >= 0 {
+			return j + end + 1
+		}
+		return -1
+	}
+	return -1
+}
+
+// isHexLiteralSuffix reports whether suffix is the x1F of 0x1F.
+func isHexLiteralSuffix(suffix string) bool {
+	if len(suffix) < 2 || suffix[0] != 'x' && suffix[0] != 'X' {
+		return false
+	}
+	for _, c := range suffix[1:] {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
 // convertTupleUnpacking converts tuple unpacking syntax to simple assignment
 // (a, b, c) = func() -> _tuple_result = func()
 // This handles patterns like: extend (Anomalies, Score, Baseline) = series_decompose_anomalies(...)
@@ -1351,10 +1490,11 @@ func normalizeLookupSubquery(query string) string {
 	return b.String()
 }
 
-// stripMvApplySubquery removes entire mv-apply statements that have on (subquery)
-// | mv-apply x = col on (subquery) -> (removed entirely)
-// The mv-apply with subquery isn't needed for condition extraction
-func stripMvApplySubquery(query string) string {
+// normalizeMvApplySubquery rewrites mv-apply into the form the grammar accepts,
+// which has no on keyword, with_itemindex or limit, and gives the subquery the
+// DummyTable source a tabular expression needs:
+// | mv-apply with_itemindex=i p = Props limit 10 on (where p.Name == "x") -> | mv-apply p = Props (DummyTable | where p.Name == "x")
+func normalizeMvApplySubquery(query string) string {
 	lowerQuery := strings.ToLower(query)
 	var b strings.Builder
 	b.Grow(len(query))
@@ -1400,44 +1540,14 @@ func stripMvApplySubquery(query string) string {
 			continue
 		}
 
-		// Find matching closing paren
-		depth := 1
-		parenEnd := parenStart + 1
-		inString := false
-		stringChar := byte(0)
-		for parenEnd < len(query) && depth > 0 {
-			c := query[parenEnd]
-			if !inString {
-				if c == '"' || c == '\'' {
-					inString = true
-					stringChar = c
-				} else if c == '(' {
-					depth++
-				} else if c == ')' {
-					depth--
-				}
-			} else {
-				// In KQL, only double-quoted strings have backslash escaping
-				if c == stringChar {
-					if stringChar == '"' && parenEnd > 0 && query[parenEnd-1] == '\\' {
-						// Escaped quote, continue
-					} else {
-						inString = false
-					}
-				}
-			}
-			parenEnd++
-		}
-
-		if depth != 0 {
-			// Unbalanced parens, skip
-			break
-		}
-
-		// Remove entire mv-apply statement from "| mv-apply" to closing paren
-		b.WriteString(query[lastCopied:idx])
-		lastCopied = parenEnd
-		searchFrom = parenEnd
+		items := query[idx+10 : onIdx]
+		items = removeUnionParam(items, "with_itemindex", len("with_itemindex"))
+		items = stripMvApplyLimit(items)
+		b.WriteString(query[lastCopied : idx+10])
+		b.WriteString(items)
+		b.WriteString("(DummyTable | ")
+		lastCopied = parenStart + 1
+		searchFrom = parenStart + 1
 		changed = true
 	}
 
@@ -1448,158 +1558,146 @@ func stripMvApplySubquery(query string) string {
 	return b.String()
 }
 
-// stripParseStatements removes parse operator statements
-// parse field with 'pattern' var1 'pattern2' var2 -> (entire statement removed)
-// The parse operator extracts substrings but isn't needed for condition extraction
-func stripParseStatements(query string) string {
+// stripMvApplyLimit removes the row limit that ends the items of an mv-apply:
+// p = Props limit 10 -> p = Props
+func stripMvApplyLimit(items string) string {
+	trimmed := strings.TrimRight(items, " \t\r\n")
+	digits := strings.TrimRight(trimmed, "0123456789")
+	if len(digits) == len(trimmed) {
+		return items
+	}
+	rest := strings.TrimRight(digits, " \t\r\n")
+	if len(rest) == len(digits) || len(rest) < 5 || !strings.EqualFold(rest[len(rest)-5:], "limit") ||
+		(len(rest) > 5 && isIdentChar(rest[len(rest)-6])) {
+		return items
+	}
+	return rest[:len(rest)-5] + items[len(trimmed):]
+}
+
+// normalizeParsePatterns rewrites parse and parse-where patterns into the form the
+// grammar accepts, which requires a colon after every column:
+// parse Msg with * "user=" User " " Port:int -> parse Msg with * "user=" User: " " Port:int
+// The regex flags parameter, which the grammar lacks, is dropped:
+// parse kind=regex flags=Ui Msg with ... -> parse kind=regex Msg with ...
+func normalizeParsePatterns(query string) string {
 	lowerQuery := strings.ToLower(query)
 	var b strings.Builder
-	b.Grow(len(query))
 	lastCopied := 0
-	changed := false
-	searchFrom := 0
-
-	for {
-		// Find "| parse" or "\nparse" (parse operator at start of pipe stage)
-		idx := strings.Index(lowerQuery[searchFrom:], "| parse ")
-		if idx == -1 {
-			idx = strings.Index(lowerQuery[searchFrom:], "| parse\t")
+	for i := 0; i < len(query); i++ {
+		if query[i] == '"' || query[i] == '\'' {
+			i = stringLiteralEnd(query, i) - 1
+			continue
 		}
-		if idx == -1 {
-			idx = strings.Index(lowerQuery[searchFrom:], "| parse\n")
+		if query[i] != '|' {
+			continue
 		}
-		if idx == -1 {
-			break
+		j := i + 1
+		for j < len(query) && isSpace(query[j]) {
+			j++
 		}
-		idx += searchFrom
-
-		// Find the end of this parse statement (next pipe, closing paren, or end of query)
-		parseStart := idx + 2 // skip "| "
-		pipeOrEnd := parseStart
-
-		// Track string literals and parentheses
-		inString := false
-		stringChar := byte(0)
-		isVerbatim := false
-		parenDepth := 0
-
-		// Count starting paren depth from query beginning to idx (ignoring strings)
-		inStrInit := false
-		strCharInit := byte(0)
-		isVerbatimInit := false
-		for i := 0; i < idx; i++ {
-			c := query[i]
-			if !inStrInit {
-				if c == '"' || c == '\'' {
-					inStrInit = true
-					strCharInit = c
-					isVerbatimInit = i > 0 && query[i-1] == '@'
-				} else if c == '(' {
-					parenDepth++
-				} else if c == ')' {
-					parenDepth--
-				}
-			} else {
-				if c == strCharInit {
-					if isVerbatimInit {
-						// Verbatim strings: any closing quote ends the string
-						inStrInit = false
-					} else if strCharInit == '"' {
-						// Regular double-quoted: check backslash escaping
-						if i == 0 || query[i-1] != '\\' {
-							inStrInit = false
-						}
-					} else {
-						// Single-quoted: no escaping
-						inStrInit = false
-					}
-				}
-			}
+		var k int
+		switch {
+		case strings.HasPrefix(lowerQuery[j:], "parse-where"):
+			k = j + len("parse-where")
+		case strings.HasPrefix(lowerQuery[j:], "parse") && !strings.HasPrefix(lowerQuery[j:], "parse-"):
+			k = j + len("parse")
+		default:
+			continue
+		}
+		if k >= len(query) || !isSpace(query[k]) {
+			continue
 		}
-		startingDepth := parenDepth
 
-		for pipeOrEnd < len(query) {
-			c := query[pipeOrEnd]
-			if !inString {
-				if c == '"' || c == '\'' {
-					inString = true
-					stringChar = c
-					isVerbatim = pipeOrEnd > 0 && query[pipeOrEnd-1] == '@'
-				} else if c == '|' {
-					// Found next pipe at same paren level
+		// Walk the statement up to the next pipe, semicolon or unbalanced paren.
+		depth := 0
+		inPattern := false
+		for k < len(query) {
+			c := query[k]
+			if c == '"' || c == '\'' {
+				k = stringLiteralEnd(query, k)
+				continue
+			}
+			if c == '(' {
+				depth++
+			} else if c == ')' {
+				if depth == 0 {
 					break
-				} else if c == ';' {
-					// Semicolon ends statements (like let statements that contain parse)
-					if parenDepth <= startingDepth {
-						break
-					}
-				} else if c == ')' {
-					// Closing paren - stop here if we'd go below starting depth
-					if parenDepth <= startingDepth {
-						break
-					}
-					parenDepth--
-				} else if c == '(' {
-					parenDepth++
-				} else if c == '\n' {
-					// Check if next non-whitespace is a new operator
-					nextNonSpace := pipeOrEnd + 1
-					for nextNonSpace < len(query) && (query[nextNonSpace] == ' ' || query[nextNonSpace] == '\t') {
-						nextNonSpace++
-					}
-					if nextNonSpace < len(query) && query[nextNonSpace] == '|' {
-						pipeOrEnd = nextNonSpace
-						break
-					}
 				}
-			} else {
-				if c == stringChar {
-					if isVerbatim {
-						// Verbatim strings (@"..."): any closing quote ends the string
-						inString = false
-					} else if stringChar == '"' {
-						// Regular double-quoted strings: check backslash escaping
-						backslashes := 0
-						for j := pipeOrEnd - 1; j >= 0 && query[j] == '\\'; j-- {
-							backslashes++
-						}
-						if backslashes%2 == 0 {
-							inString = false
-						}
-					} else {
-						// Single quote - no escaping, so this ends the string
-						inString = false
+				depth--
+			} else if depth == 0 && (c == '|' || c == ';') {
+				break
+			}
+			if depth > 0 || !isIdentStart(c) || isIdentChar(query[k-1]) {
+				k++
+				continue
+			}
+			end := k
+			for end < len(query) && isIdentChar(query[end]) {
+				end++
+			}
+			word := lowerQuery[k:end]
+			switch {
+			case !inPattern && word == "with":
+				inPattern = true
+			case !inPattern && word == "flags" && strings.HasPrefix(query[end:], "="):
+				// flags=U: drop the parameter and the space after it
+				stop := end + 1
+				for stop < len(query) && isIdentChar(query[stop]) {
+					stop++
+				}
+				for stop < len(query) && isSpace(query[stop]) {
+					stop++
+				}
+				b.WriteString(query[lastCopied:k])
+				lastCopied = stop
+				end = stop
+			case inPattern:
+				next := end
+				for next < len(query) && isSpace(query[next]) {
+					next++
+				}
+				if next < len(query) && query[next] == ':' {
+					// Typed column: skip the colon and the type
+					end = next + 1
+					for end < len(query) && isSpace(query[end]) {
+						end++
 					}
+					for end < len(query) && isIdentChar(query[end]) {
+						end++
+					}
+				} else {
+					b.WriteString(query[lastCopied:end])
+					b.WriteByte(':')
+					lastCopied = end
 				}
 			}
-			pipeOrEnd++
-		}
-
-		// Remove the parse statement (keep the delimiter for the next statement if any)
-		b.WriteString(query[lastCopied:idx])
-		if pipeOrEnd < len(query) {
-			delim := query[pipeOrEnd]
-			if delim == '|' || delim == ')' || delim == ';' {
-				// Keep the delimiter: "| parse ... | next" -> "| next"
-				lastCopied = pipeOrEnd
-			} else {
-				lastCopied = pipeOrEnd
-			}
-		} else {
-			// No following delimiter, just remove to end: "| parse ..." -> ""
-			lastCopied = pipeOrEnd
+			k = end
 		}
-		searchFrom = pipeOrEnd
-		changed = true
+		i = k - 1
 	}
-
-	if !changed {
+	if lastCopied == 0 {
 		return query
 	}
 	b.WriteString(query[lastCopied:])
 	return b.String()
 }
 
+// stringLiteralEnd returns the position after the string literal whose opening
+// quote is at position i, honoring backslash escapes except in verbatim strings.
+func stringLiteralEnd(query string, i int) int {
+	quote := query[i]
+	verbatim := i > 0 && query[i-1] == '@'
+	for j := i + 1; j < len(query); j++ {
+		switch {
+		case query[j] == '\\' && !verbatim:
+			j++
+		case query[j] == quote:
+			return j + 1
+		}
+	}
+	return len(query)
+}
+
 // normalizeNotEqualOperator converts SQL-style <> to KQL !=
 // Handles all spacing variations: x<>y, x<> y, x <> y, x<>"foo"
 func normalizeNotEqualOperator(query string) string {
@@ -2598,7 +2696,7 @@ func stripTableWildcards(query string) string {
 				}
 			}
 
-			if shouldRemove {
+			if shouldRemove && !inColumnPatternList(query, i) {
 				b.WriteString(query[lastCopied:i])
 				lastCopied = i + 1
 				changed = true
@@ -2613,6 +2711,19 @@ func stripTableWildcards(query string) string {
 	return b.String()
 }
 
+// inColumnPatternList reports whether position i of query is in the column list of
+// an operator that takes wildcard patterns, such as project-away Temp*, where the
+// grammar keeps the * and stripping it would change the columns matched.
+func inColumnPatternList(query string, i int) bool {
+	segment := strings.ToLower(strings.TrimSpace(query[strings.LastIndexByte(query[:i], '|')+1 : i]))
+	for _, keyword := range []string{"project-away", "project-keep", "project-reorder"} {
+		if strings.HasPrefix(segment, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
 // stripNamedFunctionParams removes named parameter assignments from function calls
 // that appear at the start of a query (user-defined function calls)
 // Example: parser(pack=true) -> parser or parser (pack=pack) -> parser
@@ -2985,43 +3096,44 @@ type asimEntry struct {
 	len   int
 }
 
-// asimByFirstByte groups ASIM function names by their lowercase first byte for
+// asimIndex groups ASIM function names by their lowercase first byte for
 // O(1) lookup at each query position. Within each group entries are sorted
 // longest-first so the greedy match is always correct.
-var asimByFirstByte [256][]asimEntry
+type asimIndex [256][]asimEntry
 
-func init() {
-	asimFunctions := []string{
-		"imAuthentication", "imProcess", "imNetworkSession", "imDns",
-		"imWebSession", "imFileEvent", "imProcessCreate", "imProcessTerminate",
-		"imRegistry", "imAuditEvent", "imUserManagement",
-		"_Im_Authentication", "_Im_Process", "_Im_NetworkSession", "_Im_Dns",
-		"_Im_WebSession", "_Im_FileEvent", "_Im_Registry", "_Im_AuditEvent",
-		"_Im_ProcessCreate", "_Im_ProcessTerminate", "_Im_UserManagement",
-		// Sentinel watchlist and other underscore-prefixed functions
-		"_GetWatchlist", "_GetWatchlistAlias",
-	}
+var defaultASIMIndex = newASIMIndex(defaultASIMFunctions)
 
-	for _, fn := range asimFunctions {
+func newASIMIndex(functions []string) *asimIndex {
+	var index asimIndex
+	for _, fn := range functions {
+		if fn == "" {
+			continue
+		}
 		lower := strings.ToLower(fn)
 		fb := lower[0]
-		asimByFirstByte[fb] = append(asimByFirstByte[fb], asimEntry{lower: lower, len: len(lower)})
+		index[fb] = append(index[fb], asimEntry{lower: lower, len: len(lower)})
 	}
 	// Sort each bucket longest-first so greedy matching picks the longest name.
-	for i := range asimByFirstByte {
-		bucket := asimByFirstByte[i]
+	for i := range index {
+		bucket := index[i]
 		if len(bucket) > 1 {
 			sort.Slice(bucket, func(a, b int) bool {
 				return bucket[a].len > bucket[b].len
 			})
 		}
 	}
+	return &index
 }
 
 // replaceASIMFunctions replaces ASIM function calls with dummy table references.
 // Handles both simple calls (imAuthentication) and parameterised calls
 // (_Im_Dns(param=value)) in a single pass over the query.
 func replaceASIMFunctions(query string) string {
+	return replaceASIMFunctionsWith(query, defaultASIMIndex)
+}
+
+// replaceASIMFunctionsWith is replaceASIMFunctions for the functions in index.
+func replaceASIMFunctionsWith(query string, index *asimIndex) string {
 	lowerQuery := strings.ToLower(query)
 	qLen := len(query)
 
@@ -3039,7 +3151,7 @@ func replaceASIMFunctions(query string) string {
 		}
 
 		// Look up candidate ASIM names by the lowercase byte at position i.
-		bucket := asimByFirstByte[lowerQuery[i]]
+		bucket := index[lowerQuery[i]]
 		if len(bucket) == 0 {
 			i++
 			continue
@@ -3376,7 +3488,7 @@ func replaceExternalData(query string) string {
 
 		// Replace entire externaldata expression with ExtDataResult
 		b.WriteString(query[lastCopied:idx])
-		b.WriteString("ExtDataResult")
+		b.WriteString(externalDataTable)
 		lastCopied = end
 		searchFrom = end
 		changed = true
@@ -3648,14 +3760,12 @@ func stripLeadingComments(query string) string {
 
 // replaceParameters replaces {Parameter} placeholders with dummy values
 func replaceParameters(query string) string {
-	// Common parameter patterns (non-time-related)
-	replacements := map[string]string{
-		"{SourceTable}":  "SecurityEvent",
-		"{TotalE5Seats}": "100",
-		"{Workspace}":    "workspace",
-		"{Subscription}": "subscription",
-	}
+	return replaceParametersWith(query, defaultConfig.parameters)
+}
 
+// replaceParametersWith is replaceParameters with the given placeholder substitutions
+// (keys include the braces). Placeholders without a substitution get dummy values.
+func replaceParametersWith(query string, replacements map[string]string) string {
 	result := query
 
 	// Handle double curly braces {{param}} (Jinja2/Sentinel/Logic Apps style)
@@ -4120,7 +4230,8 @@ func isValidParamName(s string) bool {
 	return true
 }
 
-// NormalizeQueryForDebug returns the normalized query for debugging purposes
+// NormalizeQueryForDebug returns the normalized query for debugging purposes.
+// Use NormalizeQueryWithSourceMap to relate its offsets to the original query.
 func NormalizeQueryForDebug(query string) string {
 	return normalizeQuery(query)
 }
@@ -4129,100 +4240,201 @@ func NormalizeQueryForDebug(query string) string {
 // Uses a timeout (MaxParseTime) to abort queries that cause the parser to hang
 // on deeply nested expressions. Recovers from panics.
 func ExtractConditions(query string) *ParseResult {
+	limit := MaxParseTime
+	ctx, cancel := context.WithTimeout(context.Background(), limit)
+	defer cancel()
+	return extractConditions(ctx, query, limit, defaultConfig)
+}
+
+// ExtractConditionsContext is like ExtractConditions but is bounded by ctx instead
+// of MaxParseTime. When ctx is canceled or its deadline passes, the lexer and parser
+// stop at their next token access and a timeout or canceled diagnostic is returned.
+func ExtractConditionsContext(ctx context.Context, query string) *ParseResult {
+	return extractConditions(ctx, query, 0, defaultConfig)
+}
+
+// extractConditions runs the extraction in a goroutine so that the caller is released
+// as soon as ctx ends, even while normalization is still running; the parser itself
+// observes ctx and stops shortly after. limit is only used to word the timeout message.
+func extractConditions(ctx context.Context, query string, limit time.Duration, cfg *extractConfig) *ParseResult {
+	if err := ctx.Err(); err != nil {
+		return failedParseResult(contextDiagnostic(err, limit))
+	}
+
 	ch := make(chan *ParseResult, 1)
 	go func() {
-		ch <- extractConditionsInternal(query)
+		ch <- extractConditionsInternal(ctx, query, limit, cfg)
 	}()
 
 	select {
 	case result := <-ch:
 		return result
-	case <-time.After(MaxParseTime):
-		return &ParseResult{
-			Conditions:  []Condition{},
-			DataSources: []string{},
-			Commands:    []string{},
-			Errors:      []string{fmt.Sprintf("parser timeout: query took longer than %s to parse", MaxParseTime)},
-		}
+	case <-ctx.Done():
+		return failedParseResult(contextDiagnostic(ctx.Err(), limit))
 	}
 }
 
-func extractConditionsInternal(query string) (result *ParseResult) {
+func extractConditionsInternal(ctx context.Context, query string, limit time.Duration, cfg *extractConfig) (result *ParseResult) {
 	defer func() {
 		if r := recover(); r != nil {
-			result = &ParseResult{
-				Conditions:  []Condition{},
-				DataSources: []string{},
-				Commands:    []string{},
-				Errors:      []string{fmt.Sprintf("parser panic: %v", r)},
+			if canceled, ok := r.(parseCanceled); ok {
+				result = failedParseResult(contextDiagnostic(canceled.err, limit))
+				return
 			}
+			result = failedParseResult(panicDiagnostic(r))
 		}
 	}()
 
 	// Normalize the query to handle operators the parser doesn't fully support
-	normalizedQuery := normalizeQuery(query)
-	input := antlr.NewInputStream(normalizedQuery)
-	lexer := NewKQLLexer(input)
-
-	// Remove default error listener and add our own
-	lexer.RemoveErrorListeners()
-	lexerErrors := &errorListener{}
-	lexer.AddErrorListener(lexerErrors)
-
-	stream := antlr.NewCommonTokenStream(lexer, antlr.TokenDefaultChannel)
-	parser := NewKQLParser(stream)
+	normalized := normalizeWithSourceMap(ctx, query, cfg)
+	normalizedQuery, sourceMap := normalized.text, normalized.sm
+	if err := ctx.Err(); err != nil {
+		return failedParseResult(contextDiagnostic(err, limit))
+	}
+	p := newKQLParser(ctx, normalizedQuery)
+	p.sourceMap = sourceMap
 
-	// Remove default error listener and add our own
-	parser.RemoveErrorListeners()
-	parserErrors := &errorListener{}
-	parser.AddErrorListener(parserErrors)
+	// Values of scalar lets, which nested queries like join right sides also see
+	lets := normalized.lets
+	if !cfg.inlineLets {
+		lets = letDefinitions(ctx, query)
+	}
+	if values := scalarLetValues(lets); len(values) > 0 {
+		cfg = cfg.withLetValues(values)
+	}
 
 	// Parse the query
-	tree := parser.Query()
+	tree := p.parser.Query()
+	locator := newSpanLocator(sourceMap)
+
+	// The time window is taken from the tree before the walk, so that dropped
+	// conditions on time columns can tell whether it reports them
+	builder := &astBuilder{input: p.input, locator: locator}
+	if cfg.validateSchema {
+		builder.spans = make(map[ast.Node]*Span)
+	}
+	var pipeline *ast.TabularExpression
+	var timeWindow *TimeWindow
+	if body := tree.TabularExpression(); body != nil {
+		pipeline = builder.tabularExpression(body)
+		timeWindow = queryTimeWindow(pipeline, lets)
+	}
 
 	// Walk the tree to extract conditions
 	extractor := &conditionExtractor{
 		conditions:          make([]Condition, 0),
 		computedFields:      make(map[string]string), // computed field -> source field
 		computedExpressions: make(map[string]string), // computed field -> expression
+		parsedColumns:       make(map[string]bool),
 		commands:            make([]string, 0),
 		joins:               make([]JoinInfo, 0),
 		lastLogicalOp:       "AND", // default
 		originalQuery:       normalizedQuery,
+		locator:             locator,
+		windowColumns:       timeWindow.columns(),
+		ctx:                 ctx,
+		limit:               limit,
+		cfg:                 cfg,
 	}
 	antlr.ParseTreeWalkerDefault.Walk(extractor, tree)
 
-	// Combine errors
-	allErrors := append(lexerErrors.errors, parserErrors.errors...)
-	allErrors = append(allErrors, extractor.errors...)
+	// Combine diagnostics
+	diagnostics := append(p.diagnostics(), normalized.diagnostics...)
+	diagnostics = append(diagnostics, extractor.diagnostics...)
 
 	// Post-process to group OR conditions on same field
-	conditions := groupORConditions(extractor.conditions)
-	if !hasPortableFieldConditions(conditions) {
+	conditions, mapping := groupORConditionsIndexed(extractor.conditions)
+	remapWhereClauses(extractor.whereClauses, mapping)
+	// Conditions of an mv-apply subquery, on mv-expand items and on parsed columns are
+	// the query's own filters, attributed to the source column, and those in functions
+	// and aggregations are predicates the parser found; the fallback would report them
+	// again, or turn the values of iff and case into keywords.
+	if cfg.portableFallback && !hasPortableFieldConditions(conditions, cfg.excluded) &&
+		!hasScopedConditions(conditions, ScopeFunction, ScopeAggregation) &&
+		!hasScopedConditions(extractor.scopedConditions, ScopeMvApply) && extractor.elementConditions == 0 &&
+		!hasConditionsOn(conditions, extractor.parsedColumns) {
 		var note string
 		var extracted []Condition
 		extracted, note = extractPortableConditions(query, normalizedQuery)
+		// The string literals of a parse pattern are not search terms
+		if note == portableKeywordExtractionNote && len(extractor.parsedColumns) > 0 {
+			extracted, note = nil, ""
+		}
 		for _, condition := range extracted {
+			describeOperator(&condition, condition.Operator)
+			if path, ok := parseFieldPath(condition.Field); ok {
+				condition.Path = &path
+			}
 			if !containsCondition(conditions, condition) {
 				conditions = append(conditions, condition)
 			}
 		}
 		if note != "" {
-			allErrors = append(allErrors, note)
+			diagnostics = append(diagnostics, portableDiagnostic(note))
+		}
+	}
+
+	for i := range conditions {
+		if conditions[i].Scope == "" {
+			conditions[i].Scope = ScopeMain
+		}
+	}
+
+	letStatements := letStatements(lets, normalized.inlined)
+	scoped := groupORConditions(extractor.scopedConditions)
+	scoped = append(scoped, joinScopedConditions(extractor.joins, cfg.includeSubquery)...)
+	scoped = append(scoped, letScopedConditions(ctx, query, letStatements, limit, cfg)...)
+	if cfg.includeSubquery {
+		conditions = append(conditions, scoped...)
+	}
+
+	var lineage []ColumnLineage
+	var output []OutputColumn
+	var outputComplete bool
+	if pipeline != nil {
+		schema := newSchema(ctx, cfg.catalog, lets)
+		stages := schema.stages(pipeline)
+		unpackedPaths(conditions, stages)
+		lineage = queryLineage(pipeline, lets, stages)
+		output, outputComplete = outputColumns(schema.output(pipeline))
+		if cfg.validateSchema {
+			diagnostics = append(diagnostics, validateSchema(conditions, stages, query)...)
+			diagnostics = append(diagnostics, checkExpressionTypes(stages, schema, builder.spans, query)...)
 		}
 	}
 
+	dataSources := extractPortableDataSources(query, normalizedQuery)
 	return &ParseResult{
 		Conditions:          conditions,
-		DataSources:         extractPortableDataSources(query, normalizedQuery),
-		LetStatements:       extractLetStatements(query),
+		DataSources:         dataSources,
+		DataSourceSpans:     dataSourceSpans(query, dataSources),
+		LetStatements:       letStatements,
 		ComputedFields:      extractor.computedFields,
 		ComputedExpressions: extractor.computedExpressions,
+		Lineage:             lineage,
+		OutputColumns:       output,
+		OutputComplete:      outputComplete,
 		GroupByFields:       extractor.groupByFields,
 		Commands:            extractor.commands,
 		ProjectedFields:     extractor.projectedFields,
 		Joins:               extractor.joins,
-		Errors:              allErrors,
+		Unions:              extractor.unions,
+		ScopedConditions:    scoped,
+		WhereClauses:        extractor.whereClauses,
+		TimeWindow:          timeWindow,
+		Errors:              diagnosticMessages(diagnostics),
+		Diagnostics:         diagnostics,
+	}
+}
+
+// failedParseResult returns an empty result carrying a single diagnostic.
+func failedParseResult(d Diagnostic) *ParseResult {
+	return &ParseResult{
+		Conditions:  []Condition{},
+		DataSources: []string{},
+		Commands:    []string{},
+		Errors:      []string{d.String()},
+		Diagnostics: []Diagnostic{d},
 	}
 }
 
@@ -4233,6 +4445,7 @@ func (e *conditionExtractor) EnterJoinOperator(ctx *JoinOperatorContext) {
 	info := JoinInfo{
 		Type:      "innerunique", // KQL default
 		PipeStage: e.currentStage,
+		Span:      e.locator.ruleSpan(ctx),
 	}
 
 	// Extract join kind (e.g., kind=inner, kind=leftouter)
@@ -4267,9 +4480,10 @@ func (e *conditionExtractor) EnterJoinOperator(ctx *JoinOperatorContext) {
 		// Subquery: join kind=inner (SubQuery | where ...) on field
 		subText := e.extractTabularExpressionText(ctx.TabularExpression())
 		if subText != "" {
-			info.Subsearch = ExtractConditions(subText)
+			info.Subsearch = extractConditionsInternal(e.ctx, subText, e.limit, e.cfg)
+			e.locator.remapSubquerySpans(info.Subsearch, ctx.TabularExpression())
 			allJoinFields := append(info.JoinFields, info.LeftFields...)
-			info.ExposedFields = deriveExposedFields(info.Subsearch, allJoinFields)
+			info.ExposedFields = deriveExposedFields(info.Subsearch, allJoinFields, e.cfg.excluded)
 		}
 	}
 
@@ -4308,7 +4522,7 @@ func (e *conditionExtractor) extractTabularExpressionText(ctx ITabularExpression
 }
 
 // deriveExposedFields determines what fields the right side of a join makes available
-func deriveExposedFields(subResult *ParseResult, joinFields []string) []string {
+func deriveExposedFields(subResult *ParseResult, joinFields []string, excluded map[string]bool) []string {
 	if subResult == nil {
 		return nil
 	}
@@ -4322,7 +4536,7 @@ func deriveExposedFields(subResult *ParseResult, joinFields []string) []string {
 
 	// Condition fields from the right side
 	for _, c := range subResult.Conditions {
-		if !kqlKeywords[strings.ToLower(c.Field)] {
+		if !excluded[strings.ToLower(c.Field)] {
 			fieldSet[c.Field] = true
 		}
 	}
@@ -4408,49 +4622,56 @@ func (e *conditionExtractor) ExitTabularOperator(ctx *TabularOperatorContext) {
 	e.currentStage++
 }
 
-// EnterFunctionCall tracks when we enter a function call (countif, sumif, etc.)
-// Conditions inside function calls are aggregation expressions, not filter conditions.
+// EnterFunctionCall tracks when we enter a function call (countif, iff, etc.)
+// Conditions inside function calls are aggregation predicates or function arguments,
+// not filters of the pipeline, so they are reported in the function's scope.
 // Special handling for existence-check functions: isnotempty, isnotnull, isnull, isempty.
 func (e *conditionExtractor) EnterFunctionCall(ctx *FunctionCallContext) {
+	funcName := ""
 	if ctx.Identifier() != nil {
-		funcName := strings.ToLower(ctx.Identifier().GetText())
-		switch funcName {
-		case "isnotempty", "isnotnull":
-			if ctx.ArgumentList() != nil {
-				args := ctx.ArgumentList().AllArgument()
-				if len(args) >= 1 {
-					field := args[0].GetText()
-					e.conditions = append(e.conditions, Condition{
-						Field:    field,
-						Operator: "isnotnull",
-						Value:    "",
-						Negated:  e.negated,
-					})
+		funcName = strings.ToLower(ctx.Identifier().GetText())
+	}
+	if existenceChecks[funcName] {
+		operator := "isnotnull"
+		if funcName == "isnull" || funcName == "isempty" {
+			operator = "isnull"
+		}
+		if ctx.ArgumentList() != nil {
+			args := ctx.ArgumentList().AllArgument()
+			if len(args) >= 1 {
+				field, path, ok := operandField(args[0].GetText())
+				if !ok {
+					field = args[0].GetText()
 				}
-			}
-			return // Don't increment inFunctionCall
-		case "isnull", "isempty":
-			if ctx.ArgumentList() != nil {
-				args := ctx.ArgumentList().AllArgument()
-				if len(args) >= 1 {
-					field := args[0].GetText()
-					e.conditions = append(e.conditions, Condition{
-						Field:    field,
-						Operator: "isnull",
-						Value:    "",
-						Negated:  e.negated,
-					})
+				cond := Condition{
+					Field:        field,
+					Operator:     operator,
+					Value:        "",
+					Negated:      e.negated,
+					NegatedByNot: e.negated,
+					PipeStage:    e.currentStage,
+					Path:         path,
+					Span:         e.locator.ruleSpan(ctx),
 				}
+				describeOperator(&cond, operator)
+				e.addCondition(cond)
 			}
-			return // Don't increment inFunctionCall
 		}
+		return // Don't open a scope
+	}
+	kind := ScopeFunction
+	if conditionalAggregations[funcName] {
+		kind = ScopeAggregation
 	}
-	e.inFunctionCall++
+	e.pushScope(kind, funcName)
 }
 
-// ExitFunctionCall tracks when we exit a function call
+// ExitFunctionCall closes the scope opened by EnterFunctionCall
 func (e *conditionExtractor) ExitFunctionCall(ctx *FunctionCallContext) {
-	e.inFunctionCall--
+	if ctx.Identifier() != nil && existenceChecks[strings.ToLower(ctx.Identifier().GetText())] {
+		return
+	}
+	e.popScope()
 }
 
 // EnterLetStatement tracks computed fields from let statements
@@ -4531,6 +4752,77 @@ func (e *conditionExtractor) EnterExtendItem(ctx *ExtendItemContext) {
 
 		e.computedFields[strings.ToLower(field)] = sourceField
 		e.computedExpressions[strings.ToLower(field)] = expression
+		delete(e.elements, strings.ToLower(field))
+	}
+}
+
+// EnterParseOperator tracks the columns parse and parse-where extract as computed
+// from the parsed field. Rows parse-where keeps contain each string anchor of the
+// pattern, so anchors other than whitespace are reported as implicit contains_cs
+// conditions on the field:
+// parse-where Msg with * "user=" User " port " Port:int -> Msg contains_cs "user=", Msg contains_cs " port "
+func (e *conditionExtractor) EnterParseOperator(ctx *ParseOperatorContext) {
+	if ctx.Expression() == nil || ctx.ParsePattern() == nil {
+		return
+	}
+	field := ctx.Expression().GetText()
+	sourceField, isComputed := e.computedFields[strings.ToLower(field)]
+	parsed := extractFirstFieldFromExpression(ctx.Expression())
+	for _, item := range ctx.ParsePattern().AllParsePatternItem() {
+		if item.Identifier() != nil {
+			e.computedFields[strings.ToLower(item.Identifier().GetText())] = parsed
+			e.parsedColumns[strings.ToLower(item.Identifier().GetText())] = true
+		}
+	}
+
+	// Anchors of regex patterns are not literal text
+	kind := ctx.ParseKind()
+	if ctx.PARSE_WHERE() == nil || !isValidFieldName(field) ||
+		(kind != nil && kind.Identifier() != nil && strings.EqualFold(kind.Identifier().GetText(), "regex")) {
+		return
+	}
+	if e.dropExcluded(field) {
+		return
+	}
+	for _, item := range ctx.ParsePattern().AllParsePatternItem() {
+		if item.STRING_LITERAL() == nil && item.VERBATIM_STRING() == nil {
+			continue
+		}
+		lit := e.literalOf(item)
+		value := literalValue(extractValue(item.GetText()), lit)
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		cond := Condition{
+			Field:       field,
+			Operator:    "contains_cs",
+			Value:       value,
+			PipeStage:   e.currentStage,
+			LogicalOp:   "AND",
+			IsComputed:  isComputed,
+			SourceField: sourceField,
+			Implicit:    true,
+			Span:        e.locator.ruleSpan(item),
+		}
+		describeOperator(&cond, "contains_cs")
+		cond.Literal = lit
+		cond.RawValue = rawStringValue(lit)
+		e.addCondition(cond)
+	}
+}
+
+// EnterParseKvOperator tracks the keys parse-kv extracts as computed from the
+// parsed field.
+func (e *conditionExtractor) EnterParseKvOperator(ctx *ParseKvOperatorContext) {
+	if ctx.Expression() == nil || ctx.KvPairList() == nil {
+		return
+	}
+	sourceField := extractFirstFieldFromExpression(ctx.Expression())
+	for _, pair := range ctx.KvPairList().AllKvPair() {
+		if pair.Identifier() != nil {
+			e.computedFields[strings.ToLower(pair.Identifier().GetText())] = sourceField
+			e.parsedColumns[strings.ToLower(pair.Identifier().GetText())] = true
+		}
 	}
 }
 
@@ -4553,7 +4845,7 @@ func firstFieldInExpressionText(expr string) string {
 	}
 
 	// Simple identifier by itself (e.g., the right-hand side of "extend Account = AccountName").
-	if isSimpleIdentifier(expr) && !kqlKeywords[strings.ToLower(expr)] {
+	if isSimpleIdentifier(expr) && !isReservedName(expr) {
 		return expr
 	}
 
@@ -4567,7 +4859,7 @@ func firstFieldInExpressionText(expr string) string {
 		}
 		field := expr[identStart:end]
 		identStart = -1
-		if isSimpleIdentifier(field) && !kqlKeywords[strings.ToLower(field)] {
+		if isSimpleIdentifier(field) && !isReservedName(field) {
 			return field
 		}
 		return ""
@@ -4642,6 +4934,13 @@ func (e *conditionExtractor) EnterProjectItem(ctx *ProjectItemContext) {
 		field := ctx.Identifier().GetText()
 		e.computedFields[strings.ToLower(field)] = ""
 		e.projectedFields = append(e.projectedFields, field)
+		delete(e.elements, strings.ToLower(field))
+		if ctx.Expression() != nil {
+			if element, ok := e.elements[strings.ToLower(ctx.Expression().GetText())]; ok {
+				// A renamed array element is still one
+				e.elements[strings.ToLower(field)] = element
+			}
+		}
 	} else if ctx.Expression() != nil {
 		// Simple project item: project FieldName
 		// The field name is the expression text (for simple identifiers)
@@ -4652,24 +4951,43 @@ func (e *conditionExtractor) EnterProjectItem(ctx *ProjectItemContext) {
 	}
 }
 
+// EnterRenameItem tracks columns renamed by project-rename as computed from the
+// column they rename, or from its source if that was computed too.
+func (e *conditionExtractor) EnterRenameItem(ctx *RenameItemContext) {
+	if e.inSubquery > 0 || len(ctx.AllIdentifier()) != 2 {
+		return
+	}
+	field := ctx.Identifier(0).GetText()
+	old := ctx.Identifier(1).GetText()
+	sourceField := old
+	if source, ok := e.computedFields[strings.ToLower(old)]; ok {
+		sourceField = source
+	}
+	e.computedFields[strings.ToLower(field)] = sourceField
+	e.computedExpressions[strings.ToLower(field)] = old
+	delete(e.elements, strings.ToLower(field))
+	if element, ok := e.elements[strings.ToLower(old)]; ok {
+		// A renamed array element is still one
+		e.elements[strings.ToLower(field)] = element
+	}
+}
+
 // EnterComparisonExpression extracts field comparisons
 func (e *conditionExtractor) EnterComparisonExpression(ctx *ComparisonExpressionContext) {
+	e.comparisons = append(e.comparisons, ctx)
+
 	// Skip conditions inside subqueries
 	if e.inSubquery > 0 {
 		return
 	}
 
-	// Skip conditions inside function calls (like countif(), sumif(), etc.)
-	// These are aggregation expressions, not filter conditions
-	if e.inFunctionCall > 0 {
-		return
-	}
+	e.predicateSpan = e.locator.ruleSpan(ctx)
 
 	// Handle comparison operators: field == value, field != value, etc.
 	if ctx.ComparisonOperator() != nil {
 		addExprs := ctx.AllAdditiveExpression()
 		if len(addExprs) >= 2 {
-			e.handleComparison(addExprs[0].GetText(), ctx.ComparisonOperator().GetText(), addExprs[1].GetText())
+			e.handleComparison(addExprs[0].GetText(), ctx.ComparisonOperator().GetText(), addExprs[1])
 		}
 		return
 	}
@@ -4678,25 +4996,29 @@ func (e *conditionExtractor) EnterComparisonExpression(ctx *ComparisonExpression
 	if ctx.StringOperator() != nil {
 		addExprs := ctx.AllAdditiveExpression()
 		if len(addExprs) >= 2 {
-			e.handleComparison(addExprs[0].GetText(), ctx.StringOperator().GetText(), addExprs[1].GetText())
+			e.handleComparison(addExprs[0].GetText(), ctx.StringOperator().GetText(), addExprs[1])
 		}
 		return
 	}
 
-	// Handle IN operator: field in (values) - including case-sensitive variants (in~, !in~)
-	// Note: IN_CS (in~) and NOT_IN_CS (!in~) tokens exist but generated parser doesn't have methods
-	// So we check using GetToken directly for both regular and case-sensitive IN operators
-	hasIN := ctx.IN() != nil
-	hasNOT_IN := ctx.NOT_IN() != nil
-	hasIN_CS := ctx.GetToken(KQLParserIN_CS, 0) != nil
-	hasNOT_IN_CS := ctx.GetToken(KQLParserNOT_IN_CS, 0) != nil
+	// Handle IN operator: field in (values), including !in and the case-insensitive in~ and !in~
+	// (the grammar names the latter IN_CS and NOT_IN_CS)
+	var inOp string
+	switch {
+	case ctx.IN() != nil:
+		inOp = "in"
+	case ctx.NOT_IN() != nil:
+		inOp = "!in"
+	case ctx.IN_CS() != nil:
+		inOp = "in~"
+	case ctx.NOT_IN_CS() != nil:
+		inOp = "!in~"
+	}
 
-	if hasIN || hasNOT_IN || hasIN_CS || hasNOT_IN_CS {
+	if inOp != "" {
 		addExprs := ctx.AllAdditiveExpression()
 		if len(addExprs) >= 1 && ctx.ExpressionList() != nil {
-			leftText := addExprs[0].GetText()
-			isNegated := (hasNOT_IN || hasNOT_IN_CS) != e.negated
-			e.handleInOperator(leftText, ctx.ExpressionList(), isNegated)
+			e.handleInOperator(addExprs[0].GetText(), inOp, ctx.ExpressionList())
 		}
 		return
 	}
@@ -4706,10 +5028,7 @@ func (e *conditionExtractor) EnterComparisonExpression(ctx *ComparisonExpression
 		addExprs := ctx.AllAdditiveExpression()
 		if len(addExprs) >= 3 {
 			leftText := addExprs[0].GetText()
-			lowValue := addExprs[1].GetText()
-			highValue := addExprs[2].GetText()
-			isNegated := (ctx.NOT_BETWEEN() != nil) != e.negated
-			e.handleBetweenOperator(leftText, lowValue, highValue, isNegated)
+			e.handleBetweenOperator(leftText, addExprs[1], addExprs[2], ctx.NOT_BETWEEN() != nil)
 		}
 		return
 	}
@@ -4729,17 +5048,45 @@ func (e *conditionExtractor) EnterComparisonExpression(ctx *ComparisonExpression
 	}
 }
 
+// dropExcluded reports whether conditions on field are left out, and notes the
+// dropped condition in the diagnostics when they are.
+func (e *conditionExtractor) dropExcluded(field string) bool {
+	reason := e.cfg.exclusion(field)
+	if reason == "" {
+		return false
+	}
+	if e.inSubquery > 0 {
+		return true // noted in the join's Subsearch
+	}
+	if reason == timeColumnExclusion && e.windowColumns[strings.ToLower(field)] {
+		reason += ", reported in TimeWindow"
+	}
+	e.diagnostics = append(e.diagnostics, excludedFieldDiagnostic(field, reason, e.currentPredicateSpan(), e.locator.sourceMap.original))
+	return true
+}
+
+// currentPredicateSpan returns a copy of the span of the comparison being handled,
+// so that conditions expanded from one predicate do not share a pointer.
+func (e *conditionExtractor) currentPredicateSpan() *Span {
+	if e.predicateSpan == nil {
+		return nil
+	}
+	span := *e.predicateSpan
+	return &span
+}
+
 // handleComparison processes a simple comparison (field op value)
-func (e *conditionExtractor) handleComparison(left, op, right string) {
+func (e *conditionExtractor) handleComparison(operand, op string, right antlr.ParseTree) {
 	// Check if left side looks like a field name
-	if !isValidFieldName(left) {
+	left, path, ok := operandField(operand)
+	if !ok {
 		return
 	}
 
 	fieldLower := strings.ToLower(left)
 
-	// Skip KQL keywords
-	if kqlKeywords[fieldLower] {
+	// Skip KQL keywords, excluded fields and table names
+	if e.dropExcluded(left) {
 		return
 	}
 
@@ -4749,67 +5096,82 @@ func (e *conditionExtractor) handleComparison(left, op, right string) {
 	// Normalize the operator
 	normalizedOp := normalizeOperator(op)
 
-	// Extract value (remove quotes if present)
-	value := extractValue(right)
-
 	cond := Condition{
-		Field:       left,
-		Operator:    normalizedOp,
-		Value:       value,
-		Negated:     e.negated,
-		PipeStage:   e.currentStage,
-		LogicalOp:   e.lastLogicalOp,
-		IsComputed:  isComputed,
-		SourceField: sourceField,
-	}
-	e.conditions = append(e.conditions, cond)
+		Field:        left,
+		Operator:     normalizedOp,
+		Negated:      e.negated,
+		NegatedByNot: e.negated,
+		PipeStage:    e.currentStage,
+		LogicalOp:    e.lastLogicalOp,
+		IsComputed:   isComputed,
+		SourceField:  sourceField,
+		Path:         path,
+		Span:         e.currentPredicateSpan(),
+	}
+	describeOperator(&cond, op)
+	// Extract value (remove quotes if present)
+	e.setValue(&cond, right)
+	e.addCondition(cond)
 	e.lastLogicalOp = "AND" // reset to default
 }
 
-// handleInOperator processes IN operator conditions
-func (e *conditionExtractor) handleInOperator(field string, exprList IExpressionListContext, negated bool) {
-	if !isValidFieldName(field) {
+// handleInOperator processes IN operator conditions. op is in, !in, in~ or !in~;
+// the condition is reported with Operator in and negated for !in and !in~.
+func (e *conditionExtractor) handleInOperator(operand, op string, exprList IExpressionListContext) {
+	field, path, ok := operandField(operand)
+	if !ok {
 		return
 	}
 
 	fieldLower := strings.ToLower(field)
-	if kqlKeywords[fieldLower] {
+	if e.dropExcluded(field) {
 		return
 	}
 
 	// Mark if this is a computed field (created by extend/project)
 	sourceField, isComputed := e.computedFields[fieldLower]
 
-	values := extractExpressionListValues(exprList)
+	values, literals, reference := e.expressionListValues(exprList)
 	if len(values) == 0 {
 		return
 	}
-	cond := Condition{
-		Field:        field,
-		Operator:     "in",
-		Value:        values[0],
-		Negated:      negated,
-		PipeStage:    e.currentStage,
-		LogicalOp:    e.lastLogicalOp,
-		Alternatives: values,
-		IsComputed:   isComputed,
-		SourceField:  sourceField,
+	literal := literals[0]
+	if bound, ok := e.letValue(reference); ok {
+		// in (procs) compares with the list procs binds
+		literal = bound.literal
 	}
-	if len(values) == 1 && isSimpleIdentifier(values[0]) {
-		cond.ValueReference = values[0]
-	}
-	e.conditions = append(e.conditions, cond)
+	cond := Condition{
+		Field:          field,
+		Operator:       "in",
+		Value:          values[0],
+		ValueReference: reference,
+		Literal:        literal,
+		RawValue:       rawStringValue(literal),
+		NegatedByNot:   e.negated,
+		PipeStage:      e.currentStage,
+		LogicalOp:      e.lastLogicalOp,
+		Alternatives:   values,
+		IsComputed:     isComputed,
+		SourceField:    sourceField,
+		Path:           path,
+		Span:           e.currentPredicateSpan(),
+	}
+	describeOperator(&cond, op)
+	cond.Negated = cond.NegatedByOperator != e.negated
+	e.addCondition(cond)
 	e.lastLogicalOp = "AND"
 }
 
-// handleBetweenOperator processes BETWEEN operator conditions
-func (e *conditionExtractor) handleBetweenOperator(field, lowValue, highValue string, negated bool) {
-	if !isValidFieldName(field) {
+// handleBetweenOperator processes BETWEEN operator conditions as a pair of bounds,
+// both negated for !between.
+func (e *conditionExtractor) handleBetweenOperator(operand string, low, high antlr.ParseTree, notBetween bool) {
+	field, path, ok := operandField(operand)
+	if !ok {
 		return
 	}
 
 	fieldLower := strings.ToLower(field)
-	if kqlKeywords[fieldLower] {
+	if e.dropExcluded(field) {
 		return
 	}
 
@@ -4818,47 +5180,58 @@ func (e *conditionExtractor) handleBetweenOperator(field, lowValue, highValue st
 
 	// Add lower bound condition
 	cond1 := Condition{
-		Field:       field,
-		Operator:    ">=",
-		Value:       extractValue(lowValue),
-		Negated:     negated,
-		PipeStage:   e.currentStage,
-		LogicalOp:   e.lastLogicalOp,
-		IsComputed:  isComputed,
-		SourceField: sourceField,
+		Field:        field,
+		Operator:     ">=",
+		Negated:      notBetween != e.negated,
+		NegatedByNot: e.negated,
+		PipeStage:    e.currentStage,
+		LogicalOp:    e.lastLogicalOp,
+		IsComputed:   isComputed,
+		SourceField:  sourceField,
+		Path:         path,
+		Span:         e.currentPredicateSpan(),
 	}
-	e.conditions = append(e.conditions, cond1)
+	describeOperator(&cond1, ">=")
+	cond1.NegatedByOperator = notBetween
+	e.setValue(&cond1, low)
+	e.addCondition(cond1)
 
 	// Add upper bound condition
 	cond2 := Condition{
-		Field:       field,
-		Operator:    "<=",
-		Value:       extractValue(highValue),
-		Negated:     negated,
-		PipeStage:   e.currentStage,
-		LogicalOp:   "AND",
-		IsComputed:  isComputed,
-		SourceField: sourceField,
-	}
-	e.conditions = append(e.conditions, cond2)
+		Field:        field,
+		Operator:     "<=",
+		Negated:      notBetween != e.negated,
+		NegatedByNot: e.negated,
+		PipeStage:    e.currentStage,
+		LogicalOp:    "AND",
+		IsComputed:   isComputed,
+		SourceField:  sourceField,
+		Path:         path,
+		Span:         e.currentPredicateSpan(),
+	}
+	describeOperator(&cond2, "<=")
+	cond2.NegatedByOperator = notBetween
+	e.setValue(&cond2, high)
+	e.addCondition(cond2)
 	e.lastLogicalOp = "AND"
 }
 
 // handleHasAnyAllOperator processes has_any and has_all operators
-func (e *conditionExtractor) handleHasAnyAllOperator(field, op string, exprList IExpressionListContext) {
-	if !isValidFieldName(field) {
+func (e *conditionExtractor) handleHasAnyAllOperator(operand, op string, exprList IExpressionListContext) {
+	field, path, ok := operandField(operand)
+	if !ok {
 		return
 	}
 
 	fieldLower := strings.ToLower(field)
-	if kqlKeywords[fieldLower] {
+	if e.dropExcluded(field) {
 		return
 	}
 
 	// Mark if this is a computed field (created by extend/project)
 	sourceField, isComputed := e.computedFields[fieldLower]
 
-	values := extractExpressionListValues(exprList)
+	values, literals, reference := e.expressionListValues(exprList)
 	logicalConnector := "OR"
 	if op == "has_all" {
 		logicalConnector = "AND"
@@ -4870,16 +5243,23 @@ func (e *conditionExtractor) handleHasAnyAllOperator(field, op string, exprList
 			logOp = logicalConnector
 		}
 		cond := Condition{
-			Field:       field,
-			Operator:    "has",
-			Value:       value,
-			Negated:     e.negated,
-			PipeStage:   e.currentStage,
-			LogicalOp:   logOp,
-			IsComputed:  isComputed,
-			SourceField: sourceField,
-		}
-		e.conditions = append(e.conditions, cond)
+			Field:          field,
+			Operator:       "has",
+			Value:          value,
+			ValueReference: reference,
+			Literal:        literals[i],
+			RawValue:       rawStringValue(literals[i]),
+			Negated:        e.negated,
+			NegatedByNot:   e.negated,
+			PipeStage:      e.currentStage,
+			LogicalOp:      logOp,
+			IsComputed:     isComputed,
+			SourceField:    sourceField,
+			Path:           path,
+			Span:           e.currentPredicateSpan(),
+		}
+		describeOperator(&cond, op)
+		e.addCondition(cond)
 	}
 	e.lastLogicalOp = "AND"
 }
@@ -4976,10 +5356,14 @@ func normalizeOperator(op string) string {
 	}
 }
 
-// extractValue extracts the value, removing quotes if present
+// extractValue extracts the value, decoding it if it is a string literal
 func extractValue(s string) string {
 	s = strings.TrimSpace(s)
 
+	if value, ok := unquoteString(s); ok {
+		return value
+	}
+
 	// Remove double quotes
 	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
 		return s[1 : len(s)-1]
@@ -5012,34 +5396,15 @@ func extractPortableDataSources(originalQuery, normalizedQuery string) []string
 	var sources []string
 	for _, query := range []string{originalQuery, normalizedQuery} {
 		for _, source := range extractDataSourcesFromQuery(query, letNames) {
-			sources = appendUnique(sources, source)
+			// externaldata reads a URL, not a table
+			if source != externalDataTable {
+				sources = appendUnique(sources, source)
+			}
 		}
 	}
 	return sources
 }
 
-func extractLetStatements(query string) []LetStatement {
-	var statements []LetStatement
-	seen := make(map[string]bool)
-	for _, statement := range splitStatements(normalizeNewlines(query)) {
-		cleaned := trimLeadingLineComments(statement)
-		name, expression, ok := parseLetAssignment(strings.TrimSpace(cleaned))
-		if !ok || expression == "" {
-			continue
-		}
-		key := strings.ToLower(name)
-		if seen[key] {
-			continue
-		}
-		seen[key] = true
-		statements = append(statements, LetStatement{
-			Name:       name,
-			Expression: strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(expression), ";")),
-		})
-	}
-	return statements
-}
-
 func trimLeadingLineComments(value string) string {
 	lines := strings.Split(normalizeNewlines(value), "\n")
 	for len(lines) > 0 {
@@ -5053,7 +5418,7 @@ func trimLeadingLineComments(value string) string {
 	return strings.Join(lines, "\n")
 }
 
-func hasPortableFieldConditions(conditions []Condition) bool {
+func hasPortableFieldConditions(conditions []Condition, excluded map[string]bool) bool {
 	for _, condition := range conditions {
 		if condition.IsComputed {
 			continue
@@ -5061,7 +5426,7 @@ func hasPortableFieldConditions(conditions []Condition) bool {
 		if condition.Field == "" || condition.Field == "_keyword_" {
 			continue
 		}
-		if kqlKeywords[strings.ToLower(condition.Field)] {
+		if excluded[strings.ToLower(condition.Field)] {
 			continue
 		}
 		return true
@@ -5069,6 +5434,30 @@ func hasPortableFieldConditions(conditions []Condition) bool {
 	return false
 }
 
+// hasConditionsOn reports whether any of conditions is on one of columns, which
+// are lowercase.
+func hasConditionsOn(conditions []Condition, columns map[string]bool) bool {
+	for _, condition := range conditions {
+		if columns[strings.ToLower(condition.Field)] {
+			return true
+		}
+	}
+	return false
+}
+
+// hasScopedConditions reports whether any of conditions is in a scope of one of
+// the kinds.
+func hasScopedConditions(conditions []Condition, kinds ...ScopeKind) bool {
+	for _, cond := range conditions {
+		for _, kind := range kinds {
+			if cond.Scope == kind {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func extractLetNames(query string) map[string]bool {
 	names := make(map[string]bool)
 	for _, statement := range splitStatements(normalizeNewlines(query)) {
@@ -5111,7 +5500,18 @@ func extractDataSourcesFromQuery(query string, letNames map[string]bool) []strin
 }
 
 func splitStatements(query string) []string {
-	var statements []string
+	ranges := splitStatementRanges(query)
+	statements := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		statements = append(statements, query[r[0]:r[1]])
+	}
+	return statements
+}
+
+// splitStatementRanges returns the [start, end) byte ranges of the top-level
+// semicolon-separated statements in query.
+func splitStatementRanges(query string) [][2]int {
+	var statements [][2]int
 	start := 0
 	depth := 0
 	var quote byte
@@ -5152,12 +5552,12 @@ func splitStatements(query string) []string {
 			}
 		case ';':
 			if depth == 0 {
-				statements = append(statements, query[start:i])
+				statements = append(statements, [2]int{start, i})
 				start = i + 1
 			}
 		}
 	}
-	statements = append(statements, query[start:])
+	statements = append(statements, [2]int{start, len(query)})
 	return statements
 }
 
@@ -5310,7 +5710,13 @@ func isPortableDataSourceCandidate(token string, letNames map[string]bool) bool
 }
 
 func findMatchingParen(s string, open int) int {
-	if open < 0 || open >= len(s) || s[open] != '(' {
+	return findMatchingDelimiter(s, open, '(', ')')
+}
+
+// findMatchingDelimiter returns the index of the closer that balances the opener
+// at s[open], skipping string literals, or -1.
+func findMatchingDelimiter(s string, open int, opener, closer byte) int {
+	if open < 0 || open >= len(s) || s[open] != opener {
 		return -1
 	}
 	depth := 0
@@ -5343,11 +5749,11 @@ func findMatchingParen(s string, open int) int {
 			quote = ch
 			continue
 		}
-		if ch == '(' {
+		if ch == opener {
 			depth++
 			continue
 		}
-		if ch == ')' {
+		if ch == closer {
 			depth--
 			if depth == 0 {
 				return i
@@ -5898,8 +6304,10 @@ func containsCondition(conditions []Condition, condition Condition) bool {
 	return false
 }
 
+// conditionKey identifies a condition by its field, operator and value, so that a
+// condition the fallback finds again is not reported twice.
 func conditionKey(condition Condition) string {
-	return fmt.Sprintf("%t|%s|%s|%s|%s|%s", condition.IsComputed, strings.ToLower(condition.Field), condition.Operator, condition.Value, condition.ValueReference, strings.Join(condition.Alternatives, "\x00"))
+	return fmt.Sprintf("%s|%s|%s", strings.ToLower(condition.Field), condition.Operator, condition.Value)
 }
 
 func appendUnique(values []string, value string) []string {
@@ -6045,8 +6453,9 @@ func parseStringLiteral(raw string) (string, string, bool) {
 			continue
 		}
 		if !verbatim && ch == '\\' && i+1 < len(raw) {
-			i++
-			b.WriteByte(raw[i])
+			decoded, next := decodeEscape(raw, i)
+			b.WriteString(decoded)
+			i = next - 1
 			continue
 		}
 		if ch == quote {
@@ -6168,25 +6577,101 @@ func compactKeyword(query string) string {
 	return compact
 }
 
-func extractExpressionListValues(ctx IExpressionListContext) []string {
-	if ctx == nil {
-		return nil
+// letValue returns what text is bound to when it names a scalar let of the query,
+// like procs in let procs = dynamic(["a.exe", "b.exe"]).
+func (e *conditionExtractor) letValue(text string) (letValue, bool) {
+	text = strings.TrimSpace(text)
+	if !isSimpleIdentifier(text) {
+		return letValue{}, false
 	}
+	value, ok := e.cfg.letValues[text]
+	return value, ok
+}
 
-	var values []string
-	for _, expr := range ctx.AllExpression() {
-		values = append(values, extractValue(expr.GetText()))
+// setValue sets the value of cond from the expression node. A name bound by a
+// scalar let is replaced by its values, and kept in ValueReference.
+func (e *conditionExtractor) setValue(cond *Condition, node antlr.ParseTree) {
+	text := node.GetText()
+	if bound, ok := e.letValue(text); ok {
+		cond.Value = bound.values[0]
+		cond.ValueReference = strings.TrimSpace(text)
+		cond.Literal = bound.literal
+		cond.RawValue = rawStringValue(bound.literal)
+		if len(bound.values) > 1 {
+			cond.Alternatives = bound.values
+		}
+		return
 	}
-	return values
+	cond.Literal = e.literalOf(node)
+	cond.Value = literalValue(extractValue(text), cond.Literal)
+	cond.RawValue = rawStringValue(cond.Literal)
+}
+
+// rawStringValue returns the text of a string literal as written, or "" for other
+// values.
+func rawStringValue(lit *Literal) string {
+	if lit == nil || lit.Kind != LiteralString {
+		return ""
+	}
+	return lit.Text
+}
+
+// literalValue returns the decoded value of a string literal read from the original
+// query, or value, the text the parser saw, for other values. Normalization rewrites
+// text inside strings too, as in "a | filter b".
+func literalValue(value string, lit *Literal) string {
+	if lit == nil || lit.Kind != LiteralString {
+		return value
+	}
+	if s, ok := lit.Value.(string); ok {
+		return s
+	}
+	return value
+}
+
+// expressionListValues returns the values of an in() or has_any() list with let
+// references expanded, and the literal of each value where it is one. reference
+// is the name of the list when it is a single identifier, like procs in
+// FileName in~ (procs).
+func (e *conditionExtractor) expressionListValues(ctx IExpressionListContext) (values []string, literals []*Literal, reference string) {
+	if ctx == nil {
+		return nil, nil, ""
+	}
+	exprs := ctx.AllExpression()
+	for _, expr := range exprs {
+		text := expr.GetText()
+		if bound, ok := e.letValue(text); ok {
+			values = append(values, bound.values...)
+			for range bound.values {
+				literals = append(literals, bound.element())
+			}
+			continue
+		}
+		lit := e.literalOf(expr)
+		values = append(values, literalValue(extractValue(text), lit))
+		literals = append(literals, lit)
+	}
+	if len(exprs) == 1 && isSimpleIdentifier(exprs[0].GetText()) {
+		reference = exprs[0].GetText()
+	}
+	return values, literals, reference
 }
 
 // groupORConditions groups consecutive OR conditions on the same field
 func groupORConditions(conditions []Condition) []Condition {
+	result, _ := groupORConditionsIndexed(conditions)
+	return result
+}
+
+// groupORConditionsIndexed is groupORConditions that also returns, for each input
+// condition, the index of the output condition it became part of.
+func groupORConditionsIndexed(conditions []Condition) ([]Condition, []int) {
 	if len(conditions) == 0 {
-		return conditions
+		return conditions, nil
 	}
 
 	result := make([]Condition, 0, len(conditions))
+	mapping := make([]int, len(conditions))
 
 	for i := 0; i < len(conditions); i++ {
 		cond := conditions[i]
@@ -6194,12 +6679,14 @@ func groupORConditions(conditions []Condition) []Condition {
 		// Look ahead for OR conditions on the same field
 		if i+1 < len(conditions) && conditions[i+1].LogicalOp == "OR" && sameConditionGroup(cond, conditions[i+1]) {
 			alternatives := conditionAlternatives(cond)
+			span := cond.Span
 
 			j := i + 1
 			for j < len(conditions) {
 				next := conditions[j]
 				if next.LogicalOp == "OR" && sameConditionGroup(cond, next) {
 					alternatives = append(alternatives, conditionAlternatives(next)...)
+					span = joinSpans(span, next.Span)
 					j++
 				} else {
 					break
@@ -6208,20 +6695,26 @@ func groupORConditions(conditions []Condition) []Condition {
 
 			if len(alternatives) > 1 {
 				cond.Alternatives = deduplicateConditionValues(alternatives)
+				cond.Span = span
+				for k := i; k < j; k++ {
+					mapping[k] = len(result)
+				}
 				result = append(result, cond)
 				i = j - 1 // skip the grouped conditions
 				continue
 			}
 		}
 
+		mapping[i] = len(result)
 		result = append(result, cond)
 	}
 
-	return result
+	return result, mapping
 }
 
 func sameConditionGroup(a, b Condition) bool {
-	return strings.EqualFold(a.Field, b.Field) &&
+	return a.Scope == b.Scope && a.ScopeName == b.ScopeName &&
+		strings.EqualFold(a.Field, b.Field) &&
 		a.Operator == b.Operator &&
 		a.Negated == b.Negated &&
 		a.IsComputed == b.IsComputed &&
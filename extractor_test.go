@@ -1,6 +1,7 @@
 package kql
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -98,7 +99,7 @@ func TestExtractConditions_StringOperators(t *testing.T) {
 			name:  "startswith operator",
 			query: "SecurityEvent | where FilePath startswith \"C:\\\\Windows\"",
 			expected: []Condition{
-				{Field: "FilePath", Operator: "startswith", Value: "C:\\\\Windows"},
+				{Field: "FilePath", Operator: "startswith", Value: "C:\\Windows"},
 			},
 		},
 		{
@@ -478,6 +479,123 @@ func TestExtractConditions_ExtendedFields(t *testing.T) {
 	}
 }
 
+func TestExtractConditions_ParseOperator(t *testing.T) {
+	query := `Syslog
+		| parse SyslogMessage with "Failed password for " User " from " IP " port " Port:int
+		| parse-kv EventData as (Action:string) with (pair_delimiter=";")
+		| where User == "root" and Port > 1024 and Action == "deny"`
+
+	result := ExtractConditionsWithOptions(query, Options{DisablePortableFallback: true})
+	for _, field := range []string{"user", "ip", "port"} {
+		if result.ComputedFields[field] != "SyslogMessage" {
+			t.Errorf("expected %s to be computed from SyslogMessage, got %q", field, result.ComputedFields[field])
+		}
+	}
+	if result.ComputedFields["action"] != "EventData" {
+		t.Errorf("expected Action to be computed from EventData, got %q", result.ComputedFields["action"])
+	}
+	for _, cond := range result.Conditions {
+		if !cond.IsComputed || cond.PipeStage != 2 {
+			t.Errorf("expected a computed condition at stage 2, got %+v", cond)
+		}
+	}
+	for _, l := range result.Lineage {
+		if l.Column == "Port" && (l.Operator != "parse" || l.Type != TypeInt || !reflect.DeepEqual(l.Sources, []string{"SyslogMessage"})) {
+			t.Errorf("unexpected lineage of Port: %+v", l)
+		}
+	}
+	if !reflect.DeepEqual(result.OutputColumns[len(result.OutputColumns)-4:], []OutputColumn{
+		{"User", TypeString}, {"IP", TypeString}, {"Port", TypeInt}, {"Action", TypeString}}) {
+		t.Errorf("expected the parsed columns to be output, got %v", result.OutputColumns)
+	}
+}
+
+func TestExtractConditions_ParseWhereAnchors(t *testing.T) {
+	query := `SecurityEvent | parse-where CommandLine with * "-user " User " -pass " * | where User != "svc"`
+	result := ExtractConditions(query)
+	var anchors []string
+	for _, cond := range result.Conditions {
+		if !cond.Implicit {
+			continue
+		}
+		if cond.Field != "CommandLine" || cond.Operator != "contains_cs" || cond.OperatorKind != OperatorContains ||
+			!cond.CaseSensitive || cond.PipeStage != 0 || cond.Span.Text(query) != `"`+cond.Value+`"` {
+			t.Errorf("unexpected anchor condition %+v", cond)
+		}
+		anchors = append(anchors, cond.Value)
+	}
+	if !reflect.DeepEqual(anchors, []string{"-user ", " -pass "}) {
+		t.Errorf("expected the anchors as implicit conditions, got %v", anchors)
+	}
+
+	// parse does not filter, and regex anchors are not literal text
+	for _, query := range []string{
+		`SecurityEvent | parse CommandLine with * "-user " User | where User != "svc"`,
+		`SecurityEvent | parse-where kind=regex CommandLine with @"-user\s+" User | where User != "svc"`,
+	} {
+		for _, cond := range ExtractConditions(query).Conditions {
+			if cond.Implicit {
+				t.Errorf("%s: unexpected implicit condition %+v", query, cond)
+			}
+		}
+	}
+}
+
+func TestExtractConditions_ParsedColumnsSkipFallback(t *testing.T) {
+	for _, query := range []string{
+		`SecurityEvent | parse CommandLine with * "-user " User | where User != "svc"`,
+		`SecurityEvent | parse-where kind=regex CommandLine with @"user=(\w+)" User | where User != "svc"`,
+		`SecurityEvent | parse-kv EventData as (User:string) | where User != "svc"`,
+	} {
+		result := ExtractConditions(query)
+		if len(result.Conditions) != 1 || result.Conditions[0].Field != "User" || !result.Conditions[0].IsComputed {
+			t.Errorf("%s: expected the computed User condition once, got %+v", query, result.Conditions)
+		}
+		if len(result.Diagnostics) != 0 {
+			t.Errorf("%s: expected no fallback, got %v", query, result.Diagnostics)
+		}
+	}
+
+	// A parse pattern is not a search term
+	result := ExtractConditions(`SecurityEvent | parse kind=regex CommandLine with @"user=(\w+)" User`)
+	if len(result.Conditions) != 0 || len(result.Diagnostics) != 0 {
+		t.Errorf("expected no conditions, got %+v %v", result.Conditions, result.Diagnostics)
+	}
+}
+
+func TestNormalizeParsePatterns(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{`T | parse Msg with * "user=" User " " Port:int | where x == 1`, `T | parse Msg with * "user=" User: " " Port:int | where x == 1`},
+		{`T | parse-where Msg with "a" A "b" B`, `T | parse-where Msg with "a" A: "b" B:`},
+		{`T | parse kind=regex flags=Ui Msg with @"user=(\w+)" User`, `T | parse kind=regex Msg with @"user=(\w+)" User:`},
+		{`(T | parse Msg with "a" A) | where B == 1`, `(T | parse Msg with "a" A:) | where B == 1`},
+		{`T | parse-kv Msg as (A:string) | extend with_x = 1`, `T | parse-kv Msg as (A:string) | extend with_x = 1`},
+		{`T | where Msg has "| parse x with y"`, `T | where Msg has "| parse x with y"`},
+	}
+	for _, tt := range tests {
+		if got := normalizeParsePatterns(tt.input); got != tt.want {
+			t.Errorf("normalizeParsePatterns(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeMvApplySubquery(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{`T | mv-apply p = Props on (where p.a == 1) | where x == 1`, `T | mv-apply p = Props (DummyTable | where p.a == 1) | where x == 1`},
+		{`T | mv-apply with_itemindex=i p = Props limit 5 on (top 1 by p.a)`, `T | mv-apply p = Props  (DummyTable | top 1 by p.a)`},
+		{`T | mv-apply Limits = Props to typeof(dynamic) on(where Limits > 0)`, `T | mv-apply Limits = Props to typeof(dynamic) (DummyTable | where Limits > 0)`},
+	}
+	for _, tt := range tests {
+		if got := normalizeMvApplySubquery(tt.input); got != tt.want {
+			t.Errorf("normalizeMvApplySubquery(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
 func TestExtractConditions_NotExpression(t *testing.T) {
 	tests := []struct {
 		name          string
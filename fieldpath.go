@@ -0,0 +1,386 @@
+package kql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// FieldPath is the structure of a condition's field: the column holding the value
+// and, for a value inside a dynamic column, the properties and array elements that
+// lead to it. AdditionalFields['my key'][0].name is the column AdditionalFields
+// with the segments my key, 0 and name.
+type FieldPath struct {
+	Root     string        `json:"root"`
+	Segments []PathSegment `json:"segments,omitempty"`
+}
+
+// SegmentKind is the kind of a step of a FieldPath.
+type SegmentKind string
+
+const (
+	SegmentProperty SegmentKind = "property" // A property of a bag: .name or ['name']
+	SegmentIndex    SegmentKind = "index"    // An element of an array: [0], or [-1] counting from the end
+	SegmentWildcard SegmentKind = "wildcard" // Any element or property: [*] of a JSON path, an mv-expand item or a computed index
+)
+
+// PathSegment is a step of a FieldPath.
+type PathSegment struct {
+	Kind     SegmentKind `json:"kind"`
+	Name     string      `json:"name,omitempty"`     // Property name
+	Index    int         `json:"index"`              // Array index of an index segment, 0 for the others
+	Optional bool        `json:"optional,omitempty"` // Reached with ?., which is null rather than an error when there is no such property
+}
+
+// JSONPath returns the path within the root column, like $.a['my key'][0][*].
+func (p FieldPath) JSONPath() string {
+	var b strings.Builder
+	b.WriteByte('$')
+	for _, s := range p.Segments {
+		switch s.Kind {
+		case SegmentProperty:
+			if isValidPropertyKey(s.Name) {
+				b.WriteString("." + s.Name)
+			} else {
+				b.WriteString("['" + strings.ReplaceAll(s.Name, "'", `\'`) + "']")
+			}
+		case SegmentIndex:
+			b.WriteString("[" + strconv.Itoa(s.Index) + "]")
+		case SegmentWildcard:
+			b.WriteString("[*]")
+		}
+	}
+	return b.String()
+}
+
+// String returns the path in KQL notation, like AdditionalFields.a['my key'][0].
+func (p FieldPath) String() string {
+	return p.Root + strings.TrimPrefix(p.JSONPath(), "$")
+}
+
+// field returns the path in the dotted form of condition fields, the one
+// normalization gives bracket access: AdditionalFields.a._my_key_._idx0
+func (p FieldPath) field() string {
+	var b strings.Builder
+	b.WriteString(p.Root)
+	for _, s := range p.Segments {
+		switch s.Kind {
+		case SegmentProperty:
+			if isValidPropertyKey(s.Name) {
+				b.WriteString("." + s.Name)
+			} else {
+				b.WriteString("." + sanitizeIdentifier(s.Name))
+			}
+		case SegmentIndex:
+			if s.Index < 0 {
+				b.WriteString("._idxn" + strconv.Itoa(-s.Index))
+			} else {
+				b.WriteString("._idx" + strconv.Itoa(s.Index))
+			}
+		case SegmentWildcard:
+			b.WriteString("._dyn")
+		}
+	}
+	return b.String()
+}
+
+// dynamicFunctions return their argument as a dynamic value.
+var dynamicFunctions = map[string]bool{
+	"parse_json": true, "parsejson": true, "todynamic": true, "toobject": true,
+}
+
+// conversionFunctions convert a value to another type without changing which one
+// it is, so a converted property is still a condition on the property.
+var conversionFunctions = map[string]bool{
+	"tostring": true, "toint": true, "tolong": true, "toreal": true, "todouble": true,
+	"tobool": true, "toboolean": true, "todatetime": true, "totimespan": true,
+	"toguid": true, "todecimal": true,
+}
+
+// parseFieldPath parses a field as the extractor sees it, the text of an operand
+// in the normalized query, into its path. Dynamic values are looked through:
+// parse_json and todynamic, conversions of a property, extract_json and ?.:
+// tostring(parse_json(AdditionalFields)?.a._idx0) -> AdditionalFields a 0
+// extract_json("$.a[*].b", Data, typeof(string)) -> Data a * b
+// ok is false for other expressions, such as calls of other functions.
+func parseFieldPath(text string) (FieldPath, bool) {
+	open := strings.IndexByte(text, '(')
+	if open < 0 {
+		end := strings.IndexAny(text, ".?")
+		if end < 0 {
+			end = len(text)
+		}
+		root := text[:end]
+		if !isValidFieldName(root) || strings.Contains(root, ".") {
+			return FieldPath{}, false
+		}
+		segments, ok := fieldSegments(text[end:])
+		return FieldPath{Root: root, Segments: segments}, ok
+	}
+	close := findMatchingParen(text, open)
+	if close < 0 {
+		return FieldPath{}, false
+	}
+	name := strings.ToLower(text[:open])
+	args := splitCommaList(text[open+1 : close])
+	rest, ok := fieldSegments(text[close+1:])
+	if !ok || len(args) == 0 {
+		return FieldPath{}, false
+	}
+	var path FieldPath
+	switch {
+	case dynamicFunctions[name] && len(args) == 1:
+		path, ok = parseFieldPath(args[0])
+	case conversionFunctions[name] && len(args) == 1 && len(rest) == 0:
+		// tostring(Account) is not a field of its own, tostring(Bag.Account) is Bag.Account
+		path, ok = parseFieldPath(args[0])
+		ok = ok && len(path.Segments) > 0
+	case (name == "extract_json" || name == "extractjson") && len(args) >= 2:
+		var jsonPath string
+		if jsonPath, ok = unquoteString(args[0]); !ok {
+			return FieldPath{}, false
+		}
+		if path, ok = parseFieldPath(args[1]); !ok {
+			return FieldPath{}, false
+		}
+		var segments []PathSegment
+		if segments, ok = parseJSONPath(jsonPath); ok {
+			path.Segments = append(path.Segments, segments...)
+		}
+	default:
+		return FieldPath{}, false
+	}
+	if !ok {
+		return FieldPath{}, false
+	}
+	path.Segments = append(path.Segments, rest...)
+	return path, true
+}
+
+// fieldSegments parses the properties after the root of a field, where
+// normalization has turned [0] into ._idx0, [-1] into ._idxn1 and a computed
+// index into ._dyn: .a?.b._idx0 -> a, b (optional), 0
+func fieldSegments(text string) ([]PathSegment, bool) {
+	var out []PathSegment
+	for text != "" {
+		optional := strings.HasPrefix(text, "?.")
+		switch {
+		case optional:
+			text = text[2:]
+		case text[0] == '.':
+			text = text[1:]
+		default:
+			return nil, false
+		}
+		end := strings.IndexAny(text, ".?")
+		if end < 0 {
+			end = len(text)
+		}
+		name := text[:end]
+		text = text[end:]
+		if name == "" || strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != "" {
+			return nil, false
+		}
+		segment := PathSegment{Kind: SegmentProperty, Name: name, Optional: optional}
+		if name == "_dyn" {
+			segment = PathSegment{Kind: SegmentWildcard, Optional: optional}
+		} else if index, ok := strings.CutPrefix(name, "_idx"); ok {
+			digits := strings.TrimPrefix(index, "n")
+			if n, err := strconv.Atoi(digits); err == nil && strings.Trim(digits, "0123456789") == "" {
+				if digits != index {
+					n = -n // _idxn1 is [-1]
+				}
+				segment = PathSegment{Kind: SegmentIndex, Index: n, Optional: optional}
+			}
+		}
+		out = append(out, segment)
+	}
+	return out, true
+}
+
+// parseJSONPath parses the JSON path of extract_json into segments:
+// $.a['b c'][0][*] -> a, b c, 0, *
+func parseJSONPath(path string) ([]PathSegment, bool) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, false
+	}
+	path = path[1:]
+	var out []PathSegment
+	for path != "" {
+		switch {
+		case strings.HasPrefix(path, ".."):
+			return nil, false // Recursive descent has no single path
+		case path[0] == '.':
+			end := strings.IndexAny(path[1:], ".[")
+			if end < 0 {
+				end = len(path) - 1
+			}
+			name := path[1 : end+1]
+			path = path[end+1:]
+			switch name {
+			case "":
+				return nil, false
+			case "*":
+				out = append(out, PathSegment{Kind: SegmentWildcard})
+			default:
+				out = append(out, PathSegment{Kind: SegmentProperty, Name: name})
+			}
+		case path[0] == '[':
+			end := findMatchingDelimiter(path, 0, '[', ']')
+			if end < 0 {
+				return nil, false
+			}
+			inner := strings.TrimSpace(path[1:end])
+			path = path[end+1:]
+			if inner == "*" {
+				out = append(out, PathSegment{Kind: SegmentWildcard})
+			} else if n, err := strconv.Atoi(inner); err == nil {
+				out = append(out, PathSegment{Kind: SegmentIndex, Index: n})
+			} else if key, ok := unquoteString(inner); ok {
+				out = append(out, PathSegment{Kind: SegmentProperty, Name: key})
+			} else {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// operandField returns the field an operand of a predicate reads, and its path.
+// Fields read through parse_json, todynamic, a conversion, extract_json or ?. are
+// reported in the dotted form of other fields: parse_json(AdditionalFields)?.a ->
+// AdditionalFields.a. ok is false when the operand is not a field.
+func operandField(operand string) (string, *FieldPath, bool) {
+	path, ok := parseFieldPath(operand)
+	switch {
+	case ok && isValidFieldName(operand):
+		return operand, &path, true
+	case ok:
+		return path.field(), &path, true
+	case isValidFieldName(operand):
+		return operand, nil, true
+	}
+	return "", nil, false
+}
+
+// describePath sets the path of a condition's field, following it to where the
+// value comes from, and attributes conditions on array elements to the array.
+// Property names normalization had to sanitize, like ['my key'], are taken from
+// the original text of the predicate.
+func (e *conditionExtractor) describePath(cond *Condition) {
+	if cond.Path == nil {
+		path, ok := parseFieldPath(cond.Field)
+		if !ok {
+			return
+		}
+		cond.Path = &path
+	}
+	path := *cond.Path
+	path.Segments = append([]PathSegment(nil), path.Segments...)
+	if cond.Span != nil && e.locator != nil {
+		restoreKeys(&path, cond.Span.Text(e.locator.sourceMap.original))
+	}
+	e.attributeElement(cond, path)
+	if resolved, ok := e.resolve(path); ok {
+		path = resolved
+	}
+	cond.Path = &path
+}
+
+// resolve returns where the value at p comes from: the array of an mv-expand or
+// mv-apply item, or the column extend read a dynamic value from, as for P.a after
+// extend P = parse_json(AdditionalFields). ok is false for an element whose path
+// within its array is not known.
+func (e *conditionExtractor) resolve(p FieldPath) (FieldPath, bool) {
+	if _, ok := e.elements[strings.ToLower(p.Root)]; !ok {
+		if expr, ok := e.computedExpressions[strings.ToLower(p.Root)]; ok {
+			if inner, ok := parseFieldPath(expr); ok && !strings.EqualFold(inner.Root, p.Root) {
+				p = FieldPath{Root: inner.Root, Segments: append(inner.Segments, p.Segments...)}
+			}
+		}
+	}
+	if element, ok := e.elements[strings.ToLower(p.Root)]; ok {
+		return element.elementPath(p.Segments)
+	}
+	return p, true
+}
+
+// restoreKeys replaces the names normalization sanitized, like _my_key_ for
+// ['my key'], with the keys of the bracket accesses in text that they stand for.
+func restoreKeys(path *FieldPath, text string) {
+	sanitized := func(name string) bool {
+		return len(name) > 1 && name[0] == '_' && name[len(name)-1] == '_'
+	}
+	var keys []string
+	if sanitized(path.Root) {
+		keys = bracketKeys(text)
+	}
+	for _, s := range path.Segments {
+		if keys == nil && s.Kind == SegmentProperty && sanitized(s.Name) {
+			keys = bracketKeys(text)
+		}
+	}
+	restore := func(name string) string {
+		for _, key := range keys {
+			if !isValidPropertyKey(key) && sanitizeIdentifier(key) == name {
+				return key
+			}
+		}
+		return name
+	}
+	path.Root = restore(path.Root)
+	for i, s := range path.Segments {
+		if s.Kind == SegmentProperty {
+			path.Segments[i].Name = restore(s.Name)
+		}
+	}
+}
+
+// bracketKeys returns the keys of the quoted bracket accesses in text, like my key
+// for ['my key'].
+func bracketKeys(text string) []string {
+	var keys []string
+	for i := 0; i+1 < len(text); i++ {
+		if text[i] != '[' || text[i+1] != '\'' && text[i+1] != '"' {
+			continue
+		}
+		end := findMatchingDelimiter(text, i, '[', ']')
+		if end < 0 {
+			continue
+		}
+		if key, ok := unquoteString(text[i+1 : end]); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// unpackedPaths attributes the main conditions on columns evaluate bag_unpack
+// added to the bag they are properties of, stages being the query's as
+// schema.stages numbers them. A column is taken to come from a bag when it has the
+// bag's column prefix or, for a bag unpacked without a prefix, when the catalog
+// has the table and the column is not one of its own.
+func unpackedPaths(conditions []Condition, stages []pipeStage) {
+	for i := range conditions {
+		cond := &conditions[i]
+		if cond.Scope != ScopeMain || cond.Path == nil || cond.Span == nil || cond.PipeStage >= len(stages) ||
+			cond.Path.Root != fieldRoot(cond.Field) {
+			continue
+		}
+		rel := stages[cond.PipeStage].in
+		if _, found, _ := rel.lookup(cond.Path.Root); found {
+			continue
+		}
+		for j := len(rel.bags) - 1; j >= 0; j-- {
+			bag := rel.bags[j]
+			key, ok := strings.CutPrefix(cond.Path.Root, bag.prefix)
+			if !ok || key == "" || bag.prefix == "" && len(rel.tables) == 0 {
+				continue
+			}
+			segments := append([]PathSegment{{Kind: SegmentProperty, Name: key}}, cond.Path.Segments...)
+			cond.Path = &FieldPath{Root: bag.column, Segments: segments}
+			break
+		}
+	}
+}
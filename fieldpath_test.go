@@ -0,0 +1,116 @@
+package kql
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFieldPath(t *testing.T) {
+	prop := func(name string) PathSegment { return PathSegment{Kind: SegmentProperty, Name: name} }
+	index := func(i int) PathSegment { return PathSegment{Kind: SegmentIndex, Index: i} }
+	wildcard := PathSegment{Kind: SegmentWildcard}
+	optional := PathSegment{Kind: SegmentProperty, Name: "b", Optional: true}
+
+	tests := []struct {
+		text string
+		want FieldPath
+	}{
+		{"EventID", FieldPath{Root: "EventID"}},
+		{"AdditionalFields.a._idx0._idxn1._dyn", FieldPath{"AdditionalFields", []PathSegment{prop("a"), index(0), index(-1), wildcard}}},
+		{"A?.b.c", FieldPath{"A", []PathSegment{optional, prop("c")}}},
+		{"parse_json(AdditionalFields).a", FieldPath{"AdditionalFields", []PathSegment{prop("a")}}},
+		{"todynamic(tostring(X.a)).b", FieldPath{"X", []PathSegment{prop("a"), prop("b")}}},
+		{"tostring(parse_json(X)?.b)", FieldPath{"X", []PathSegment{optional}}},
+		{`extract_json("$.a[*]['b c'][2]",Data,typeof(long))`, FieldPath{"Data", []PathSegment{prop("a"), wildcard, prop("b c"), index(2)}}},
+		{`extractjson("$",parse_json(Data).x)`, FieldPath{"Data", []PathSegment{prop("x")}}},
+	}
+	for _, tt := range tests {
+		got, ok := parseFieldPath(tt.text)
+		if !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFieldPath(%q) = %+v (ok=%v), want %+v", tt.text, got, ok, tt.want)
+		}
+	}
+
+	for _, text := range []string{`tostring(EventID)`, `strlen(X.a)`, `extract_json("$..a",X)`, `X.a+1`, `"text"`} {
+		if got, ok := parseFieldPath(text); ok {
+			t.Errorf("parseFieldPath(%q) = %+v, expected no field", text, got)
+		}
+	}
+}
+
+func TestFieldPathString(t *testing.T) {
+	path := FieldPath{"AdditionalFields", []PathSegment{
+		{Kind: SegmentProperty, Name: "a"}, {Kind: SegmentProperty, Name: "my key"},
+		{Kind: SegmentIndex, Index: -1}, {Kind: SegmentWildcard},
+	}}
+	if got := path.JSONPath(); got != "$.a['my key'][-1][*]" {
+		t.Errorf("JSONPath() = %q", got)
+	}
+	if got := path.String(); got != "AdditionalFields.a['my key'][-1][*]" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := path.field(); got != "AdditionalFields.a._my_key_._idxn1._dyn" {
+		t.Errorf("field() = %q", got)
+	}
+}
+
+func TestFieldPathJSON(t *testing.T) {
+	path := FieldPath{"Targets", []PathSegment{
+		{Kind: SegmentIndex, Index: 0}, {Kind: SegmentProperty, Name: "id"}, {Kind: SegmentIndex, Index: -1},
+	}}
+	data, err := json.Marshal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got FieldPath
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, path) || got.JSONPath() != "$[0].id[-1]" {
+		t.Errorf("expected %+v after a round trip through %s, got %+v", path, data, got)
+	}
+	if !strings.Contains(string(data), `{"kind":"index","index":0}`) {
+		t.Errorf("expected index 0 to be written, got %s", data)
+	}
+}
+
+func TestConditionPaths(t *testing.T) {
+	tests := []struct {
+		query string
+		field string
+		path  string
+	}{
+		{`SecurityEvent | where EventID == 4624`, "EventID", "EventID"},
+		{`AuditLogs | where AdditionalDetails['user agent'][0] has "curl"`, "AdditionalDetails._user_agent_._idx0", "AdditionalDetails['user agent'][0]"},
+		{`AuditLogs | where ['Initiated By'] == "x"`, "_Initiated_By_", "Initiated By"},
+		{`SigninLogs | where parse_json(DeviceDetail).operatingSystem == "Windows"`, "DeviceDetail.operatingSystem", "DeviceDetail.operatingSystem"},
+		{`SigninLogs | where tostring(todynamic(LocationDetails).city) =~ "Paris"`, "LocationDetails.city", "LocationDetails.city"},
+		{`SigninLogs | where extract_json("$.geoCoordinates.latitude", LocationDetails, typeof(real)) > 40`, "LocationDetails.geoCoordinates.latitude", "LocationDetails.geoCoordinates.latitude"},
+		{`SigninLogs | where DeviceDetail?.isCompliant == false`, "DeviceDetail.isCompliant", "DeviceDetail.isCompliant"},
+		{`SigninLogs | where isnotempty(parse_json(DeviceDetail).trustType)`, "DeviceDetail.trustType", "DeviceDetail.trustType"},
+		{`SigninLogs | extend City = tostring(LocationDetails.city) | where City == "Paris"`, "City", "LocationDetails.city"},
+		{`SigninLogs | extend D = parse_json(DeviceDetail) | where D.browser has "Chrome"`, "D.browser", "DeviceDetail.browser"},
+		{`AuditLogs | mv-expand Target = TargetResources | where Target.userPrincipalName has "admin"`, "Target.userPrincipalName", "TargetResources[*].userPrincipalName"},
+		{`SigninLogs | evaluate bag_unpack(DeviceDetail) | where operatingSystem == "Windows"`, "operatingSystem", "DeviceDetail.operatingSystem"},
+		{`SigninLogs | evaluate bag_unpack(DeviceDetail) | where UserPrincipalName has "admin"`, "UserPrincipalName", "UserPrincipalName"},
+		{`MyTable | evaluate bag_unpack(Props, "p_") | where p_Name == "x"`, "p_Name", "Props.Name"},
+	}
+	for _, tt := range tests {
+		result := ExtractConditionsWithOptions(tt.query, Options{DisablePortableFallback: true})
+		if len(result.Conditions) != 1 {
+			t.Errorf("%s: expected one condition, got %+v", tt.query, result.Conditions)
+			continue
+		}
+		cond := result.Conditions[0]
+		if cond.Field != tt.field || cond.Path == nil || cond.Path.String() != tt.path {
+			t.Errorf("%s: expected %s with path %s, got %s with path %v", tt.query, tt.field, tt.path, cond.Field, cond.Path)
+		}
+	}
+
+	result := ExtractConditions(`SigninLogs | where DeviceDetail?.isCompliant == false`)
+	if path := result.Conditions[0].Path; len(path.Segments) != 1 || !path.Segments[0].Optional {
+		t.Errorf("expected an optional segment, got %+v", path)
+	}
+}
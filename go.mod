@@ -2,6 +2,9 @@ module github.com/craftedsignal/kql-parser
 
 go 1.25.0
 
-require github.com/antlr4-go/antlr/v4 v4.13.1
+require (
+	github.com/antlr4-go/antlr/v4 v4.13.1
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require golang.org/x/exp v0.0.0-20260709172345-9ea1abe57597 // indirect
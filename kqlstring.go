@@ -0,0 +1,143 @@
+package kql
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/antlr4-go/antlr/v4"
+)
+
+// unquoteString decodes a KQL string literal: "..." and '...' with backslash
+// escapes, verbatim @"..." and @'...' where a doubled quote stands for one, and
+// multi-line ```...``` and """...""" taken as is. Each form may carry the h or H
+// prefix of obfuscated strings, which only affects logging. ok is false when s is
+// not a single string literal.
+func unquoteString(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == 'h' || s[0] == 'H') && strings.ContainsRune("\"'@`", rune(s[1])) {
+		s = s[1:]
+	}
+	for _, fence := range []string{"```", `"""`} {
+		if len(s) >= 2*len(fence) && strings.HasPrefix(s, fence) && strings.HasSuffix(s, fence) {
+			return s[len(fence) : len(s)-len(fence)], true
+		}
+	}
+
+	verbatim := false
+	if len(s) >= 1 && s[0] == '@' {
+		verbatim = true
+		s = s[1:]
+	}
+	if len(s) < 2 || s[0] != '"' && s[0] != '\'' || s[len(s)-1] != s[0] {
+		return "", false
+	}
+	quote := s[0]
+	body := s[1 : len(s)-1]
+
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		ch := body[i]
+		switch {
+		case verbatim && ch == quote:
+			if i+1 == len(body) || body[i+1] != quote {
+				return "", false
+			}
+			b.WriteByte(quote)
+			i++
+		case !verbatim && ch == quote:
+			return "", false
+		case !verbatim && ch == '\\':
+			decoded, next := decodeEscape(body, i)
+			b.WriteString(decoded)
+			i = next - 1
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String(), true
+}
+
+// decodeEscape decodes the escape sequence starting with the backslash at s[i] and
+// returns it with the index after the sequence. Unknown sequences are kept as
+// written.
+func decodeEscape(s string, i int) (string, int) {
+	if i+1 >= len(s) {
+		return `\`, i + 1
+	}
+	switch c := s[i+1]; c {
+	case 'b':
+		return "\b", i + 2
+	case 't':
+		return "\t", i + 2
+	case 'n':
+		return "\n", i + 2
+	case 'f':
+		return "\f", i + 2
+	case 'r':
+		return "\r", i + 2
+	case '"', '\'', '\\':
+		return string(c), i + 2
+	case 'x', 'u':
+		digits := 2
+		if c == 'u' {
+			digits = 4
+		}
+		if i+2+digits <= len(s) {
+			if code, err := strconv.ParseUint(s[i+2:i+2+digits], 16, 32); err == nil {
+				return string(rune(code)), i + 2 + digits
+			}
+		}
+	}
+	// Keep a multi-byte character after an unknown escape whole
+	_, size := utf8.DecodeRuneInString(s[i+1:])
+	return s[i : i+1+size], i + 1 + size
+}
+
+// stringTokens are the lexer tokens of string literals.
+var stringTokens = map[int]bool{
+	KQLLexerSTRING_LITERAL:   true,
+	KQLLexerVERBATIM_STRING:  true,
+	KQLLexerMULTILINE_STRING: true,
+}
+
+// stripObfuscatedStrings removes the h or H prefix of obfuscated strings like
+// h"secret", which the grammar does not accept. The remaining string maps back to
+// the prefixed literal, so its span and raw text keep the prefix.
+func (r *rewriter) stripObfuscatedStrings() {
+	lexer := NewKQLLexer(antlr.NewInputStream(r.text))
+	lexer.RemoveErrorListeners()
+	runeBytes := runeByteOffsets(r.text)
+
+	var edits []textEdit
+	var prev antlr.Token
+	for {
+		token := lexer.NextToken()
+		if token.GetTokenType() == antlr.TokenEOF {
+			break
+		}
+		if prev != nil && stringTokens[token.GetTokenType()] && isObfuscationPrefix(prev) &&
+			prev.GetStop()+1 == token.GetStart() && token.GetStop()+1 < len(runeBytes) {
+			text := r.text[runeBytes[token.GetStart()]:runeBytes[token.GetStop()+1]]
+			edits = append(edits, textEdit{
+				start:  runeBytes[prev.GetStart()],
+				end:    runeBytes[token.GetStop()+1],
+				pieces: []textPiece{{text: text, from: -1}},
+			})
+		}
+		prev = token
+	}
+	if len(edits) > 0 {
+		r.splice(edits)
+	}
+}
+
+// isObfuscationPrefix reports whether token is the h or H in front of an
+// obfuscated string.
+func isObfuscationPrefix(token antlr.Token) bool {
+	if token.GetTokenType() != KQLLexerIDENTIFIER {
+		return false
+	}
+	text := token.GetText()
+	return text == "h" || text == "H"
+}
@@ -0,0 +1,64 @@
+package kql
+
+import "testing"
+
+func TestUnquoteString(t *testing.T) {
+	tests := map[string]string{
+		`"C:\\Windows"`:      `C:\Windows`,
+		`@"C:\Windows"`:      `C:\Windows`,
+		`'it\'s'`:            `it's`,
+		`@'it''s'`:           `it's`,
+		`"a\tb"`:             "a\tb",
+		`"\x41\u0042"`:       "AB",
+		`"\d+"`:              `\d+`,
+		"```line1\nline2```": "line1\nline2",
+		`h"secret"`:          "secret",
+		`H@"C:\Temp"`:        `C:\Temp`,
+	}
+	for raw, want := range tests {
+		got, ok := unquoteString(raw)
+		if !ok || got != want {
+			t.Errorf("%s: expected %q, got %q (ok %v)", raw, want, got, ok)
+		}
+	}
+
+	for _, raw := range []string{`abc`, `"a" + "b"`, `"unterminated`, `@"a"b"`} {
+		if got, ok := unquoteString(raw); ok {
+			t.Errorf("%s: expected no string, got %q", raw, got)
+		}
+	}
+}
+
+func TestDecodedConditionValues(t *testing.T) {
+	tests := []struct {
+		predicate string
+		value     string
+		raw       string
+	}{
+		{`Path startswith "C:\\Windows\\"`, `C:\Windows\`, `"C:\\Windows\\"`},
+		{`Path startswith @"C:\Windows\"`, `C:\Windows\`, `@"C:\Windows\"`},
+		{`CommandLine has h"mimikatz"`, "mimikatz", `h"mimikatz"`},
+		{`Name == "tab\there"`, "tab\there", `"tab\there"`},
+		{`Name in ("\x41")`, "A", `"\x41"`},
+		// Normalization rewrites text inside strings too
+		{`Msg has "a | filter b"`, "a | filter b", `"a | filter b"`},
+		{`Msg in ("make_set(x)", "y")`, "make_set(x)", `"make_set(x)"`},
+		{`Msg has_any ("a | filter b")`, "a | filter b", `"a | filter b"`},
+	}
+	for _, tt := range tests {
+		result := ExtractConditions("T | where " + tt.predicate)
+		if len(result.Conditions) == 0 {
+			t.Errorf("%s: no condition, errors %v", tt.predicate, result.Errors)
+			continue
+		}
+		cond := result.Conditions[0]
+		if cond.Value != tt.value || cond.RawValue != tt.raw {
+			t.Errorf("%s: expected %q from %s, got %q from %s", tt.predicate, tt.value, tt.raw, cond.Value, cond.RawValue)
+		}
+	}
+
+	result := ExtractConditions("T | where Count == 5")
+	if raw := result.Conditions[0].RawValue; raw != "" {
+		t.Errorf("only strings have a raw value, got %q", raw)
+	}
+}
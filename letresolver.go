@@ -0,0 +1,600 @@
+package kql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/craftedsignal/kql-parser/ast"
+)
+
+// maxInlinedGrowth bounds how many bytes inlineLets may add to a query.
+const maxInlinedGrowth = 64 << 10
+
+// letDefinition is a let statement parsed with the grammar, together with its
+// location in the query it was read from.
+type letDefinition struct {
+	node *ast.LetStatement
+	span Span
+}
+
+// letDefinitions parses every let statement of query, in order. Each statement is
+// parsed on its own, so one malformed let does not hide the others. The parsers
+// stop with a parseCanceled panic once ctx is done.
+func letDefinitions(ctx context.Context, query string) []letDefinition {
+	var defs []letDefinition
+	for _, r := range splitStatementRanges(query) {
+		raw := query[r[0]:r[1]]
+		cleaned := strings.TrimSpace(trimLeadingLineComments(normalizeNewlines(raw)))
+		if _, _, ok := parseLetAssignment(cleaned); !ok {
+			continue
+		}
+		node, _, ok := parseLetStatementNode(ctx, cleaned)
+		if !ok {
+			continue
+		}
+		defs = append(defs, letDefinition{node: node, span: letStatementSpan(raw, r[0])})
+	}
+	return defs
+}
+
+// inlinable reports whether references to the let can be replaced by its body:
+// tabular lets, views and functions, and scalar lets that only name another
+// table, like let Events = SecurityEvent.
+func (d letDefinition) inlinable() bool {
+	switch d.node.Kind {
+	case ast.LetTabular:
+		return true
+	case ast.LetView, ast.LetFunction:
+		return d.node.Body != nil
+	case ast.LetScalar:
+		_, ok := d.node.Value.(*ast.Ident)
+		return ok
+	}
+	return false
+}
+
+// letStatements converts let definitions to the LetStatement values of ParseResult.
+// A name bound more than once is reported for its first definition.
+func letStatements(defs []letDefinition, inlined map[string]bool) []LetStatement {
+	var statements []LetStatement
+	seen := make(map[string]bool)
+	for _, def := range defs {
+		if def.node.Text == "" {
+			continue
+		}
+		key := strings.ToLower(def.node.Name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		span := def.span
+		statements = append(statements, LetStatement{
+			Name:       def.node.Name,
+			Expression: strings.TrimSpace(normalizeNewlines(def.node.Text)),
+			Kind:       def.node.Kind,
+			Parameters: def.node.Parameters,
+			Inlined:    inlined[def.node.Name],
+			Span:       &span,
+		})
+	}
+	return statements
+}
+
+// inlineLets replaces references to inlinable lets in tabular source positions with
+// the let's body in parentheses, so that the conditions of
+//
+//	let Base = SecurityEvent | where EventID == 4688; Base | where ...
+//
+// are found in the main query. The inlined text is recorded as copied from the let
+// body, so spans of its conditions point into the let statement. The parameters of
+// a function are then replaced by the arguments of each call, see bindArguments,
+// as new text standing for the parameter. Lets are inlined in order, each as its own
+// rewrite, so a let that uses an earlier one carries the earlier body along. A
+// call whose arguments do not match the parameters is left in place with a
+// diagnostic, and so is a let whose copies would grow the query past
+// maxInlinedGrowth, as lets referencing each other several times grow it
+// exponentially. defs must have been read from r.text.
+func (r *rewriter) inlineLets(defs []letDefinition) {
+	original := r.text
+	limit := len(original) + maxInlinedGrowth
+	for k, def := range defs {
+		if r.ctx.Err() != nil {
+			return
+		}
+		if !def.inlinable() {
+			continue
+		}
+		spans := letStatementSpans(r.text)
+		if k >= len(spans) {
+			return
+		}
+		span := spans[k]
+		start, end, ok := letBodyRange(r.text, span)
+		if !ok {
+			continue
+		}
+		body := strings.TrimSpace(r.text[start:end])
+		start += strings.Index(r.text[start:end], body)
+
+		scopeEnd := len(r.text)
+		for m := k + 1; m < len(defs) && m < len(spans); m++ {
+			if defs[m].node.Name == def.node.Name {
+				scopeEnd = spans[m].Start
+				break
+			}
+		}
+
+		notInlined := func(format string, args ...any) {
+			d := Diagnostic{
+				Severity: SeverityWarning,
+				Code:     CodeLetNotInlined,
+				Message:  fmt.Sprintf("let %s not inlined: ", def.node.Name) + fmt.Sprintf(format, args...),
+				Span:     &def.span,
+			}
+			d.Line, d.Column = Position(original, def.span.Start)
+			r.diagnostics = append(r.diagnostics, d)
+		}
+
+		params := parameterReferences(body, def.node.Parameters)
+		var edits, substitutions []textEdit
+		size := len(r.text)
+		for _, ref := range tabularReferences(r.text, def.node.Name, span.End, scopeEnd) {
+			bound, err := bindArguments(r.text, def.node.Parameters, ref.args)
+			if err != nil {
+				notInlined("%v", err)
+				continue
+			}
+			// Where the body lands once the edits so far are applied
+			at := ref.span.Start + size - len(r.text) + 1
+			for _, param := range params {
+				substitutions = append(substitutions, textEdit{start: at + param.span.Start, end: at + param.span.End, pieces: []textPiece{
+					{text: bound[param.name], from: -1},
+				}})
+			}
+			edits = append(edits, textEdit{start: ref.span.Start, end: ref.span.End, pieces: []textPiece{
+				{text: "(", from: -1},
+				{text: body, from: start},
+				{text: ")", from: -1},
+			}})
+			size += len(body) + 2 - (ref.span.End - ref.span.Start)
+		}
+		for _, sub := range substitutions {
+			size += len(sub.pieces[0].text) - (sub.end - sub.start)
+		}
+		if size > limit {
+			notInlined("its %d references would grow the query past %d bytes", len(edits), limit)
+			continue
+		}
+		if len(edits) > 0 {
+			r.splice(edits)
+			if len(substitutions) > 0 {
+				r.splice(substitutions)
+			}
+			if r.inlined == nil {
+				r.inlined = make(map[string]bool)
+			}
+			r.inlined[def.node.Name] = true
+		}
+	}
+}
+
+// letStatementSpans returns the spans of the let statements in query, in the same
+// order as letDefinitions, without parsing them.
+func letStatementSpans(query string) []Span {
+	var spans []Span
+	for _, r := range splitStatementRanges(query) {
+		raw := query[r[0]:r[1]]
+		cleaned := strings.TrimSpace(trimLeadingLineComments(normalizeNewlines(raw)))
+		if _, _, ok := parseLetAssignment(cleaned); ok {
+			spans = append(spans, letStatementSpan(raw, r[0]))
+		}
+	}
+	return spans
+}
+
+// letReference is a reference to a let where a table is expected. span includes
+// the argument list of a call, and args holds each argument.
+type letReference struct {
+	span Span
+	args []letArgument
+}
+
+// letArgument is an argument of a call, named when written as name = value.
+type letArgument struct {
+	name string
+	span Span // the value
+}
+
+// tabularReferences returns the references to name in query[from:to] that are in a
+// position where a table is expected: the start of a statement or let body, after
+// join, lookup or union (and their parameters), in a union list, or inside
+// parentheses that are not a function call or an in/has_any list. The argument
+// list that follows is included, as views and functions are called with one.
+func tabularReferences(query, name string, from, to int) []letReference {
+	tokens := defaultTokens(query)
+	runeBytes := runeByteOffsets(query)
+	byteSpan := func(first, last antlr.Token) (Span, bool) {
+		start, stop := first.GetStart(), last.GetStop()+1
+		if start < 0 || stop >= len(runeBytes) {
+			return Span{}, false
+		}
+		return Span{Start: runeBytes[start], End: runeBytes[stop]}, true
+	}
+
+	var refs []letReference
+	for i, token := range tokens {
+		if token.GetText() != name {
+			continue
+		}
+		span, ok := byteSpan(token, token)
+		if !ok || span.Start < from || span.End > to || !isTabularPosition(tokens, i) {
+			continue
+		}
+		ref := letReference{span: span}
+		if i+1 < len(tokens) && tokens[i+1].GetTokenType() == KQLLexerLPAREN {
+			closing := matchingCloseParen(tokens, i+1)
+			if closing < 0 {
+				continue
+			}
+			call, ok := byteSpan(token, tokens[closing])
+			if !ok || call.End > to {
+				continue
+			}
+			ref.span = call
+			for _, arg := range splitArguments(tokens, i+2, closing) {
+				first, last := arg[0], arg[1]
+				var a letArgument
+				if last > first+1 && tokens[first+1].GetTokenType() == KQLLexerASSIGN {
+					a.name = tokens[first].GetText()
+					first += 2
+				}
+				if a.span, ok = byteSpan(tokens[first], tokens[last]); !ok {
+					break
+				}
+				ref.args = append(ref.args, a)
+			}
+			if !ok {
+				continue
+			}
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// defaultTokens returns the tokens of text on the default channel, which leaves out
+// whitespace and comments.
+func defaultTokens(text string) []antlr.Token {
+	lexer := NewKQLLexer(antlr.NewInputStream(text))
+	lexer.RemoveErrorListeners()
+	var tokens []antlr.Token
+	for {
+		token := lexer.NextToken()
+		if token.GetTokenType() == antlr.TokenEOF {
+			break
+		}
+		if token.GetChannel() == antlr.TokenDefaultChannel {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// matchingCloseParen returns the index of the ) that closes the ( at tokens[j], or -1.
+func matchingCloseParen(tokens []antlr.Token, j int) int {
+	depth := 0
+	for ; j < len(tokens); j++ {
+		switch tokens[j].GetTokenType() {
+		case KQLLexerLPAREN:
+			depth++
+		case KQLLexerRPAREN:
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// splitArguments returns the first and last token of each comma-separated argument
+// in tokens[from:to].
+func splitArguments(tokens []antlr.Token, from, to int) [][2]int {
+	var args [][2]int
+	depth, first := 0, from
+	for j := from; j <= to; j++ {
+		if j < to {
+			switch tokens[j].GetTokenType() {
+			case KQLLexerLPAREN, KQLLexerLBRACKET, KQLLexerLBRACE:
+				depth++
+				continue
+			case KQLLexerRPAREN, KQLLexerRBRACKET, KQLLexerRBRACE:
+				depth--
+				continue
+			case KQLLexerCOMMA:
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if j > first {
+			args = append(args, [2]int{first, j - 1})
+		}
+		first = j + 1
+	}
+	return args
+}
+
+// isTabularPosition reports whether tokens[i] stands where a table is expected.
+func isTabularPosition(tokens []antlr.Token, i int) bool {
+	typ := func(j int) int {
+		if j < 0 {
+			return antlr.TokenInvalidType
+		}
+		return tokens[j].GetTokenType()
+	}
+
+	if i+1 < len(tokens) && typ(i+1) == KQLLexerASSIGN {
+		return false // a parameter or column being assigned
+	}
+	switch typ(i - 1) {
+	case antlr.TokenInvalidType, KQLLexerSEMICOLON, KQLLexerLBRACE:
+		return true
+	case KQLLexerASSIGN:
+		// let x = Name
+		return typ(i-3) == KQLLexerLET
+	case KQLLexerLPAREN:
+		switch typ(i - 2) {
+		case antlr.TokenInvalidType, KQLLexerSEMICOLON, KQLLexerLBRACE, KQLLexerLPAREN,
+			KQLLexerTOSCALAR, KQLLexerMATERIALIZE, KQLLexerCOMMA:
+			return true
+		case KQLLexerASSIGN:
+			return typ(i-4) == KQLLexerLET || afterTabularKeyword(tokens, i-2)
+		}
+		return afterTabularKeyword(tokens, i-2)
+	case KQLLexerCOMMA:
+		return inUnionList(tokens, i-1)
+	}
+	return afterTabularKeyword(tokens, i-1)
+}
+
+// afterTabularKeyword reports whether tokens[j] is join, lookup or union, or the
+// last token of their name=value parameters, e.g. the inner of join kind=inner.
+func afterTabularKeyword(tokens []antlr.Token, j int) bool {
+	for j >= 0 {
+		switch tokens[j].GetTokenType() {
+		case KQLLexerJOIN, KQLLexerLOOKUP, KQLLexerUNION:
+			return true
+		}
+		// Step over "name = value" and dotted names like hint.strategy
+		if j < 2 || tokens[j-1].GetTokenType() != KQLLexerASSIGN {
+			return false
+		}
+		j -= 2
+		for j >= 2 && tokens[j-1].GetTokenType() == KQLLexerDOT {
+			j -= 2
+		}
+		if j >= 1 && tokens[j-1].GetTokenType() == KQLLexerHINT_DOT {
+			j--
+		}
+		j--
+	}
+	return false
+}
+
+// inUnionList reports whether the comma at tokens[j] separates the tables of a union.
+func inUnionList(tokens []antlr.Token, j int) bool {
+	for j >= 1 && tokens[j].GetTokenType() == KQLLexerCOMMA {
+		j--
+		if tokens[j].GetTokenType() == KQLLexerRPAREN {
+			if j = matchingOpenParen(tokens, j); j < 0 {
+				return false
+			}
+		}
+		j--
+	}
+	return j >= 0 && afterTabularKeyword(tokens, j)
+}
+
+// matchingOpenParen returns the index of the ( closed by the ) at tokens[j], or -1.
+func matchingOpenParen(tokens []antlr.Token, j int) int {
+	depth := 0
+	for ; j >= 0; j-- {
+		switch tokens[j].GetTokenType() {
+		case KQLLexerRPAREN:
+			depth++
+		case KQLLexerLPAREN:
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// bindArguments returns the text each parameter is replaced by in a call with
+// args, which are read from query: the argument in its position or of its name,
+// or else the parameter's literal default. Arguments are taken as written, in
+// parentheses unless they are a single token or a function call.
+func bindArguments(query string, params []*ast.Parameter, args []letArgument) (map[string]string, error) {
+	if len(args) > len(params) {
+		return nil, fmt.Errorf("a call passes %d arguments, but it takes %d", len(args), len(params))
+	}
+	bound := make(map[string]string, len(params))
+	for i, arg := range args {
+		name := arg.name
+		if name == "" {
+			name = params[i].Name
+		} else if !hasParameter(params, name) {
+			return nil, fmt.Errorf("a call passes %s, which is not a parameter", name)
+		}
+		value := arg.span.Text(query)
+		if tokens := defaultTokens(value); len(tokens) > 1 && !isCall(tokens) {
+			value = "(" + value + ")"
+		}
+		bound[name] = value
+	}
+	for _, param := range params {
+		if _, ok := bound[param.Name]; ok {
+			continue
+		}
+		lit, ok := param.Default.(*ast.Literal)
+		if !ok {
+			return nil, fmt.Errorf("a call passes no value for %s", param.Name)
+		}
+		bound[param.Name] = lit.Text
+	}
+	return bound, nil
+}
+
+func hasParameter(params []*ast.Parameter, name string) bool {
+	for _, param := range params {
+		if param.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isCall reports whether tokens are a single function call, like dynamic([1, 2]).
+func isCall(tokens []antlr.Token) bool {
+	return len(tokens) > 2 && tokens[1].GetTokenType() == KQLLexerLPAREN &&
+		matchingCloseParen(tokens, 1) == len(tokens)-1
+}
+
+// parameterReference is a use of a function parameter in its body.
+type parameterReference struct {
+	name string
+	span Span // within the body
+}
+
+// parameterReferences returns the uses of params in body, in order. A use is a
+// name that is not a property after a dot or a column being assigned.
+func parameterReferences(body string, params []*ast.Parameter) []parameterReference {
+	if len(params) == 0 {
+		return nil
+	}
+	tokens := defaultTokens(body)
+	runeBytes := runeByteOffsets(body)
+	var refs []parameterReference
+	for i, token := range tokens {
+		if !hasParameter(params, token.GetText()) || token.GetStart() < 0 || token.GetStop()+1 >= len(runeBytes) {
+			continue
+		}
+		if i > 0 && tokens[i-1].GetTokenType() == KQLLexerDOT {
+			continue
+		}
+		if i+1 < len(tokens) && tokens[i+1].GetTokenType() == KQLLexerASSIGN {
+			continue
+		}
+		refs = append(refs, parameterReference{
+			name: token.GetText(),
+			span: Span{Start: runeBytes[token.GetStart()], End: runeBytes[token.GetStop()+1]},
+		})
+	}
+	return refs
+}
+
+// letValue is what a scalar let binds: its values as conditions report them and
+// its literal, a dynamic one for a list.
+type letValue struct {
+	values  []string
+	literal *Literal
+}
+
+// element returns the literal of each of the values, which is only known when the
+// let binds a single literal.
+func (v letValue) element() *Literal {
+	if v.literal == nil || v.literal.Kind == LiteralDynamic {
+		return nil
+	}
+	return v.literal
+}
+
+// listLiteral returns the dynamic literal of the values of a list that is not
+// written as one literal, like pack_array(procs, "c.exe"). Its text is the
+// dynamic literal of the values.
+func listLiteral(values []string) *Literal {
+	items := make([]any, len(values))
+	for i, value := range values {
+		items[i] = value
+	}
+	text, _ := json.Marshal(values)
+	return &Literal{Kind: LiteralDynamic, Text: "dynamic(" + string(text) + ")", Value: items}
+}
+
+// scalarLetValues returns the values bound by scalar lets whose right-hand side is a
+// literal or a list of literals, such as dynamic(["a.exe", "b.exe"]), "x", 4688,
+// datetime(2024-01-01) or 1h, keyed by let name. A let that names another such let
+// gets its values, and a later definition of a name replaces an earlier one.
+func scalarLetValues(defs []letDefinition) map[string]letValue {
+	var bound map[string]letValue
+	for _, def := range defs {
+		if def.node.Kind != ast.LetScalar {
+			continue
+		}
+		if ident, ok := def.node.Value.(*ast.Ident); ok {
+			if value, ok := bound[ident.Name]; ok {
+				bound[def.node.Name] = value
+				continue
+			}
+		}
+		values := literalValues(def.node.Value, bound)
+		if len(values) == 0 {
+			delete(bound, def.node.Name)
+			continue
+		}
+		if bound == nil {
+			bound = make(map[string]letValue)
+		}
+		value := letValue{values: values, literal: astLiteral(def.node.Value)}
+		if value.literal == nil {
+			value.literal = listLiteral(values)
+		}
+		bound[def.node.Name] = value
+	}
+	return bound
+}
+
+// literalValues returns the values of a literal expression as extractValue reports
+// them, with lists flattened, or nil when expr is not made of literals.
+func literalValues(expr ast.Expr, bound map[string]letValue) []string {
+	switch x := expr.(type) {
+	case *ast.Literal:
+		switch x.Kind {
+		case ast.NullLiteral:
+			return nil
+		case ast.DynamicLiteral:
+			values, _ := parseDynamicList(x.Text)
+			return values
+		}
+		return []string{extractValue(x.Text)}
+	case *ast.UnaryExpr:
+		if lit, ok := x.X.(*ast.Literal); ok && x.Op == "-" && (lit.Kind == ast.LongLiteral || lit.Kind == ast.RealLiteral || lit.Kind == ast.DecimalLiteral) {
+			return []string{"-" + lit.Text}
+		}
+	case *ast.ParenExpr:
+		return literalValues(x.X, bound)
+	case *ast.Ident:
+		return bound[x.Name].values
+	case *ast.ArrayExpr:
+		var values []string
+		for _, elem := range x.Elems {
+			elemValues := literalValues(elem, bound)
+			if elemValues == nil {
+				return nil
+			}
+			for _, value := range elemValues {
+				values = appendUnique(values, value)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package kql
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/craftedsignal/kql-parser/ast"
+)
+
+func TestInlineTabularLets(t *testing.T) {
+	query := `let Base = SecurityEvent | where EventID == 4688;
+let Recent = view () { Base | where Account != "SYSTEM" };
+Recent
+| join kind=inner (Base | where Image has "cmd") on Computer
+| where Process == "x"`
+
+	result := ExtractConditions(query)
+	if len(result.Errors) > 0 {
+		t.Fatalf("unexpected errors: %v", result.Errors)
+	}
+
+	want := map[string]string{
+		"EventID": "EventID == 4688",
+		"Account": `Account != "SYSTEM"`,
+		"Process": `Process == "x"`,
+	}
+	for _, cond := range result.Conditions {
+		text, ok := want[cond.Field]
+		if !ok {
+			continue
+		}
+		delete(want, cond.Field)
+		if cond.Scope != ScopeMain {
+			t.Errorf("%s: expected the main scope, got %s", cond.Field, cond.Scope)
+		}
+		if cond.Span == nil || cond.Span.Text(query) != text {
+			t.Errorf("%s: expected span %q, got %+v", cond.Field, text, cond.Span)
+		}
+	}
+	for field := range want {
+		t.Errorf("expected a %s condition in Conditions, got %+v", field, result.Conditions)
+	}
+
+	var image bool
+	for _, cond := range result.ScopedConditions {
+		if cond.Scope == ScopeLet {
+			t.Errorf("inlined lets should not be reported again, got %+v", cond)
+		}
+		image = image || cond.Field == "Image" && cond.Scope == ScopeJoin
+	}
+	if !image {
+		t.Errorf("expected the Image filter in the join scope, got %+v", result.ScopedConditions)
+	}
+
+	if len(result.LetStatements) != 2 {
+		t.Fatalf("expected 2 let statements, got %+v", result.LetStatements)
+	}
+	for i, kind := range []ast.LetKind{ast.LetTabular, ast.LetView} {
+		let := result.LetStatements[i]
+		if let.Kind != kind || !let.Inlined {
+			t.Errorf("%s: expected an inlined %s let, got kind %s inlined %v", let.Name, kind, let.Kind, let.Inlined)
+		}
+	}
+}
+
+func TestLetsThatAreNotInlined(t *testing.T) {
+	query := `let ids = dynamic([4624, 4625]);
+let f = (id:int) { SecurityEvent | where EventID == id };
+let Admins = IdentityInfo | where Role == "admin" | project Account;
+f(4624, 1)
+| where Account in (Admins) and EventID in (ids)
+| extend Admins = 1`
+
+	result := ExtractConditions(query)
+
+	lets := make(map[string]LetStatement)
+	for _, let := range result.LetStatements {
+		lets[let.Name] = let
+	}
+	if let := lets["ids"]; let.Kind != ast.LetScalar || let.Inlined {
+		t.Errorf("ids: expected a scalar let that is not inlined, got %+v", let)
+	}
+	if let := lets["f"]; let.Kind != ast.LetFunction || let.Inlined || len(let.Parameters) != 1 || let.Parameters[0].Name != "id" {
+		t.Errorf("f: expected a function let with parameter id that is not inlined, got %+v", let)
+	}
+	if d := result.DiagnosticsWithCode(CodeLetNotInlined); len(d) != 1 || d[0].Message != "let f not inlined: a call passes 2 arguments, but it takes 1" {
+		t.Errorf("f: expected the extra argument to be reported, got %+v", d)
+	}
+	if let := lets["Admins"]; let.Inlined {
+		t.Errorf("Admins is only used in an in() list and should not be inlined")
+	}
+
+	for _, cond := range result.Conditions {
+		if cond.Field == "Role" {
+			t.Errorf("Role should stay in the let scope, got %+v", cond)
+		}
+	}
+}
+
+func TestInlinedFunctionArguments(t *testing.T) {
+	query := `let f = (n:string) { SigninLogs | where Account == n };
+f("bob")`
+	result := ExtractConditions(query)
+	if !reflect.DeepEqual(result.DataSources, []string{"SigninLogs"}) || len(result.Conditions) != 1 {
+		t.Fatalf("expected the function body to be inlined, got %v %+v", result.DataSources, result.Conditions)
+	}
+	cond := result.Conditions[0]
+	if cond.Field != "Account" || cond.Value != "bob" || cond.Span == nil || cond.Span.Start != strings.Index(query, "Account") {
+		t.Errorf("expected Account == bob pointing into the let body, got %+v", cond)
+	}
+	if len(result.LetStatements) != 1 || !result.LetStatements[0].Inlined {
+		t.Errorf("expected f to be inlined, got %+v", result.LetStatements)
+	}
+
+	query = `let f = (n:string, m:int = 5, k:long = 0) { SigninLogs | where Account == n and Count > m and Total > k };
+f(k = 1 + 2, n = "bob")`
+	result = ExtractConditions(query)
+	got := make(map[string]string)
+	for _, cond := range result.Conditions {
+		got[cond.Field] = cond.Value
+	}
+	if want := map[string]string{"Account": "bob", "Count": "5", "Total": "(1+2)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected named arguments and defaults to be bound, got %v", got)
+	}
+}
+
+func TestInlinedExternalData(t *testing.T) {
+	query := `let IPs = externaldata(ip:string, country:string) [@"https://example.com/ips.csv"] with (format="csv");
+IPs | where country == "RU"`
+
+	result := ExtractConditions(query)
+	if len(result.DataSources) != 0 {
+		t.Errorf("externaldata is not a table, got data sources %v", result.DataSources)
+	}
+	if len(result.Conditions) != 1 || result.Conditions[0].Field != "country" {
+		t.Errorf("expected the country condition, got %+v", result.Conditions)
+	}
+}
+
+func TestNestedLetsStopInlining(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("let A0 = SecurityEvent | where EventID == 4624;\n")
+	for i := 1; i <= 16; i++ {
+		fmt.Fprintf(&b, "let A%d = union A%d, A%d;\n", i, i-1, i-1)
+	}
+	b.WriteString("A16 | where Account == \"admin\"")
+	query := b.String()
+
+	r := normalizeWithSourceMap(context.Background(), query, defaultConfig)
+	if len(r.text) > len(query)+maxInlinedGrowth {
+		t.Errorf("expected inlining to add at most %d bytes, got %d", maxInlinedGrowth, len(r.text)-len(query))
+	}
+	if len(r.diagnostics) == 0 || r.diagnostics[0].Code != CodeLetNotInlined || r.diagnostics[0].Line == 0 {
+		t.Errorf("expected a let_not_inlined diagnostic, got %+v", r.diagnostics)
+	}
+	if !r.inlined["A16"] {
+		t.Errorf("expected the lets after the one left in place to be inlined, got %v", r.inlined)
+	}
+}
+
+func TestTabularReferences(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"let B = T; B | where x == 1", []string{"B"}},
+		{"let B = T; X | join kind=leftouter hint.strategy=shuffle B on k", []string{"B"}},
+		{"let B = T; X | lookup (B) on k", []string{"B"}},
+		{"let B = T; union A, (B), B", []string{"B", "B"}},
+		{"let B = view () { T }; B() | count", []string{"B()"}},
+		{"let B = (n:int) { T }; union (B(1)), B(f(2), 3)", []string{"B(1)", "B(f(2), 3)"}},
+		{"let B = T; X | where B == 1 | extend B = 1 | project B", nil},
+		{"let B = T; X | where k in (B) or f(B) > 1", nil},
+	}
+	for _, tt := range tests {
+		spans := letStatementSpans(tt.query)
+		var got []string
+		for _, ref := range tabularReferences(tt.query, "B", spans[0].End, len(tt.query)) {
+			got = append(got, ref.span.Text(tt.query))
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: expected references %q, got %q", tt.query, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q: expected references %q, got %q", tt.query, tt.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestParseQueryKeepsLets(t *testing.T) {
+	q, errs := ParseQuery("let Base = SecurityEvent | where EventID == 4688;\nBase | where Account == \"a\"")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if q.Body == nil || q.Body.Source == nil {
+		t.Fatalf("expected a query body, got %+v", q.Body)
+	}
+	if table, ok := q.Body.Source.(*ast.TableSource); !ok || table.Name != "Base" {
+		t.Errorf("expected the body to read from Base, got %#v", q.Body.Source)
+	}
+}
+
+func TestScalarLetValues(t *testing.T) {
+	query := `let procs = dynamic(["a.exe", "b.exe"]);
+let more = pack_array(procs, "c.exe");
+let id = 4688;
+let start = datetime(2024-01-01);
+DeviceProcessEvents
+| where FileName in~ (procs) and EventID == id and Cmd has_any (more)
+| where Time between (start .. now())
+| join (T | where Name !in (procs)) on X`
+
+	result := ExtractConditionsWithOptions(query, Options{IncludeSubqueryConditions: true})
+
+	type want struct {
+		value        string
+		alternatives int
+		reference    string
+	}
+	wants := map[string]want{
+		"FileName": {"a.exe", 2, "procs"},
+		"EventID":  {"4688", 0, "id"},
+		"Cmd":      {"a.exe", 3, "more"},
+		"Name":     {"a.exe", 2, "procs"},
+	}
+	for _, cond := range result.Conditions {
+		if cond.Field == "Time" && cond.Operator == ">=" {
+			if cond.Value != "datetime(2024-01-01)" || cond.ValueReference != "start" {
+				t.Errorf("Time: expected the start bound resolved, got %+v", cond)
+			}
+		}
+		w, ok := wants[cond.Field]
+		if !ok {
+			continue
+		}
+		delete(wants, cond.Field)
+		if cond.Value != w.value || len(cond.Alternatives) != w.alternatives || cond.ValueReference != w.reference {
+			t.Errorf("%s: expected %s with %d alternatives referencing %s, got %+v", cond.Field, w.value, w.alternatives, w.reference, cond)
+		}
+		if cond.Field == "FileName" || cond.Field == "Name" {
+			if lit := cond.Literal; lit == nil || lit.Kind != LiteralDynamic || lit.Text != `dynamic(["a.exe", "b.exe"])` ||
+				!reflect.DeepEqual(lit.Value, []any{"a.exe", "b.exe"}) {
+				t.Errorf("%s: expected the list procs binds as literal, got %+v", cond.Field, cond.Literal)
+			}
+		}
+	}
+	for field := range wants {
+		t.Errorf("expected a %s condition, got %+v", field, result.Conditions)
+	}
+
+	result = ExtractConditions(`let more = pack_array("a.exe", 4688); T | where FileName in (more)`)
+	if len(result.Conditions) != 1 {
+		t.Fatalf("expected one condition, got %+v", result.Conditions)
+	}
+	if lit := result.Conditions[0].Literal; lit == nil || lit.Kind != LiteralDynamic || !reflect.DeepEqual(lit.Value, []any{"a.exe", "4688"}) {
+		t.Errorf("expected a list literal of the values more binds, got %+v", lit)
+	}
+}
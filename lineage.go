@@ -0,0 +1,224 @@
+package kql
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/craftedsignal/kql-parser/ast"
+)
+
+// ColumnLineage describes a column output by a pipe stage: the columns of the
+// stage's input it is computed from and, following those back through earlier
+// stages, the columns of the data sources it derives from. Columns a stage passes
+// through unchanged are not listed; those it drops are listed with Removed set.
+type ColumnLineage struct {
+	Column     string     `json:"column"`
+	PipeStage  int        `json:"pipe_stage"`
+	Operator   string     `json:"operator"`             // extend, project, project-rename, project-away, summarize, mv-expand, parse or parse-where
+	Removed    bool       `json:"removed,omitempty"`    // The stage drops the column, as project-away does
+	Type       ColumnType `json:"type,omitempty"`       // Result type, when the catalog and the function signatures tell
+	Expression string     `json:"expression,omitempty"` // Defining expression as written; the whole operator for parse
+	Inputs     []string   `json:"inputs,omitempty"`     // Columns of the stage's input the column is computed from
+	Sources    []string   `json:"sources,omitempty"`    // Data source columns the column derives from, sorted
+}
+
+// lineageBuilder follows the columns of a pipeline. live maps each column defined
+// so far to its data source columns; other names are taken to be source columns.
+type lineageBuilder struct {
+	scalars map[string]bool // scalar lets, which are not columns
+	stages  []pipeStage
+	index   map[ast.Operator]int // operator -> position in stages
+	live    map[string][]string
+	out     []ColumnLineage
+}
+
+// queryLineage returns the lineage of the columns output by the stages of body,
+// including those of a subquery source such as an inlined let. stages are the
+// query's, as schema.stages numbers them, and give the columns' types.
+func queryLineage(body *ast.TabularExpression, lets []letDefinition, stages []pipeStage) []ColumnLineage {
+	b := &lineageBuilder{
+		scalars: make(map[string]bool),
+		stages:  stages,
+		index:   make(map[ast.Operator]int, len(stages)),
+		live:    make(map[string][]string),
+	}
+	for _, def := range lets {
+		if def.node.Kind == ast.LetScalar {
+			b.scalars[def.node.Name] = true
+		}
+	}
+	for i, stage := range stages {
+		b.index[stage.op] = i
+	}
+	b.pipeline(body)
+	return b.out
+}
+
+func (b *lineageBuilder) pipeline(body *ast.TabularExpression) {
+	if src, ok := body.Source.(*ast.SubquerySource); ok && src.Query != nil {
+		b.pipeline(src.Query)
+	}
+	for _, op := range body.Operators {
+		b.operator(op)
+	}
+}
+
+func (b *lineageBuilder) operator(op ast.Operator) {
+	switch o := op.(type) {
+	case *ast.ExtendOperator:
+		// Columns of an extend can use those defined before them in the same extend.
+		for _, col := range o.Columns {
+			if name := col.OutputName(); name != "" {
+				b.live[name] = b.define(op, name, col.Expr, col.Text)
+			}
+		}
+	case *ast.ProjectOperator:
+		b.replace(op, o.Columns)
+	case *ast.SummarizeOperator:
+		columns := append([]*ast.Column(nil), o.By...)
+		for _, col := range o.Aggregates {
+			if col.Name == "" {
+				col = &ast.Column{Name: aggregateName(col.Expr), Expr: col.Expr, Text: col.Text}
+			}
+			columns = append(columns, col)
+		}
+		b.replace(op, columns)
+	case *ast.ProjectRenameOperator:
+		renamed := make(map[string][]string, len(o.Columns))
+		for _, col := range o.Columns {
+			renamed[col.Name] = b.define(op, col.Name, col.Expr, "")
+		}
+		for _, col := range o.Columns {
+			delete(b.live, col.Expr.(*ast.Ident).Name)
+		}
+		for name, sources := range renamed {
+			b.live[name] = sources
+		}
+	case *ast.ProjectAwayOperator:
+		b.remove(op, o.Columns)
+	case *ast.MvExpandOperator:
+		for _, item := range o.Items {
+			if name := item.OutputName(); name != "" {
+				b.live[name] = b.define(op, name, item.Expr, item.Text)
+			}
+		}
+	case *ast.ParseOperator:
+		for _, item := range o.Pattern {
+			if item.Column != "" {
+				b.live[item.Column] = b.define(op, item.Column, o.Expr, o.Text)
+			}
+		}
+	case *ast.ParseKvOperator:
+		for _, item := range o.Columns {
+			b.live[item.Column] = b.define(op, item.Column, o.Expr, o.Text)
+		}
+	case *ast.GenericOperator:
+		if replacingOperators[o.Keyword] {
+			b.live = make(map[string][]string)
+		}
+	}
+}
+
+// remove records the columns of the stage's input that match patterns as
+// dropped. A name that is not a pattern is dropped even if the input is not
+// known to have it.
+func (b *lineageBuilder) remove(op ast.Operator, patterns []string) {
+	stage := b.index[op]
+	var candidates []string
+	for _, col := range b.stages[stage].in.columns {
+		candidates = append(candidates, col.Name)
+	}
+	live := make([]string, 0, len(b.live))
+	for name := range b.live {
+		live = append(live, name)
+	}
+	sort.Strings(live)
+	candidates = append(candidates, live...)
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "*") {
+			candidates = append(candidates, pattern)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range candidates {
+		if seen[name] || !matchesAnyPattern(name, patterns) {
+			continue
+		}
+		seen[name] = true
+		entry := ColumnLineage{Column: name, PipeStage: stage, Operator: op.Name(), Removed: true, Inputs: []string{name}}
+		if col, ok := b.stages[stage].in.column(name); ok {
+			entry.Type = col.Type
+		}
+		entry.Sources = b.live[name]
+		if _, ok := b.live[name]; !ok {
+			entry.Sources = []string{name}
+		}
+		b.out = append(b.out, entry)
+		delete(b.live, name)
+	}
+}
+
+// replace records the columns of an operator that outputs only them.
+func (b *lineageBuilder) replace(op ast.Operator, columns []*ast.Column) {
+	live := make(map[string][]string, len(columns))
+	for _, col := range columns {
+		name := col.OutputName()
+		if name == "" {
+			name = binnedColumn(col.Expr)
+		}
+		if name != "" {
+			live[name] = b.define(op, name, col.Expr, col.Text)
+		}
+	}
+	b.live = live
+}
+
+// define records the lineage of a column computed by expr and returns its sources.
+// A plain column reference has no expression of its own.
+func (b *lineageBuilder) define(op ast.Operator, name string, expr ast.Expr, text string) []string {
+	stage := b.index[op]
+	entry := ColumnLineage{Column: name, PipeStage: stage, Operator: op.Name(), Inputs: b.inputs(expr)}
+	if col, ok := b.stages[stage].out.column(name); ok {
+		entry.Type = col.Type
+	}
+	if _, plain := expr.(*ast.Ident); !plain {
+		entry.Expression = text
+	}
+	seen := make(map[string]bool)
+	for _, input := range entry.Inputs {
+		sources, ok := b.live[input]
+		if !ok {
+			sources = []string{input}
+		}
+		for _, source := range sources {
+			if !seen[source] {
+				seen[source] = true
+				entry.Sources = append(entry.Sources, source)
+			}
+		}
+	}
+	sort.Strings(entry.Sources)
+	b.out = append(b.out, entry)
+	return entry.Sources
+}
+
+// inputs returns the columns expr reads, in order of appearance. Subqueries read
+// other tables and are skipped.
+func (b *lineageBuilder) inputs(expr ast.Expr) []string {
+	var out []string
+	seen := make(map[string]bool)
+	ast.Inspect(expr, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ToScalarExpr, *ast.SubqueryExpr:
+			return false
+		case *ast.Ident:
+			if !b.scalars[n.Name] && !seen[n.Name] {
+				seen[n.Name] = true
+				out = append(out, n.Name)
+			}
+		}
+		return true
+	})
+	return out
+}
@@ -0,0 +1,96 @@
+package kql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineage(t *testing.T) {
+	query := "let n = 5;\nSecurityEvent" +
+		" | extend Cmd = tolower(CommandLine), L = strlen(Cmd) + n" +
+		" | project-rename Command = Cmd" +
+		" | project Command, L, Computer" +
+		" | summarize Count = count(), dcount(L), make_set(Command) by bin(TimeGenerated, 1h), Host = Computer"
+	want := []ColumnLineage{
+		{Column: "Cmd", PipeStage: 0, Operator: "extend", Type: TypeString, Expression: "tolower(CommandLine)", Inputs: []string{"CommandLine"}, Sources: []string{"CommandLine"}},
+		{Column: "L", PipeStage: 0, Operator: "extend", Type: TypeLong, Expression: "strlen(Cmd) + n", Inputs: []string{"Cmd"}, Sources: []string{"CommandLine"}},
+		{Column: "Command", PipeStage: 1, Operator: "project-rename", Type: TypeString, Inputs: []string{"Cmd"}, Sources: []string{"CommandLine"}},
+		{Column: "Command", PipeStage: 2, Operator: "project", Type: TypeString, Inputs: []string{"Command"}, Sources: []string{"CommandLine"}},
+		{Column: "L", PipeStage: 2, Operator: "project", Type: TypeLong, Inputs: []string{"L"}, Sources: []string{"CommandLine"}},
+		{Column: "Computer", PipeStage: 2, Operator: "project", Type: TypeString, Inputs: []string{"Computer"}, Sources: []string{"Computer"}},
+		{Column: "TimeGenerated", PipeStage: 3, Operator: "summarize", Expression: "bin(TimeGenerated, 1h)", Inputs: []string{"TimeGenerated"}, Sources: []string{"TimeGenerated"}},
+		{Column: "Host", PipeStage: 3, Operator: "summarize", Type: TypeString, Inputs: []string{"Computer"}, Sources: []string{"Computer"}},
+		{Column: "Count", PipeStage: 3, Operator: "summarize", Type: TypeLong, Expression: "count()"},
+		{Column: "dcount_L", PipeStage: 3, Operator: "summarize", Type: TypeLong, Expression: "dcount(L)", Inputs: []string{"L"}, Sources: []string{"CommandLine"}},
+		{Column: "set_Command", PipeStage: 3, Operator: "summarize", Type: TypeDynamic, Expression: "make_set(Command)", Inputs: []string{"Command"}, Sources: []string{"CommandLine"}},
+	}
+	if got := ExtractConditions(query).Lineage; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected lineage:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestLineageExpandAndProjectAway(t *testing.T) {
+	query := "SigninLogs | mv-expand Policy = ConditionalAccessPolicies" +
+		" | extend P = tostring(Policy.displayName) | project-away Policy*" +
+		" | extend Q = strcat(P, Policy)"
+	got := ExtractConditions(query).Lineage
+	if len(got) != 4 {
+		t.Fatalf("expected four columns, got %+v", got)
+	}
+	if got[1].Column != "P" || !reflect.DeepEqual(got[1].Sources, []string{"ConditionalAccessPolicies"}) {
+		t.Errorf("expected P to derive from the expanded array, got %+v", got[1])
+	}
+	removed := ColumnLineage{Column: "Policy", PipeStage: 2, Operator: "project-away", Removed: true, Type: TypeDynamic,
+		Inputs: []string{"Policy"}, Sources: []string{"ConditionalAccessPolicies"}}
+	if !reflect.DeepEqual(got[2], removed) {
+		t.Errorf("expected Policy to be removed, got %+v", got[2])
+	}
+	// Policy was projected away, so a later column of that name is a source column.
+	if !reflect.DeepEqual(got[3].Sources, []string{"ConditionalAccessPolicies", "Policy"}) {
+		t.Errorf("unexpected sources after project-away: %+v", got[3])
+	}
+}
+
+func TestLineageProjectAway(t *testing.T) {
+	query := "SigninLogs | extend Country = tostring(LocationDetails.countryOrRegion)" +
+		" | project-away Loc*, Country, Missing"
+	want := []ColumnLineage{
+		{Column: "Country", PipeStage: 0, Operator: "extend", Type: TypeString, Expression: "tostring(LocationDetails.countryOrRegion)",
+			Inputs: []string{"LocationDetails"}, Sources: []string{"LocationDetails"}},
+		{Column: "Location", PipeStage: 1, Operator: "project-away", Removed: true, Type: TypeString, Inputs: []string{"Location"}, Sources: []string{"Location"}},
+		{Column: "LocationDetails", PipeStage: 1, Operator: "project-away", Removed: true, Type: TypeDynamic, Inputs: []string{"LocationDetails"}, Sources: []string{"LocationDetails"}},
+		{Column: "Country", PipeStage: 1, Operator: "project-away", Removed: true, Type: TypeString, Inputs: []string{"Country"}, Sources: []string{"LocationDetails"}},
+		{Column: "Missing", PipeStage: 1, Operator: "project-away", Removed: true, Inputs: []string{"Missing"}, Sources: []string{"Missing"}},
+	}
+	if got := ExtractConditions(query).Lineage; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected lineage:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestProjectRenameComputedFields(t *testing.T) {
+	tests := []struct {
+		query, field, source string
+	}{
+		{`SecurityEvent | project-rename Acc = Account | where Acc == "x"`, "Acc", "Account"},
+		{`SecurityEvent | extend A = tolower(Account) | project-rename B = A | where B == "x"`, "B", "Account"},
+	}
+	for _, tt := range tests {
+		result := ExtractConditions(tt.query)
+		if result.ComputedFields[strings.ToLower(tt.field)] != tt.source {
+			t.Errorf("%s: expected %s to be computed from %s, got %v", tt.query, tt.field, tt.source, result.ComputedFields)
+		}
+		found := false
+		for _, cond := range result.Conditions {
+			if cond.Field == tt.field {
+				found = true
+				if !cond.IsComputed || cond.SourceField != tt.source {
+					t.Errorf("%s: expected %s to have source field %s, got %+v", tt.query, tt.field, tt.source, cond)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s: expected a condition on %s, got %+v", tt.query, tt.field, result.Conditions)
+		}
+	}
+}
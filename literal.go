@@ -0,0 +1,420 @@
+package kql
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/craftedsignal/kql-parser/ast"
+)
+
+// LiteralKind is the KQL type of a condition's value.
+type LiteralKind string
+
+const (
+	LiteralString       LiteralKind = "string"
+	LiteralLong         LiteralKind = "long"
+	LiteralReal         LiteralKind = "real"
+	LiteralDecimal      LiteralKind = "decimal"
+	LiteralBool         LiteralKind = "bool"
+	LiteralDatetime     LiteralKind = "datetime"
+	LiteralTimespan     LiteralKind = "timespan"
+	LiteralGuid         LiteralKind = "guid"
+	LiteralDynamic      LiteralKind = "dynamic"
+	LiteralNull         LiteralKind = "null"
+	LiteralFunctionCall LiteralKind = "function_call" // A computed value like ago(1h) or now()
+)
+
+// Literal is the typed value of a condition. Value holds the parsed Go value:
+//
+//	string             string, guid
+//	int64              long
+//	float64            real, decimal
+//	bool               bool
+//	time.Time          datetime
+//	time.Duration      timespan
+//	[]any, map[string]any  dynamic, as decoded from JSON
+//
+// Value is nil for null, for function calls, and when the text could not be
+// parsed, such as datetime(now) or an unusual date format. A list bound by a let
+// and built from other values, like pack_array(procs, "c.exe"), is the dynamic
+// literal of its values.
+type Literal struct {
+	Kind     LiteralKind `json:"kind"`
+	Text     string      `json:"text"`               // The literal as written
+	Value    any         `json:"value,omitempty"`    // Parsed value, see above
+	Function string      `json:"function,omitempty"` // Lower-case function name, for function calls
+	Args     []string    `json:"args,omitempty"`     // Argument texts, for function calls
+}
+
+// literalTokenKinds maps the tokens of the literal grammar rule to their kinds.
+var literalTokenKinds = map[int]LiteralKind{
+	KQLLexerSTRING_LITERAL:   LiteralString,
+	KQLLexerVERBATIM_STRING:  LiteralString,
+	KQLLexerMULTILINE_STRING: LiteralString,
+	KQLLexerINT_NUMBER:       LiteralLong,
+	KQLLexerLONG_NUMBER:      LiteralLong,
+	KQLLexerHEX_NUMBER:       LiteralLong,
+	KQLLexerREAL_NUMBER:      LiteralReal,
+	KQLLexerDECIMAL_NUMBER:   LiteralDecimal,
+	KQLLexerTRUE:             LiteralBool,
+	KQLLexerFALSE:            LiteralBool,
+	KQLLexerNULL:             LiteralNull,
+	KQLLexerDATETIME_LITERAL: LiteralDatetime,
+	KQLLexerTIMESPAN_LITERAL: LiteralTimespan,
+	KQLLexerTIMESPAN_SHORT:   LiteralTimespan,
+	KQLLexerGUID_LITERAL:     LiteralGuid,
+	KQLLexerDYNAMIC_LITERAL:  LiteralDynamic,
+}
+
+// literalOf returns the literal of a value node. Normalization rewrites some
+// literals before parsing, such as dynamic arrays, guids and numbers with a
+// suffix, so the original text behind the node is lexed first and the parse
+// tree is only used when that text is not a single literal token.
+func (e *conditionExtractor) literalOf(node antlr.ParseTree) *Literal {
+	if ctx, ok := node.(antlr.ParserRuleContext); ok {
+		if span := e.locator.ruleSpan(ctx); span != nil {
+			if lit := lexLiteral(span.Text(e.locator.sourceMap.original)); lit != nil {
+				return lit
+			}
+		}
+	}
+	return parseTreeLiteral(node)
+}
+
+// lexLiteral returns the literal text consists of, optionally negated, or nil when
+// it is not a single literal token. An obfuscated string keeps its h prefix.
+func lexLiteral(text string) *Literal {
+	lexer := NewKQLLexer(antlr.NewInputStream(text))
+	lexer.RemoveErrorListeners()
+	var tokens []antlr.Token
+	for {
+		token := lexer.NextToken()
+		if token.GetTokenType() == antlr.TokenEOF {
+			break
+		}
+		if token.GetChannel() == antlr.TokenDefaultChannel {
+			tokens = append(tokens, token)
+		}
+		if len(tokens) > 2 {
+			return nil
+		}
+	}
+	if len(tokens) == 2 && isObfuscationPrefix(tokens[0]) && stringTokens[tokens[1].GetTokenType()] &&
+		tokens[0].GetStop()+1 == tokens[1].GetStart() {
+		return newLiteral(LiteralString, tokens[0].GetText()+tokens[1].GetText())
+	}
+	negative := len(tokens) == 2 && tokens[0].GetTokenType() == KQLLexerMINUS
+	if negative {
+		tokens = tokens[1:]
+	}
+	if len(tokens) != 1 {
+		return nil
+	}
+	kind, ok := literalTokenKinds[tokens[0].GetTokenType()]
+	if !ok {
+		return nil
+	}
+	return signedLiteral(kind, tokens[0].GetText(), negative)
+}
+
+// parseTreeLiteral returns the literal that expression node consists of, or nil
+// when it is anything else, like a column or arithmetic. A leading minus is kept
+// for numbers and timespans.
+func parseTreeLiteral(node antlr.ParseTree) *Literal {
+	negative := false
+	for node != nil {
+		switch ctx := node.(type) {
+		case *LiteralContext:
+			return newLiteralFromContext(ctx, negative)
+		case *FunctionCallContext:
+			if negative {
+				return nil
+			}
+			return functionCallLiteral(ctx)
+		case *UnaryExpressionContext:
+			if ctx.MINUS() != nil {
+				negative = !negative
+			}
+			if ctx.UnaryExpression() != nil {
+				node = ctx.UnaryExpression()
+				continue
+			}
+			node = ctx.PostfixExpression()
+			continue
+		case *PostfixExpressionContext:
+			if len(ctx.AllPostfixOperator()) > 0 {
+				return nil
+			}
+			node = ctx.PrimaryExpression()
+			continue
+		case *PrimaryExpressionContext:
+			switch {
+			case ctx.Literal() != nil:
+				node = ctx.Literal()
+			case ctx.FunctionCall() != nil:
+				node = ctx.FunctionCall()
+			case ctx.Expression() != nil && ctx.TabularExpression() == nil:
+				node = ctx.Expression()
+			default:
+				return nil
+			}
+			continue
+		}
+		// Rules like additiveExpression that only wrap a single child
+		if node.GetChildCount() != 1 {
+			return nil
+		}
+		child, ok := node.GetChild(0).(antlr.ParseTree)
+		if !ok {
+			return nil
+		}
+		if _, terminal := child.(antlr.TerminalNode); terminal {
+			return nil
+		}
+		node = child
+	}
+	return nil
+}
+
+// newLiteralFromContext types a literal by the token the grammar matched.
+func newLiteralFromContext(ctx *LiteralContext, negative bool) *Literal {
+	start := ctx.GetStart()
+	if start == nil {
+		return nil
+	}
+	kind, ok := literalTokenKinds[start.GetTokenType()]
+	if !ok {
+		return nil
+	}
+	return signedLiteral(kind, ctx.GetText(), negative)
+}
+
+// signedLiteral is newLiteral for text preceded by a minus when negative is set.
+// Only numbers and timespans can be negated.
+func signedLiteral(kind LiteralKind, text string, negative bool) *Literal {
+	if negative {
+		switch kind {
+		case LiteralLong, LiteralReal, LiteralDecimal, LiteralTimespan:
+			text = "-" + text
+		default:
+			return nil
+		}
+	}
+	return newLiteral(kind, text)
+}
+
+// functionCallLiteral describes a call such as ago(1h) used as a value.
+func functionCallLiteral(ctx *FunctionCallContext) *Literal {
+	lit := &Literal{Kind: LiteralFunctionCall, Text: ctx.GetText()}
+	if ctx.Identifier() != nil {
+		lit.Function = strings.ToLower(ctx.Identifier().GetText())
+	} else if start := ctx.GetStart(); start != nil {
+		lit.Function = strings.ToLower(start.GetText())
+	}
+	if args := ctx.ArgumentList(); args != nil {
+		for _, arg := range args.AllArgument() {
+			lit.Args = append(lit.Args, arg.GetText())
+		}
+	}
+	return lit
+}
+
+// astLiteral converts a literal of the syntax tree, as found in let statements.
+func astLiteral(expr ast.Expr) *Literal {
+	switch x := expr.(type) {
+	case *ast.Literal:
+		return newLiteral(LiteralKind(x.Kind), x.Text)
+	case *ast.ParenExpr:
+		return astLiteral(x.X)
+	case *ast.UnaryExpr:
+		if lit, ok := x.X.(*ast.Literal); ok && x.Op == "-" {
+			return signedLiteral(LiteralKind(lit.Kind), lit.Text, true)
+		}
+	}
+	return nil
+}
+
+// newLiteral returns a literal of the given kind with its value parsed from text.
+func newLiteral(kind LiteralKind, text string) *Literal {
+	lit := &Literal{Kind: kind, Text: text}
+	switch kind {
+	case LiteralString:
+		lit.Value = extractValue(text)
+	case LiteralLong:
+		if v, ok := parseLong(text); ok {
+			lit.Value = v
+		}
+	case LiteralReal, LiteralDecimal:
+		number := strings.TrimRight(text, "mM")
+		if v, err := strconv.ParseFloat(number, 64); err == nil {
+			lit.Value = v
+		}
+	case LiteralBool:
+		lit.Value = strings.EqualFold(text, "true")
+	case LiteralDatetime:
+		if v, ok := parseDatetime(literalArgument(text)); ok {
+			lit.Value = v
+		}
+	case LiteralTimespan:
+		if v, ok := parseTimespan(text); ok {
+			lit.Value = v
+		}
+	case LiteralGuid:
+		lit.Value = literalArgument(text)
+	case LiteralDynamic:
+		var v any
+		if err := json.Unmarshal([]byte(literalArgument(text)), &v); err == nil {
+			lit.Value = v
+		} else if values, ok := parseDynamicList(text); ok {
+			items := make([]any, len(values))
+			for i, value := range values {
+				items[i] = value
+			}
+			lit.Value = items
+		}
+	}
+	return lit
+}
+
+// literalArgument returns the text between the parentheses of datetime(...),
+// timespan(...), guid(...) or dynamic(...).
+func literalArgument(text string) string {
+	open := strings.IndexByte(text, '(')
+	if open < 0 || !strings.HasSuffix(text, ")") {
+		return text
+	}
+	return strings.TrimSpace(text[open+1 : len(text)-1])
+}
+
+func parseLong(text string) (int64, bool) {
+	negative := strings.HasPrefix(text, "-")
+	text = strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(text, "-"), "l"), "L")
+	v, err := strconv.ParseInt(text, 0, 64)
+	if err != nil {
+		return 0, false
+	}
+	if negative {
+		v = -v
+	}
+	return v, true
+}
+
+// datetimeLayouts are the formats accepted in datetime(...), tried in order.
+var datetimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02",
+	time.RFC1123,
+	time.RFC1123Z,
+}
+
+func parseDatetime(text string) (time.Time, bool) {
+	text = strings.TrimSpace(text)
+	for _, layout := range datetimeLayouts {
+		if v, err := time.Parse(layout, text); err == nil {
+			return v.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// timespanUnits are the suffixes of short timespan literals like 1d or 30min.
+var timespanUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	// Longer suffixes first, so that 5ms is not read as minutes
+	{"microseconds", time.Microsecond}, {"microsecond", time.Microsecond},
+	{"milliseconds", time.Millisecond}, {"millisecond", time.Millisecond},
+	{"seconds", time.Second}, {"second", time.Second},
+	{"minutes", time.Minute}, {"minute", time.Minute},
+	{"hours", time.Hour}, {"hour", time.Hour},
+	{"days", 24 * time.Hour}, {"day", 24 * time.Hour},
+	{"ticks", 100 * time.Nanosecond}, {"tick", 100 * time.Nanosecond},
+	{"micro", time.Microsecond}, {"milli", time.Millisecond},
+	{"min", time.Minute}, {"sec", time.Second},
+	{"ms", time.Millisecond},
+	{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second},
+}
+
+// parseTimespan parses 1d, -30m, timespan(2h), time(1.02:03:04) and similar.
+func parseTimespan(text string) (time.Duration, bool) {
+	text = strings.TrimSpace(text)
+	negative := strings.HasPrefix(text, "-")
+	text = strings.TrimPrefix(text, "-")
+	if strings.HasSuffix(text, ")") {
+		text = literalArgument(text)
+	}
+
+	var v time.Duration
+	var ok bool
+	if strings.Contains(text, ":") {
+		v, ok = parseClockTimespan(text)
+	} else {
+		v, ok = parseShortTimespan(text)
+	}
+	if negative {
+		v = -v
+	}
+	return v, ok
+}
+
+func parseShortTimespan(text string) (time.Duration, bool) {
+	lower := strings.ToLower(text)
+	for _, u := range timespanUnits {
+		if !strings.HasSuffix(lower, u.suffix) {
+			continue
+		}
+		n, err := strconv.ParseFloat(text[:len(text)-len(u.suffix)], 64)
+		if err != nil {
+			return 0, false
+		}
+		return time.Duration(n * float64(u.unit)), true
+	}
+	// A bare number in timespan(...) counts days
+	if n, err := strconv.ParseFloat(text, 64); err == nil {
+		return time.Duration(n * float64(24*time.Hour)), true
+	}
+	return 0, false
+}
+
+// parseClockTimespan parses [d.]hh:mm[:ss[.fffffff]].
+func parseClockTimespan(text string) (time.Duration, bool) {
+	var days int64
+	if dot := strings.IndexByte(text, '.'); dot >= 0 && dot < strings.IndexByte(text, ':') {
+		d, err := strconv.ParseInt(text[:dot], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		days = d
+		text = text[dot+1:]
+	}
+	parts := strings.Split(text, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	hours, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	minutes, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	var seconds float64
+	if len(parts) == 3 {
+		if seconds, err = strconv.ParseFloat(parts[2], 64); err != nil {
+			return 0, false
+		}
+	}
+	return time.Duration(days)*24*time.Hour + time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), true
+}
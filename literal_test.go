@@ -0,0 +1,83 @@
+package kql
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConditionLiterals(t *testing.T) {
+	tests := []struct {
+		predicate string
+		kind      LiteralKind
+		value     any
+	}{
+		{"A == 4624", LiteralLong, int64(4624)},
+		{"A == -3", LiteralLong, int64(-3)},
+		{"A == 0x10", LiteralLong, int64(16)},
+		{"A == 10l", LiteralLong, int64(10)},
+		{"A == 1.5", LiteralReal, 1.5},
+		{"A == true", LiteralBool, true},
+		{`A == "x"`, LiteralString, "x"},
+		{"A == datetime(2024-01-02)", LiteralDatetime, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"A == datetime(2024-01-02T03:04:05Z)", LiteralDatetime, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"A < 1d", LiteralTimespan, 24 * time.Hour},
+		{"A < 100ms", LiteralTimespan, 100 * time.Millisecond},
+		{"A < timespan(1.02:00:00)", LiteralTimespan, 26 * time.Hour},
+		{"A == guid(74be27de-1e4e-49d9-b579-fe0b331d3642)", LiteralGuid, "74be27de-1e4e-49d9-b579-fe0b331d3642"},
+		{"A in (dynamic([1,2]))", LiteralDynamic, []any{float64(1), float64(2)}},
+		{"A > ago(1h)", LiteralFunctionCall, nil},
+	}
+	for _, tt := range tests {
+		result := ExtractConditions("T | where " + tt.predicate)
+		if len(result.Conditions) == 0 {
+			t.Errorf("%s: no condition", tt.predicate)
+			continue
+		}
+		lit := result.Conditions[0].Literal
+		if lit == nil {
+			t.Errorf("%s: no literal", tt.predicate)
+			continue
+		}
+		if lit.Kind != tt.kind || !reflect.DeepEqual(lit.Value, tt.value) {
+			t.Errorf("%s: expected %s %#v, got %s %#v", tt.predicate, tt.kind, tt.value, lit.Kind, lit.Value)
+		}
+	}
+
+	result := ExtractConditions("T | where A > ago(1h) and B == Other")
+	if lit := result.Conditions[0].Literal; lit.Function != "ago" || len(lit.Args) != 1 || lit.Args[0] != "1h" {
+		t.Errorf("expected the ago call with its argument, got %+v", lit)
+	}
+	if lit := result.Conditions[1].Literal; lit != nil {
+		t.Errorf("a column is not a literal, got %+v", lit)
+	}
+}
+
+func TestLetBoundLiteral(t *testing.T) {
+	result := ExtractConditions("let id = 4688;\nT | where EventID == id")
+	if len(result.Conditions) != 1 {
+		t.Fatalf("expected one condition, got %+v", result.Conditions)
+	}
+	lit := result.Conditions[0].Literal
+	if lit == nil || lit.Kind != LiteralLong || lit.Value != int64(4688) {
+		t.Errorf("expected the literal of the let, got %+v", lit)
+	}
+}
+
+func TestParseTimespan(t *testing.T) {
+	tests := map[string]time.Duration{
+		"30m":               30 * time.Minute,
+		"-2h":               -2 * time.Hour,
+		"1.5d":              36 * time.Hour,
+		"10tick":            time.Microsecond,
+		"timespan(5)":       5 * 24 * time.Hour,
+		"time(00:30:15)":    30*time.Minute + 15*time.Second,
+		"timespan(2.01:00)": 49 * time.Hour,
+	}
+	for text, want := range tests {
+		got, ok := parseTimespan(text)
+		if !ok || got != want {
+			t.Errorf("%s: expected %v, got %v (ok %v)", text, want, got, ok)
+		}
+	}
+}
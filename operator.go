@@ -0,0 +1,123 @@
+package kql
+
+import "strings"
+
+// OperatorKind is the canonical operator of a condition. Case sensitivity and
+// negation are reported in separate flags, so ==, =~, != and !~ are all
+// OperatorEqual.
+type OperatorKind string
+
+const (
+	OperatorEqual          OperatorKind = "equal"
+	OperatorLess           OperatorKind = "less"
+	OperatorLessOrEqual    OperatorKind = "less_or_equal"
+	OperatorGreater        OperatorKind = "greater"
+	OperatorGreaterOrEqual OperatorKind = "greater_or_equal"
+	OperatorIn             OperatorKind = "in"
+	OperatorHas            OperatorKind = "has"
+	OperatorHasPrefix      OperatorKind = "hasprefix"
+	OperatorHasSuffix      OperatorKind = "hassuffix"
+	OperatorHasAny         OperatorKind = "has_any" // One has condition per value, ORed
+	OperatorHasAll         OperatorKind = "has_all" // One has condition per value, ANDed
+	OperatorContains       OperatorKind = "contains"
+	OperatorStartsWith     OperatorKind = "startswith"
+	OperatorEndsWith       OperatorKind = "endswith"
+	OperatorMatchesRegex   OperatorKind = "matches_regex"
+	OperatorIsNull         OperatorKind = "isnull"
+)
+
+// OperatorFamily groups operators by how they match a value.
+type OperatorFamily string
+
+const (
+	// FamilyEquality compares whole values: ==, =~ and in.
+	FamilyEquality OperatorFamily = "equality"
+	// FamilyRange orders values: <, <=, > and >=.
+	FamilyRange OperatorFamily = "range"
+	// FamilyTerm matches whole terms of the indexed text: has, hasprefix,
+	// hassuffix, has_any and has_all.
+	FamilyTerm OperatorFamily = "term"
+	// FamilySubstring matches any part of the text: contains, startswith and
+	// endswith.
+	FamilySubstring OperatorFamily = "substring"
+	// FamilyRegex matches a regular expression.
+	FamilyRegex OperatorFamily = "regex"
+	// FamilyNull checks for a missing or empty value.
+	FamilyNull OperatorFamily = "null"
+)
+
+// operatorSpec describes one spelling of an operator.
+type operatorSpec struct {
+	kind          OperatorKind
+	family        OperatorFamily
+	caseSensitive bool
+	negated       bool
+}
+
+var operatorSpecs = map[string]operatorSpec{
+	"==":   {OperatorEqual, FamilyEquality, true, false},
+	"!=":   {OperatorEqual, FamilyEquality, true, true},
+	"=~":   {OperatorEqual, FamilyEquality, false, false},
+	"!~":   {OperatorEqual, FamilyEquality, false, true},
+	"<":    {OperatorLess, FamilyRange, false, false},
+	"<=":   {OperatorLessOrEqual, FamilyRange, false, false},
+	">":    {OperatorGreater, FamilyRange, false, false},
+	">=":   {OperatorGreaterOrEqual, FamilyRange, false, false},
+	"in":   {OperatorIn, FamilyEquality, true, false},
+	"!in":  {OperatorIn, FamilyEquality, true, true},
+	"in~":  {OperatorIn, FamilyEquality, false, false},
+	"!in~": {OperatorIn, FamilyEquality, false, true},
+
+	"has":           {OperatorHas, FamilyTerm, false, false},
+	"!has":          {OperatorHas, FamilyTerm, false, true},
+	"has_cs":        {OperatorHas, FamilyTerm, true, false},
+	"!has_cs":       {OperatorHas, FamilyTerm, true, true},
+	"hasprefix":     {OperatorHasPrefix, FamilyTerm, false, false},
+	"!hasprefix":    {OperatorHasPrefix, FamilyTerm, false, true},
+	"hasprefix_cs":  {OperatorHasPrefix, FamilyTerm, true, false},
+	"!hasprefix_cs": {OperatorHasPrefix, FamilyTerm, true, true},
+	"hassuffix":     {OperatorHasSuffix, FamilyTerm, false, false},
+	"!hassuffix":    {OperatorHasSuffix, FamilyTerm, false, true},
+	"hassuffix_cs":  {OperatorHasSuffix, FamilyTerm, true, false},
+	"!hassuffix_cs": {OperatorHasSuffix, FamilyTerm, true, true},
+	"has_any":       {OperatorHasAny, FamilyTerm, false, false},
+	"has_all":       {OperatorHasAll, FamilyTerm, false, false},
+
+	"contains":       {OperatorContains, FamilySubstring, false, false},
+	"!contains":      {OperatorContains, FamilySubstring, false, true},
+	"contains_cs":    {OperatorContains, FamilySubstring, true, false},
+	"!contains_cs":   {OperatorContains, FamilySubstring, true, true},
+	"startswith":     {OperatorStartsWith, FamilySubstring, false, false},
+	"!startswith":    {OperatorStartsWith, FamilySubstring, false, true},
+	"startswith_cs":  {OperatorStartsWith, FamilySubstring, true, false},
+	"!startswith_cs": {OperatorStartsWith, FamilySubstring, true, true},
+	"endswith":       {OperatorEndsWith, FamilySubstring, false, false},
+	"!endswith":      {OperatorEndsWith, FamilySubstring, false, true},
+	"endswith_cs":    {OperatorEndsWith, FamilySubstring, true, false},
+	"!endswith_cs":   {OperatorEndsWith, FamilySubstring, true, true},
+	"matches regex":  {OperatorMatchesRegex, FamilyRegex, true, false},
+	"matches":        {OperatorMatchesRegex, FamilyRegex, true, false},
+	"isnull":         {OperatorIsNull, FamilyNull, false, false},
+	"isnotnull":      {OperatorIsNull, FamilyNull, false, true},
+}
+
+// lookupOperator returns the spec of an operator as written, ignoring case and
+// the spacing of matches regex.
+func lookupOperator(op string) (operatorSpec, bool) {
+	spec, ok := operatorSpecs[strings.Join(strings.Fields(strings.ToLower(op)), " ")]
+	return spec, ok
+}
+
+// describeOperator sets the canonical operator and its flags on cond from the
+// operator as written, which may differ from cond.Operator: in~ is reported with
+// Operator in. Unknown operators leave cond unchanged.
+func describeOperator(cond *Condition, op string) {
+	spec, ok := lookupOperator(op)
+	if !ok {
+		return
+	}
+	cond.OperatorKind = spec.kind
+	cond.OperatorFamily = spec.family
+	cond.CaseSensitive = spec.caseSensitive
+	cond.NegatedByOperator = spec.negated
+}
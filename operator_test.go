@@ -0,0 +1,59 @@
+package kql
+
+import "testing"
+
+func TestOperatorMetadata(t *testing.T) {
+	tests := []struct {
+		predicate         string
+		kind              OperatorKind
+		family            OperatorFamily
+		caseSensitive     bool
+		negatedByOperator bool
+		negatedByNot      bool
+	}{
+		{`A == "x"`, OperatorEqual, FamilyEquality, true, false, false},
+		{`A =~ "x"`, OperatorEqual, FamilyEquality, false, false, false},
+		{`A !~ "x"`, OperatorEqual, FamilyEquality, false, true, false},
+		{`A > 5`, OperatorGreater, FamilyRange, false, false, false},
+		{`A in ("x")`, OperatorIn, FamilyEquality, true, false, false},
+		{`A in~ ("x")`, OperatorIn, FamilyEquality, false, false, false},
+		{`A !in~ ("x")`, OperatorIn, FamilyEquality, false, true, false},
+		{`A has "x"`, OperatorHas, FamilyTerm, false, false, false},
+		{`A !has_cs "x"`, OperatorHas, FamilyTerm, true, true, false},
+		{`not(A has "x")`, OperatorHas, FamilyTerm, false, false, true},
+		{`A hasprefix "x"`, OperatorHasPrefix, FamilyTerm, false, false, false},
+		{`A contains "x"`, OperatorContains, FamilySubstring, false, false, false},
+		{`A startswith_cs "x"`, OperatorStartsWith, FamilySubstring, true, false, false},
+		{`A matches regex "x+"`, OperatorMatchesRegex, FamilyRegex, true, false, false},
+		{`A has_any ("x", "y")`, OperatorHasAny, FamilyTerm, false, false, false},
+		{`A has_all ("x", "y")`, OperatorHasAll, FamilyTerm, false, false, false},
+		{`A !between (1 .. 5)`, OperatorGreaterOrEqual, FamilyRange, false, true, false},
+		{`isnotempty(A)`, OperatorIsNull, FamilyNull, false, true, false},
+	}
+	for _, tt := range tests {
+		result := ExtractConditions("T | where " + tt.predicate)
+		if len(result.Conditions) == 0 {
+			t.Errorf("%s: no condition, errors %v", tt.predicate, result.Errors)
+			continue
+		}
+		cond := result.Conditions[0]
+		if cond.OperatorKind != tt.kind || cond.OperatorFamily != tt.family || cond.CaseSensitive != tt.caseSensitive ||
+			cond.NegatedByOperator != tt.negatedByOperator || cond.NegatedByNot != tt.negatedByNot {
+			t.Errorf("%s: expected %s/%s cs=%v op-negated=%v not-negated=%v, got %s/%s cs=%v op-negated=%v not-negated=%v",
+				tt.predicate, tt.kind, tt.family, tt.caseSensitive, tt.negatedByOperator, tt.negatedByNot,
+				cond.OperatorKind, cond.OperatorFamily, cond.CaseSensitive, cond.NegatedByOperator, cond.NegatedByNot)
+		}
+	}
+}
+
+func TestCaseInsensitiveInKeepsOperator(t *testing.T) {
+	normalized := NormalizeQueryForDebug(`T | where A in~ ("x") and B !in~ ("y")`)
+	if normalized != `T | where A in~ ("x") and B !in~ ("y")` {
+		t.Errorf("in~ should not be rewritten, got %q", normalized)
+	}
+
+	result := ExtractConditions(`T | where B !in~ ("y")`)
+	if len(result.Conditions) != 1 || !result.Conditions[0].Negated || result.Conditions[0].Operator != "in" {
+		t.Errorf("expected a negated in condition, got %+v", result.Conditions)
+	}
+}
@@ -0,0 +1,265 @@
+package kql
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Options configures a single extraction. The zero value behaves like ExtractConditions,
+// so callers only set the fields they want to change. Options are read per call and
+// never stored, so differently configured callers can share a process.
+type Options struct {
+	// Timeout bounds the time spent parsing. Zero uses MaxParseTime; a negative
+	// value disables the limit.
+	Timeout time.Duration
+
+	// ExcludedFields lists names, matched case-insensitively, that are never reported
+	// as condition fields. Nil uses DefaultExcludedFields; an empty non-nil slice
+	// excludes none. KQL keywords such as where and by are always excluded.
+	ExcludedFields []string
+
+	// Tables lists table names, matched case-insensitively, that are not reported
+	// as condition fields, since a table reference the parser did not understand
+	// can look like one. Nil uses DefaultTables; an empty non-nil slice excludes
+	// none. Pass Catalog.Tables() to exclude every table of a catalog.
+	Tables []string
+
+	// Catalog gives the tables and columns the query may refer to. Nil uses
+	// DefaultCatalog; merge it with LoadCatalog's result to add custom tables.
+	Catalog *Catalog
+
+	// ValidateSchema checks the query against Catalog. Fields that are not
+	// columns of the tables read, with suggested corrections, operators or values
+	// that do not fit a column's type, and expressions that pass a function or
+	// operator values of the wrong type are reported in Diagnostics, as
+	// unknown_column, type_mismatch and type_error. None of them is checked when
+	// it is off.
+	ValidateSchema bool
+
+	// Parameters maps placeholder names to the text substituted for {Name} and
+	// {{Name}} before parsing. Entries are added to the built-in substitutions and
+	// take precedence over them.
+	Parameters map[string]string
+
+	// ASIMFunctions lists functions that return tables, such as ASIM parsers and
+	// watchlist helpers. Calls to them are parsed as a table reference. Nil uses
+	// DefaultASIMFunctions.
+	ASIMFunctions []string
+
+	// DisablePortableFallback turns off the string-based condition extraction that
+	// runs when the parse tree yields no field conditions.
+	DisablePortableFallback bool
+
+	// IncludeSubqueryConditions appends ScopedConditions, the conditions found in
+	// let bodies, join right sides, subqueries and function arguments, to Conditions.
+	IncludeSubqueryConditions bool
+}
+
+// defaultParameters are the placeholder substitutions applied to every query.
+var defaultParameters = map[string]string{
+	"SourceTable":  "SecurityEvent",
+	"TotalE5Seats": "100",
+	"Workspace":    "workspace",
+	"Subscription": "subscription",
+}
+
+// defaultASIMFunctions are the table-returning functions known without configuration.
+var defaultASIMFunctions = []string{
+	"imAuthentication", "imProcess", "imNetworkSession", "imDns",
+	"imWebSession", "imFileEvent", "imProcessCreate", "imProcessTerminate",
+	"imRegistry", "imAuditEvent", "imUserManagement",
+	"_Im_Authentication", "_Im_Process", "_Im_NetworkSession", "_Im_Dns",
+	"_Im_WebSession", "_Im_FileEvent", "_Im_Registry", "_Im_AuditEvent",
+	"_Im_ProcessCreate", "_Im_ProcessTerminate", "_Im_UserManagement",
+	// Sentinel watchlist and other underscore-prefixed functions
+	"_GetWatchlist", "_GetWatchlistAlias",
+}
+
+// grammarKeywords are KQL keywords that can end up where a field is expected in a
+// query the parser only partly understood. They are never condition fields.
+var grammarKeywords = map[string]bool{
+	"where": true, "project": true, "extend": true, "summarize": true,
+	"join": true, "union": true, "let": true, "datatable": true,
+	"by": true, "on": true, "with": true, "and": true, "or": true, "not": true,
+	"in": true, "between": true,
+}
+
+// defaultTables are the tables excluded from condition fields without configuration.
+// Only names that a misunderstood table reference has been taken for are listed, so
+// generic ones like Event or Syslog stay valid field names.
+var defaultTables = []string{
+	"SecurityEvent", "SigninLogs", "AuditLogs",
+	"DeviceEvents", "DeviceProcessEvents", "DeviceNetworkEvents",
+	"DeviceFileEvents", "DeviceRegistryEvents", "DeviceLogonEvent",
+	"CommonComputerEnvironment", "AABOracleTable",
+}
+
+// DefaultExcludedFields returns the names excluded from conditions when
+// Options.ExcludedFields is nil, in lower case and sorted. These are the time
+// columns, whose filters are reported in ParseResult.TimeWindow instead.
+func DefaultExcludedFields() []string {
+	return sortedKeys(timeColumns)
+}
+
+// DefaultTables returns the tables excluded from condition fields when
+// Options.Tables is nil.
+func DefaultTables() []string {
+	return append([]string(nil), defaultTables...)
+}
+
+// isReservedName reports whether name is a KQL keyword or a time column, which
+// are not taken for the source field of a computed column.
+func isReservedName(name string) bool {
+	name = strings.ToLower(name)
+	return grammarKeywords[name] || timeColumns[name]
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func lowerSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[strings.ToLower(name)] = true
+	}
+	return set
+}
+
+// DefaultASIMFunctions returns the functions treated as tables when
+// Options.ASIMFunctions is nil.
+func DefaultASIMFunctions() []string {
+	return append([]string(nil), defaultASIMFunctions...)
+}
+
+// extractConfig is Options resolved into the lookup structures used while extracting.
+type extractConfig struct {
+	excluded         map[string]bool // every name not reported as a field: keywords, excluded fields and tables
+	excludedFields   map[string]bool // Options.ExcludedFields, to tell why a name is excluded
+	tables           map[string]bool
+	catalog          *Catalog
+	validateSchema   bool
+	parameters       map[string]string // placeholder with braces -> replacement
+	asim             *asimIndex
+	portableFallback bool
+	includeSubquery  bool
+	inlineLets       bool                // replace references to tabular lets with their bodies
+	letValues        map[string]letValue // values of the scalar lets of the query being extracted
+}
+
+var defaultConfig = newExtractConfig(Options{})
+
+// astConfig is defaultConfig without let inlining, as ParseQuery reports let
+// statements as nodes of their own.
+var astConfig = func() *extractConfig {
+	cfg := *defaultConfig
+	cfg.inlineLets = false
+	return &cfg
+}()
+
+func newExtractConfig(opts Options) *extractConfig {
+	cfg := &extractConfig{
+		excludedFields:   timeColumns,
+		catalog:          DefaultCatalog(),
+		parameters:       make(map[string]string, len(defaultParameters)+len(opts.Parameters)),
+		asim:             defaultASIMIndex,
+		portableFallback: !opts.DisablePortableFallback,
+		includeSubquery:  opts.IncludeSubqueryConditions,
+		validateSchema:   opts.ValidateSchema,
+		inlineLets:       true,
+	}
+	if opts.ExcludedFields != nil {
+		cfg.excludedFields = lowerSet(opts.ExcludedFields)
+	}
+	if opts.Catalog != nil {
+		cfg.catalog = opts.Catalog
+	}
+	if opts.Tables != nil {
+		cfg.tables = lowerSet(opts.Tables)
+	} else {
+		cfg.tables = lowerSet(defaultTables)
+	}
+	cfg.excluded = make(map[string]bool, len(grammarKeywords)+len(cfg.excludedFields)+len(cfg.tables))
+	for _, set := range []map[string]bool{grammarKeywords, cfg.excludedFields, cfg.tables} {
+		for name := range set {
+			cfg.excluded[name] = true
+		}
+	}
+	for name, value := range defaultParameters {
+		cfg.parameters["{"+name+"}"] = value
+	}
+	for name, value := range opts.Parameters {
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "{"), "}")
+		cfg.parameters["{"+name+"}"] = value
+	}
+	if opts.ASIMFunctions != nil {
+		cfg.asim = newASIMIndex(opts.ASIMFunctions)
+	}
+	return cfg
+}
+
+// withLetValues returns a copy of cfg that resolves the given scalar lets in addition
+// to those cfg already resolves, as a let body or join right side sees the lets of
+// the query around it.
+func (cfg *extractConfig) withLetValues(values map[string]letValue) *extractConfig {
+	out := *cfg
+	out.letValues = make(map[string]letValue, len(cfg.letValues)+len(values))
+	for name, bound := range cfg.letValues {
+		out.letValues[name] = bound
+	}
+	for name, bound := range values {
+		out.letValues[name] = bound
+	}
+	return &out
+}
+
+// timeColumnExclusion is why conditions on a time column are not reported.
+const timeColumnExclusion = "it is a time column"
+
+// exclusion returns why field is not reported as a condition field, or "" when it
+// is reported.
+func (cfg *extractConfig) exclusion(field string) string {
+	name := strings.ToLower(field)
+	switch {
+	case !cfg.excluded[name]:
+		return ""
+	case grammarKeywords[name]:
+		return "it is a KQL keyword"
+	case cfg.excludedFields[name] && timeColumns[name]:
+		return timeColumnExclusion
+	case cfg.excludedFields[name]:
+		return "it is an excluded field"
+	}
+	return "it is a table name"
+}
+
+// timeout returns the parse time limit for opts, or 0 when there is none.
+func (opts Options) timeout() time.Duration {
+	switch {
+	case opts.Timeout < 0:
+		return 0
+	case opts.Timeout == 0:
+		return MaxParseTime
+	}
+	return opts.Timeout
+}
+
+// ExtractConditionsWithOptions parses a KQL query and extracts all field conditions
+// using the given options instead of the package defaults.
+func ExtractConditionsWithOptions(query string, opts Options) *ParseResult {
+	ctx := context.Background()
+	limit := opts.timeout()
+	if limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+	return extractConditions(ctx, query, limit, newExtractConfig(opts))
+}
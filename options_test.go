@@ -0,0 +1,145 @@
+package kql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOptionsZeroValueMatchesDefaults(t *testing.T) {
+	query := `SecurityEvent | where EventID == 4624 and Account has "admin" | join (SigninLogs | where ResultType == "0") on UserPrincipalName`
+	want := ExtractConditions(query)
+	got := ExtractConditionsWithOptions(query, Options{})
+	if len(got.Conditions) != len(want.Conditions) || len(got.Joins) != len(want.Joins) {
+		t.Fatalf("zero Options changed the result: %+v vs %+v", got.Conditions, want.Conditions)
+	}
+}
+
+func TestOptionsExcludedFields(t *testing.T) {
+	query := `SecurityEvent | where TimeGenerated > ago(1d) and Computer == "dc01"`
+
+	result := ExtractConditionsWithOptions(query, Options{})
+	if hasCondition(result, "TimeGenerated") || !hasCondition(result, "Computer") {
+		t.Fatalf("unexpected default conditions %+v", result.Conditions)
+	}
+
+	result = ExtractConditionsWithOptions(query, Options{ExcludedFields: []string{"computer"}})
+	if !hasCondition(result, "TimeGenerated") || hasCondition(result, "Computer") {
+		t.Errorf("expected custom exclusions to replace the defaults, got %+v", result.Conditions)
+	}
+}
+
+func TestOptionsParameters(t *testing.T) {
+	query := `{SourceTable} | where {Field} == "x"`
+	result := ExtractConditionsWithOptions(query, Options{
+		Parameters: map[string]string{"SourceTable": "DeviceProcessEvents", "Field": "FileName"},
+	})
+	if !containsString(result.DataSources, "DeviceProcessEvents") {
+		t.Errorf("expected substituted data source, got %v", result.DataSources)
+	}
+	if !hasCondition(result, "FileName") {
+		t.Errorf("expected substituted field, got %+v", result.Conditions)
+	}
+
+	// Options must not leak into other calls
+	result = ExtractConditions(query)
+	if !containsString(result.DataSources, "SecurityEvent") {
+		t.Errorf("expected built-in substitution, got %v", result.DataSources)
+	}
+}
+
+func TestOptionsASIMFunctions(t *testing.T) {
+	query := `_Custom_Parser(starttime=ago(1d)) | where SrcIpAddr == "10.0.0.1"`
+	result := ExtractConditionsWithOptions(query, Options{ASIMFunctions: []string{"_Custom_Parser"}})
+	if result.HasFatalErrors() || !hasCondition(result, "SrcIpAddr") {
+		t.Fatalf("expected custom parser function to be treated as a table, got %+v", result)
+	}
+}
+
+func TestOptionsDisablePortableFallback(t *testing.T) {
+	query := `search "mimikatz"`
+	if result := ExtractConditionsWithOptions(query, Options{}); len(result.Conditions) == 0 {
+		t.Fatal("expected fallback conditions by default")
+	}
+	result := ExtractConditionsWithOptions(query, Options{DisablePortableFallback: true})
+	if len(result.Conditions) != 0 || len(result.DiagnosticsWithCode(CodePortableKeyword)) != 0 {
+		t.Errorf("expected no fallback conditions, got %+v", result.Conditions)
+	}
+}
+
+func TestOptionsIncludeSubqueryConditions(t *testing.T) {
+	query := `SecurityEvent | where EventID == 4624 | join (SigninLogs | where ResultType == "0") on Account`
+	if result := ExtractConditionsWithOptions(query, Options{}); hasCondition(result, "ResultType") {
+		t.Fatalf("subquery conditions should not be merged by default, got %+v", result.Conditions)
+	}
+	result := ExtractConditionsWithOptions(query, Options{IncludeSubqueryConditions: true})
+	if !hasCondition(result, "EventID") || !hasCondition(result, "ResultType") {
+		t.Errorf("expected subquery conditions to be merged, got %+v", result.Conditions)
+	}
+}
+
+func TestOptionsTimeout(t *testing.T) {
+	if got := (Options{}).timeout(); got != MaxParseTime {
+		t.Errorf("zero Timeout should use MaxParseTime, got %s", got)
+	}
+	if got := (Options{Timeout: -1}).timeout(); got != 0 {
+		t.Errorf("negative Timeout should disable the limit, got %s", got)
+	}
+	result := ExtractConditionsWithOptions("SecurityEvent | where EventID == 4624", Options{Timeout: time.Minute})
+	if result.HasFatalErrors() || len(result.Conditions) != 1 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func hasCondition(result *ParseResult, field string) bool {
+	for _, c := range result.Conditions {
+		if c.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOptionsIncludeSubqueryConditionsDoesNotDuplicate(t *testing.T) {
+	query := `let x = T | where A == 1 | summarize countif(B == 2);
+x | where K != "" | join (U | where C == 3 | summarize countif(D == 4)) on K`
+	result := ExtractConditionsWithOptions(query, Options{IncludeSubqueryConditions: true})
+	seen := make(map[string]int)
+	for _, c := range result.Conditions {
+		seen[c.Field]++
+	}
+	for _, field := range []string{"K", "A", "B", "C", "D"} {
+		if seen[field] != 1 {
+			t.Errorf("expected one condition on %s, got %d in %+v", field, seen[field], result.Conditions)
+		}
+	}
+}
+
+func TestOptionsTables(t *testing.T) {
+	query := `T | where SigninLogs == "x" and Computer == "dc01"`
+
+	result := ExtractConditionsWithOptions(query, Options{})
+	if hasCondition(result, "SigninLogs") {
+		t.Fatalf("expected default tables to be excluded, got %+v", result.Conditions)
+	}
+	dropped := result.DiagnosticsWithCode(CodeExcludedField)
+	if len(dropped) != 1 || dropped[0].Message != "condition on SigninLogs dropped: it is a table name" || dropped[0].Span == nil {
+		t.Errorf("expected the dropped field to be noted, got %+v", dropped)
+	}
+	if len(result.Errors) != 0 {
+		t.Errorf("excluded fields should not be reported as errors, got %v", result.Errors)
+	}
+
+	result = ExtractConditionsWithOptions(query, Options{Tables: []string{"Computer"}})
+	if !hasCondition(result, "SigninLogs") || hasCondition(result, "Computer") {
+		t.Errorf("expected custom tables to replace the defaults, got %+v", result.Conditions)
+	}
+
+	// Keywords stay excluded whatever the configuration
+	cfg := newExtractConfig(Options{ExcludedFields: []string{}, Tables: []string{}})
+	if reason := cfg.exclusion("By"); reason != "it is a KQL keyword" {
+		t.Errorf("expected keywords to be excluded, got %q", reason)
+	}
+	if reason := cfg.exclusion("TimeGenerated"); reason != "" {
+		t.Errorf("expected nothing else to be excluded, got %q", reason)
+	}
+}
@@ -0,0 +1,763 @@
+package kql
+
+import (
+	"context"
+	"strings"
+
+	"github.com/craftedsignal/kql-parser/ast"
+)
+
+// OutputColumn is a column a query returns.
+type OutputColumn struct {
+	Name string     `json:"name"`
+	Type ColumnType `json:"type,omitempty"` // Empty when the catalog and the pipeline do not tell
+}
+
+// outputColumns returns the columns of rel, the relation a query returns, and
+// whether they are all of them, which is not the case when a table is missing from
+// the catalog or not marked complete, or an operator's output is not tracked.
+func outputColumns(rel *relation) ([]OutputColumn, bool) {
+	var out []OutputColumn
+	for _, col := range rel.columns {
+		out = append(out, OutputColumn(col))
+	}
+	return out, !rel.open
+}
+
+// schema is what relations are computed from: the tables of the catalog and the
+// types of the query's scalar lets. ctx bounds the parsing of operator arguments.
+type schema struct {
+	ctx     context.Context
+	catalog *Catalog
+	scalars map[string]ColumnType
+}
+
+// newSchema returns the schema of a query with the given lets. Scalar lets are
+// typed in order, so each can use those before it.
+func newSchema(ctx context.Context, catalog *Catalog, lets []letDefinition) *schema {
+	s := &schema{ctx: ctx, catalog: catalog, scalars: make(map[string]ColumnType)}
+	for _, def := range lets {
+		if def.node.Kind == ast.LetScalar && def.node.Value != nil {
+			s.scalars[def.node.Name] = s.checker(openRelation()).typeOf(def.node.Value)
+		}
+	}
+	return s
+}
+
+// relColumn is a column of a relation. Type is empty when it is not known, such as
+// for computed columns.
+type relColumn struct {
+	Name string
+	Type ColumnType
+}
+
+// relation is what is known about the columns of a tabular value: those the catalog
+// or the pipeline operators define. When open is set the value may have columns
+// that are not listed, because a table is missing from the catalog or an operator
+// adds columns that are not tracked.
+type relation struct {
+	columns []relColumn
+	index   map[string]int // name -> position in columns
+	open    bool
+	tables  []string // catalog tables the columns were read from
+	reshape string   // last operator that replaced the table's columns, if any
+	bags    []unpackedBag
+	leading bool // the empty input of a leading union, which adds nothing of its own
+}
+
+// unpackedBag is a column evaluate bag_unpack replaced with a column per property,
+// named after the property with prefix in front.
+type unpackedBag struct {
+	column, prefix string
+}
+
+func newRelation() *relation {
+	return &relation{index: make(map[string]int)}
+}
+
+// openRelation is a relation nothing is known about.
+func openRelation() *relation {
+	r := newRelation()
+	r.open = true
+	return r
+}
+
+// tableRelation returns the relation read from a table, open when the catalog does
+// not have it or does not list all its columns.
+func tableRelation(catalog *Catalog, name string) *relation {
+	table := catalog.Table(name)
+	if table == nil {
+		return openRelation()
+	}
+	r := newRelation()
+	r.open = !table.Complete
+	r.tables = []string{table.Name}
+	for _, col := range table.Columns {
+		r.add(relColumn{col.Name, col.Type})
+	}
+	return r
+}
+
+func (r *relation) clone() *relation {
+	out := &relation{
+		columns: append([]relColumn(nil), r.columns...),
+		index:   make(map[string]int, len(r.index)),
+		open:    r.open,
+		tables:  append([]string(nil), r.tables...),
+		reshape: r.reshape,
+		bags:    append([]unpackedBag(nil), r.bags...),
+	}
+	for name, i := range r.index {
+		out.index[name] = i
+	}
+	return out
+}
+
+// add adds col, replacing a column of the same name.
+func (r *relation) add(col relColumn) {
+	if i, ok := r.index[col.Name]; ok {
+		r.columns[i] = col
+		return
+	}
+	r.index[col.Name] = len(r.columns)
+	r.columns = append(r.columns, col)
+}
+
+// column returns the column called name.
+func (r *relation) column(name string) (relColumn, bool) {
+	i, ok := r.index[name]
+	if !ok {
+		return relColumn{}, false
+	}
+	return r.columns[i], true
+}
+
+// lookup returns the column called name, matched case-insensitively, and whether
+// the case matches too. KQL column names are case-sensitive, so a match that
+// differs in case is still not the column.
+func (r *relation) lookup(name string) (col relColumn, found, exact bool) {
+	if i, ok := r.index[name]; ok {
+		return r.columns[i], true, true
+	}
+	for _, col := range r.columns {
+		if strings.EqualFold(col.Name, name) {
+			return col, true, false
+		}
+	}
+	return relColumn{}, false, false
+}
+
+// untyped returns a copy of r with all column types forgotten and open set, for
+// operators that may add columns or change their types.
+func (r *relation) untyped() *relation {
+	out := r.clone()
+	for i := range out.columns {
+		out.columns[i].Type = ""
+	}
+	out.open = true
+	return out
+}
+
+// passthroughOperators keep the columns of their input.
+var passthroughOperators = map[string]bool{
+	"take": true, "limit": true, "sort": true, "order": true, "top": true,
+	"sample": true, "serialize": true, "as": true, "render": true,
+}
+
+// replacingOperators produce columns unrelated to their input.
+var replacingOperators = map[string]bool{
+	"make-series": true, "evaluate": true, "getschema": true, "reduce": true,
+	"facet": true, "top-nested": true, "invoke": true,
+}
+
+// pipeline returns the relation entering each operator of body, followed by the
+// relation it returns.
+func (s *schema) pipeline(body *ast.TabularExpression) []*relation {
+	out := make([]*relation, 0, len(body.Operators)+1)
+	current := s.source(body)
+	out = append(out, current)
+	for _, op := range body.Operators {
+		current = s.apply(current, op)
+		out = append(out, current)
+	}
+	return out
+}
+
+// pipeStage is an operator with the relations entering and leaving it.
+type pipeStage struct {
+	op      ast.Operator
+	in, out *relation
+}
+
+// stages returns the operators of body numbered the way the extractor numbers
+// PipeStage: a subquery source and the pipelines nested in an operator, like a
+// join's right side or union legs, come before the operator itself.
+func (s *schema) stages(body *ast.TabularExpression) []pipeStage {
+	var out []pipeStage
+	s.appendStages(body, &out)
+	return out
+}
+
+// appendStages appends the stages of body to out and returns the relation body
+// returns.
+func (s *schema) appendStages(body *ast.TabularExpression, out *[]pipeStage) *relation {
+	var current *relation
+	if src, ok := body.Source.(*ast.SubquerySource); ok && src.Query != nil {
+		current = s.appendStages(src.Query, out)
+	} else {
+		current = s.source(body)
+	}
+	for _, op := range body.Operators {
+		switch o := op.(type) {
+		case *ast.JoinOperator:
+			if o.Right != nil {
+				s.appendStages(o.Right, out)
+			}
+		case *ast.UnionOperator:
+			for _, leg := range o.Tables {
+				s.appendStages(leg, out)
+			}
+		}
+		next := s.apply(current, op)
+		*out = append(*out, pipeStage{op, current, next})
+		current = next
+	}
+	return current
+}
+
+// output returns the relation body returns.
+func (s *schema) output(body *ast.TabularExpression) *relation {
+	relations := s.pipeline(body)
+	return relations[len(relations)-1]
+}
+
+// source returns the relation read by body's source.
+func (s *schema) source(body *ast.TabularExpression) *relation {
+	switch src := body.Source.(type) {
+	case *ast.TableSource:
+		if src.Name == "DummyTable" {
+			// A leading union is parsed as DummyTable | union ..., which adds
+			// nothing of its own. Otherwise DummyTable stands for a source
+			// normalization could not keep, like a placeholder.
+			if len(body.Operators) > 0 {
+				if _, ok := body.Operators[0].(*ast.UnionOperator); ok {
+					r := newRelation()
+					r.leading = true
+					return r
+				}
+			}
+			return openRelation()
+		}
+		return tableRelation(s.catalog, src.Name)
+	case *ast.SubquerySource:
+		if src.Query != nil {
+			return s.output(src.Query)
+		}
+	}
+	return openRelation()
+}
+
+func (s *schema) apply(in *relation, op ast.Operator) *relation {
+	switch o := op.(type) {
+	case *ast.WhereOperator:
+		return in
+	case *ast.ExtendOperator:
+		// Columns of an extend can use those defined before them in the same extend.
+		out := in.clone()
+		for _, col := range o.Columns {
+			if name := col.OutputName(); name != "" {
+				out.add(relColumn{name, s.checker(out).typeOf(col.Expr)})
+			} else {
+				out.open = true
+			}
+		}
+		return out
+	case *ast.ProjectOperator:
+		out := reshaped(in, "project")
+		s.addColumns(out, in, o.Columns)
+		return out
+	case *ast.SummarizeOperator:
+		out := reshaped(in, "summarize")
+		s.addColumns(out, in, o.By)
+		for _, col := range o.Aggregates {
+			s.addAggregate(out, in, col)
+		}
+		return out
+	case *ast.JoinOperator:
+		return s.join(in, o)
+	case *ast.UnionOperator:
+		out := in.clone()
+		for i, leg := range o.Tables {
+			switch {
+			case i == 0 && in.leading:
+				out = s.output(leg).clone()
+			case strings.EqualFold(o.Kind, "inner"):
+				out = intersectRelation(out, s.output(leg))
+			default:
+				mergeRelation(out, s.output(leg))
+			}
+		}
+		if o.WithSource != "" {
+			// The source column comes first
+			withSource := newRelation()
+			withSource.add(relColumn{o.WithSource, TypeString})
+			mergeRelation(withSource, out)
+			withSource.reshape, withSource.bags = out.reshape, out.bags
+			out = withSource
+		}
+		return out
+	case *ast.ProjectRenameOperator:
+		out := in.clone()
+		for _, col := range o.Columns {
+			old := col.Expr.(*ast.Ident).Name
+			if c, ok := in.column(old); ok {
+				out.rename(old, relColumn{col.Name, c.Type})
+			} else {
+				out.add(relColumn{Name: col.Name})
+			}
+		}
+		return out
+	case *ast.ProjectAwayOperator:
+		out := newRelation()
+		out.open, out.tables, out.reshape = in.open, in.tables, in.reshape
+		for _, col := range in.columns {
+			if !matchesAnyPattern(col.Name, o.Columns) {
+				out.add(col)
+			}
+		}
+		return out
+	case *ast.MvExpandOperator:
+		out := in.clone()
+		for _, item := range o.Items {
+			name := item.OutputName()
+			if name == "" {
+				out.open = true
+				continue
+			}
+			t := TypeDynamic
+			if item.Type != "" {
+				t, _ = parseColumnType(item.Type)
+			}
+			out.add(relColumn{name, t})
+		}
+		if o.ItemIndex != "" {
+			out.add(relColumn{o.ItemIndex, TypeLong})
+		}
+		return out
+	case *ast.ParseOperator:
+		return parsedColumns(in, o.Pattern)
+	case *ast.ParseKvOperator:
+		return parsedColumns(in, o.Columns)
+	case *ast.GenericOperator:
+		return s.generic(in, o)
+	}
+	return in.untyped()
+}
+
+// matchesAnyPattern reports whether name matches one of the column patterns of
+// project-away and the like, where * stands for any text.
+func matchesAnyPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchWildcard(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchWildcard(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return strings.HasSuffix(name, parts[len(parts)-1])
+}
+
+// reshaped starts the relation of an operator that replaces in's columns.
+func reshaped(in *relation, keyword string) *relation {
+	out := newRelation()
+	out.tables = in.tables
+	out.reshape = keyword
+	return out
+}
+
+// addColumns adds the output columns of project or summarize items to out. Items
+// whose name KQL makes up, like Column1 for an unnamed expression, leave out open.
+func (s *schema) addColumns(out, in *relation, columns []*ast.Column) {
+	for _, col := range columns {
+		name := col.OutputName()
+		if name == "" {
+			name = binnedColumn(col.Expr)
+		}
+		if name == "" || strings.ContainsAny(name, "*") {
+			out.open = true
+			continue
+		}
+		out.add(relColumn{name, s.checker(in).typeOf(col.Expr)})
+	}
+}
+
+// binnedColumn returns the column KQL names an unnamed bin(Column, ...) or
+// floor(Column, ...) after.
+func binnedColumn(expr ast.Expr) string {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok || len(call.Args) == 0 {
+		return ""
+	}
+	switch strings.ToLower(call.Func) {
+	case "bin", "floor":
+		if id, ok := call.Args[0].(*ast.Ident); ok {
+			return id.Name
+		}
+	}
+	return ""
+}
+
+// addAggregate adds the output columns of a summarize aggregation to out.
+func (s *schema) addAggregate(out, in *relation, col *ast.Column) {
+	call, _ := col.Expr.(*ast.CallExpr)
+	if call != nil {
+		switch strings.ToLower(call.Func) {
+		case "arg_max", "arg_min":
+			addArgExtreme(out, in, col.Name, call)
+			return
+		}
+	}
+	name := col.Name
+	if name == "" {
+		name = aggregateName(col.Expr)
+	}
+	if name == "" {
+		out.open = true
+		return
+	}
+	out.add(relColumn{name, s.checker(in).typeOf(col.Expr)})
+}
+
+// addArgExtreme adds the columns of arg_max or arg_min: the one maximized or
+// minimized, renamed when the aggregation is named, then the other arguments,
+// where * stands for all the input's columns. Columns already output by the
+// summarize's by clause are not repeated.
+func addArgExtreme(out, in *relation, name string, call *ast.CallExpr) {
+	add := func(col relColumn) {
+		if _, ok := out.column(col.Name); !ok {
+			out.add(col)
+		}
+	}
+	for i, arg := range call.Args {
+		switch a := arg.(type) {
+		case *ast.StarExpr:
+			for _, col := range in.columns {
+				add(col)
+			}
+			out.open = out.open || in.open
+		case *ast.Ident:
+			col, ok := in.column(a.Name)
+			if !ok {
+				col = relColumn{Name: a.Name}
+			}
+			if i == 0 && name != "" {
+				col.Name = name
+			}
+			add(col)
+		default:
+			out.open = true
+		}
+	}
+}
+
+// aggregatePrefixes are the column name prefixes KQL gives unnamed aggregations.
+var aggregatePrefixes = map[string]string{
+	"count": "count_", "countif": "countif_", "dcount": "dcount_", "dcountif": "dcountif_",
+	"sum": "sum_", "sumif": "sumif_", "avg": "avg_", "avgif": "avgif_", "min": "min_", "max": "max_",
+	"stdev": "stdev_", "variance": "variance_", "make_set": "set_", "make_list": "list_",
+	"take_any": "any_", "any": "any_", "makeset": "set_", "makelist": "list_",
+}
+
+// aggregateName returns the column name KQL gives an unnamed aggregation such as
+// count() or dcount(Account), or "" when it does not follow the simple pattern.
+func aggregateName(expr ast.Expr) string {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return ""
+	}
+	name := strings.ToLower(call.Func)
+	prefix, ok := aggregatePrefixes[name]
+	switch {
+	case !ok:
+		return ""
+	case name == "count" || name == "countif":
+		return prefix
+	case len(call.Args) > 0:
+		if id, ok := call.Args[0].(*ast.Ident); ok {
+			return prefix + id.Name
+		}
+	}
+	return ""
+}
+
+// join returns the columns of a join: the left side's, the right side's, or both,
+// in which case right columns whose name is already taken get a 1 suffix.
+func (s *schema) join(left *relation, op *ast.JoinOperator) *relation {
+	right := openRelation()
+	if op.Right != nil {
+		right = s.output(op.Right)
+	}
+	switch strings.ToLower(op.Kind) {
+	case "leftsemi", "leftanti", "leftantisemi", "anti":
+		return left
+	case "rightsemi", "rightanti", "rightantisemi":
+		return right
+	}
+	out := left.clone()
+	for _, col := range right.columns {
+		if _, ok := out.column(col.Name); ok {
+			col.Name += "1"
+		}
+		out.add(col)
+	}
+	out.open = left.open || right.open
+	out.tables = append(out.tables, right.tables...)
+	return out
+}
+
+// mergeRelation adds the columns of a union leg to out.
+func mergeRelation(out, leg *relation) {
+	for _, col := range leg.columns {
+		if _, ok := out.column(col.Name); !ok {
+			out.add(col)
+		}
+	}
+	out.open = out.open || leg.open
+	out.tables = append(out.tables, leg.tables...)
+}
+
+// intersectRelation returns the columns out and a union leg have in common, for
+// union kind=inner.
+func intersectRelation(out, leg *relation) *relation {
+	r := newRelation()
+	for _, col := range out.columns {
+		if _, ok := leg.column(col.Name); ok {
+			r.add(col)
+		}
+	}
+	r.open = out.open && leg.open
+	r.tables = append(append(r.tables, out.tables...), leg.tables...)
+	return r
+}
+
+// parsedColumns adds the columns a parse or parse-kv operator extracts, which are
+// strings unless the pattern declares their type.
+func parsedColumns(in *relation, items []*ast.ParsePatternItem) *relation {
+	out := in.clone()
+	for _, item := range items {
+		if item.Column != "" {
+			t := TypeString
+			if item.Type != "" {
+				t, _ = parseColumnType(item.Type)
+			}
+			out.add(relColumn{item.Column, t})
+		}
+	}
+	return out
+}
+
+// generic handles the operators without a dedicated node.
+func (s *schema) generic(in *relation, op *ast.GenericOperator) *relation {
+	switch {
+	case passthroughOperators[op.Keyword]:
+		return in
+	case op.Keyword == "evaluate" && s.unpackedColumn(op) != "":
+		// bag_unpack replaces the bag with columns named after its keys.
+		out := newRelation()
+		out.open, out.tables, out.reshape = true, in.tables, in.reshape
+		unpacked := s.unpackedColumn(op)
+		out.bags = append(append([]unpackedBag(nil), in.bags...), unpackedBag{unpacked, s.unpackedPrefix(op)})
+		for _, col := range in.columns {
+			if col.Name != unpacked {
+				out.add(col)
+			}
+		}
+		return out
+	case replacingOperators[op.Keyword]:
+		out := reshaped(in, op.Keyword)
+		out.open = true
+		return out
+	case op.Keyword == "project-keep":
+		return keepColumns(in, op.Text)
+	case op.Keyword == "project-reorder":
+		return reorderColumns(in, op.Text)
+	case op.Keyword == "count":
+		out := reshaped(in, op.Keyword)
+		out.add(relColumn{"Count", TypeLong})
+		return out
+	case op.Keyword == "distinct":
+		names, ok := operatorIdentifiers(op.Text)
+		if !ok {
+			return in.untyped()
+		}
+		if len(names) == 1 && names[0] == "*" {
+			return in
+		}
+		out := reshaped(in, op.Keyword)
+		for _, name := range names {
+			col, ok := in.column(name)
+			if !ok {
+				col = relColumn{Name: name}
+			}
+			out.add(col)
+		}
+		return out
+	}
+	return in.untyped()
+}
+
+// keepColumns returns the columns of in that project-keep keeps. Names that are
+// not known in an open input are kept too, as the input may have them.
+func keepColumns(in *relation, text string) *relation {
+	patterns, ok := operatorPatterns(text)
+	if !ok {
+		return in.untyped()
+	}
+	out := newRelation()
+	out.tables, out.reshape = in.tables, in.reshape
+	for _, col := range in.columns {
+		if matchesAnyPattern(col.Name, patterns) {
+			out.add(col)
+		}
+	}
+	if in.open {
+		for _, pattern := range patterns {
+			if strings.Contains(pattern, "*") {
+				out.open = true
+			} else if _, ok := out.column(pattern); !ok {
+				out.add(relColumn{Name: pattern})
+			}
+		}
+	}
+	return out
+}
+
+// reorderColumns returns the columns of in with those project-reorder lists
+// first, in the order of its patterns.
+func reorderColumns(in *relation, text string) *relation {
+	patterns, ok := operatorPatterns(text)
+	if !ok {
+		return in
+	}
+	out := newRelation()
+	out.open, out.tables, out.reshape = in.open, in.tables, in.reshape
+	for _, pattern := range patterns {
+		for _, col := range in.columns {
+			if matchWildcard(pattern, col.Name) {
+				if _, ok := out.column(col.Name); !ok {
+					out.add(col)
+				}
+			}
+		}
+	}
+	for _, col := range in.columns {
+		if _, ok := out.column(col.Name); !ok {
+			out.add(col)
+		}
+	}
+	return out
+}
+
+// operatorPatterns returns the comma-separated column patterns after an
+// operator's keyword, and false when an item is not a name with * wildcards.
+func operatorPatterns(text string) ([]string, bool) {
+	var patterns []string
+	for _, item := range splitByTopLevelComma(operatorArguments(text)) {
+		item = strings.TrimSpace(item)
+		if item != "*" && !isPlainIdentifier(strings.ReplaceAll(item, "*", "")) {
+			return nil, false
+		}
+		patterns = append(patterns, item)
+	}
+	return patterns, len(patterns) > 0
+}
+
+// unpackedColumn returns the column evaluate bag_unpack(Column) unpacks, or "".
+func (s *schema) unpackedColumn(op *ast.GenericOperator) string {
+	call := s.evaluatePlugin(op)
+	if call == nil || !strings.EqualFold(call.Func, "bag_unpack") || len(call.Args) == 0 {
+		return ""
+	}
+	if id, ok := call.Args[0].(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// unpackedPrefix returns the prefix evaluate bag_unpack(Column, "prefix") gives the
+// columns it adds, or "".
+func (s *schema) unpackedPrefix(op *ast.GenericOperator) string {
+	call := s.evaluatePlugin(op)
+	if call == nil || len(call.Args) < 2 {
+		return ""
+	}
+	if lit, ok := call.Args[1].(*ast.Literal); ok && lit.Kind == ast.StringLiteral {
+		prefix, _ := unquoteString(lit.Text)
+		return prefix
+	}
+	return ""
+}
+
+// rename replaces the column called old with col.
+func (r *relation) rename(old string, col relColumn) {
+	i := r.index[old]
+	delete(r.index, old)
+	r.columns[i] = col
+	r.index[col.Name] = i
+}
+
+// operatorArguments returns the text after an operator's keyword.
+func operatorArguments(text string) string {
+	text = strings.TrimSpace(text)
+	if i := strings.IndexAny(text, " \t\r\n("); i > 0 {
+		return strings.TrimSpace(text[i:])
+	}
+	return ""
+}
+
+// operatorIdentifiers returns the comma-separated column names after an operator's
+// keyword, and false when an item is not a plain name.
+func operatorIdentifiers(text string) ([]string, bool) {
+	var names []string
+	for _, item := range splitByTopLevelComma(operatorArguments(text)) {
+		item = strings.TrimSpace(item)
+		if item != "*" && !isPlainIdentifier(item) {
+			return nil, false
+		}
+		names = append(names, item)
+	}
+	return names, len(names) > 0
+}
+
+// isPlainIdentifier reports whether s is a column name without quoting.
+func isPlainIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		case i > 0 && c >= '0' && c <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package kql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOutputColumns(t *testing.T) {
+	tests := []struct {
+		query    string
+		want     []OutputColumn
+		complete bool
+	}{
+		{"SecurityEvent | extend Cmd = tolower(CommandLine) | project Cmd, Account, EventID",
+			[]OutputColumn{{"Cmd", TypeString}, {"Account", TypeString}, {"EventID", TypeInt}}, true},
+		{"SecurityEvent | summarize Count = count(), dcount(Account), max(TimeGenerated), make_set(Process) by Computer, bin(TimeGenerated, 1h)",
+			[]OutputColumn{{"Computer", TypeString}, {"TimeGenerated", TypeDatetime}, {"Count", TypeLong},
+				{"dcount_Account", TypeLong}, {"max_TimeGenerated", TypeDatetime}, {"set_Process", TypeDynamic}}, true},
+		{"SecurityEvent | project-keep Account, Event* | project-reorder EventID",
+			[]OutputColumn{{"EventID", TypeInt}, {"EventSourceName", TypeString}, {"EventData", TypeString}, {"Account", TypeString}}, true},
+		{"SecurityEvent | join kind=leftanti (SigninLogs) on $left.Account == $right.UserPrincipalName | distinct Account, EventID",
+			[]OutputColumn{{"Account", TypeString}, {"EventID", TypeInt}}, true},
+		{"SecurityEvent | join (SigninLogs | project Account = UserPrincipalName, IPAddress) on Account | project Account1, IPAddress",
+			[]OutputColumn{{"Account1", TypeString}, {"IPAddress", TypeString}}, true},
+		{"union SigninLogs, AADNonInteractiveUserSignInLogs | top 10 by TimeGenerated | project UserPrincipalName, TimeGenerated",
+			[]OutputColumn{{"UserPrincipalName", TypeString}, {"TimeGenerated", TypeDatetime}}, true},
+		{"SecurityEvent | count", []OutputColumn{{"Count", TypeLong}}, true},
+		{"MyTable | project A, B", []OutputColumn{{"A", ""}, {"B", ""}}, true},
+		{"MyTable | where A == 1", nil, false},
+		{"MyTable | project-keep A, B* | where A == 1", []OutputColumn{{"A", ""}}, false},
+	}
+	catalog := completeCatalog("SecurityEvent", "SigninLogs", "AADNonInteractiveUserSignInLogs")
+	for _, tt := range tests {
+		result := ExtractConditionsWithOptions(tt.query, Options{Catalog: catalog})
+		if !reflect.DeepEqual(result.OutputColumns, tt.want) || result.OutputComplete != tt.complete {
+			t.Errorf("%s: expected %v (complete %v), got %v (complete %v)",
+				tt.query, tt.want, tt.complete, result.OutputColumns, result.OutputComplete)
+		}
+	}
+}
+
+func TestOutputColumnsArgMax(t *testing.T) {
+	result := ExtractConditionsWithOptions("SecurityEvent | summarize arg_max(TimeGenerated, *) by Computer | project-away Event*",
+		Options{Catalog: completeCatalog("SecurityEvent")})
+	if !result.OutputComplete || len(result.OutputColumns) < 3 {
+		t.Fatalf("expected all columns of SecurityEvent, got %v", result.OutputColumns)
+	}
+	if first := result.OutputColumns[:2]; !reflect.DeepEqual(first, []OutputColumn{{"Computer", TypeString}, {"TimeGenerated", TypeDatetime}}) {
+		t.Errorf("expected the by column and the maximized column first, got %v", first)
+	}
+	for _, col := range result.OutputColumns {
+		if matchWildcard("Event*", col.Name) {
+			t.Errorf("expected project-away Event* to drop %s", col.Name)
+		}
+	}
+}
+
+func TestOutputCompleteIncompleteTable(t *testing.T) {
+	queries := []string{
+		"SecurityEvent | project-away CommandLine",
+		"SecurityEvent | summarize arg_max(TimeGenerated, *) by Computer",
+		"SecurityEvent | where EventID == 4624",
+	}
+	for _, query := range queries {
+		if result := ExtractConditions(query); result.OutputComplete {
+			t.Errorf("%s: expected incomplete output on the built-in SecurityEvent, got %v", query, result.OutputColumns)
+		}
+		result := ExtractConditionsWithOptions(query, Options{Catalog: completeCatalog("SecurityEvent")})
+		if !result.OutputComplete {
+			t.Errorf("%s: expected complete output with a complete catalog", query)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package kql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxSuggestions bounds the corrections offered for an unknown column.
+const maxSuggestions = 3
+
+// validateSchema checks the main conditions against the columns the catalog gives
+// for the pipe stage they filter, stages being the query's as schema.stages
+// numbers them. Conditions the parser did not locate, such
+// as those of the string-based fallback, have no reliable stage and are skipped,
+// as are fields that normalization made up, like DummyParam for a placeholder.
+func validateSchema(conditions []Condition, stages []pipeStage, original string) []Diagnostic {
+	var out []Diagnostic
+	for _, cond := range conditions {
+		if cond.Scope != ScopeMain || cond.Span == nil || cond.PipeStage >= len(stages) ||
+			!strings.Contains(cond.Span.Text(original), fieldRoot(cond.Field)) {
+			continue
+		}
+		if d := checkCondition(cond, stages[cond.PipeStage].in); d != nil {
+			if d.Span = cond.Span; d.Span != nil {
+				d.Line, d.Column = Position(original, d.Span.Start)
+			}
+			out = append(out, *d)
+		}
+	}
+	return out
+}
+
+// checkCondition returns the problem with cond's field in rel, or nil.
+func checkCondition(cond Condition, rel *relation) *Diagnostic {
+	root := fieldRoot(cond.Field)
+	if !isPlainIdentifier(root) {
+		return nil
+	}
+	col, found, exact := rel.lookup(root)
+	switch {
+	case !found && rel.open:
+		// The column may exist without the catalog listing it, but one that
+		// nearly matches a listed column is likely a typo of it.
+		suggestions := suggestColumns(root, rel)
+		if len(suggestions) == 0 {
+			return nil
+		}
+		return &Diagnostic{
+			Severity:    SeverityInfo,
+			Code:        CodeUnknownColumn,
+			Message:     fmt.Sprintf("column %q is not listed %s; did you mean %q?", root, relationPlace(rel), suggestions[0]),
+			Suggestions: suggestions,
+		}
+	case !found || !exact:
+		d := &Diagnostic{
+			Severity:    SeverityWarning,
+			Code:        CodeUnknownColumn,
+			Message:     fmt.Sprintf("column %q does not exist %s", root, relationPlace(rel)),
+			Suggestions: suggestColumns(root, rel),
+		}
+		if len(d.Suggestions) > 0 {
+			d.Message += fmt.Sprintf("; did you mean %q?", d.Suggestions[0])
+		}
+		return d
+	case root != cond.Field || col.Type == "":
+		return nil
+	}
+	if problem := typeMismatch(cond, col.Type); problem != "" {
+		return &Diagnostic{
+			Severity: SeverityWarning,
+			Code:     CodeTypeMismatch,
+			Message:  fmt.Sprintf("%s is %s, but %s", col.Name, col.Type, problem),
+		}
+	}
+	return nil
+}
+
+// fieldRoot returns the column a field reads, without its property path.
+func fieldRoot(field string) string {
+	if i := strings.IndexAny(field, ".["); i >= 0 {
+		return field[:i]
+	}
+	return field
+}
+
+// relationPlace describes where a column was looked up, for messages.
+func relationPlace(rel *relation) string {
+	if rel.reshape != "" {
+		return "after " + rel.reshape
+	}
+	if len(rel.tables) > 0 {
+		return "on " + strings.Join(rel.tables, ", ")
+	}
+	return "in the input"
+}
+
+// suggestColumns returns the columns of rel whose name is closest to name, best
+// first: a different case, then one or two typos depending on the name's length.
+func suggestColumns(name string, rel *relation) []string {
+	limit := 1
+	if len(name) >= 6 {
+		limit = 2
+	}
+	lower := strings.ToLower(name)
+	type candidate struct {
+		name     string
+		distance int
+	}
+	var candidates []candidate
+	for _, col := range rel.columns {
+		if d := editDistance(lower, strings.ToLower(col.Name)); d <= limit {
+			candidates = append(candidates, candidate{col.Name, d})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+	var out []string
+	for _, c := range candidates {
+		if len(out) == maxSuggestions {
+			break
+		}
+		out = append(out, c.name)
+	}
+	return out
+}
+
+// editDistance returns the number of single-byte insertions, deletions,
+// substitutions and transpositions that turn a into b.
+func editDistance(a, b string) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// typeCategories groups column and literal types that compare with each other.
+var typeCategories = map[string]string{
+	string(TypeInt): "number", string(TypeLong): "number", string(TypeReal): "number",
+	string(TypeDecimal): "number", string(TypeString): "string", string(TypeBool): "bool",
+	string(TypeDatetime): "datetime", string(TypeTimespan): "timespan",
+}
+
+// typeMismatch returns why cond cannot apply to a column of type t, or "".
+func typeMismatch(cond Condition, t ColumnType) string {
+	columnCategory := typeCategories[string(t)]
+	if columnCategory == "" {
+		return ""
+	}
+	switch cond.OperatorFamily {
+	case FamilyTerm, FamilySubstring, FamilyRegex:
+		if columnCategory != "string" {
+			return cond.Operator + " compares strings"
+		}
+	case FamilyEquality, FamilyRange:
+		if cond.Literal == nil {
+			return ""
+		}
+		if valueCategory := typeCategories[string(cond.Literal.Kind)]; valueCategory != "" && valueCategory != columnCategory {
+			return "it is compared with a " + string(cond.Literal.Kind)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package kql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		query       string
+		code        DiagnosticCode
+		message     string
+		suggestions []string
+	}{
+		{`DeviceProcessEvents | where ProcesCommandLine has "x"`, CodeUnknownColumn,
+			`column "ProcesCommandLine" does not exist on DeviceProcessEvents; did you mean "ProcessCommandLine"?`, []string{"ProcessCommandLine"}},
+		{`SecurityEvent | where ProcessCommandLine has "x"`, CodeUnknownColumn,
+			`column "ProcessCommandLine" does not exist on SecurityEvent`, nil},
+		{`SecurityEvent | where eventid == 4624`, CodeUnknownColumn,
+			`column "eventid" does not exist on SecurityEvent; did you mean "EventID"?`, []string{"EventID"}},
+		{`SecurityEvent | summarize count() by Account | where Computer == "a"`, CodeUnknownColumn,
+			`column "Computer" does not exist after summarize`, nil},
+		{`SecurityEvent | project-rename Acct = Account | where Account == "a"`, CodeUnknownColumn,
+			`column "Account" does not exist on SecurityEvent`, nil},
+		{`SecurityEvent | where EventID has "46"`, CodeTypeMismatch, "EventID is int, but has compares strings", nil},
+		{`SecurityEvent | where EventID == "4624"`, CodeTypeMismatch, "EventID is int, but it is compared with a string", nil},
+		{`SigninLogs | where IsInteractive == 1`, CodeTypeMismatch, "IsInteractive is bool, but it is compared with a long", nil},
+	}
+	catalog := completeCatalog("SecurityEvent", "DeviceProcessEvents", "SigninLogs")
+	for _, tt := range tests {
+		result := ExtractConditionsWithOptions(tt.query, Options{Catalog: catalog, ValidateSchema: true})
+		var found []Diagnostic
+		found = append(found, result.DiagnosticsWithCode(CodeUnknownColumn)...)
+		found = append(found, result.DiagnosticsWithCode(CodeTypeMismatch)...)
+		if len(found) != 1 {
+			t.Errorf("%s: expected one schema diagnostic, got %+v", tt.query, found)
+			continue
+		}
+		d := found[0]
+		if d.Code != tt.code || d.Message != tt.message || !reflect.DeepEqual(d.Suggestions, tt.suggestions) ||
+			d.Severity != SeverityWarning || d.Span == nil {
+			t.Errorf("%s: unexpected diagnostic %+v", tt.query, d)
+		}
+		if len(result.Errors) != 0 {
+			t.Errorf("%s: schema diagnostics should not be in Errors, got %v", tt.query, result.Errors)
+		}
+	}
+}
+
+// completeCatalog returns the default catalog with the named tables marked
+// complete, as if they listed every column.
+func completeCatalog(names ...string) *Catalog {
+	c := DefaultCatalog().Merge(nil)
+	for _, name := range names {
+		table := *c.Table(name)
+		table.Complete = true
+		c.add(&table)
+	}
+	return c
+}
+
+func TestValidateSchemaAccepts(t *testing.T) {
+	for _, query := range []string{
+		`SecurityEvent | where EventID == 4624 and Account has "admin"`,
+		`SecurityEvent | extend Cmd = CommandLine | where Cmd has "x"`,
+		`SecurityEvent | summarize count() by Account | where count_ > 5`,
+		`SecurityEvent | project-rename Acct = Account | where Acct == "a"`,
+		`DeviceProcessEvents | join (DeviceNetworkEvents) on DeviceId | where RemoteIP == "1" and DeviceId1 == "x"`,
+		`SigninLogs | where LocationDetails.countryOrRegion == "US"`,
+		`union SigninLogs, AADNonInteractiveUserSignInLogs | where UserPrincipalName == "x"`,
+		`MyApp_CL | where Anything == 1`,
+		`DeviceProcessEvents | mv-expand Tags = AdditionalFields | where Tags == 1`,
+		`Syslog | parse SyslogMessage with * "user=" User " " * | where isnotempty(User)`,
+		`SecurityEvent | parse-kv EventData as (Port:long) | where Port == 22`,
+		`T1 | where Status == "Failed"`,
+	} {
+		result := ExtractConditionsWithOptions(query, Options{ValidateSchema: true})
+		for _, d := range result.Diagnostics {
+			if d.Code == CodeUnknownColumn || d.Code == CodeTypeMismatch {
+				t.Errorf("%s: unexpected diagnostic %+v", query, d)
+			}
+		}
+	}
+
+	if result := ExtractConditions(`SecurityEvent | where ProcessCommandLine has "x"`); len(result.DiagnosticsWithCode(CodeUnknownColumn)) != 0 {
+		t.Error("expected schema validation to be off by default")
+	}
+}
+
+// Built-in tables do not list every column, so a real column missing from the
+// catalog is not reported; a column of the wrong case is, and a near miss of a
+// listed column is noted.
+func TestValidateSchemaIncompleteTable(t *testing.T) {
+	query := `SecurityEvent | where VirtualAccount == "%%1843" and RestrictedAdminMode == "-" and TargetOutboundUserName == "x"`
+	result := ExtractConditionsWithOptions(query, Options{ValidateSchema: true})
+	if d := result.DiagnosticsWithCode(CodeUnknownColumn); len(d) != 0 {
+		t.Errorf("expected no unknown columns on an incomplete table, got %+v", d)
+	}
+
+	result = ExtractConditionsWithOptions(`SecurityEvent | where eventid == 4624`, Options{ValidateSchema: true})
+	if d := result.DiagnosticsWithCode(CodeUnknownColumn); len(d) != 1 || !reflect.DeepEqual(d[0].Suggestions, []string{"EventID"}) {
+		t.Errorf("expected the case of EventID to be corrected, got %+v", d)
+	}
+
+	// A near miss of a listed column is still reported, as a note
+	result = ExtractConditionsWithOptions(`DeviceProcessEvents | where ProcessCommandLne has "x"`, Options{ValidateSchema: true})
+	d := result.DiagnosticsWithCode(CodeUnknownColumn)
+	if len(d) != 1 || d[0].Severity != SeverityInfo || !reflect.DeepEqual(d[0].Suggestions, []string{"ProcessCommandLine"}) {
+		t.Errorf("expected ProcessCommandLine to be suggested, got %+v", d)
+	}
+}
+
+func TestValidateSchemaCustomTable(t *testing.T) {
+	custom, err := LoadCatalog([]byte(`{"tables": {"MyApp_CL": {"columns": {"Message_s": "string"}, "complete": true}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := ExtractConditionsWithOptions(`MyApp_CL | where Mesage_s has "x"`,
+		Options{Catalog: DefaultCatalog().Merge(custom), ValidateSchema: true})
+	if d := result.DiagnosticsWithCode(CodeUnknownColumn); len(d) != 1 || !reflect.DeepEqual(d[0].Suggestions, []string{"Message_s"}) {
+		t.Errorf("expected a suggestion from the custom table, got %+v", d)
+	}
+}
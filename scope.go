@@ -0,0 +1,301 @@
+package kql
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// ScopeKind says which part of a query a condition was found in.
+type ScopeKind string
+
+const (
+	ScopeMain        ScopeKind = "main"        // A filter of the main pipeline
+	ScopeLet         ScopeKind = "let"         // The body of a let statement; ScopeName is the let name
+	ScopeJoin        ScopeKind = "join"        // The right side of a join; ScopeName is its first data source
+	ScopeSubquery    ScopeKind = "subquery"    // A toscalar() subquery, or a parenthesized one such as the list of in; ScopeName is toscalar or its first data source
+	ScopeFunction    ScopeKind = "function"    // An argument of a scalar function such as iff or case; ScopeName is the function
+	ScopeAggregation ScopeKind = "aggregation" // The predicate of a conditional aggregation such as countif; ScopeName is the aggregation
+	ScopeMvApply     ScopeKind = "mv-apply"    // The subquery of an mv-apply; ScopeName is the array column it applies to
+)
+
+// scopeFrame is a construct outside the main pipeline that the walker is inside.
+type scopeFrame struct {
+	kind     ScopeKind
+	name     string
+	stage    int                     // currentStage to restore when leaving a subquery
+	elements map[string]arrayElement // elements to restore when leaving an mv-apply
+}
+
+// conditionalAggregations take a predicate that selects the rows they aggregate.
+var conditionalAggregations = map[string]bool{
+	"countif": true, "dcountif": true, "sumif": true, "avgif": true,
+	"minif": true, "maxif": true, "anyif": true, "stdevif": true, "varianceif": true,
+	"percentileif": true, "arg_maxif": true, "arg_minif": true,
+	"make_set_if": true, "make_list_if": true, "make_bag_if": true,
+	"makeset_if": true, "makelist_if": true, "take_anyif": true, "hll_if": true,
+}
+
+// existenceChecks are the functions turned into isnull/isnotnull conditions.
+var existenceChecks = map[string]bool{
+	"isnotempty": true, "isnotnull": true, "isnull": true, "isempty": true,
+}
+
+// pushScope enters a construct outside the main pipeline.
+func (e *conditionExtractor) pushScope(kind ScopeKind, name string) {
+	e.scopes = append(e.scopes, scopeFrame{kind: kind, name: name, stage: e.currentStage})
+}
+
+// popScope leaves the innermost construct entered with pushScope.
+func (e *conditionExtractor) popScope() scopeFrame {
+	frame := e.scopes[len(e.scopes)-1]
+	e.scopes = e.scopes[:len(e.scopes)-1]
+	return frame
+}
+
+// EnterToScalarExpression starts a subquery scope. Its operators are numbered from
+// zero, independently of the enclosing pipeline.
+func (e *conditionExtractor) EnterToScalarExpression(ctx *ToScalarExpressionContext) {
+	e.pushScope(ScopeSubquery, "toscalar")
+	e.currentStage = 0
+}
+
+// ExitToScalarExpression restores the stage counter of the enclosing pipeline.
+func (e *conditionExtractor) ExitToScalarExpression(ctx *ToScalarExpressionContext) {
+	e.currentStage = e.popScope().stage
+}
+
+// EnterPrimaryExpression starts a subquery scope for a parenthesized tabular
+// expression, such as the list of in ((T | where ...)). Like toscalar, its
+// operators are numbered from zero.
+func (e *conditionExtractor) EnterPrimaryExpression(ctx *PrimaryExpressionContext) {
+	if ctx.TabularExpression() == nil {
+		return
+	}
+	e.pushScope(ScopeSubquery, ctx.TabularExpression().GetStart().GetText())
+	e.currentStage = 0
+}
+
+// ExitPrimaryExpression closes the scope opened by EnterPrimaryExpression.
+func (e *conditionExtractor) ExitPrimaryExpression(ctx *PrimaryExpressionContext) {
+	if ctx.TabularExpression() == nil {
+		return
+	}
+	e.currentStage = e.popScope().stage
+}
+
+// EnterMvApplyOperator starts an mv-apply scope. Its operators are numbered from
+// zero, and conditions on its items are attributed to the array they expand.
+func (e *conditionExtractor) EnterMvApplyOperator(ctx *MvApplyOperatorContext) {
+	elements := make(map[string]arrayElement, len(e.elements))
+	for name, element := range e.elements {
+		elements[name] = element
+	}
+	name := ""
+	if list := ctx.MvApplyItemList(); list != nil {
+		for _, item := range list.AllMvApplyItem() {
+			if item.Expression() == nil {
+				continue
+			}
+			text := item.Expression().GetText()
+			element := e.arrayOf(text)
+			if name == "" {
+				name = element.array.Root
+			}
+			alias := text
+			if item.Identifier() != nil {
+				alias = item.Identifier().GetText()
+			}
+			if isSimpleIdentifier(alias) {
+				elements[strings.ToLower(alias)] = element
+			}
+		}
+	}
+	e.pushScope(ScopeMvApply, name)
+	e.scopes[len(e.scopes)-1].elements = e.elements
+	e.elements = elements
+	e.currentStage = 0
+}
+
+// ExitMvApplyOperator restores the stage counter and the elements of the
+// enclosing pipeline.
+func (e *conditionExtractor) ExitMvApplyOperator(ctx *MvApplyOperatorContext) {
+	frame := e.popScope()
+	e.currentStage = frame.stage
+	e.elements = frame.elements
+}
+
+// EnterIffExpression starts a function scope for iff() and iif().
+func (e *conditionExtractor) EnterIffExpression(ctx *IffExpressionContext) {
+	e.pushScope(ScopeFunction, strings.ToLower(ctx.GetStart().GetText()))
+}
+
+// ExitIffExpression closes the scope opened by EnterIffExpression.
+func (e *conditionExtractor) ExitIffExpression(ctx *IffExpressionContext) {
+	e.popScope()
+}
+
+// EnterCaseExpression starts a function scope for case().
+func (e *conditionExtractor) EnterCaseExpression(ctx *CaseExpressionContext) {
+	e.pushScope(ScopeFunction, "case")
+}
+
+// ExitCaseExpression closes the scope opened by EnterCaseExpression.
+func (e *conditionExtractor) ExitCaseExpression(ctx *CaseExpressionContext) {
+	e.popScope()
+}
+
+// tagScope sets the scope of conditions found in a nested query, such as a join's
+// right side or a let body. The outermost construct wins, so a countif inside a
+// let body is reported under the let.
+func tagScope(conditions []Condition, kind ScopeKind, name string) []Condition {
+	out := make([]Condition, len(conditions))
+	for i, cond := range conditions {
+		cond.Scope = kind
+		cond.ScopeName = name
+		out[i] = cond
+	}
+	return out
+}
+
+// joinScopedConditions returns the conditions of every join's right side. merged
+// says whether the subsearches already include their scoped conditions in Conditions.
+func joinScopedConditions(joins []JoinInfo, merged bool) []Condition {
+	var out []Condition
+	for _, join := range joins {
+		if join.Subsearch == nil {
+			continue
+		}
+		name := join.RightTable
+		if name == "" && len(join.Subsearch.DataSources) > 0 {
+			name = join.Subsearch.DataSources[0]
+		}
+		out = append(out, tagScope(join.Subsearch.Conditions, ScopeJoin, name)...)
+		if !merged {
+			out = append(out, tagScope(join.Subsearch.ScopedConditions, ScopeJoin, name)...)
+		}
+	}
+	return out
+}
+
+// letScopedConditions extracts the conditions in the bodies of let statements.
+// Tabular bodies are parsed as queries and scalar bodies as a print expression;
+// function and view lets contribute the query between their braces. Errors in
+// a body are not reported, since the main query has already been diagnosed, and
+// the portable fallback is not run, as it would turn literals into keywords.
+// Inlined lets are skipped: their conditions are part of the main query.
+func letScopedConditions(ctx context.Context, query string, lets []LetStatement, limit time.Duration, cfg *extractConfig) []Condition {
+	if len(lets) == 0 {
+		return nil
+	}
+	bodyCfg := *cfg
+	bodyCfg.portableFallback = false
+	bodyCfg.includeSubquery = false
+
+	var out []Condition
+	for _, let := range lets {
+		if let.Span == nil || let.Inlined {
+			continue
+		}
+		start, end, ok := letBodyRange(query, *let.Span)
+		if !ok {
+			continue
+		}
+		body := query[start:end]
+
+		offset := start
+		if !hasTopLevelPipe(body) {
+			const prefix = "print "
+			body = prefix + body
+			offset -= len(prefix)
+		}
+		sub := extractConditionsInternal(ctx, body, limit, &bodyCfg)
+		mapSpans(sub, func(s *Span) {
+			s.Start += offset
+			s.End += offset
+		})
+		out = append(out, tagScope(sub.Conditions, ScopeLet, let.Name)...)
+		out = append(out, tagScope(sub.ScopedConditions, ScopeLet, let.Name)...)
+	}
+	return out
+}
+
+// letBodyRange returns the byte range of the query a let statement binds, given
+// the statement's span. For function and view lets that is the text between the
+// braces of the body.
+func letBodyRange(query string, span Span) (int, int, bool) {
+	raw := span.Text(query)
+	eq := strings.IndexByte(raw, '=')
+	if eq < 0 {
+		return 0, 0, false
+	}
+	start := span.Start + eq + 1
+	end := span.End
+	for start < end && isSpace(query[start]) {
+		start++
+	}
+	rest := query[start:end]
+
+	lower := strings.ToLower(rest)
+	if strings.HasPrefix(lower, "view") && len(rest) > 4 && !isIdentChar(rest[4]) {
+		i := 4
+		for i < len(rest) && isSpace(rest[i]) {
+			i++
+		}
+		rest = rest[i:]
+		start += i
+	}
+	if strings.HasPrefix(rest, "(") {
+		closing := findMatchingParen(rest, 0)
+		if closing < 0 {
+			return start, end, true
+		}
+		i := closing + 1
+		for i < len(rest) && isSpace(rest[i]) {
+			i++
+		}
+		if i == len(rest) || rest[i] != '{' {
+			// A parenthesized query rather than a parameter list
+			return start, end, true
+		}
+		rest = rest[i:]
+		start += i
+	}
+	if strings.HasPrefix(rest, "{") {
+		closing := findMatchingDelimiter(rest, 0, '{', '}')
+		if closing < 0 {
+			return 0, 0, false
+		}
+		return start + 1, start + closing, true
+	}
+	return start, end, start < end
+}
+
+// hasTopLevelPipe reports whether s contains a | outside parentheses and string
+// literals, which distinguishes a tabular let body from a scalar one.
+func hasTopLevelPipe(s string) bool {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'':
+			end := strings.IndexByte(s[i+1:], s[i])
+			if end < 0 {
+				return false
+			}
+			i += end + 1
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case '|':
+			if depth == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
@@ -0,0 +1,190 @@
+package kql
+
+import "testing"
+
+func TestScopedConditions(t *testing.T) {
+	query := `let Admins = IdentityInfo | where Role == "admin" | project AccountUPN;
+let threshold = toscalar(SigninLogs | where ResultType == "50126" | count);
+let f = (x:string) { DeviceEvents | where ActionType == x };
+SigninLogs
+| where UserPrincipalName in (Admins)
+| extend Risk = iff(RiskLevel == "high", 1, 0)
+| summarize Failures = countif(ResultType != "0") by UserPrincipalName
+| join (AADUsers | where Department == "IT") on UserPrincipalName`
+
+	result := ExtractConditions(query)
+
+	type scope struct {
+		scope ScopeKind
+		name  string
+		text  string
+	}
+	check := func(conditions []Condition, want map[string]scope) map[string]bool {
+		found := make(map[string]bool)
+		for _, cond := range conditions {
+			found[cond.Field+"/"+string(cond.Scope)] = true
+			exp, ok := want[cond.Field]
+			if !ok {
+				continue
+			}
+			if cond.Scope != exp.scope || cond.ScopeName != exp.name {
+				t.Errorf("%s: expected scope %s/%s, got %s/%s", cond.Field, exp.scope, exp.name, cond.Scope, cond.ScopeName)
+			}
+			if cond.Span == nil || cond.Span.Text(query) != exp.text {
+				t.Errorf("%s: expected span %q, got %+v", cond.Field, exp.text, cond.Span)
+			}
+		}
+		return found
+	}
+
+	// Predicates of functions and aggregations stay with the main pipeline's
+	if len(result.Conditions) != 3 {
+		t.Errorf("expected the main pipeline's conditions in Conditions, got %+v", result.Conditions)
+	}
+	found := check(result.Conditions, map[string]scope{
+		"UserPrincipalName": {ScopeMain, "", "UserPrincipalName in (Admins)"},
+		"RiskLevel":         {ScopeFunction, "iff", `RiskLevel == "high"`},
+		"ResultType":        {ScopeAggregation, "countif", `ResultType != "0"`},
+	})
+	if len(found) != 3 {
+		t.Errorf("expected UserPrincipalName, RiskLevel and ResultType in Conditions, got %+v", result.Conditions)
+	}
+
+	found = check(result.ScopedConditions, map[string]scope{
+		"Role":       {ScopeLet, "Admins", `Role == "admin"`},
+		"ActionType": {ScopeLet, "f", "ActionType == x"},
+		"Department": {ScopeJoin, "AADUsers", `Department == "IT"`},
+	})
+	if !found["ResultType/let"] {
+		t.Errorf("expected a ResultType condition in scope let, got %+v", result.ScopedConditions)
+	}
+}
+
+// Predicates of iff and case are conditions the parser found, so the portable
+// fallback does not run and turn the values they return into keywords.
+func TestFunctionConditionsSkipFallback(t *testing.T) {
+	tests := []struct {
+		query string
+		field string
+	}{
+		{`SecurityEvent | extend Severity = case(EventID == 4625, "High", EventID == 4624, "Low", "Medium")`, "EventID"},
+		{`SecurityEvent | extend IsAdmin = iff(Account contains "admin", true, false)`, "Account"},
+		{`SigninLogs | summarize Baseline = count() by User | extend Score = iff(Baseline > 0, 1.0, 0.0)`, "Baseline"},
+	}
+	for _, tt := range tests {
+		for _, opts := range []Options{{}, {IncludeSubqueryConditions: true}} {
+			result := ExtractConditionsWithOptions(tt.query, opts)
+			if len(result.Conditions) == 0 {
+				t.Errorf("%s: expected conditions on %s", tt.query, tt.field)
+			}
+			for _, cond := range result.Conditions {
+				if cond.Field != tt.field || cond.Scope != ScopeFunction {
+					t.Errorf("%s: unexpected condition %+v", tt.query, cond)
+				}
+			}
+			for _, d := range result.Diagnostics {
+				if d.Code == CodePortablePredicates || d.Code == CodePortableKeyword {
+					t.Errorf("%s: unexpected fallback %+v", tt.query, d)
+				}
+			}
+		}
+	}
+}
+
+func TestScopedConditionsKeepPipeStage(t *testing.T) {
+	query := `T | where A == toscalar(U | where B == 1 | summarize max(C)) | where D == 2`
+	result := ExtractConditions(query)
+
+	for _, cond := range result.Conditions {
+		if cond.Field == "D" && cond.PipeStage != 1 {
+			t.Errorf("toscalar operators should not advance the outer stage, got %d", cond.PipeStage)
+		}
+	}
+	if len(result.ScopedConditions) != 1 || result.ScopedConditions[0].Scope != ScopeSubquery || result.ScopedConditions[0].PipeStage != 0 {
+		t.Errorf("expected B == 1 at stage 0 of the subquery, got %+v", result.ScopedConditions)
+	}
+}
+
+func TestInSubqueryConditions(t *testing.T) {
+	query := `SigninLogs | where ResultType == "0" and Account in ((SecurityEvent | where EventID == 1 | project Account)) | where AppId == "a"`
+	result := ExtractConditions(query)
+
+	for _, cond := range result.Conditions {
+		if cond.Field == "EventID" {
+			t.Errorf("subquery predicate should not be a main condition, got %+v", cond)
+		}
+		if cond.Field == "AppId" && cond.PipeStage != 1 {
+			t.Errorf("subquery operators should not advance the outer stage, got %d", cond.PipeStage)
+		}
+	}
+	if len(result.ScopedConditions) != 1 {
+		t.Fatalf("expected EventID == 1 in scoped conditions, got %+v", result.ScopedConditions)
+	}
+	if cond := result.ScopedConditions[0]; cond.Field != "EventID" || cond.Scope != ScopeSubquery ||
+		cond.ScopeName != "SecurityEvent" || cond.PipeStage != 0 {
+		t.Errorf("expected EventID == 1 at stage 0 of subquery/SecurityEvent, got %+v", cond)
+	}
+	if len(result.WhereClauses) != 2 || result.WhereClauses[0].PipeStage != 0 || result.WhereClauses[1].PipeStage != 1 {
+		t.Errorf("expected only the two main where clauses, got %+v", result.WhereClauses)
+	}
+}
+
+func TestMvApplyConditions(t *testing.T) {
+	query := `AuditLogs
+| mv-apply with_itemindex=i Target = TargetResources limit 10 on (
+    where Target.type =~ "User"
+    | mv-apply Prop = Target.modifiedProperties on (where Prop.displayName == "StrongAuthenticationMethod")
+)
+| mv-apply Key = bag_keys(AdditionalDetails) to typeof(string) on (where Key startswith "x")
+| where OperationName == "Update user"`
+
+	result := ExtractConditions(query)
+
+	if len(result.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", result.Errors)
+	}
+	if len(result.Conditions) != 1 || result.Conditions[0].Field != "OperationName" || result.Conditions[0].PipeStage != 2 {
+		t.Errorf("expected only OperationName at stage 2 in Conditions, got %+v", result.Conditions)
+	}
+	want := map[string]struct {
+		name, source, path, text string
+	}{
+		"Target.type":      {"TargetResources", "TargetResources", "$[*].type", `Target.type =~ "User"`},
+		"Prop.displayName": {"TargetResources", "TargetResources", "$[*].modifiedProperties[*].displayName", `Prop.displayName == "StrongAuthenticationMethod"`},
+		"Key":              {"AdditionalDetails", "AdditionalDetails", "", `Key startswith "x"`},
+	}
+	if len(result.ScopedConditions) != len(want) {
+		t.Fatalf("expected %d mv-apply conditions, got %+v", len(want), result.ScopedConditions)
+	}
+	for _, cond := range result.ScopedConditions {
+		exp := want[cond.Field]
+		if cond.Scope != ScopeMvApply || cond.ScopeName != exp.name || cond.PipeStage != 0 {
+			t.Errorf("%s: expected stage 0 of scope mv-apply/%s, got %s/%s at %d", cond.Field, exp.name, cond.Scope, cond.ScopeName, cond.PipeStage)
+		}
+		if !cond.IsComputed || cond.SourceField != exp.source || cond.SourcePath != exp.path {
+			t.Errorf("%s: expected source %s %q, got %s %q", cond.Field, exp.source, exp.path, cond.SourceField, cond.SourcePath)
+		}
+		if cond.Span == nil || cond.Span.Text(query) != exp.text {
+			t.Errorf("%s: expected span %q, got %+v", cond.Field, exp.text, cond.Span)
+		}
+	}
+}
+
+func TestLetBodyRange(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{`let x = T | where A == 1`, `T | where A == 1`},
+		{`let f = (a:string, b:long = 5) { T | where A == a }`, ` T | where A == a `},
+		{`let v = view () { T }`, ` T `},
+		{`let q = (T | where A == 1)`, `(T | where A == 1)`},
+		{`let s = dynamic(["a", "b"])`, `dynamic(["a", "b"])`},
+	}
+	for _, tt := range tests {
+		start, end, ok := letBodyRange(tt.stmt, Span{Start: 0, End: len(tt.stmt)})
+		if !ok || tt.stmt[start:end] != tt.want {
+			t.Errorf("%s: got %q (ok=%v), want %q", tt.stmt, tt.stmt[start:end], ok, tt.want)
+		}
+	}
+}
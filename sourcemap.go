@@ -0,0 +1,336 @@
+package kql
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// SourceMap maps offsets in a normalized query back to the query it was derived
+// from. normalizeQuery applies a long chain of textual rewrites; each rewrite that
+// changes the text is recorded as a layer of segments, and offsets are translated
+// by walking the layers from the newest to the oldest.
+type SourceMap struct {
+	original   string
+	normalized string
+	layers     [][]mapSegment // oldest first; each layer covers its output text completely
+}
+
+// mapSegment relates the output range [newStart, newEnd) of a rewrite to the input
+// range [oldStart, oldEnd). Copied segments have equal lengths and map byte for byte;
+// other segments were replaced, inserted or deleted and map as a whole.
+type mapSegment struct {
+	newStart, newEnd int
+	oldStart, oldEnd int
+	copied           bool
+}
+
+func newSourceMap(original string) *SourceMap {
+	return &SourceMap{original: original, normalized: original}
+}
+
+// NormalizeQueryWithSourceMap returns the normalized query the parser sees, together
+// with a SourceMap that translates offsets in it back to query.
+func NormalizeQueryWithSourceMap(query string) (string, *SourceMap) {
+	return normalizeQueryWithSourceMap(query, defaultConfig)
+}
+
+// Original returns the query the map translates to.
+func (m *SourceMap) Original() string { return m.original }
+
+// Normalized returns the query the map translates from.
+func (m *SourceMap) Normalized() string { return m.normalized }
+
+// OriginalOffset maps a byte offset in the normalized query to the original query.
+// Offsets inside rewritten text map to the start of the text it replaced.
+func (m *SourceMap) OriginalOffset(offset int) int {
+	for i := len(m.layers) - 1; i >= 0; i-- {
+		offset = mapStart(m.layers[i], offset)
+	}
+	return offset
+}
+
+// OriginalSpan maps the byte range [start, end) of the normalized query to the
+// smallest range of the original query that produced it.
+func (m *SourceMap) OriginalSpan(start, end int) Span {
+	if end < start {
+		end = start
+	}
+	for i := len(m.layers) - 1; i >= 0; i-- {
+		start, end = mapStart(m.layers[i], start), mapEnd(m.layers[i], end)
+	}
+	if end < start {
+		end = start
+	}
+	return Span{Start: start, End: end}
+}
+
+// OriginalPosition maps a byte offset in the normalized query to a 1-based line and
+// column in the original query.
+func (m *SourceMap) OriginalPosition(offset int) (line, column int) {
+	return Position(m.original, m.OriginalOffset(offset))
+}
+
+// normalizedOffset converts a 1-based line and 0-based rune column, as reported by
+// ANTLR, to a byte offset in the normalized query.
+func (m *SourceMap) normalizedOffset(line, column int) int {
+	offset := 0
+	for l := 1; l < line; l++ {
+		nl := strings.IndexByte(m.normalized[offset:], '\n')
+		if nl < 0 {
+			return len(m.normalized)
+		}
+		offset += nl + 1
+	}
+	for _, r := range m.normalized[offset:] {
+		if column == 0 || r == '\n' {
+			break
+		}
+		offset += len(string(r))
+		column--
+	}
+	return offset
+}
+
+// mapStart maps an offset used as the start of a range through one layer.
+func mapStart(layer []mapSegment, offset int) int {
+	i := sort.Search(len(layer), func(i int) bool { return layer[i].newEnd > offset })
+	for i < len(layer) && layer[i].newStart == layer[i].newEnd {
+		i++
+	}
+	if i == len(layer) {
+		if len(layer) == 0 {
+			return offset
+		}
+		return layer[len(layer)-1].oldEnd
+	}
+	seg := layer[i]
+	if seg.copied {
+		return seg.oldStart + max(offset-seg.newStart, 0)
+	}
+	return seg.oldStart
+}
+
+// mapEnd maps an offset used as the exclusive end of a range through one layer.
+func mapEnd(layer []mapSegment, offset int) int {
+	i := sort.Search(len(layer), func(i int) bool { return layer[i].newEnd >= offset })
+	for i < len(layer) && layer[i].newStart == layer[i].newEnd && offset > 0 {
+		i++
+	}
+	if i == len(layer) {
+		if len(layer) == 0 {
+			return offset
+		}
+		return layer[len(layer)-1].oldEnd
+	}
+	seg := layer[i]
+	if seg.copied {
+		return seg.oldStart + min(offset-seg.newStart, seg.oldEnd-seg.oldStart)
+	}
+	if offset <= seg.newStart {
+		return seg.oldStart
+	}
+	return seg.oldEnd
+}
+
+// rewriter applies normalization steps to a query, recording each change in a
+// SourceMap when one is attached.
+type rewriter struct {
+	ctx         context.Context
+	text        string
+	sm          *SourceMap
+	cfg         *extractConfig
+	lets        []letDefinition // the let statements of the input, read when inlining
+	inlined     map[string]bool // names of the let statements inlined by inlineLets
+	diagnostics []Diagnostic    // lets inlineLets left in place
+}
+
+// apply runs a rewrite step and records the difference between its input and output.
+func (r *rewriter) apply(step func(string) string) {
+	next := step(r.text)
+	if r.sm != nil && next != r.text {
+		r.sm.layers = append(r.sm.layers, diffSegments(r.text, next))
+	}
+	r.text = next
+}
+
+// replaceAll is strings.ReplaceAll with each replacement recorded exactly.
+func (r *rewriter) replaceAll(old, replacement string) {
+	if r.sm == nil {
+		r.text = strings.ReplaceAll(r.text, old, replacement)
+		return
+	}
+	if !strings.Contains(r.text, old) {
+		return
+	}
+	var b strings.Builder
+	var layer []mapSegment
+	prev := 0
+	for {
+		idx := strings.Index(r.text[prev:], old)
+		if idx < 0 {
+			break
+		}
+		at := prev + idx
+		if at > prev {
+			layer = append(layer, copySegment(b.Len(), prev, at-prev))
+			b.WriteString(r.text[prev:at])
+		}
+		layer = append(layer, mapSegment{
+			newStart: b.Len(), newEnd: b.Len() + len(replacement),
+			oldStart: at, oldEnd: at + len(old),
+		})
+		b.WriteString(replacement)
+		prev = at + len(old)
+	}
+	if prev < len(r.text) {
+		layer = append(layer, copySegment(b.Len(), prev, len(r.text)-prev))
+		b.WriteString(r.text[prev:])
+	}
+	r.sm.layers = append(r.sm.layers, layer)
+	r.text = b.String()
+}
+
+// textEdit replaces the byte range [start, end) of a rewriter's text with pieces.
+type textEdit struct {
+	start, end int
+	pieces     []textPiece
+}
+
+// textPiece is part of a replacement. Text copied from elsewhere in the input gives
+// its offset in from, so that it maps back byte for byte; new text has from -1 and
+// maps to the range it replaced.
+type textPiece struct {
+	text string
+	from int
+}
+
+// splice applies edits, which must be sorted and must not overlap, in one layer.
+func (r *rewriter) splice(edits []textEdit) {
+	var b strings.Builder
+	var layer []mapSegment
+	prev := 0
+	for _, edit := range edits {
+		if edit.start > prev {
+			layer = append(layer, copySegment(b.Len(), prev, edit.start-prev))
+			b.WriteString(r.text[prev:edit.start])
+		}
+		for _, piece := range edit.pieces {
+			if piece.from >= 0 {
+				layer = append(layer, copySegment(b.Len(), piece.from, len(piece.text)))
+			} else {
+				layer = append(layer, mapSegment{
+					newStart: b.Len(), newEnd: b.Len() + len(piece.text),
+					oldStart: edit.start, oldEnd: edit.end,
+				})
+			}
+			b.WriteString(piece.text)
+		}
+		prev = edit.end
+	}
+	if prev < len(r.text) {
+		layer = append(layer, copySegment(b.Len(), prev, len(r.text)-prev))
+		b.WriteString(r.text[prev:])
+	}
+	if r.sm != nil {
+		r.sm.layers = append(r.sm.layers, layer)
+	}
+	r.text = b.String()
+}
+
+func copySegment(newStart, oldStart, length int) mapSegment {
+	return mapSegment{
+		newStart: newStart, newEnd: newStart + length,
+		oldStart: oldStart, oldEnd: oldStart + length,
+		copied: true,
+	}
+}
+
+// resyncLength is the number of bytes that must match for diffSegments to treat
+// two positions as aligned again after a difference.
+const resyncLength = 8
+
+// diffSegments describes how next was derived from prev. Rewrite steps make local
+// edits, so a greedy alignment is enough: equal bytes are copied, and after a
+// difference the cheapest position where resyncLength bytes line up again is found
+// through an index of next's substrings.
+func diffSegments(prev, next string) []mapSegment {
+	prefix := 0
+	for prefix < len(prev) && prefix < len(next) && prev[prefix] == next[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(prev)-prefix && suffix < len(next)-prefix &&
+		prev[len(prev)-1-suffix] == next[len(next)-1-suffix] {
+		suffix++
+	}
+
+	var layer []mapSegment
+	if prefix > 0 {
+		layer = append(layer, copySegment(0, 0, prefix))
+	}
+	layer = append(layer, diffMiddle(prev[prefix:len(prev)-suffix], next[prefix:len(next)-suffix], prefix, prefix)...)
+	if suffix > 0 {
+		layer = append(layer, copySegment(len(next)-suffix, len(prev)-suffix, suffix))
+	}
+	return layer
+}
+
+func diffMiddle(prev, next string, prevOffset, nextOffset int) []mapSegment {
+	if prev == "" && next == "" {
+		return nil
+	}
+	replaced := func(i, iEnd, j, jEnd int) mapSegment {
+		return mapSegment{
+			newStart: nextOffset + j, newEnd: nextOffset + jEnd,
+			oldStart: prevOffset + i, oldEnd: prevOffset + iEnd,
+		}
+	}
+
+	var index map[string][]int
+	var layer []mapSegment
+	i, j := 0, 0
+	for i < len(prev) && j < len(next) {
+		if prev[i] == next[j] {
+			k := 0
+			for i+k < len(prev) && j+k < len(next) && prev[i+k] == next[j+k] {
+				k++
+			}
+			layer = append(layer, copySegment(nextOffset+j, prevOffset+i, k))
+			i += k
+			j += k
+			continue
+		}
+
+		if index == nil {
+			index = make(map[string][]int)
+			for p := 0; p+resyncLength <= len(next); p++ {
+				key := next[p : p+resyncLength]
+				index[key] = append(index[key], p)
+			}
+		}
+		bestCost, bestI, bestJ := -1, 0, 0
+		for di := 0; i+di+resyncLength <= len(prev); di++ {
+			if bestCost >= 0 && di >= bestCost {
+				break
+			}
+			positions := index[prev[i+di:i+di+resyncLength]]
+			k := sort.SearchInts(positions, j)
+			if k == len(positions) {
+				continue
+			}
+			if cost := di + positions[k] - j; bestCost < 0 || cost < bestCost {
+				bestCost, bestI, bestJ = cost, i+di, positions[k]
+			}
+		}
+		if bestCost < 0 {
+			break
+		}
+		layer = append(layer, replaced(i, bestI, j, bestJ))
+		i, j = bestI, bestJ
+	}
+	if i < len(prev) || j < len(next) {
+		layer = append(layer, replaced(i, len(prev), j, len(next)))
+	}
+	return layer
+}
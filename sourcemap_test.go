@@ -0,0 +1,88 @@
+package kql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSourceMapReplaceAll(t *testing.T) {
+	query := "T | summarize S = make_set(A) by C | filter B == 1"
+	normalized, sm := NormalizeQueryWithSourceMap(query)
+	if normalized != NormalizeQueryForDebug(query) {
+		t.Fatalf("source-mapped normalization differs: %q vs %q", normalized, NormalizeQueryForDebug(query))
+	}
+
+	idx := strings.Index(normalized, "B == 1")
+	span := sm.OriginalSpan(idx, idx+len("B == 1"))
+	if got := span.Text(query); got != "B == 1" {
+		t.Errorf("expected B == 1, got %q", got)
+	}
+
+	idx = strings.Index(normalized, "makeset(")
+	span = sm.OriginalSpan(idx, idx+len("makeset(A)"))
+	if got := span.Text(query); got != "make_set(A)" {
+		t.Errorf("expected rewritten operator to map to the original, got %q", got)
+	}
+}
+
+func TestSourceMapThroughLetsAndComments(t *testing.T) {
+	query := "// Detects things\nlet threshold = 5;\nlet Base = SecurityEvent | where EventID == 4625;\n" +
+		"Base\n| summarize Failures = count() by Account\n| where Failures > threshold"
+	normalized, sm := NormalizeQueryWithSourceMap(query)
+
+	idx := strings.Index(normalized, "Failures > threshold")
+	if idx < 0 {
+		t.Fatalf("normalized query lost the predicate: %q", normalized)
+	}
+	line, column := sm.OriginalPosition(idx)
+	if line != 6 || column != 9 {
+		t.Errorf("expected 6:9, got %d:%d", line, column)
+	}
+}
+
+func TestSourceMapInsertedText(t *testing.T) {
+	query := "where A == 1"
+	normalized, sm := NormalizeQueryWithSourceMap(query)
+	if !strings.HasPrefix(normalized, "DummyTable | ") {
+		t.Fatalf("expected DummyTable prefix, got %q", normalized)
+	}
+	if span := sm.OriginalSpan(0, len("DummyTable")); span.Start != span.End {
+		t.Errorf("inserted text should map to an empty span, got %+v", span)
+	}
+	idx := strings.Index(normalized, "A == 1")
+	if got := sm.OriginalSpan(idx, idx+6).Text(query); got != "A == 1" {
+		t.Errorf("expected A == 1, got %q", got)
+	}
+}
+
+func TestDiffSegmentsMapsUnchangedText(t *testing.T) {
+	tests := []struct {
+		prev, next, probe string
+	}{
+		{"T | where x == 1 | parse y with * 'a' z | where w == 2", "T | where x == 1 | where w == 2", "w == 2"},
+		{"a | where obj['key'] == 1 and other == 2", "a | where obj.key == 1 and other == 2", "other == 2"},
+		{"union withsource=S T1, T2 | where q == 3", "union T1, T2 | where q == 3", "q == 3"},
+	}
+	for _, tt := range tests {
+		layer := diffSegments(tt.prev, tt.next)
+		idx := strings.Index(tt.next, tt.probe)
+		start, end := mapStart(layer, idx), mapEnd(layer, idx+len(tt.probe))
+		if got := tt.prev[start:end]; got != tt.probe {
+			t.Errorf("%q: expected %q, got %q", tt.next, tt.probe, got)
+		}
+	}
+}
+
+func TestSyntaxErrorPositionsReferToOriginalQuery(t *testing.T) {
+	query := "let x = 1;\nT\n| where A =="
+	result := ExtractConditions(query)
+	found := false
+	for _, err := range result.Errors {
+		if strings.HasPrefix(err, "line 3:") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected an error on line 3 of the original query, got %v", result.Errors)
+	}
+}
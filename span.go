@@ -0,0 +1,290 @@
+package kql
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/antlr4-go/antlr/v4"
+)
+
+// Span is a half-open byte range [Start, End) in the query passed to ExtractConditions.
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Text returns the text the span covers in query.
+func (s Span) Text(query string) string {
+	if s.Start < 0 || s.End > len(query) || s.Start > s.End {
+		return ""
+	}
+	return query[s.Start:s.End]
+}
+
+// Position converts a byte offset in query to a 1-based line and column.
+// Columns count runes, so a tab or a multi-byte character is one column.
+func Position(query string, offset int) (line, column int) {
+	if offset > len(query) {
+		offset = len(query)
+	}
+	line, column = 1, 1
+	for _, r := range query[:max(offset, 0)] {
+		if r == '\n' {
+			line++
+			column = 1
+			continue
+		}
+		column++
+	}
+	return line, column
+}
+
+// runeByteOffsets maps rune indexes of s to byte offsets. ANTLR input streams index
+// runes, so token positions must be translated before slicing Go strings. The result
+// has one extra entry holding len(s).
+func runeByteOffsets(s string) []int {
+	offsets := make([]int, 0, utf8.RuneCountInString(s)+1)
+	for i := range s {
+		offsets = append(offsets, i)
+	}
+	return append(offsets, len(s))
+}
+
+// spanLocator translates token positions in the normalized query into spans of
+// the original query. ANTLR indexes runes, so positions are first converted to
+// byte offsets and then mapped through the normalization source map.
+type spanLocator struct {
+	sourceMap *SourceMap
+	runeBytes []int
+}
+
+func newSpanLocator(sourceMap *SourceMap) *spanLocator {
+	return &spanLocator{
+		sourceMap: sourceMap,
+		runeBytes: runeByteOffsets(sourceMap.normalized),
+	}
+}
+
+// ruleSpan returns the original span of a parse tree node, or nil when the node
+// has no tokens or was produced entirely by normalization (e.g. DummyTable).
+func (l *spanLocator) ruleSpan(ctx antlr.ParserRuleContext) *Span {
+	start, end, ok := l.normalizedRange(ctx)
+	if !ok {
+		return nil
+	}
+	span := l.sourceMap.OriginalSpan(start, end)
+	if span.End <= span.Start {
+		return nil
+	}
+	return &span
+}
+
+// normalizedRange returns the byte range of ctx in the normalized query.
+func (l *spanLocator) normalizedRange(ctx antlr.ParserRuleContext) (int, int, bool) {
+	if l == nil || ctx == nil {
+		return 0, 0, false
+	}
+	start, stop := ctx.GetStart(), ctx.GetStop()
+	if start == nil || stop == nil {
+		return 0, 0, false
+	}
+	from, to := start.GetStart(), stop.GetStop()+1
+	if from < 0 || to <= from || to >= len(l.runeBytes) {
+		return 0, 0, false
+	}
+	return l.runeBytes[from], l.runeBytes[to], true
+}
+
+// remapSubquerySpans rewrites the spans of a subquery that was parsed on its own
+// from the text of ctx, so that they refer to the original query.
+func (l *spanLocator) remapSubquerySpans(result *ParseResult, ctx antlr.ParserRuleContext) {
+	start, _, ok := l.normalizedRange(ctx)
+	if !ok {
+		clearSpans(result)
+		return
+	}
+	mapSpans(result, func(s *Span) {
+		*s = l.sourceMap.OriginalSpan(start+s.Start, start+s.End)
+	})
+}
+
+// mapSpans calls fn on every span in result, including those of join subsearches.
+// Every span is visited once, so fn may modify it in place.
+func mapSpans(result *ParseResult, fn func(*Span)) {
+	if result == nil {
+		return
+	}
+	for i := range result.Conditions {
+		if result.Conditions[i].Span != nil {
+			fn(result.Conditions[i].Span)
+		}
+	}
+	for i := range result.LetStatements {
+		if result.LetStatements[i].Span != nil {
+			fn(result.LetStatements[i].Span)
+		}
+	}
+	for i := range result.ScopedConditions {
+		if result.ScopedConditions[i].Span != nil {
+			fn(result.ScopedConditions[i].Span)
+		}
+	}
+	for _, clause := range result.WhereClauses {
+		if clause.Span != nil {
+			fn(clause.Span)
+		}
+		for _, leaf := range clause.Predicate.Leaves() {
+			if leaf.Span != nil {
+				fn(leaf.Span)
+			}
+			if leaf.Condition != nil && leaf.Condition.Span != nil {
+				fn(leaf.Condition.Span)
+			}
+		}
+	}
+	for _, spans := range result.DataSourceSpans {
+		for i := range spans {
+			fn(&spans[i])
+		}
+	}
+	for i := range result.Joins {
+		if result.Joins[i].Span != nil {
+			fn(result.Joins[i].Span)
+		}
+		mapSpans(result.Joins[i].Subsearch, fn)
+	}
+	for i := range result.Unions {
+		if result.Unions[i].Span != nil {
+			fn(result.Unions[i].Span)
+		}
+		for j := range result.Unions[i].Legs {
+			if result.Unions[i].Legs[j].Span != nil {
+				fn(result.Unions[i].Legs[j].Span)
+			}
+			mapSpans(result.Unions[i].Legs[j].Subsearch, fn)
+		}
+	}
+}
+
+// dataSourceSpans locates every reference to the given data sources in query.
+// The query is tokenized with the KQL lexer so that names inside string literals
+// and comments, and property accesses like x.SecurityEvent, are not reported.
+func dataSourceSpans(query string, sources []string) map[string][]Span {
+	if len(sources) == 0 {
+		return nil
+	}
+	wanted := make(map[string]string, len(sources))
+	for _, source := range sources {
+		wanted[source] = source
+		wanted[strings.ToLower(source)] = source
+	}
+
+	lexer := NewKQLLexer(antlr.NewInputStream(query))
+	lexer.RemoveErrorListeners()
+	runeBytes := runeByteOffsets(query)
+
+	spans := make(map[string][]Span)
+	prev := antlr.TokenInvalidType
+	for {
+		token := lexer.NextToken()
+		if token.GetTokenType() == antlr.TokenEOF {
+			break
+		}
+		if token.GetChannel() != antlr.TokenDefaultChannel {
+			continue
+		}
+		tokenType := token.GetTokenType()
+		if prev != KQLLexerDOT && prev != KQLLexerQUESTIONDOT {
+			name := token.GetText()
+			if tokenType == KQLLexerQUOTED_IDENTIFIER {
+				name = unquoteIdentifier(name)
+			}
+			source, ok := wanted[name]
+			if !ok {
+				source, ok = wanted[strings.ToLower(name)]
+			}
+			start, stop := token.GetStart(), token.GetStop()+1
+			if ok && start >= 0 && stop < len(runeBytes) {
+				spans[source] = append(spans[source], Span{Start: runeBytes[start], End: runeBytes[stop]})
+			}
+		}
+		prev = tokenType
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	return spans
+}
+
+// letStatementSpan returns the byte range of a let statement within raw, skipping
+// leading whitespace and line comments and excluding the terminating semicolon.
+func letStatementSpan(raw string, offset int) Span {
+	start := 0
+	for start < len(raw) {
+		switch {
+		case raw[start] == ' ' || raw[start] == '\t' || raw[start] == '\r' || raw[start] == '\n':
+			start++
+		case strings.HasPrefix(raw[start:], "//"):
+			nl := strings.IndexByte(raw[start:], '\n')
+			if nl < 0 {
+				start = len(raw)
+			} else {
+				start += nl + 1
+			}
+		default:
+			return Span{Start: offset + start, End: offset + len(strings.TrimRight(raw, " \t\r\n;"))}
+		}
+	}
+	return Span{Start: offset + start, End: offset + start}
+}
+
+// clearSpans removes every span in result. It is used when a subquery's location
+// in the enclosing query is unknown, so its offsets would be misleading.
+func clearSpans(result *ParseResult) {
+	if result == nil {
+		return
+	}
+	for i := range result.Conditions {
+		result.Conditions[i].Span = nil
+	}
+	for i := range result.LetStatements {
+		result.LetStatements[i].Span = nil
+	}
+	for i := range result.ScopedConditions {
+		result.ScopedConditions[i].Span = nil
+	}
+	for i := range result.WhereClauses {
+		result.WhereClauses[i].Span = nil
+		for _, leaf := range result.WhereClauses[i].Predicate.Leaves() {
+			leaf.Span = nil
+			if leaf.Condition != nil {
+				leaf.Condition.Span = nil
+			}
+		}
+	}
+	result.DataSourceSpans = nil
+	for i := range result.Joins {
+		result.Joins[i].Span = nil
+		clearSpans(result.Joins[i].Subsearch)
+	}
+	for i := range result.Unions {
+		result.Unions[i].Span = nil
+		for j := range result.Unions[i].Legs {
+			result.Unions[i].Legs[j].Span = nil
+			clearSpans(result.Unions[i].Legs[j].Subsearch)
+		}
+	}
+}
+
+// joinSpans returns the smallest span covering a and b. A nil span is ignored.
+func joinSpans(a, b *Span) *Span {
+	switch {
+	case a == nil && b == nil:
+		return nil
+	case a == nil:
+		return &Span{Start: b.Start, End: b.End}
+	case b == nil:
+		return &Span{Start: a.Start, End: a.End}
+	}
+	return &Span{Start: min(a.Start, b.Start), End: max(a.End, b.End)}
+}
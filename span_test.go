@@ -0,0 +1,83 @@
+package kql
+
+import "testing"
+
+func TestConditionSpans(t *testing.T) {
+	query := "// header\r\nlet Base = SecurityEvent | where EventID == 4688;\r\nBase\r\n" +
+		"| where Process has_any (\"cmd\", \"pwsh\") and isnotempty(Account)\r\n" +
+		"| where A == 1 or A == 2\r\n" +
+		"| where B between (1 .. 3)"
+
+	result := ExtractConditions(query)
+
+	want := map[string]string{
+		"Process": `Process has_any ("cmd", "pwsh")`,
+		"Account": "isnotempty(Account)",
+		"A":       "A == 1 or A == 2",
+		"B":       "B between (1 .. 3)",
+	}
+	for _, cond := range result.Conditions {
+		expected, ok := want[cond.Field]
+		if !ok {
+			continue
+		}
+		if cond.Span == nil {
+			t.Errorf("condition on %s has no span", cond.Field)
+			continue
+		}
+		if got := cond.Span.Text(query); got != expected {
+			t.Errorf("condition on %s: expected span text %q, got %q", cond.Field, expected, got)
+		}
+	}
+
+	if len(result.LetStatements) != 1 || result.LetStatements[0].Span == nil {
+		t.Fatalf("expected one let statement with a span, got %#v", result.LetStatements)
+	}
+	if got := result.LetStatements[0].Span.Text(query); got != "let Base = SecurityEvent | where EventID == 4688" {
+		t.Errorf("unexpected let span text %q", got)
+	}
+
+	spans := result.DataSourceSpans["SecurityEvent"]
+	if len(spans) != 1 || spans[0].Text(query) != "SecurityEvent" {
+		t.Errorf("unexpected data source spans: %#v", result.DataSourceSpans)
+	}
+}
+
+func TestJoinSpans(t *testing.T) {
+	query := `DeviceProcessEvents
+| join kind=inner (DeviceInfo | where OSPlatform == "Windows") on DeviceId`
+
+	result := ExtractConditions(query)
+	if len(result.Joins) != 1 {
+		t.Fatalf("expected 1 join, got %d", len(result.Joins))
+	}
+	join := result.Joins[0]
+	if join.Span == nil || join.Span.Text(query) != `join kind=inner (DeviceInfo | where OSPlatform == "Windows") on DeviceId` {
+		t.Errorf("unexpected join span: %#v", join.Span)
+	}
+	if join.Subsearch == nil || len(join.Subsearch.Conditions) != 1 {
+		t.Fatalf("expected one subsearch condition, got %#v", join.Subsearch)
+	}
+	if span := join.Subsearch.Conditions[0].Span; span == nil || span.Text(query) != `OSPlatform == "Windows"` {
+		t.Errorf("subsearch span should be relative to the outer query, got %#v", span)
+	}
+}
+
+func TestPosition(t *testing.T) {
+	query := "T\n| where A == \"é\"\n| where B == 1"
+	tests := []struct {
+		offset       int
+		line, column int
+	}{
+		{0, 1, 1},
+		{2, 2, 1},
+		{10, 2, 9},
+		{len("T\n| where A == \"é\"\n"), 3, 1},
+	}
+	for _, tt := range tests {
+		line, column := Position(query, tt.offset)
+		if line != tt.line || column != tt.column {
+			t.Errorf("Position(%d) = %d:%d, want %d:%d", tt.offset, line, column, tt.line, tt.column)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package kql
+
+import (
+	"strings"
+	"time"
+
+	"github.com/craftedsignal/kql-parser/ast"
+)
+
+// TimeWindow is the time range a query reads, taken from the filters its where
+// clauses put on time columns such as TimeGenerated > ago(1h) or Timestamp
+// between (datetime(2024-01-01) .. now()).
+type TimeWindow struct {
+	Lookback time.Duration      `json:"lookback,omitempty"` // Longest lookback from now of any data source
+	Start    *time.Time         `json:"start,omitempty"`    // Earliest absolute start of any data source
+	End      *time.Time         `json:"end,omitempty"`      // Latest absolute end of any data source
+	Sources  []SourceTimeWindow `json:"sources,omitempty"`  // Window of each read of a data source with a time filter
+}
+
+// SourceTimeWindow is the time filter on one read of a data source. Bounds
+// relative to now are given as durations back from now, absolute bounds as times;
+// a source can have both. Several filters on the same read are intersected.
+type SourceTimeWindow struct {
+	Source    string        `json:"source,omitempty"`     // Data source, empty when the pipeline starts from none
+	Column    string        `json:"column"`               // Time column filtered on, like TimeGenerated
+	Lookback  time.Duration `json:"lookback,omitempty"`   // Start as a duration back from now, like 1h for ago(1h)
+	EndOffset time.Duration `json:"end_offset,omitempty"` // End as a duration back from now, like 10m for < ago(10m)
+	Start     *time.Time    `json:"start,omitempty"`      // Absolute start, from a datetime literal
+	End       *time.Time    `json:"end,omitempty"`        // Absolute end, from a datetime literal
+	StartOf   string        `json:"start_of,omitempty"`   // Unit the start is rounded down to: day, week, month or year
+}
+
+// columns returns the lower-case names of the time columns w has filters on.
+func (w *TimeWindow) columns() map[string]bool {
+	if w == nil {
+		return nil
+	}
+	columns := make(map[string]bool, len(w.Sources))
+	for _, source := range w.Sources {
+		columns[strings.ToLower(source.Column)] = true
+	}
+	return columns
+}
+
+// timeColumns are the columns treated as the time of a record.
+var timeColumns = map[string]bool{
+	"timegenerated": true, "timestamp": true, "ingestiontime": true,
+}
+
+// maxLetDepth bounds how many scalar lets are followed to evaluate a time bound.
+const maxLetDepth = 8
+
+// timePoint is a time bound: an offset back from now when relative, else an
+// absolute time.
+type timePoint struct {
+	relative bool
+	offset   time.Duration
+	at       time.Time
+	startOf  string
+}
+
+// sourceWindow is a SourceTimeWindow being built. hasLookback tells a lookback
+// of zero, as in startofday(now()), from none.
+type sourceWindow struct {
+	SourceTimeWindow
+	hasLookback bool
+}
+
+// timeWindowBuilder collects the time filters of a query's pipelines.
+type timeWindowBuilder struct {
+	lets    map[string]ast.Expr
+	windows []*sourceWindow
+}
+
+// queryTimeWindow returns the time window of body, with the scalar lets of the
+// query available to its bounds, or nil when no time column is filtered.
+func queryTimeWindow(body *ast.TabularExpression, lets []letDefinition) *TimeWindow {
+	b := &timeWindowBuilder{lets: make(map[string]ast.Expr)}
+	for _, def := range lets {
+		if def.node.Kind == ast.LetScalar && def.node.Value != nil {
+			if _, ok := b.lets[def.node.Name]; !ok {
+				b.lets[def.node.Name] = def.node.Value
+			}
+		}
+	}
+	b.pipeline(body)
+	if len(b.windows) == 0 {
+		return nil
+	}
+
+	window := &TimeWindow{}
+	for _, w := range b.windows {
+		window.Sources = append(window.Sources, w.SourceTimeWindow)
+		if w.Lookback > window.Lookback {
+			window.Lookback = w.Lookback
+		}
+		if w.Start != nil && (window.Start == nil || w.Start.Before(*window.Start)) {
+			window.Start = w.Start
+		}
+		if w.End != nil && (window.End == nil || w.End.After(*window.End)) {
+			window.End = w.End
+		}
+	}
+	return window
+}
+
+// sourceRead is one read of a data source in the query, with the windows its
+// filters put on each time column. Two reads of the same table, like both sides
+// of a self join, have separate windows.
+type sourceRead struct {
+	name    string
+	windows []*sourceWindow
+}
+
+// pipeline records the time filters of te and returns the reads its rows come
+// from.
+func (b *timeWindowBuilder) pipeline(te *ast.TabularExpression) []*sourceRead {
+	if te == nil {
+		return nil
+	}
+	var reads []*sourceRead
+	switch src := te.Source.(type) {
+	case *ast.TableSource:
+		// Normalization puts DummyTable in front of a leading union or find
+		if src.Name != "DummyTable" {
+			reads = []*sourceRead{{name: src.Name}}
+		}
+	case *ast.CallSource:
+		reads = []*sourceRead{{name: src.Call.Func}}
+	case *ast.SubquerySource:
+		reads = b.pipeline(src.Query)
+	}
+
+	for _, op := range te.Operators {
+		switch op := op.(type) {
+		case *ast.WhereOperator:
+			if len(reads) == 0 {
+				reads = []*sourceRead{{}}
+			}
+			b.where(reads, op.Predicate)
+		case *ast.UnionOperator:
+			for _, table := range op.Tables {
+				reads = append(reads, b.pipeline(table)...)
+			}
+		case *ast.JoinOperator:
+			// The right side keeps its own time filters; the time column after
+			// the join is the left side's
+			b.pipeline(op.Right)
+		}
+	}
+	return reads
+}
+
+// where records the bounds that the conjuncts of predicate put on time columns.
+// Bounds inside or and not are ignored, since they do not restrict the window.
+func (b *timeWindowBuilder) where(reads []*sourceRead, predicate ast.Expr) {
+	switch x := predicate.(type) {
+	case *ast.ParenExpr:
+		b.where(reads, x.X)
+	case *ast.BinaryExpr:
+		if x.Op == "and" {
+			b.where(reads, x.X)
+			b.where(reads, x.Y)
+			return
+		}
+		column, bound, op, ok := b.comparison(x)
+		if !ok {
+			return
+		}
+		for _, read := range reads {
+			w := b.window(read, column)
+			if op == ">" || op == ">=" {
+				w.addStart(bound)
+			} else {
+				w.addEnd(bound)
+			}
+		}
+	case *ast.BetweenExpr:
+		column, ok := timeColumn(x.X)
+		if !ok || x.Negated {
+			return
+		}
+		low, lowOK := b.point(x.Low, 0)
+		high, highOK := b.point(x.High, 0)
+		for _, read := range reads {
+			w := b.window(read, column)
+			if lowOK {
+				w.addStart(low)
+			}
+			if highOK {
+				w.addEnd(high)
+			}
+		}
+	}
+}
+
+// comparison returns the time column, bound and operator of a comparison between
+// a time column and a time, with the operands swapped when the column is on the
+// right.
+func (b *timeWindowBuilder) comparison(x *ast.BinaryExpr) (string, timePoint, string, bool) {
+	flipped := map[string]string{">": "<", ">=": "<=", "<": ">", "<=": ">="}
+	if _, ok := flipped[x.Op]; !ok {
+		return "", timePoint{}, "", false
+	}
+	if column, ok := timeColumn(x.X); ok {
+		bound, ok := b.point(x.Y, 0)
+		return column, bound, x.Op, ok
+	}
+	if column, ok := timeColumn(x.Y); ok {
+		bound, ok := b.point(x.X, 0)
+		return column, bound, flipped[x.Op], ok
+	}
+	return "", timePoint{}, "", false
+}
+
+// window returns the window of column for read, creating it.
+func (b *timeWindowBuilder) window(read *sourceRead, column string) *sourceWindow {
+	for _, w := range read.windows {
+		if strings.EqualFold(w.Column, column) {
+			return w
+		}
+	}
+	w := &sourceWindow{SourceTimeWindow: SourceTimeWindow{Source: read.name, Column: column}}
+	read.windows = append(read.windows, w)
+	b.windows = append(b.windows, w)
+	return w
+}
+
+// addStart narrows the window to start no earlier than p.
+func (w *sourceWindow) addStart(p timePoint) {
+	if p.relative {
+		if !w.hasLookback || p.offset < w.Lookback {
+			w.Lookback = p.offset
+			w.StartOf = p.startOf
+			w.hasLookback = true
+		}
+		return
+	}
+	if w.Start == nil || p.at.After(*w.Start) {
+		at := p.at
+		w.Start = &at
+	}
+}
+
+// addEnd narrows the window to end no later than p.
+func (w *sourceWindow) addEnd(p timePoint) {
+	if p.relative {
+		if p.offset > w.EndOffset {
+			w.EndOffset = p.offset
+		}
+		return
+	}
+	if w.End == nil || p.at.Before(*w.End) {
+		at := p.at
+		w.End = &at
+	}
+}
+
+// timeColumn returns the name of expr when it is a time column, or
+// ingestion_time() for that function.
+func timeColumn(expr ast.Expr) (string, bool) {
+	switch x := expr.(type) {
+	case *ast.Ident:
+		return x.Name, timeColumns[strings.ToLower(x.Name)]
+	case *ast.CallExpr:
+		if strings.EqualFold(x.Func, "ingestion_time") && len(x.Args) == 0 {
+			return "ingestion_time()", true
+		}
+	}
+	return "", false
+}
+
+// point evaluates expr as a time bound: ago(), now(), datetime literals,
+// startofday() and its siblings, timespan arithmetic on those, and scalar lets
+// bound to any of them.
+func (b *timeWindowBuilder) point(expr ast.Expr, depth int) (timePoint, bool) {
+	switch x := expr.(type) {
+	case *ast.ParenExpr:
+		return b.point(x.X, depth)
+	case *ast.Ident:
+		if value, ok := b.lets[x.Name]; ok && depth < maxLetDepth {
+			return b.point(value, depth+1)
+		}
+	case *ast.Literal:
+		if lit := astLiteral(x); lit != nil && lit.Kind == LiteralDatetime {
+			if at, ok := lit.Value.(time.Time); ok {
+				return timePoint{at: at}, true
+			}
+		}
+	case *ast.BinaryExpr:
+		if x.Op != "+" && x.Op != "-" {
+			break
+		}
+		p, ok := b.point(x.X, depth)
+		d, dOK := b.timespan(x.Y, depth)
+		if !ok || !dOK {
+			break
+		}
+		if x.Op == "-" {
+			d = -d
+		}
+		return p.add(d), true
+	case *ast.CallExpr:
+		return b.callPoint(x, depth)
+	}
+	return timePoint{}, false
+}
+
+// callPoint evaluates the time functions for point.
+func (b *timeWindowBuilder) callPoint(x *ast.CallExpr, depth int) (timePoint, bool) {
+	name := strings.ToLower(x.Func)
+	switch name {
+	case "ago":
+		if len(x.Args) == 1 {
+			if d, ok := b.timespan(x.Args[0], depth); ok {
+				return timePoint{relative: true, offset: d}, true
+			}
+		}
+	case "now":
+		switch len(x.Args) {
+		case 0:
+			return timePoint{relative: true}, true
+		case 1:
+			if d, ok := b.timespan(x.Args[0], depth); ok {
+				return timePoint{relative: true, offset: -d}, true
+			}
+		}
+	case "startofday", "startofweek", "startofmonth", "startofyear":
+		if len(x.Args) == 0 || len(x.Args) > 2 {
+			break
+		}
+		p, ok := b.point(x.Args[0], depth)
+		if !ok {
+			break
+		}
+		unit := strings.TrimPrefix(name, "startof")
+		p = p.truncate(unit)
+		if len(x.Args) == 2 {
+			lit := astLiteral(x.Args[1])
+			n, isLong := int64(0), false
+			if lit != nil {
+				n, isLong = lit.Value.(int64)
+			}
+			if !isLong {
+				break
+			}
+			p = p.shift(unit, int(n))
+		}
+		return p, true
+	}
+	return timePoint{}, false
+}
+
+// timespan evaluates expr as a duration: timespan literals, negation,
+// multiplication by a number and scalar lets bound to those.
+func (b *timeWindowBuilder) timespan(expr ast.Expr, depth int) (time.Duration, bool) {
+	switch x := expr.(type) {
+	case *ast.ParenExpr:
+		return b.timespan(x.X, depth)
+	case *ast.Ident:
+		if value, ok := b.lets[x.Name]; ok && depth < maxLetDepth {
+			return b.timespan(value, depth+1)
+		}
+	case *ast.BinaryExpr:
+		if x.Op != "*" {
+			break
+		}
+		if d, ok := b.timespan(x.X, depth); ok {
+			if n, ok := numberValue(x.Y); ok {
+				return time.Duration(float64(d) * n), true
+			}
+		}
+		if d, ok := b.timespan(x.Y, depth); ok {
+			if n, ok := numberValue(x.X); ok {
+				return time.Duration(float64(d) * n), true
+			}
+		}
+	case *ast.CallExpr:
+		if (strings.EqualFold(x.Func, "totimespan") || strings.EqualFold(x.Func, "timespan")) && len(x.Args) == 1 {
+			return b.timespan(x.Args[0], depth)
+		}
+	}
+	if lit := astLiteral(expr); lit != nil {
+		switch v := lit.Value.(type) {
+		case time.Duration:
+			return v, true
+		case string:
+			return parseTimespan(v)
+		}
+	}
+	return 0, false
+}
+
+// numberValue returns the value of a numeric literal.
+func numberValue(expr ast.Expr) (float64, bool) {
+	lit := astLiteral(expr)
+	if lit == nil {
+		return 0, false
+	}
+	switch v := lit.Value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// add moves p later by d.
+func (p timePoint) add(d time.Duration) timePoint {
+	if p.relative {
+		p.offset -= d
+	} else {
+		p.at = p.at.Add(d)
+	}
+	return p
+}
+
+// truncate rounds p down to the start of its day, week, month or year. For a
+// relative point this can only be recorded, since it depends on the current time.
+func (p timePoint) truncate(unit string) timePoint {
+	if p.relative {
+		p.startOf = unit
+		return p
+	}
+	y, m, d := p.at.Date()
+	switch unit {
+	case "day":
+		p.at = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	case "week":
+		p.at = time.Date(y, m, d-int(p.at.Weekday()), 0, 0, 0, 0, time.UTC)
+	case "month":
+		p.at = time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	case "year":
+		p.at = time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return p
+}
+
+// shift applies the offset argument of startofday() and its siblings, in units.
+// Months and years only shift absolute points, since their length varies.
+func (p timePoint) shift(unit string, n int) timePoint {
+	switch unit {
+	case "day":
+		return p.add(time.Duration(n) * 24 * time.Hour)
+	case "week":
+		return p.add(time.Duration(n) * 7 * 24 * time.Hour)
+	}
+	if p.relative {
+		return p
+	}
+	if unit == "month" {
+		p.at = p.at.AddDate(0, n, 0)
+	} else {
+		p.at = p.at.AddDate(n, 0, 0)
+	}
+	return p
+}
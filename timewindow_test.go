@@ -0,0 +1,92 @@
+package kql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindow(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		query     string
+		lookback  time.Duration
+		endOffset time.Duration
+		start     string
+		startOf   string
+	}{
+		{"SecurityEvent | where TimeGenerated > ago(1h) | where EventID == 4624", time.Hour, 0, "", ""},
+		{"T | where TimeGenerated between (ago(7d) .. ago(1d))", 7 * day, day, "", ""},
+		{"T | where TimeGenerated >= now(-2d) and TimeGenerated > ago(1h)", time.Hour, 0, "", ""},
+		{"T | where ago(3h) < Timestamp", 3 * time.Hour, 0, "", ""},
+		{"T | where TimeGenerated > now() - 30m", 30 * time.Minute, 0, "", ""},
+		{"T | where TimeGenerated > startofday(ago(1d))", day, 0, "", "day"},
+		{"let lookback = 1h;\nlet start = ago(lookback * 2);\nT | where TimeGenerated > start", 2 * time.Hour, 0, "", ""},
+		{"T | where TimeGenerated between (datetime(2024-01-01) .. now())", 0, 0, "2024-01-01T00:00:00Z", ""},
+		{"T | where TimeGenerated > startofday(datetime(2024-03-05T10:00:00Z), -1)", 0, 0, "2024-03-04T00:00:00Z", ""},
+	}
+	for _, tt := range tests {
+		window := ExtractConditions(tt.query).TimeWindow
+		if window == nil || len(window.Sources) != 1 {
+			t.Errorf("%q: expected one source window, got %+v", tt.query, window)
+			continue
+		}
+		w := window.Sources[0]
+		start := ""
+		if w.Start != nil {
+			start = w.Start.Format(time.RFC3339)
+		}
+		if w.Lookback != tt.lookback || w.EndOffset != tt.endOffset || start != tt.start || w.StartOf != tt.startOf {
+			t.Errorf("%q: expected lookback %v, end offset %v, start %q, start of %q, got %+v",
+				tt.query, tt.lookback, tt.endOffset, tt.start, tt.startOf, w)
+		}
+	}
+}
+
+func TestTimeWindowSources(t *testing.T) {
+	result := ExtractConditions("DeviceProcessEvents | where Timestamp > ago(1h)\n" +
+		"| join (DeviceNetworkEvents | where Timestamp > ago(7d)) on DeviceId")
+	window := result.TimeWindow
+	if window == nil || len(window.Sources) != 2 {
+		t.Fatalf("expected a window per source, got %+v", window)
+	}
+	if window.Lookback != 7*24*time.Hour {
+		t.Errorf("expected the longest lookback, got %v", window.Lookback)
+	}
+	if s := window.Sources[0]; s.Source != "DeviceProcessEvents" || s.Column != "Timestamp" || s.Lookback != time.Hour {
+		t.Errorf("unexpected left window %+v", s)
+	}
+	if s := window.Sources[1]; s.Source != "DeviceNetworkEvents" || s.Lookback != 7*24*time.Hour {
+		t.Errorf("unexpected right window %+v", s)
+	}
+
+	result = ExtractConditions("union SigninLogs, AADNonInteractiveUserSignInLogs | where TimeGenerated > ago(1d)")
+	if window := result.TimeWindow; window == nil || len(window.Sources) != 2 || window.Sources[1].Source != "AADNonInteractiveUserSignInLogs" {
+		t.Errorf("expected the filter after union to apply to both tables, got %+v", window)
+	}
+
+	for _, query := range []string{
+		"T | where TimeGenerated > ago(1h) or EventID == 1",
+		"T | where not(TimeGenerated > ago(1h))",
+		"T | where EventID == 1",
+	} {
+		if window := ExtractConditions(query).TimeWindow; window != nil {
+			t.Errorf("%q: expected no window, got %+v", query, window)
+		}
+	}
+}
+
+func TestTimeColumnDiagnostics(t *testing.T) {
+	tests := []struct {
+		query   string
+		message string
+	}{
+		{`T | where TimeGenerated > ago(1h)`, "condition on TimeGenerated dropped: it is a time column, reported in TimeWindow"},
+		{`T | where TimeGenerated > LastSeen`, "condition on TimeGenerated dropped: it is a time column"},
+	}
+	for _, tt := range tests {
+		dropped := ExtractConditions(tt.query).DiagnosticsWithCode(CodeExcludedField)
+		if len(dropped) != 1 || dropped[0].Message != tt.message {
+			t.Errorf("%s: expected %q, got %+v", tt.query, tt.message, dropped)
+		}
+	}
+}
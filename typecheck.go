@@ -0,0 +1,523 @@
+package kql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/craftedsignal/kql-parser/ast"
+)
+
+// signature describes a built-in function: the kind of value each argument takes
+// and the type of the result. Kinds are the categories of typeCategories, or ""
+// for any value.
+type signature struct {
+	params  []string   // Kind of each argument; the last repeats for variadic functions
+	min     int        // Fewest arguments
+	max     int        // Most arguments, -1 for no limit
+	result  ColumnType // Result type, when it does not depend on the arguments
+	fromArg int        // 1-based argument whose type the result has, when set
+}
+
+// fn returns the signature of a function taking exactly the given kinds.
+func fn(result ColumnType, params ...string) signature {
+	return signature{params: params, min: len(params), max: len(params), result: result}
+}
+
+// optional makes the last n arguments optional.
+func (s signature) optional(n int) signature {
+	s.min = len(s.params) - n
+	return s
+}
+
+// variadic lets the last argument repeat.
+func (s signature) variadic() signature {
+	s.max = -1
+	return s
+}
+
+// sameAs makes the result have the type of the 1-based argument i.
+func (s signature) sameAs(i int) signature {
+	s.fromArg = i
+	return s
+}
+
+// functionSignatures are the built-in functions whose arguments and results are
+// typed. Functions missing from it are not checked and have an unknown type.
+var functionSignatures = map[string]signature{
+	// Conversions
+	"tostring":   fn(TypeString, ""),
+	"toint":      fn(TypeInt, ""),
+	"tolong":     fn(TypeLong, ""),
+	"toreal":     fn(TypeReal, ""),
+	"todouble":   fn(TypeReal, ""),
+	"todecimal":  fn(TypeDecimal, ""),
+	"tobool":     fn(TypeBool, ""),
+	"toboolean":  fn(TypeBool, ""),
+	"todatetime": fn(TypeDatetime, ""),
+	"totimespan": fn(TypeTimespan, ""),
+	"toguid":     fn(TypeGuid, ""),
+	"todynamic":  fn(TypeDynamic, "string"),
+	"parse_json": fn(TypeDynamic, "string"),
+	"parse_xml":  fn(TypeDynamic, "string"),
+	"bag_unpack": fn("", "dynamic", "string").optional(1),
+
+	// Strings
+	"strcat":                   fn(TypeString, "").variadic(),
+	"strcat_delim":             fn(TypeString, "string", "", "").variadic(),
+	"strlen":                   fn(TypeLong, "string"),
+	"tolower":                  fn(TypeString, "string"),
+	"toupper":                  fn(TypeString, "string"),
+	"substring":                fn(TypeString, "string", "number", "number").optional(1),
+	"trim":                     fn(TypeString, "string", "string"),
+	"trim_start":               fn(TypeString, "string", "string"),
+	"trim_end":                 fn(TypeString, "string", "string"),
+	"split":                    fn(TypeDynamic, "string", "string", "number").optional(1),
+	"replace_string":           fn(TypeString, "string", "string", "string"),
+	"replace_regex":            fn(TypeString, "string", "string", "string"),
+	"indexof":                  fn(TypeLong, "string", "string", "number", "number", "number").optional(3),
+	"countof":                  fn(TypeLong, "string", "string", "string").optional(1),
+	"extract":                  fn(TypeString, "string", "number", "string", "").optional(1),
+	"extract_all":              fn(TypeDynamic, "string", "", "string").optional(1),
+	"extract_json":             fn(TypeString, "string", "string", "").optional(1),
+	"extractjson":              fn(TypeString, "string", "string", "").optional(1),
+	"reverse":                  fn(TypeString, ""),
+	"base64_decode_tostring":   fn(TypeString, "string"),
+	"base64_encode_tostring":   fn(TypeString, "string"),
+	"url_decode":               fn(TypeString, "string"),
+	"url_encode":               fn(TypeString, "string"),
+	"parse_url":                fn(TypeDynamic, "string"),
+	"parse_path":               fn(TypeDynamic, "string"),
+	"parse_command_line":       fn(TypeDynamic, "string", "string"),
+	"hash_sha256":              fn(TypeString, ""),
+	"hash_md5":                 fn(TypeString, ""),
+	"isempty":                  fn(TypeBool, ""),
+	"isnotempty":               fn(TypeBool, ""),
+	"isnull":                   fn(TypeBool, ""),
+	"isnotnull":                fn(TypeBool, ""),
+	"array_length":             fn(TypeLong, "dynamic"),
+	"bag_keys":                 fn(TypeDynamic, "dynamic"),
+	"bag_has_key":              fn(TypeBool, "dynamic", "string"),
+	"set_has_element":          fn(TypeBool, "dynamic", ""),
+	"array_index_of":           fn(TypeLong, "dynamic", "").variadic(),
+	"array_concat":             fn(TypeDynamic, "dynamic").variadic(),
+	"array_slice":              fn(TypeDynamic, "dynamic", "number", "number"),
+	"pack":                     fn(TypeDynamic, "").variadic(),
+	"bag_pack":                 fn(TypeDynamic, "").variadic(),
+	"pack_array":               fn(TypeDynamic, "").variadic(),
+	"pack_all":                 fn(TypeDynamic, "bool").optional(1),
+	"geo_info_from_ip_address": fn(TypeDynamic, "string"),
+
+	// Dates and times
+	"now":                              fn(TypeDatetime, "timespan").optional(1),
+	"ago":                              fn(TypeDatetime, "timespan"),
+	"datetime_add":                     fn(TypeDatetime, "string", "number", "datetime"),
+	"datetime_diff":                    fn(TypeLong, "string", "datetime", "datetime"),
+	"datetime_part":                    fn(TypeInt, "string", "datetime"),
+	"startofday":                       fn(TypeDatetime, "datetime", "number").optional(1),
+	"startofweek":                      fn(TypeDatetime, "datetime", "number").optional(1),
+	"startofmonth":                     fn(TypeDatetime, "datetime", "number").optional(1),
+	"startofyear":                      fn(TypeDatetime, "datetime", "number").optional(1),
+	"endofday":                         fn(TypeDatetime, "datetime", "number").optional(1),
+	"endofweek":                        fn(TypeDatetime, "datetime", "number").optional(1),
+	"endofmonth":                       fn(TypeDatetime, "datetime", "number").optional(1),
+	"endofyear":                        fn(TypeDatetime, "datetime", "number").optional(1),
+	"format_datetime":                  fn(TypeString, "datetime", "string"),
+	"format_timespan":                  fn(TypeString, "timespan", "string"),
+	"dayofweek":                        fn(TypeTimespan, "datetime"),
+	"dayofmonth":                       fn(TypeInt, "datetime"),
+	"dayofyear":                        fn(TypeInt, "datetime"),
+	"hourofday":                        fn(TypeInt, "datetime"),
+	"getmonth":                         fn(TypeInt, "datetime"),
+	"getyear":                          fn(TypeInt, "datetime"),
+	"monthofyear":                      fn(TypeInt, "datetime"),
+	"weekofyear":                       fn(TypeInt, "datetime"),
+	"unixtime_seconds_todatetime":      fn(TypeDatetime, "number"),
+	"unixtime_milliseconds_todatetime": fn(TypeDatetime, "number"),
+	"unixtime_microseconds_todatetime": fn(TypeDatetime, "number"),
+	"unixtime_nanoseconds_todatetime":  fn(TypeDatetime, "number"),
+
+	// IP addresses
+	"ipv4_is_private":      fn(TypeBool, "string"),
+	"ipv4_is_in_range":     fn(TypeBool, "string", "string"),
+	"ipv4_is_in_any_range": fn(TypeBool, "string", "").variadic(),
+	"ipv4_is_match":        fn(TypeBool, "string", "string", "number").optional(1),
+	"ipv4_compare":         fn(TypeLong, "string", "string", "number").optional(1),
+	"ipv4_netmask_suffix":  fn(TypeInt, "string"),
+	"parse_ipv4":           fn(TypeLong, "string"),
+	"parse_ipv4_mask":      fn(TypeLong, "string", "number"),
+	"format_ipv4":          fn(TypeString, "", "number").optional(1),
+	"format_ipv4_mask":     fn(TypeString, "", "number").optional(1),
+	"ipv6_compare":         fn(TypeLong, "string", "string", "number").optional(1),
+	"ipv6_is_match":        fn(TypeBool, "string", "string", "number").optional(1),
+	"parse_ipv6":           fn(TypeString, "string"),
+
+	// Numbers
+	"bin":    fn("", "", "").sameAs(1),
+	"floor":  fn("", "", "").sameAs(1),
+	"abs":    fn("", "").sameAs(1),
+	"round":  fn("", "number", "number").optional(1).sameAs(1),
+	"min_of": fn("", "", "").variadic().sameAs(1),
+	"max_of": fn("", "", "").variadic().sameAs(1),
+	"sqrt":   fn(TypeReal, "number"),
+	"log":    fn(TypeReal, "number"),
+	"log10":  fn(TypeReal, "number"),
+	"exp":    fn(TypeReal, "number"),
+	"pow":    fn(TypeReal, "number", "number"),
+	"rand":   fn(TypeReal, "number").optional(1),
+
+	// Aggregations
+	"count":        fn(TypeLong, "").optional(1),
+	"countif":      fn(TypeLong, "bool"),
+	"dcount":       fn(TypeLong, "", "number").optional(1),
+	"dcountif":     fn(TypeLong, "", "bool", "number").optional(1),
+	"sum":          fn("", "").sameAs(1),
+	"sumif":        fn("", "", "bool").sameAs(1),
+	"avg":          fn(TypeReal, ""),
+	"avgif":        fn(TypeReal, "", "bool"),
+	"stdev":        fn(TypeReal, ""),
+	"variance":     fn(TypeReal, ""),
+	"min":          fn("", "").sameAs(1),
+	"max":          fn("", "").sameAs(1),
+	"minif":        fn("", "", "bool").sameAs(1),
+	"maxif":        fn("", "", "bool").sameAs(1),
+	"any":          fn("", "").variadic().sameAs(1),
+	"take_any":     fn("", "").variadic().sameAs(1),
+	"percentile":   fn("", "", "number").sameAs(1),
+	"make_set":     fn(TypeDynamic, "", "number").optional(1),
+	"make_list":    fn(TypeDynamic, "", "number").optional(1),
+	"makeset":      fn(TypeDynamic, "", "number").optional(1),
+	"makelist":     fn(TypeDynamic, "", "number").optional(1),
+	"make_bag":     fn(TypeDynamic, "dynamic", "number").optional(1),
+	"make_set_if":  fn(TypeDynamic, "", "bool", "number").optional(1),
+	"make_list_if": fn(TypeDynamic, "", "bool", "number").optional(1),
+}
+
+// typeError is a misuse of a type found while typing an expression.
+type typeError struct {
+	message string
+	span    *Span // Innermost located expression containing the misuse, if any
+}
+
+// typeChecker types the scalar expressions evaluated over a relation. Comparisons
+// and string operators are left to the condition checks when compareOK is set, so
+// that a where predicate is not reported twice.
+type typeChecker struct {
+	in        *relation
+	scalars   map[string]ColumnType
+	spans     map[ast.Node]*Span
+	compareOK bool
+	at        *Span
+	errors    []typeError
+}
+
+// checker returns a type checker for expressions over in.
+func (s *schema) checker(in *relation) *typeChecker {
+	return &typeChecker{in: in, scalars: s.scalars}
+}
+
+// typeOf returns the type of expr, or "" when it is not known.
+func (c *typeChecker) typeOf(expr ast.Expr) ColumnType {
+	if expr == nil {
+		return ""
+	}
+	if span := c.spans[expr]; span != nil {
+		outer := c.at
+		c.at = span
+		defer func() { c.at = outer }()
+	}
+	switch e := expr.(type) {
+	case *ast.Literal:
+		if e.Kind == ast.NullLiteral {
+			return ""
+		}
+		t, _ := parseColumnType(string(e.Kind))
+		return t
+	case *ast.Ident:
+		if col, ok := c.in.column(e.Name); ok {
+			return col.Type
+		}
+		return c.scalars[e.Name]
+	case *ast.ParenExpr:
+		return c.typeOf(e.X)
+	case *ast.UnaryExpr:
+		t := c.typeOf(e.X)
+		if e.Op == "not" {
+			return TypeBool
+		}
+		if category := typeCategories[string(t)]; category != "" && category != "number" && category != "timespan" {
+			c.errorf("cannot apply %s to %s", e.Op, t)
+			return ""
+		}
+		return t
+	case *ast.BinaryExpr:
+		return c.binary(e)
+	case *ast.InExpr:
+		c.typeOf(e.X)
+		for _, v := range e.Values {
+			c.typeOf(v)
+		}
+		return TypeBool
+	case *ast.BetweenExpr:
+		c.typeOf(e.X)
+		c.typeOf(e.Low)
+		c.typeOf(e.High)
+		return TypeBool
+	case *ast.CallExpr:
+		return c.call(e)
+	case *ast.NamedArg:
+		return c.typeOf(e.Value)
+	case *ast.MemberExpr:
+		c.typeOf(e.X)
+		return TypeDynamic
+	case *ast.IndexExpr:
+		c.typeOf(e.X)
+		c.typeOf(e.Index)
+		return TypeDynamic
+	case *ast.CaseExpr:
+		var values []ast.Expr
+		for _, when := range e.Whens {
+			c.condition(when.Cond, "case")
+			values = append(values, when.Value)
+		}
+		return c.branches("case", append(values, e.Else))
+	case *ast.ArrayExpr:
+		for _, elem := range e.Elems {
+			c.typeOf(elem)
+		}
+		return TypeDynamic
+	case *ast.ObjectExpr:
+		for _, field := range e.Fields {
+			c.typeOf(field.Value)
+		}
+		return TypeDynamic
+	}
+	return ""
+}
+
+// numericRanks orders the numeric types by the type arithmetic on them returns.
+var numericRanks = map[ColumnType]int{TypeInt: 1, TypeLong: 2, TypeReal: 3, TypeDecimal: 4}
+
+func (c *typeChecker) binary(e *ast.BinaryExpr) ColumnType {
+	x, y := c.typeOf(e.X), c.typeOf(e.Y)
+	cx, cy := typeCategories[string(x)], typeCategories[string(y)]
+	op := strings.ToLower(e.Op)
+	switch op {
+	case "and", "or":
+		return TypeBool
+	case "==", "!=", "<", ">", "<=", ">=", "<>":
+		if !c.compareOK && cx != "" && cy != "" && cx != cy {
+			c.errorf("cannot compare %s and %s", x, y)
+		}
+		return TypeBool
+	case "+", "-", "*", "/", "%":
+	default:
+		// String operators such as has, contains and matches regex.
+		if !c.compareOK && cx != "" && cx != "string" {
+			c.errorf("%s compares strings, but its left side is %s", e.Op, x)
+		}
+		return TypeBool
+	}
+	if cx == "" || cy == "" {
+		return ""
+	}
+	switch {
+	case cx == "number" && cy == "number":
+		if numericRanks[x] >= numericRanks[y] {
+			return x
+		}
+		return y
+	case cx == "datetime" && cy == "datetime" && op == "-":
+		return TypeTimespan
+	case cx == "datetime" && cy == "timespan" && (op == "+" || op == "-"),
+		cx == "timespan" && cy == "datetime" && op == "+":
+		return TypeDatetime
+	case cx == "timespan" && cy == "timespan" && (op == "+" || op == "-"):
+		return TypeTimespan
+	case cx == "timespan" && cy == "timespan" && op == "/":
+		return TypeReal
+	case cx == "timespan" && cy == "number" && (op == "*" || op == "/"),
+		cx == "number" && cy == "timespan" && op == "*":
+		return TypeTimespan
+	}
+	if cx == "string" && cy == "string" && op == "+" {
+		c.errorf("cannot add strings with +; use strcat")
+	} else {
+		c.errorf("cannot apply %s to %s and %s", e.Op, x, y)
+	}
+	return ""
+}
+
+func (c *typeChecker) call(e *ast.CallExpr) ColumnType {
+	if e.Receiver != nil {
+		c.typeOf(e.Receiver)
+	}
+	name := strings.ToLower(e.Func)
+	switch name {
+	case "iff", "iif":
+		if len(e.Args) != 3 {
+			c.errorf("%s expects 3 arguments, got %d", name, len(e.Args))
+			return ""
+		}
+		c.condition(e.Args[0], name)
+		return c.branches(name, e.Args[1:])
+	case "coalesce":
+		return c.branches(name, e.Args)
+	}
+	args := make([]ColumnType, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = c.typeOf(arg)
+	}
+	sig, ok := functionSignatures[name]
+	if !ok || e.Receiver != nil {
+		return ""
+	}
+	if len(args) < sig.min || sig.max >= 0 && len(args) > sig.max {
+		c.errorf("%s expects %s, got %d", name, argumentCount(sig), len(args))
+		return ""
+	}
+	for i, t := range args {
+		want := sig.params[min(i, len(sig.params)-1)]
+		if got := typeCategories[string(t)]; want != "" && got != "" && got != want {
+			c.argumentError(e.Args[i], "%s expects a %s for argument %d, but %s", name, want, i+1, describeOperand(e.Args[i], t))
+		}
+	}
+	if sig.fromArg > 0 {
+		if sig.fromArg > len(args) {
+			return ""
+		}
+		if t := args[sig.fromArg-1]; t != TypeInt || !strings.HasPrefix(name, "sum") {
+			return t
+		}
+		return TypeLong // Sums of ints are longs
+	}
+	return sig.result
+}
+
+// condition types the predicate of iff or case, which must be a bool.
+func (c *typeChecker) condition(expr ast.Expr, fn string) {
+	if t := c.typeOf(expr); t != "" && t != TypeBool && t != TypeDynamic {
+		c.argumentError(expr, "%s expects a bool condition, but %s", fn, describeOperand(expr, t))
+	}
+}
+
+// branches types the values of iff, case or coalesce, which must all have the
+// same kind of type, and returns the type of the first one that is known.
+func (c *typeChecker) branches(fn string, values []ast.Expr) ColumnType {
+	var result ColumnType
+	for _, v := range values {
+		t := c.typeOf(v)
+		if t == "" || t == TypeDynamic {
+			continue
+		}
+		switch {
+		case result == "":
+			result = t
+		case typeCategories[string(t)] != typeCategories[string(result)]:
+			c.errorf("%s returns both %s and %s", fn, result, t)
+		case numericRanks[t] > numericRanks[result]:
+			result = t
+		}
+	}
+	return result
+}
+
+// argumentCount describes how many arguments sig takes, for messages.
+func argumentCount(sig signature) string {
+	switch {
+	case sig.max < 0:
+		return fmt.Sprintf("at least %d arguments", sig.min)
+	case sig.min == sig.max && sig.min == 1:
+		return "1 argument"
+	case sig.min == sig.max:
+		return fmt.Sprintf("%d arguments", sig.min)
+	}
+	return fmt.Sprintf("%d to %d arguments", sig.min, sig.max)
+}
+
+// describeOperand names the type of an operand, with the column when it is one.
+func describeOperand(expr ast.Expr, t ColumnType) string {
+	if id, ok := expr.(*ast.Ident); ok {
+		return fmt.Sprintf("%s is %s", id.Name, t)
+	}
+	return "got " + string(t)
+}
+
+func (c *typeChecker) errorf(format string, args ...any) {
+	c.errors = append(c.errors, typeError{fmt.Sprintf(format, args...), c.at})
+}
+
+// argumentError records a misuse located at the argument when it has a span.
+func (c *typeChecker) argumentError(arg ast.Expr, format string, args ...any) {
+	span := c.spans[arg]
+	if span == nil {
+		span = c.at
+	}
+	c.errors = append(c.errors, typeError{fmt.Sprintf(format, args...), span})
+}
+
+// checkExpressionTypes types the expressions of each pipe stage and reports the
+// misuses found. spans locate the expressions in the original query.
+func checkExpressionTypes(stages []pipeStage, s *schema, spans map[ast.Node]*Span, original string) []Diagnostic {
+	var out []Diagnostic
+	for _, stage := range stages {
+		c := s.checker(stage.in)
+		c.spans = spans
+		switch o := stage.op.(type) {
+		case *ast.WhereOperator:
+			c.compareOK = true
+			c.typeOf(o.Predicate)
+		case *ast.ExtendOperator:
+			for _, col := range o.Columns {
+				t := c.typeOf(col.Expr)
+				if name := col.OutputName(); name != "" {
+					// Later columns of the extend can use this one.
+					c.in = c.in.clone()
+					c.in.add(relColumn{name, t})
+				}
+			}
+		case *ast.ProjectOperator:
+			for _, col := range o.Columns {
+				c.typeOf(col.Expr)
+			}
+		case *ast.SummarizeOperator:
+			for _, col := range append(append([]*ast.Column(nil), o.Aggregates...), o.By...) {
+				c.typeOf(col.Expr)
+			}
+		case *ast.MvExpandOperator:
+			for _, item := range o.Items {
+				c.typeOf(item.Expr)
+			}
+		case *ast.ParseOperator:
+			c.typeOf(o.Expr)
+		case *ast.ParseKvOperator:
+			c.typeOf(o.Expr)
+		case *ast.GenericOperator:
+			if call := s.evaluatePlugin(o); call != nil {
+				c.typeOf(call)
+			}
+		}
+		for _, e := range c.errors {
+			d := Diagnostic{Severity: SeverityWarning, Code: CodeTypeError, Message: e.message, Span: e.span}
+			if d.Span != nil {
+				d.Line, d.Column = Position(original, d.Span.Start)
+			}
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// evaluatePlugin returns the plugin call of an evaluate operator, such as
+// bag_unpack(Properties), or nil for other operators and calls it cannot parse.
+func (s *schema) evaluatePlugin(op *ast.GenericOperator) *ast.CallExpr {
+	if op.Keyword != "evaluate" {
+		return nil
+	}
+	p := newKQLParser(s.ctx, operatorArguments(op.Text))
+	ctx := p.parser.Expression()
+	if len(p.errors()) > 0 || !p.atEOF() {
+		return nil
+	}
+	call, _ := (&astBuilder{input: p.input}).expression(ctx).(*ast.CallExpr)
+	return call
+}
@@ -0,0 +1,90 @@
+package kql
+
+import (
+	"testing"
+)
+
+func TestTypeCheck(t *testing.T) {
+	tests := []struct {
+		query   string
+		message string
+		span    string
+	}{
+		{`SecurityEvent | extend L = strlen(EventID)`, "strlen expects a string for argument 1, but EventID is int", "EventID"},
+		{`SecurityEvent | extend S = Account + "x"`, "cannot add strings with +; use strcat", `Account + "x"`},
+		{`SecurityEvent | extend P = ipv4_is_private(EventID)`, "ipv4_is_private expects a string for argument 1, but EventID is int", "EventID"},
+		{`SecurityEvent | extend D = datetime_diff("day", Account, TimeGenerated)`, "datetime_diff expects a datetime for argument 2, but Account is string", "Account"},
+		{`SecurityEvent | extend X = iff(EventID > 5, "a", 1)`, "iff returns both string and long", `iff(EventID > 5, "a", 1)`},
+		{`SecurityEvent | extend X = iff(Account, 1, 2)`, "iff expects a bool condition, but Account is string", "Account"},
+		{`SecurityEvent | extend B = tolower(Account, 1)`, "tolower expects 1 argument, got 2", "tolower(Account, 1)"},
+		{`SecurityEvent | extend A = ago(1h) > Account`, "cannot compare datetime and string", "ago(1h) > Account"},
+		{`SecurityEvent | summarize sum(EventID) by S = Account * 2`, "cannot apply * to string and long", "Account * 2"},
+		{`SecurityEvent | extend C = strcat(Account, "x") | extend N = -C`, "cannot apply - to string", "-C"},
+	}
+	for _, tt := range tests {
+		result := ExtractConditionsWithOptions(tt.query, Options{ValidateSchema: true, DisablePortableFallback: true})
+		found := result.DiagnosticsWithCode(CodeTypeError)
+		if len(found) != 1 {
+			t.Errorf("%s: expected one type error, got %+v", tt.query, found)
+			continue
+		}
+		d := found[0]
+		if d.Message != tt.message || d.Severity != SeverityWarning || d.Span == nil || d.Span.Text(tt.query) != tt.span {
+			t.Errorf("%s: unexpected diagnostic %+v", tt.query, d)
+		}
+		if len(result.Errors) != 0 {
+			t.Errorf("%s: type errors should not be in Errors, got %v", tt.query, result.Errors)
+		}
+	}
+}
+
+func TestTypeCheckAccepts(t *testing.T) {
+	for _, query := range []string{
+		`SecurityEvent | extend C = strcat(Account, EventID, 1.5), L = strlen(tostring(EventID))`,
+		`SecurityEvent | extend Age = now() - TimeGenerated, Day = startofday(TimeGenerated), Later = TimeGenerated + 1h`,
+		`SigninLogs | extend City = tostring(LocationDetails.city), Private = ipv4_is_private(IPAddress)`,
+		`SigninLogs | extend P = parse_json(tostring(DeviceDetail)) | extend OS = tostring(P.operatingSystem)`,
+		`SigninLogs | evaluate bag_unpack(LocationDetails)`,
+		`SecurityEvent | where EventID == "4624"`,
+		`SecurityEvent | extend X = iff(EventID > 5, 1, 2.5), Y = case(EventID == 1, "a", EventID == 2, "b", "c")`,
+		`let n = 5;
+SecurityEvent | extend M = EventID * n, Ratio = (now() - TimeGenerated) / 1h`,
+		`MyTable | extend L = strlen(Anything) + Other`,
+	} {
+		result := ExtractConditionsWithOptions(query, Options{ValidateSchema: true})
+		if found := result.DiagnosticsWithCode(CodeTypeError); len(found) != 0 {
+			t.Errorf("%s: unexpected type errors %+v", query, found)
+		}
+	}
+
+	result := ExtractConditions(`SecurityEvent | extend L = strlen(EventID)`)
+	if len(result.DiagnosticsWithCode(CodeTypeError)) != 0 {
+		t.Error("expected type checking to be off by default")
+	}
+}
+
+func TestTypeInference(t *testing.T) {
+	query := `let n = 5;
+SecurityEvent
+| extend Cmd = tolower(CommandLine), Len = strlen(Cmd), Age = now() - TimeGenerated, Hour = bin(TimeGenerated, 1h)
+| extend Score = EventID * n + 0.5, Private = ipv4_is_private(IpAddress), Bag = parse_json(EventData), Prop = Bag.Name
+| summarize Total = sum(EventID), Avg = avg(EventID), Last = max(TimeGenerated) by Cmd, Len, Age, Hour, Score, Private, Prop`
+	want := map[string]ColumnType{
+		"Cmd": TypeString, "Len": TypeLong, "Age": TypeTimespan, "Hour": TypeDatetime, "Score": TypeReal,
+		"Private": TypeBool, "Prop": TypeDynamic, "Total": TypeLong, "Avg": TypeReal, "Last": TypeDatetime,
+	}
+	result := ExtractConditions(query)
+	if len(result.OutputColumns) != len(want) {
+		t.Fatalf("expected %d output columns, got %v", len(want), result.OutputColumns)
+	}
+	for _, col := range result.OutputColumns {
+		if col.Type != want[col.Name] {
+			t.Errorf("%s: expected type %s, got %s", col.Name, want[col.Name], col.Type)
+		}
+	}
+	for _, l := range result.Lineage {
+		if l.PipeStage == 0 && l.Type != want[l.Column] {
+			t.Errorf("lineage of %s: expected type %s, got %s", l.Column, want[l.Column], l.Type)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package kql
+
+import (
+	"strings"
+)
+
+// EnterUnionOperator records the union's parameters and legs. Normalization removes
+// what the grammar does not accept, like withsource=, isfuzzy=, table patterns and
+// the arguments of function legs, so those are read from the original query around
+// the parsed legs.
+func (e *conditionExtractor) EnterUnionOperator(ctx *UnionOperatorContext) {
+	e.commands = append(e.commands, "union")
+
+	info := UnionInfo{
+		Kind:      "outer", // KQL default
+		PipeStage: e.currentStage,
+		Span:      e.locator.unionSpan(ctx),
+	}
+	original := e.locator.sourceMap.original
+
+	if tables := ctx.UnionTables(); tables != nil {
+		for _, t := range tables.AllUnionTable() {
+			leg := UnionLeg{Span: e.locator.ruleSpan(t)}
+			if t.TabularExpression() != nil {
+				// Subquery: union (SubQuery | where ...)
+				subText := e.extractTabularExpressionText(t.TabularExpression())
+				if subText != "" {
+					leg.Subsearch = extractConditionsInternal(e.ctx, subText, e.limit, e.cfg)
+					e.locator.remapSubquerySpans(leg.Subsearch, t.TabularExpression())
+				}
+			} else if t.TableName() != nil {
+				leg.Table = t.TableName().GetText()
+				if leg.Span != nil {
+					unionTableSource(&leg, original)
+				}
+			}
+			info.Legs = append(info.Legs, leg)
+		}
+	}
+
+	if len(info.Legs) > 0 {
+		unionParameters(&info, e.locator.unionParameterText(info.Span, info.Legs[0].Span))
+	}
+
+	e.unions = append(e.unions, info)
+}
+
+// unionSpan returns the original span of a union operator, starting at the union
+// keyword.
+func (l *spanLocator) unionSpan(ctx IUnionOperatorContext) *Span {
+	span := l.ruleSpan(ctx)
+	if span != nil {
+		// The span takes in the parentheses normalization removed around (union ...)
+		if i := strings.Index(strings.ToLower(span.Text(l.sourceMap.original)), "union"); i > 0 {
+			span.Start += i
+		}
+	}
+	return span
+}
+
+// unionParameterText returns the original text of a union from its keyword up to
+// its first leg, where the parameters normalization removes are, or "". first is
+// the span of the first leg as UnionLeg reports it.
+func (l *spanLocator) unionParameterText(union, first *Span) string {
+	if union == nil || first == nil || first.Start <= union.Start {
+		return ""
+	}
+	return l.sourceMap.original[union.Start:first.Start]
+}
+
+// firstUnionLegSpan returns the original span of the first leg of a union, as
+// UnionLeg reports it, or nil.
+func (l *spanLocator) firstUnionLegSpan(ctx IUnionOperatorContext) *Span {
+	tables := ctx.UnionTables()
+	if tables == nil || len(tables.AllUnionTable()) == 0 {
+		return nil
+	}
+	t := tables.AllUnionTable()[0]
+	leg := UnionLeg{Span: l.ruleSpan(t)}
+	if t.TableName() != nil && leg.Span != nil {
+		leg.Table = t.TableName().GetText()
+		unionTableSource(&leg, l.sourceMap.original)
+	}
+	return leg.Span
+}
+
+// unionParameters reads the kind=, withsource= and isfuzzy= parameters of a union
+// from text, the union keyword and what follows it up to the first leg.
+func unionParameters(info *UnionInfo, text string) {
+	text = strings.TrimPrefix(strings.ToLower(text[:min(len(text), 5)]), "union") + text[min(len(text), 5):]
+	text = strings.Join(strings.Fields(text), " ")
+	text = strings.NewReplacer(" = ", "=", " =", "=", "= ", "=").Replace(text)
+	for _, param := range strings.Fields(text) {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "kind":
+			info.Kind = strings.ToLower(value)
+		case "withsource":
+			info.WithSource = unquoteIdentifier(value)
+		case "isfuzzy":
+			info.IsFuzzy = strings.EqualFold(value, "true")
+		}
+	}
+}
+
+// unionTableSource completes a table leg from the original query: the wildcards
+// normalization stripped from a pattern like Device* or *_CL, a * it replaced with
+// a placeholder table, and the arguments of a function leg like Func('a'). The
+// leg's span may take in the text normalization removed next to it, so the name is
+// looked up in it first.
+func unionTableSource(leg *UnionLeg, original string) {
+	start, end := leg.Span.Start, leg.Span.End
+	if i := nameIndex(original[start:end], leg.Table); i >= 0 {
+		start += i
+		end = start + len(leg.Table)
+	} else if i := strings.IndexFunc(original[start:end], func(r rune) bool {
+		return r == '*' || r < 128 && isIdentChar(byte(r))
+	}); i >= 0 {
+		// A * normalization replaced with a placeholder table
+		start += i
+		end = start + 1
+	}
+	for start > 0 && (original[start-1] == '*' || isIdentChar(original[start-1])) {
+		start--
+	}
+	for end < len(original) && (original[end] == '*' || isIdentChar(original[end])) {
+		end++
+	}
+	if name := original[start:end]; strings.Contains(name, "*") {
+		leg.Table, leg.Wildcard = name, true
+	}
+	leg.Span = &Span{Start: start, End: end}
+
+	open := end
+	for open < len(original) && (original[open] == ' ' || original[open] == '\t') {
+		open++
+	}
+	if close := findMatchingParen(original, open); close > open {
+		for _, arg := range splitCommaList(original[open+1 : close]) {
+			if arg = strings.TrimSpace(arg); arg != "" {
+				leg.Arguments = append(leg.Arguments, arg)
+			}
+		}
+		leg.Span.End = close + 1
+	}
+}
+
+// nameIndex returns the position in text of the first occurrence of name as a
+// whole word that is not a parameter name or value, or -1.
+func nameIndex(text, name string) int {
+	for from := 0; name != ""; {
+		i := strings.Index(text[from:], name)
+		if i < 0 {
+			return -1
+		}
+		i += from
+		end := i + len(name)
+		before := strings.TrimRight(text[:i], " \t\n\r")
+		after := strings.TrimLeft(text[end:], " \t\n\r")
+		if (i == 0 || !isIdentChar(text[i-1])) && (end == len(text) || !isIdentChar(text[end])) &&
+			!strings.HasSuffix(before, "=") && !strings.HasPrefix(after, "=") {
+			return i
+		}
+		from = i + 1
+	}
+	return -1
+}
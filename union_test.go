@@ -0,0 +1,116 @@
+package kql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnionInfo(t *testing.T) {
+	query := `union withsource=SourceTable isfuzzy=true Device*, *_CL, SecurityEvent
+| where EventID == 4624`
+
+	result := ExtractConditions(query)
+	if len(result.Unions) != 1 {
+		t.Fatalf("expected one union, got %+v", result.Unions)
+	}
+	union := result.Unions[0]
+	if union.Kind != "outer" || union.WithSource != "SourceTable" || !union.IsFuzzy || union.PipeStage != 0 {
+		t.Errorf("unexpected union parameters %+v", union)
+	}
+	if union.Span == nil || union.Span.Text(query) != "union withsource=SourceTable isfuzzy=true Device*, *_CL, SecurityEvent" {
+		t.Errorf("unexpected union span %+v", union.Span)
+	}
+	want := []struct {
+		table    string
+		wildcard bool
+	}{{"Device*", true}, {"*_CL", true}, {"SecurityEvent", false}}
+	if len(union.Legs) != len(want) {
+		t.Fatalf("expected %d legs, got %+v", len(want), union.Legs)
+	}
+	for i, leg := range union.Legs {
+		if leg.Table != want[i].table || leg.Wildcard != want[i].wildcard || leg.Subsearch != nil {
+			t.Errorf("leg %d: expected %s (wildcard=%v), got %+v", i, want[i].table, want[i].wildcard, leg)
+		}
+		if leg.Span == nil || leg.Span.Text(query) != want[i].table {
+			t.Errorf("leg %d: unexpected span %+v", i, leg.Span)
+		}
+	}
+	if !containsString(result.Commands, "union") {
+		t.Errorf("expected union in commands, got %v", result.Commands)
+	}
+}
+
+func TestUnionInfoSubqueryLegs(t *testing.T) {
+	query := `SecurityEvent
+| where EventID == 4625
+| union kind=inner (SigninLogs | where ResultType != "0"), (AuditLogs | where OperationName has "reset")`
+
+	result := ExtractConditions(query)
+	if len(result.Unions) != 1 {
+		t.Fatalf("expected one union, got %+v", result.Unions)
+	}
+	union := result.Unions[0]
+	if union.Kind != "inner" || union.WithSource != "" || union.IsFuzzy || len(union.Legs) != 2 {
+		t.Fatalf("unexpected union %+v", union)
+	}
+	for i, field := range []string{"ResultType", "OperationName"} {
+		leg := union.Legs[i]
+		if leg.Table != "" || leg.Subsearch == nil || len(leg.Subsearch.Conditions) != 1 {
+			t.Errorf("leg %d: expected a subsearch with one condition, got %+v", i, leg)
+			continue
+		}
+		cond := leg.Subsearch.Conditions[0]
+		if cond.Field != field || cond.Span == nil || cond.Span.Text(query) != cond.Field+map[string]string{
+			"ResultType": ` != "0"`, "OperationName": ` has "reset"`}[field] {
+			t.Errorf("leg %d: unexpected condition %+v", i, cond)
+		}
+	}
+}
+
+func TestUnionInfoFunctionLegs(t *testing.T) {
+	query := `(union isfuzzy = true MyParser('a', 2), OtherTable, *) | where Account == "x"`
+
+	result := ExtractConditions(query)
+	if len(result.Unions) != 1 || len(result.Unions[0].Legs) != 3 {
+		t.Fatalf("expected one union of three legs, got %+v", result.Unions)
+	}
+	union := result.Unions[0]
+	if !union.IsFuzzy || union.Span == nil || union.Span.Text(query)[:5] != "union" {
+		t.Errorf("unexpected union %+v", union)
+	}
+	parser := union.Legs[0]
+	if parser.Table != "MyParser" || !reflect.DeepEqual(parser.Arguments, []string{"'a'", "2"}) ||
+		parser.Span == nil || parser.Span.Text(query) != "MyParser('a', 2)" {
+		t.Errorf("unexpected function leg %+v", parser)
+	}
+	if all := union.Legs[2]; all.Table != "*" || !all.Wildcard {
+		t.Errorf("expected the * leg, got %+v", all)
+	}
+}
+
+func TestUnionOutputColumns(t *testing.T) {
+	catalog := completeCatalog("SecurityEvent", "SigninLogs")
+	security, signin := catalog.Table("SecurityEvent"), catalog.Table("SigninLogs")
+
+	// Column names are case-sensitive, so IpAddress and IPAddress are two columns
+	names := make(map[string]bool)
+	for _, col := range signin.Columns {
+		names[col.Name] = true
+	}
+	var inner []OutputColumn
+	for _, col := range security.Columns {
+		if names[col.Name] {
+			inner = append(inner, OutputColumn{col.Name, col.Type})
+		}
+	}
+	result := ExtractConditionsWithOptions(`union kind=inner withsource=Src SecurityEvent, SigninLogs`, Options{Catalog: catalog})
+	if want := append([]OutputColumn{{"Src", TypeString}}, inner...); !result.OutputComplete || !reflect.DeepEqual(result.OutputColumns, want) {
+		t.Errorf("inner union: expected %v, got %v", want, result.OutputColumns)
+	}
+
+	result = ExtractConditionsWithOptions(`SecurityEvent | union withsource=Src SigninLogs`, Options{Catalog: catalog})
+	outer := len(security.Columns) + len(signin.Columns) - len(inner) + 1
+	if len(result.OutputColumns) != outer || result.OutputColumns[0] != (OutputColumn{"Src", TypeString}) {
+		t.Errorf("outer union: expected Src and %d columns, got %v", outer-1, result.OutputColumns)
+	}
+}